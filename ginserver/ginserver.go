@@ -28,6 +28,8 @@ var (
 	JsonParamBindError = map[string]interface{}{"errCode": 1, "errDesc": "Param Error"}
 	// 处理逻辑Panic了 回复状态：http.StatusInternalServerError
 	PanicError = map[string]interface{}{"errCode": 500, "errDesc": "Server Error"}
+	// 请求被限流了 回复状态：http.StatusTooManyRequests
+	RateLimitError = map[string]interface{}{"errCode": 429, "errDesc": "Too Many Requests"}
 )
 
 type GinServer struct {
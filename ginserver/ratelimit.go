@@ -0,0 +1,88 @@
+package ginserver
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// 限流器接口 goredis.RateLimiter实现了该接口
+// 返回是否允许 被拒绝时需要等待的时间(-1表示永远不会允许)
+type RateLimiter interface {
+	Limit(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// 按客户端IP限流
+func RateLimitKeyIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// 按路径限流
+func RateLimitKeyPath(c *gin.Context) string {
+	return c.Request.URL.Path
+}
+
+// 按客户端IP+路径限流
+func RateLimitKeyIPPath(c *gin.Context) string {
+	return c.ClientIP() + ":" + c.Request.URL.Path
+}
+
+// 按请求头限流，比如请求头中的用户ID
+func RateLimitKeyHeader(name string) func(c *gin.Context) string {
+	return func(c *gin.Context) string {
+		return c.GetHeader(name)
+	}
+}
+
+// 按前面中间件c.Set设置的值限流，比如鉴权后设置的用户ID
+func RateLimitKeyGet(name string) func(c *gin.Context) string {
+	return func(c *gin.Context) string {
+		v, ok := c.Get(name)
+		if !ok {
+			return ""
+		}
+		return fmt.Sprint(v)
+	}
+}
+
+// 限流中间件 可以用engine.Use或者RegHandler的optionsHandlers注册
+// key返回空表示不限流，限流器出错时不限流
+// 被限流时回复http.StatusTooManyRequests，并设置Retry-After头
+func RateLimit(limiter RateLimiter, key func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k := key(c)
+		if len(k) == 0 {
+			return
+		}
+		ctxv, _ := c.Get("ctx")
+		ctx, _ := ctxv.(context.Context)
+		if ctx == nil {
+			ctx = context.TODO()
+		}
+		allowed, retryAfter, err := limiter.Limit(ctx, k)
+		if err != nil || allowed {
+			return
+		}
+		utils.LogCtx(log.Warn(), ctx).Str("RemoteAddr", c.Request.RemoteAddr).Str("path", c.Request.URL.Path).Str("key", k).
+			Dur("retryAfter", retryAfter).Msg("GinServer RateLimit")
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		if RateLimitError != nil {
+			c.Set("resp", RateLimitError) // 日志使用
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, RateLimitError)
+		} else {
+			c.AbortWithStatus(http.StatusTooManyRequests)
+		}
+	}
+}
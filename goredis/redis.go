@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 	"unsafe"
@@ -63,6 +64,8 @@ type Config struct {
 	Passwd string   `json:"passwd,omitempty"` // 秘钥
 	DB     int      `json:"db,omitempty"`     // 只有单节点模式使用
 	TSL    bool     `json:"tsl,omitempty"`    // 是否使用TSL连接
+
+	ClientCache *ClientCacheConfig `json:"clientcache,omitempty"` // 不为空开启客户端缓存 见redisclientcache.go
 }
 
 // Redis对象
@@ -71,6 +74,11 @@ type Redis struct {
 
 	// 执行命令时的回调 不使用锁，默认要求提前注册好
 	hook []func(ctx context.Context, cmd *RedisCommond)
+
+	cache *clientCache // 客户端缓存 可能为nil
+
+	lockNotifyMu sync.Mutex
+	lockNotifys  map[string]*lockNotify // 加锁等待共享的订阅 channel:*lockNotify
 }
 
 var defaultRedis *Redis
@@ -130,17 +138,32 @@ func NewRedis(cfg *Config) (*Redis, error) {
 
 	// 测试连接
 	cmd := client.Ping(context.TODO())
-	if cmd.Err() != nil {
+	err := cmd.Err()
+	if err != nil {
 		client.Close()
 		log.Error().Err(cmd.Err()).Str("addr", strings.Join(cfg.Addrs, ",")).Str("passwd", cfg.Passwd).Int("db", cfg.DB).Bool("tsl", cfg.TSL).Msg("Redis Conn Fail")
 		return nil, cmd.Err()
 	}
+	if cfg.ClientCache != nil {
+		r.cache, err = newClientCache(cfg)
+		if err != nil {
+			// 客户端缓存开启失败不影响使用
+			log.Error().Err(err).Str("addr", strings.Join(cfg.Addrs, ",")).Msg("Redis ClientCache Fail")
+		}
+	}
 	client.AddHook(&hook{redis: r})
 
 	log.Info().Str("addr", strings.Join(cfg.Addrs, ",")).Str("passwd", cfg.Passwd).Int("db", cfg.DB).Bool("tsl", cfg.TSL).Msg("Redis Conn Success")
 	return r, nil
 }
 
+func (r *Redis) Close() error {
+	if r.cache != nil {
+		r.cache.close()
+	}
+	return r.UniversalClient.Close()
+}
+
 func (r *Redis) RegHook(f func(ctx context.Context, cmd *RedisCommond)) {
 	r.hook = append(r.hook, f)
 }
@@ -237,7 +260,7 @@ func getCmd(query, def string) string {
 	return def
 }
 
-func (r *Redis) cmdCallback(ctx context.Context, cmd redis.Cmder, entry time.Time) {
+func (r *Redis) cmdCallback(ctx context.Context, cmd redis.Cmder, entry time.Time, clientCache int) {
 	// 构造或查找RedisCommond
 	var redisCmd *RedisCommond
 	rediscmd, ok := ctx.Value(CtxKey_rediscmd).(*RedisCommond)
@@ -251,6 +274,7 @@ func (r *Redis) cmdCallback(ctx context.Context, cmd redis.Cmder, entry time.Tim
 	// 命令赋值
 	redisCmd.Cmd = cmd
 	redisCmd.Elapsed = time.Since(entry)
+	redisCmd.ClientCache = clientCache
 	// 填充cmddesc 优先使用ctx中的
 	cmddesc, ok := ctx.Value(CtxKey_cmddesc).(string)
 	if ok {
@@ -454,9 +478,15 @@ func (h *hook) DialHook(next redis.DialHook) redis.DialHook {
 func (h *hook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
 	callback := func(ctx context.Context, cmd redis.Cmder) error {
 		entry := time.Now()
-		err := next(ctx, cmd)
+		var err error
+		clientCache := ClientCacheNone
+		if h.redis.cache != nil {
+			clientCache, err = h.redis.cache.process(ctx, cmd, next)
+		} else {
+			err = next(ctx, cmd)
+		}
 		cmd.SetErr(err) // 会在下一层设置，这里需要提前设置下，cmdCallback中就可以使用了
-		h.redis.cmdCallback(ctx, cmd, entry)
+		h.redis.cmdCallback(ctx, cmd, entry, clientCache)
 		return cmd.Err()
 	}
 	return callback
@@ -465,7 +495,17 @@ func (h *hook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
 func (h *hook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
 	callback := func(ctx context.Context, cmds []redis.Cmder) error {
 		entry := time.Now()
+		if h.redis.cache != nil {
+			for _, cmd := range cmds {
+				h.redis.cache.invalidate(cmd)
+			}
+		}
 		err := next(ctx, cmds)
+		if h.redis.cache != nil {
+			for _, cmd := range cmds {
+				h.redis.cache.invalidate(cmd) // 执行期间可能填充了旧值，参考clientCache.invalidate
+			}
+		}
 		err = h.redis.pipelineCallback(ctx, cmds, err, entry)
 		return err
 	}
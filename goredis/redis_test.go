@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -257,6 +258,193 @@ func BenchmarkTryLockWait(b *testing.B) {
 	fmt.Printf("%p %v\n", fun, err)
 }
 
+func BenchmarkAcquire(b *testing.B) {
+	redis, _ := NewRedis(cfg)
+	if redis == nil {
+		return
+	}
+	lock, err := redis.Acquire(context.TODO(), "testkey3", &LockOption{TTL: time.Second * 3, Reentrant: true})
+	if err != nil {
+		return
+	}
+	// 重入
+	lock2, err := redis.Acquire(lock.Context(), "testkey3", &LockOption{Reentrant: true})
+	fmt.Println(lock == lock2, lock.Token(), err)
+	lock2.Unlock()
+
+	// 超过TTL依然持有
+	select {
+	case err := <-lock.Lost():
+		fmt.Println(err)
+	case <-time.After(time.Second * 10):
+	}
+	lock.Unlock()
+}
+
+func BenchmarkRedlock(b *testing.B) {
+	var rs []*Redis
+	for _, addr := range []string{"127.0.0.1:6379", "127.0.0.1:6380", "127.0.0.1:6381"} {
+		redis, _ := NewRedis(&Config{Addrs: []string{addr}})
+		if redis == nil {
+			return
+		}
+		rs = append(rs, redis)
+	}
+	rl := NewRedlock(rs...)
+	m, err := rl.Lock(context.TODO(), "testkey4", time.Second*5, time.Second)
+	if err != nil {
+		return
+	}
+	fmt.Println(time.Until(m.Until()), m.Extend(context.TODO(), time.Second*5))
+	m.Unlock(context.TODO())
+}
+
+func BenchmarkRWLock(b *testing.B) {
+	redis, _ := NewRedis(cfg)
+	if redis == nil {
+		return
+	}
+	rw := redis.NewRWLock("testguild", time.Second*10)
+	runlock, err := rw.RLock(context.TODO(), time.Second)
+	fmt.Println(err)
+	go func() {
+		time.Sleep(time.Second * 2)
+		runlock()
+	}()
+	unlock, err := rw.Lock(context.TODO(), time.Second*5) // 等待读锁释放
+	fmt.Println(err)
+	if unlock != nil {
+		unlock()
+	}
+
+	sem := redis.NewSemaphore("testmatch", 2, time.Second*10)
+	for i := 0; i < 3; i++ {
+		release, err := sem.Acquire(context.TODO(), time.Second)
+		fmt.Println(i, err)
+		if release != nil {
+			defer release()
+		}
+	}
+}
+
+func BenchmarkStream(b *testing.B) {
+	redis, _ := NewRedis(cfg)
+	if redis == nil {
+		return
+	}
+	type Msg struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	stream := redis.NewStream("teststream")
+	stream.MaxLen = 10000
+	consumer, err := stream.NewConsumer(context.TODO(), "testgroup", "consumer1")
+	if err != nil {
+		return
+	}
+	stream.Add(context.TODO(), &Msg{ID: 1, Name: "a"})
+	stream.Add(context.TODO(), &Msg{ID: 2, Name: "b"})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+	consumer.Consume(ctx, 10, func(ctx context.Context, msg *StreamMessage) error {
+		var m Msg
+		err := msg.Bind(&m)
+		fmt.Println(msg.ID, msg.Deliveries, m, err)
+		return err
+	})
+}
+
+func BenchmarkSubscriber(b *testing.B) {
+	redis, _ := NewRedis(cfg)
+	if redis == nil {
+		return
+	}
+	redis.RegHook(func(ctx context.Context, cmd *RedisCommond) {
+		if cmd.Subscribe != nil {
+			fmt.Println(cmd.Subscribe.Channel, cmd.Subscribe.Lag, cmd.Subscribe.Pending, cmd.Subscribe.Dropped)
+		}
+	})
+	sub := redis.NewSubscriber()
+	defer sub.Close()
+	sub.Handle(context.TODO(), "testchannel", func(ctx context.Context, channel, payload string) {
+		fmt.Println(channel, payload)
+	})
+	sub.HandlePattern(context.TODO(), "testpattern.*", func(ctx context.Context, channel, payload string) {
+		fmt.Println(channel, payload)
+	})
+	redis.Publish(context.TODO(), "testchannel", "hello")
+	redis.Publish(context.TODO(), "testpattern.1", "world")
+	time.Sleep(time.Second)
+}
+
+func BenchmarkDelayQueue(b *testing.B) {
+	redis, _ := NewRedis(cfg)
+	if redis == nil {
+		return
+	}
+	type Mail struct {
+		ID int `json:"id"`
+	}
+	queue := redis.NewDelayQueue("testdelay")
+	queue.AddDelay(context.TODO(), "mail1", &Mail{ID: 1}, time.Second)
+	queue.AddAt(context.TODO(), "mail2", &Mail{ID: 2}, time.Now().Add(time.Second*2))
+	queue.AddDelay(context.TODO(), "mail3", &Mail{ID: 3}, time.Second)
+	queue.Cancel(context.TODO(), "mail3")
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*5)
+	defer cancel()
+	queue.Consume(ctx, 10, func(ctx context.Context, job *DelayJob) error {
+		var m Mail
+		err := job.Bind(&m)
+		fmt.Println(job.ID, job.Attempts, m, err)
+		return err
+	})
+}
+
+func BenchmarkRateLimit(b *testing.B) {
+	redis, _ := NewRedis(cfg)
+	if redis == nil {
+		return
+	}
+	bucket := redis.NewTokenBucket("testtokenbucket", 10, time.Second, 5)
+	window := redis.NewSlidingWindow("testslidingwindow", 5, time.Second)
+	for i := 0; i < 8; i++ {
+		res1, err1 := bucket.Allow(context.TODO(), "user1")
+		res2, err2 := window.Allow(context.TODO(), "user1")
+		fmt.Println(res1, err1, res2, err2)
+	}
+}
+
+func BenchmarkLeaderboard(b *testing.B) {
+	redis, _ := NewRedis(cfg)
+	if redis == nil {
+		return
+	}
+	type User struct {
+		Name string `redis:"name"`
+		Lv   int    `redis:"lv"`
+	}
+	lb := redis.NewLeaderboard("testleaderboard", LeaderboardTotal, LeaderboardDaily, LeaderboardWeekly)
+	lb.DataKey = func(member string) string { return "testleaderboard_user_" + member }
+	for i := 0; i < 5; i++ {
+		member := strconv.Itoa(i)
+		redis.HMSetObj(context.TODO(), lb.DataKey(member), &User{Name: "user" + member, Lv: i})
+		lb.Incr(context.TODO(), member, int64(i%3*10))
+	}
+
+	board := lb.Current(LeaderboardDaily)
+	var users []*User
+	entries, err := lb.Page(context.TODO(), board, 1, 3, &users)
+	for i, entry := range entries {
+		fmt.Println(*entry, *users[i])
+	}
+	entry, err := lb.Rank(context.TODO(), board, "2")
+	fmt.Println(entry, err)
+	entries, err = lb.Around(context.TODO(), board, "2", 1, 1)
+	fmt.Println(len(entries), err)
+}
+
 func BenchmarkKeyLockWait(b *testing.B) {
 	redis, _ := NewRedis(cfg)
 	if redis == nil {
@@ -425,3 +613,31 @@ func BenchmarkInterfaceToValue(b *testing.B) {
 	InterfaceToValue(str, reflect.ValueOf(i)) // 这种写法会崩溃
 
 }
+
+func BenchmarkClientCache(b *testing.B) {
+	redis, _ := NewRedis(&Config{
+		Addrs:       cfg.Addrs,
+		Passwd:      cfg.Passwd,
+		ClientCache: &ClientCacheConfig{Patterns: []string{"cc_*"}},
+	})
+	if redis == nil {
+		return
+	}
+	defer redis.Close()
+	redis.RegHook(func(ctx context.Context, cmd *RedisCommond) {
+		fmt.Println(cmd.CmdString(), cmd.ClientCache)
+	})
+
+	redis.Do(context.TODO(), "set", "cc_test", "1")
+	var v int
+	redis.Do2(context.TODO(), "get", "cc_test").Bind(&v) // 未命中
+	redis.Do2(context.TODO(), "get", "cc_test").Bind(&v) // 命中
+	fmt.Println(v)
+
+	// 其他客户端修改后，等待失效消息
+	other, _ := NewRedis(cfg)
+	other.Do(context.TODO(), "set", "cc_test", "2")
+	time.Sleep(time.Millisecond * 100)
+	redis.Do2(context.TODO(), "get", "cc_test").Bind(&v) // 未命中
+	fmt.Println(v)
+}
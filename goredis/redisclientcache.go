@@ -0,0 +1,444 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// 客户端缓存 使用CLIENT TRACKING的BCAST模式
+// 单独创建一个RESP2的订阅连接，该连接开启 CLIENT TRACKING ON REDIRECT 自己 BCAST PREFIX ...，并订阅__redis__:invalidate
+// Redis中匹配前缀的key被修改时，会向订阅连接推送失效消息，收到后删除本地缓存
+// 订阅连接断开或者出错时，清空全部缓存，重新订阅成功前不使用缓存
+// 只缓存非管道中执行的GET HGET HMGET命令，命令会经过Do2 HMGetObj RedisCommond.Bind*等函数，本地命中的命令也会回调RegHook注册的函数
+// 只支持单节点和哨兵模式
+
+const CtxKey_noclientcache = utils.CtxKey("_goredis_noclientcache_") // 不使用客户端缓存 值：不受限制 一般写1
+
+func CtxNoClientCache(parent context.Context) context.Context {
+	return ctxWithValue(parent, CtxKey_noclientcache)
+}
+
+// RedisCommond.ClientCache的值
+const (
+	ClientCacheNone = 0 // 没有使用客户端缓存
+	ClientCacheHit  = 1 // 命中客户端缓存，没有请求Redis
+	ClientCacheMiss = 2 // 未命中客户端缓存，请求了Redis
+)
+
+type ClientCacheConfig struct {
+	MaxKeys  int      `json:"maxkeys,omitempty"`  // 最多缓存的key数量，超过后淘汰最久未使用的，<=0时默认10000
+	Patterns []string `json:"patterns,omitempty"` // 允许缓存的key，支持*和?通配符，例如 user_*，为空时不缓存
+}
+
+const clientCacheChannel = "__redis__:invalidate"
+
+type clientCacheEntry struct {
+	key    string
+	elem   *list.Element
+	hasStr bool
+	str    interface{}            // GET的结果 nil表示key不存在
+	fields map[string]interface{} // HGET HMGET的结果 nil表示field不存在
+}
+
+type clientCache struct {
+	conf     ClientCacheConfig
+	prefixes []string
+
+	client redis.UniversalClient // 订阅连接使用的客户端
+	sub    *redis.PubSub
+
+	mu      sync.Mutex
+	entries map[string]*clientCacheEntry
+	lru     *list.List // 头部是最近使用的
+	ready   bool       // 订阅连接正常时才能使用缓存
+	gen     int64      // 每次订阅连接重连或者出错时修改，防止填充之前连接上读取的数据
+
+	closed int32
+}
+
+// 通配符之前的部分作为BCAST的前缀，前缀之间不能有包含关系
+func clientCachePrefixes(patterns []string) []string {
+	prefixes := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if i := strings.IndexAny(p, "*?"); i >= 0 {
+			p = p[:i]
+		}
+		if len(p) == 0 {
+			return nil // 需要跟踪所有的key
+		}
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	ret := prefixes[:0]
+	for _, p := range prefixes {
+		if len(ret) > 0 && strings.HasPrefix(p, ret[len(ret)-1]) {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+func newClientCache(cfg *Config) (*clientCache, error) {
+	if cfg.Master == "" && len(cfg.Addrs) > 1 {
+		return nil, errors.New("clientcache not support cluster")
+	}
+	cc := &clientCache{
+		conf:     *cfg.ClientCache,
+		prefixes: clientCachePrefixes(cfg.ClientCache.Patterns),
+		entries:  map[string]*clientCacheEntry{},
+		lru:      list.New(),
+	}
+	if cc.conf.MaxKeys <= 0 {
+		cc.conf.MaxKeys = 10000
+	}
+	options := &redis.UniversalOptions{
+		MasterName: cfg.Master,
+		Addrs:      cfg.Addrs,
+		Password:   cfg.Passwd,
+		DB:         cfg.DB,
+		Protocol:   2, // 失效消息通过订阅的方式接收
+		OnConnect:  cc.onConnect,
+
+		DialTimeout:  4 * time.Second,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 3 * time.Second,
+		PoolSize:     1,
+	}
+	if cfg.TSL {
+		options.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	cc.client = redis.NewUniversalClient(options)
+
+	ctx := context.TODO()
+	cc.sub = cc.client.Subscribe(ctx, clientCacheChannel)
+	// 首次订阅确认
+	msg, err := cc.sub.ReceiveTimeout(ctx, time.Second*3)
+	if err != nil {
+		cc.sub.Close()
+		cc.client.Close()
+		return nil, err
+	}
+	cc.onMessage(msg)
+	go cc.loop()
+	return cc, nil
+}
+
+// 订阅连接创建时开启跟踪，之前的缓存不再可信
+func (cc *clientCache) onConnect(ctx context.Context, conn *redis.Conn) error {
+	cc.reset(false)
+	id, err := conn.ClientID(ctx).Result()
+	if err != nil {
+		return err
+	}
+	args := []interface{}{"client", "tracking", "on", "redirect", id, "bcast"}
+	for _, p := range cc.prefixes {
+		args = append(args, "prefix", p)
+	}
+	return conn.Process(ctx, redis.NewCmd(ctx, args...))
+}
+
+func (cc *clientCache) loop() {
+	defer utils.HandlePanic()
+	ctx := context.TODO()
+	for atomic.LoadInt32(&cc.closed) == 0 {
+		msg, err := cc.sub.Receive(ctx)
+		if err != nil {
+			if atomic.LoadInt32(&cc.closed) != 0 {
+				return
+			}
+			// FLUSHALL FLUSHDB的失效消息内容为空，go-redis也会返回错误，同样清空缓存
+			// 连接断开时，下次Receive会重新连接并订阅，Ping的回复用来确认连接依然可用
+			log.Warn().Err(err).Msg("Redis ClientCache Receive fail")
+			cc.reset(false)
+			if cc.sub.Ping(ctx) != nil {
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		cc.onMessage(msg)
+	}
+}
+
+func (cc *clientCache) onMessage(msg interface{}) {
+	switch msg := msg.(type) {
+	case *redis.Subscription:
+		if msg.Kind == "subscribe" {
+			cc.reset(true)
+		}
+	case *redis.Pong:
+		cc.mu.Lock()
+		cc.ready = true
+		cc.mu.Unlock()
+	case *redis.Message:
+		cc.mu.Lock()
+		for _, key := range msg.PayloadSlice {
+			cc.remove(key)
+		}
+		if len(msg.Payload) > 0 {
+			cc.remove(msg.Payload)
+		}
+		cc.mu.Unlock()
+	}
+}
+
+// 清空缓存
+func (cc *clientCache) reset(ready bool) {
+	cc.mu.Lock()
+	cc.entries = map[string]*clientCacheEntry{}
+	cc.lru.Init()
+	cc.ready = ready
+	cc.gen++
+	cc.mu.Unlock()
+}
+
+func (cc *clientCache) close() {
+	if atomic.CompareAndSwapInt32(&cc.closed, 0, 1) {
+		cc.sub.Close()
+		cc.client.Close()
+		cc.reset(false)
+	}
+}
+
+// 需要加锁调用
+func (cc *clientCache) remove(key string) {
+	if e, ok := cc.entries[key]; ok {
+		cc.lru.Remove(e.elem)
+		delete(cc.entries, key)
+	}
+}
+
+func (cc *clientCache) allow(key string) bool {
+	for _, p := range cc.conf.Patterns {
+		if utils.IsMatch(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析可以缓存的命令 返回命令名 key 和field
+func clientCacheArgs(cmd redis.Cmder) (string, string, []string, bool) {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return "", "", nil, false
+	}
+	name := cmd.Name()
+	switch name {
+	case "get":
+		if len(args) != 2 {
+			return "", "", nil, false
+		}
+	case "hget":
+		if len(args) != 3 {
+			return "", "", nil, false
+		}
+	case "hmget":
+		if len(args) < 3 {
+			return "", "", nil, false
+		}
+	default:
+		return "", "", nil, false
+	}
+	strs := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		switch v := arg.(type) {
+		case string:
+			strs[i] = v
+		case []byte:
+			strs[i] = string(v)
+		default:
+			return "", "", nil, false
+		}
+	}
+	return name, strs[0], strs[1:], true
+}
+
+// 读取缓存 命中时直接设置命令的结果
+func (cc *clientCache) get(cmd redis.Cmder, name, key string, fields []string) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.ready {
+		return false
+	}
+	e, ok := cc.entries[key]
+	if !ok {
+		return false
+	}
+	var vals []interface{}
+	if name == "get" {
+		if !e.hasStr {
+			return false
+		}
+		vals = []interface{}{e.str}
+	} else {
+		vals = make([]interface{}, len(fields))
+		for i, f := range fields {
+			v, ok := e.fields[f]
+			if !ok {
+				return false
+			}
+			vals[i] = v
+		}
+	}
+	cc.lru.MoveToFront(e.elem)
+
+	switch c := cmd.(type) {
+	case *redis.Cmd:
+		if name == "hmget" {
+			c.SetVal(vals)
+		} else if vals[0] == nil {
+			c.SetErr(redis.Nil)
+		} else {
+			c.SetVal(vals[0])
+		}
+	case *redis.StringCmd:
+		if vals[0] == nil {
+			c.SetErr(redis.Nil)
+		} else {
+			c.SetVal(vals[0].(string))
+		}
+	case *redis.SliceCmd:
+		c.SetVal(vals)
+	default:
+		return false
+	}
+	return true
+}
+
+// 读取Redis之前占位，返回的对象用来填充
+// 在读取过程中收到了失效消息，占位会被删除，读取的结果不再填充
+func (cc *clientCache) reserve(key string) (*clientCacheEntry, int64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.ready {
+		return nil, 0
+	}
+	e, ok := cc.entries[key]
+	if !ok {
+		e = &clientCacheEntry{key: key}
+		e.elem = cc.lru.PushFront(e)
+		cc.entries[key] = e
+		for cc.lru.Len() > cc.conf.MaxKeys {
+			cc.remove(cc.lru.Back().Value.(*clientCacheEntry).key)
+		}
+	}
+	return e, cc.gen
+}
+
+func (cc *clientCache) fill(e *clientCacheEntry, gen int64, cmd redis.Cmder, name string, fields []string) {
+	if cmd.Err() != nil && cmd.Err() != redis.Nil {
+		return
+	}
+	var vals []interface{}
+	switch c := cmd.(type) {
+	case *redis.Cmd:
+		if c.Err() == redis.Nil {
+			vals = []interface{}{nil}
+		} else if name == "hmget" {
+			vals, _ = c.Val().([]interface{})
+		} else {
+			vals = []interface{}{c.Val()}
+		}
+	case *redis.StringCmd:
+		if c.Err() == redis.Nil {
+			vals = []interface{}{nil}
+		} else {
+			vals = []interface{}{c.Val()}
+		}
+	case *redis.SliceCmd:
+		vals = c.Val()
+	}
+	if name == "get" {
+		fields = []string{""}
+	}
+	if len(vals) != len(fields) {
+		return
+	}
+	for _, v := range vals {
+		switch v.(type) {
+		case nil, string:
+		default:
+			return // 只缓存字符串
+		}
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.ready || cc.gen != gen || cc.entries[e.key] != e {
+		return
+	}
+	if name == "get" {
+		e.hasStr = true
+		e.str = vals[0]
+		return
+	}
+	if e.fields == nil {
+		e.fields = make(map[string]interface{}, len(fields))
+	}
+	for i, f := range fields {
+		e.fields[f] = vals[i]
+	}
+}
+
+// 本客户端的写命令 执行前后都删除本地缓存，失效消息是异步的，这样可以立即读到自己写入的数据
+// 执行期间其他读取可能占位并填充旧值，执行后再删除一次，占位被删除后正在进行的填充也会被丢弃（fill检查占位是否还在）
+func (cc *clientCache) invalidate(cmd redis.Cmder) {
+	args := cmd.Args()
+	pos := GetFirstKeyPos(cmd)
+	if pos <= 0 || pos >= len(args) {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if len(cc.entries) == 0 {
+		return
+	}
+	for _, arg := range args[pos:] {
+		switch v := arg.(type) {
+		case string:
+			cc.remove(v)
+		case []byte:
+			cc.remove(string(v))
+		}
+	}
+}
+
+// 执行命令，返回客户端缓存的使用状态
+func (cc *clientCache) process(ctx context.Context, cmd redis.Cmder, next redis.ProcessHook) (int, error) {
+	name, key, fields, ok := clientCacheArgs(cmd)
+	if !ok {
+		cc.invalidate(cmd)
+		err := next(ctx, cmd)
+		cc.invalidate(cmd)
+		return ClientCacheNone, err
+	}
+	if ctx.Value(CtxKey_noclientcache) != nil || !cc.allow(key) {
+		return ClientCacheNone, next(ctx, cmd)
+	}
+	if cc.get(cmd, name, key, fields) {
+		return ClientCacheHit, cmd.Err()
+	}
+	e, gen := cc.reserve(key)
+	err := next(ctx, cmd)
+	if e != nil {
+		cc.fill(e, gen, cmd, name, fields)
+	}
+	return ClientCacheMiss, err
+}
@@ -53,6 +53,10 @@ type RedisCommond struct {
 	Cmds    []redis.Cmder // 管道的使用
 	CmdDesc string        // 命令的描述
 	Elapsed time.Duration // 耗时
+	// 客户端缓存的使用状态 ClientCacheNone ClientCacheHit ClientCacheMiss
+	ClientCache int
+	// Subscriber收到消息时填充
+	Subscribe *SubscribeStat
 	// 绑定回调
 	callback func(reply interface{}) error // 如果命令失败 不会回调， redis.Nil返回的空错误也认为是一种错误也认为是错误
 
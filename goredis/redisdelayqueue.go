@@ -0,0 +1,317 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 延迟任务队列
+// 任务写入延迟集合(zset score为执行时间)，消费者轮询时通过Lua脚本使用Redis服务器时间把到期的任务移到就绪列表，并取出任务
+// 取出的任务放入执行集合(zset score为租约到期时间)，多个实例同时消费时一个任务只会被一个消费者取出
+// 消费者崩溃没有完成的任务，租约到期后重新就绪，所以Lease需要大于任务的执行时间
+// 执行失败的任务按照Backoff指数退避重试，执行次数超过MaxAttempts后写入死信 key+"_dead"(hash)，租约到期的任务执行次数已经达到MaxAttempts时也写入死信
+// 任务的执行次数作为租约的标识，Done、Retry时执行次数不一致说明租约到期后被其他消费者取出了，不处理
+// 所有的key使用{key}作为前缀，集群模式下在同一个slot
+
+// KEYS[1]:延迟集合 KEYS[2]:就绪列表 KEYS[3]:任务数据 KEYS[4]:执行次数 KEYS[5]:执行集合
+// ARGV[1]:id ARGV[2]:数据 ARGV[3]:执行时间(毫秒) <=0时使用服务器时间+ARGV[4]
+var delayQueueAddScript = NewScript(`
+	local at = tonumber(ARGV[3])
+	if at <= 0 then
+		local t = redis.call('TIME')
+		at = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000) + tonumber(ARGV[4])
+	end
+	redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	redis.call('LREM', KEYS[2], 0, ARGV[1])
+	redis.call('ZREM', KEYS[5], ARGV[1])
+	redis.call('ZADD', KEYS[1], at, ARGV[1])
+	return at
+`)
+
+var delayQueueCancelScript = NewScript(`
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('LREM', KEYS[2], 0, ARGV[1])
+	redis.call('ZREM', KEYS[5], ARGV[1])
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	return redis.call('HDEL', KEYS[3], ARGV[1])
+`)
+
+// KEYS[6]:死信 ARGV[1]:最多取出的数量 ARGV[2]:租约时间(毫秒) ARGV[3]:最大执行次数
+// 返回 {取出的任务{id 数据 执行次数 ...}, 租约到期写入死信的任务{id 数据 执行次数 ...}}
+var delayQueuePollScript = NewScript(`
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, 100)
+	for _, id in ipairs(ids) do
+		redis.call('ZREM', KEYS[1], id)
+		redis.call('RPUSH', KEYS[2], id)
+	end
+	local dead = {}
+	ids = redis.call('ZRANGEBYSCORE', KEYS[5], '-inf', now, 'LIMIT', 0, 100)
+	for _, id in ipairs(ids) do
+		redis.call('ZREM', KEYS[5], id)
+		local n = tonumber(redis.call('HGET', KEYS[4], id) or 0)
+		if n >= tonumber(ARGV[3]) then
+			local data = redis.call('HGET', KEYS[3], id)
+			if data then
+				redis.call('HSET', KEYS[6], id, data)
+				table.insert(dead, id)
+				table.insert(dead, data)
+				table.insert(dead, n)
+			end
+			redis.call('HDEL', KEYS[4], id)
+			redis.call('HDEL', KEYS[3], id)
+		else
+			redis.call('RPUSH', KEYS[2], id)
+		end
+	end
+	local ret = {}
+	local count = 0
+	while count < tonumber(ARGV[1]) do
+		local id = redis.call('LPOP', KEYS[2])
+		if not id then
+			break
+		end
+		local data = redis.call('HGET', KEYS[3], id)
+		if data then
+			local n = redis.call('HINCRBY', KEYS[4], id, 1)
+			redis.call('ZADD', KEYS[5], now + tonumber(ARGV[2]), id)
+			table.insert(ret, id)
+			table.insert(ret, data)
+			table.insert(ret, n)
+			count = count + 1
+		end
+	end
+	return {ret, dead}
+`)
+
+// ARGV[2]:取出时的执行次数
+// 执行次数不一致说明已经被其他消费者取出了，任务不在执行集合或者就绪列表中，说明已经被重新添加或者取消了，都不删除
+var delayQueueDoneScript = NewScript(`
+	if redis.call('HGET', KEYS[4], ARGV[1]) ~= ARGV[2] then
+		return 0
+	end
+	if redis.call('ZREM', KEYS[5], ARGV[1]) == 0 and redis.call('LREM', KEYS[2], 0, ARGV[1]) == 0 then
+		return 0
+	end
+	redis.call('HDEL', KEYS[4], ARGV[1])
+	redis.call('HDEL', KEYS[3], ARGV[1])
+	return 1
+`)
+
+// KEYS[6]:死信 ARGV[2]:重试延迟(毫秒) ARGV[3]:最大执行次数 ARGV[4]:取出时的执行次数
+// 返回 1:重试 0:写入死信 -1:任务已经不属于自己了
+var delayQueueRetryScript = NewScript(`
+	if redis.call('HGET', KEYS[4], ARGV[1]) ~= ARGV[4] then
+		return -1
+	end
+	if redis.call('ZREM', KEYS[5], ARGV[1]) == 0 and redis.call('LREM', KEYS[2], 0, ARGV[1]) == 0 then
+		return -1
+	end
+	local n = tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or 0)
+	if n >= tonumber(ARGV[3]) then
+		local data = redis.call('HGET', KEYS[3], ARGV[1])
+		if data then
+			redis.call('HSET', KEYS[6], ARGV[1], data)
+		end
+		redis.call('HDEL', KEYS[4], ARGV[1])
+		redis.call('HDEL', KEYS[3], ARGV[1])
+		return 0
+	end
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+	return 1
+`)
+
+type DelayQueue struct {
+	r    *Redis
+	key  string
+	keys []string // 延迟集合 就绪列表 任务数据 执行次数 执行集合 死信
+
+	Lease        time.Duration // 取出任务的租约时间，超过后认为消费者崩溃了，任务重新就绪，默认1分钟
+	MaxAttempts  int           // 最大执行次数，默认5，<=0时按1处理
+	Backoff      time.Duration // 第一次重试的延迟，之后每次翻倍，默认5秒
+	MaxBackoff   time.Duration // 重试的最大延迟，默认10分钟
+	PollInterval time.Duration // Consume没有任务时的轮询间隔，默认1秒
+}
+
+func (r *Redis) NewDelayQueue(key string) *DelayQueue {
+	return &DelayQueue{
+		r:   r,
+		key: key,
+		keys: []string{
+			lockSubKey(key, "_delay"),
+			lockSubKey(key, "_ready"),
+			lockSubKey(key, "_jobs"),
+			lockSubKey(key, "_attempts"),
+			lockSubKey(key, "_running"),
+			lockSubKey(key, "_dead"),
+		},
+		Lease:        time.Minute,
+		MaxAttempts:  5,
+		Backoff:      time.Second * 5,
+		MaxBackoff:   time.Minute * 10,
+		PollInterval: time.Second,
+	}
+}
+
+// 最大执行次数，至少执行一次
+func (q *DelayQueue) maxAttempts() int {
+	if q.MaxAttempts <= 0 {
+		return 1
+	}
+	return q.MaxAttempts
+}
+
+// 死信的key hash结构 id:数据
+func (q *DelayQueue) DeadKey() string {
+	return q.keys[5]
+}
+
+// 添加任务 在at时间执行，v会json格式化
+// id相同的任务会被替换，id为空时自动生成，返回任务id
+func (q *DelayQueue) AddAt(ctx context.Context, id string, v interface{}, at time.Time) (string, error) {
+	return q.add(ctx, id, v, at.UnixMilli(), 0)
+}
+
+// 添加任务 以Redis服务器时间为准，延迟delay后执行
+func (q *DelayQueue) AddDelay(ctx context.Context, id string, v interface{}, delay time.Duration) (string, error) {
+	return q.add(ctx, id, v, 0, delay.Milliseconds())
+}
+
+func (q *DelayQueue) add(ctx context.Context, id string, v interface{}, at, delay int64) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		utils.LogCtx(log.Error(), ctx).Err(err).Str("key", q.key).Msg("Redis DelayQueue Add Param error")
+		return "", err
+	}
+	if len(id) == 0 {
+		id = utils.RandString(16)
+	}
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "DelayQueueAdd")
+	err = q.r.DoScript(ctx, delayQueueAddScript, q.keys[:5], id, b, at, delay).Err()
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// 取消任务 返回任务是否存在
+func (q *DelayQueue) Cancel(ctx context.Context, id string) (bool, error) {
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "DelayQueueCancel")
+	n, err := q.r.DoScript(ctx, delayQueueCancelScript, q.keys[:5], id).Int()
+	return n == 1, err
+}
+
+type DelayJob struct {
+	ID       string
+	Data     string // json格式的任务数据
+	Attempts int    // 第几次执行
+
+	q *DelayQueue
+}
+
+// 绑定任务数据 参考RedisCommond.BindJsonObj
+func (j *DelayJob) Bind(v interface{}) error {
+	return bindJsonData(context.TODO(), j.q.key+" "+j.ID, j.Data, v)
+}
+
+// 执行成功 删除任务，租约到期后被其他消费者取出了不删除
+func (j *DelayJob) Done(ctx context.Context) error {
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "DelayQueueDone")
+	return j.q.r.DoScript(ctx, delayQueueDoneScript, j.q.keys[:5], j.ID, j.Attempts).Err()
+}
+
+// 执行失败 延迟重试，超过最大次数后写入死信，租约到期后被其他消费者取出了不处理
+func (j *DelayJob) Retry(ctx context.Context) error {
+	delay := j.q.Backoff
+	for i := 1; i < j.Attempts && delay < j.q.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > j.q.MaxBackoff {
+		delay = j.q.MaxBackoff
+	}
+	cmdCtx := context.WithValue(ctx, CtxKey_cmddesc, "DelayQueueRetry")
+	n, err := j.q.r.DoScript(cmdCtx, delayQueueRetryScript, j.q.keys, j.ID, delay.Milliseconds(), j.q.maxAttempts(), j.Attempts).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		utils.LogCtx(log.Error(), ctx).Str("key", j.q.key).Str("id", j.ID).Int("attempts", j.Attempts).Str("data", j.Data).
+			Msg("Redis DelayQueue Job Dead")
+	}
+	return nil
+}
+
+// 取出到期的任务 最多count个
+func (q *DelayQueue) Poll(ctx context.Context, count int) ([]*DelayJob, error) {
+	ctx = CtxNonilErr(ctx)
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "DelayQueuePoll")
+	reply, err := q.r.DoScript(ctx, delayQueuePollScript, q.keys, count, q.Lease.Milliseconds(), q.maxAttempts()).Slice()
+	if err != nil {
+		return nil, err
+	}
+	var jobs, dead []*DelayJob
+	if len(reply) > 0 {
+		jobs = q.parseJobs(reply[0])
+	}
+	if len(reply) > 1 {
+		dead = q.parseJobs(reply[1])
+	}
+	for _, job := range dead {
+		utils.LogCtx(log.Error(), ctx).Str("key", q.key).Str("id", job.ID).Int("attempts", job.Attempts).Str("data", job.Data).
+			Msg("Redis DelayQueue Job Dead")
+	}
+	return jobs, nil
+}
+
+// 解析脚本返回的 id 数据 执行次数 ...
+func (q *DelayQueue) parseJobs(v interface{}) []*DelayJob {
+	reply, _ := v.([]interface{})
+	jobs := make([]*DelayJob, 0, len(reply)/3)
+	for i := 0; i+2 < len(reply); i += 3 {
+		id, _ := reply[i].(string)
+		data, _ := reply[i+1].(string)
+		attempts, _ := reply[i+2].(int64)
+		jobs = append(jobs, &DelayJob{ID: id, Data: data, Attempts: int(attempts), q: q})
+	}
+	return jobs
+}
+
+// 循环取出任务并回调，直到ctx结束，回调返回nil时任务完成，返回错误或者崩溃时重试
+func (q *DelayQueue) Consume(ctx context.Context, count int, f func(ctx context.Context, job *DelayJob) error) error {
+	for ctx.Err() == nil {
+		jobs, err := q.Poll(utils.CtxSetNolog(ctx), count) // 轮询不需要日志
+		if err != nil || len(jobs) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.PollInterval):
+			}
+			continue
+		}
+		for _, job := range jobs {
+			err := func() (err error) {
+				defer utils.HandlePanic2(func(r any) {
+					err = fmt.Errorf("%s handle panic", job.ID)
+				})
+				return f(ctx, job)
+			}()
+			if err == nil {
+				job.Done(context.TODO())
+			} else {
+				job.Retry(context.TODO())
+			}
+		}
+	}
+	return ctx.Err()
+}
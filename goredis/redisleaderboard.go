@@ -0,0 +1,383 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// 排行榜 基于zset
+// zset的score存储组合分数 = 分数*2^TimeBits + 时间部分，分数相同时先达到的排名靠前
+// 时间部分为距离Epoch的秒数，降序榜存储2^TimeBits-1-秒数，升序榜直接存储秒数
+// score是double类型，分数的绝对值需要小于2^(53-TimeBits)，默认TimeBits为32，分数最大约200万，分数更大时可以减小TimeBits并调整Epoch
+// 一个排行榜可以同时写入总榜和多个周期榜(日榜 周榜 月榜)，周期榜的key按时间自动切换，过期时间为周期结束后再保留Retain个周期
+// 所有榜的key使用{key}作为前缀，集群模式下在同一个slot
+
+const (
+	LeaderboardTotal   = 0 // 总榜
+	LeaderboardDaily   = 1 // 日榜
+	LeaderboardWeekly  = 2 // 周榜 周一开始
+	LeaderboardMonthly = 3 // 月榜
+)
+
+// KEYS:所有榜
+// ARGV[1]:模式 set:设置 incr:增加 best:更好时才设置 ARGV[2]:2^TimeBits ARGV[3]:时间部分 ARGV[4]:成员 ARGV[5]:分数 ARGV[6]:是否升序
+// ARGV[6+i]:KEYS[i]的过期时间戳(秒) 0表示不过期
+// 返回每个榜中成员的分数，incr模式增加后的分数超出范围时返回错误，不修改任何榜
+var leaderboardUpdateScript = NewScript(`
+	local mode = ARGV[1]
+	local unit = tonumber(ARGV[2])
+	local tp = tonumber(ARGV[3])
+	local member = ARGV[4]
+	local asc = ARGV[6] == '1'
+	local limit = 2^53 / unit
+	local curs = {}
+	if mode == 'incr' then
+		-- 增加后的分数超出范围时会丢失精度，全部检查后再写入
+		for i, key in ipairs(KEYS) do
+			curs[i] = redis.call('ZSCORE', key, member)
+			if curs[i] then
+				local score = math.floor(tonumber(curs[i]) / unit) + tonumber(ARGV[5])
+				if score >= limit or score <= -limit then
+					return redis.error_reply('leaderboard score overflow')
+				end
+			end
+		end
+	end
+	local ret = {}
+	for i, key in ipairs(KEYS) do
+		local cur = curs[i] or redis.call('ZSCORE', key, member)
+		local score = tonumber(ARGV[5])
+		if mode == 'incr' and cur then
+			score = math.floor(tonumber(cur) / unit) + score
+		end
+		local v = score * unit + tp
+		local write = true
+		if mode == 'best' and cur then
+			if asc then
+				write = v < tonumber(cur)
+			else
+				write = v > tonumber(cur)
+			end
+		end
+		if write then
+			redis.call('ZADD', key, string.format('%.0f', v), member)
+		else
+			score = math.floor(tonumber(cur) / unit)
+		end
+		local exp = tonumber(ARGV[6 + i])
+		if exp > 0 then
+			redis.call('EXPIREAT', key, exp)
+		end
+		table.insert(ret, score)
+	end
+	return ret
+`)
+
+type LeaderboardEntry struct {
+	Member string
+	Score  int64
+	Time   time.Time // 分数更新的时间，精确到秒
+	Rank   int64     // 排名 从1开始
+}
+
+type Leaderboard struct {
+	r       *Redis
+	key     string
+	periods []int
+
+	Asc      bool                       // 升序榜，分数小的排名靠前，默认降序
+	Epoch    time.Time                  // 时间部分的起始时间，默认2024-01-01 UTC
+	TimeBits uint                       // 时间部分占用的位数，默认32
+	Retain   int                        // 周期榜在周期结束后保留的周期数，用来结算上一期，默认1
+	Location *time.Location             // 周期划分的时区，默认time.Local
+	DataKey  func(member string) string // 成员数据的key(hash结构)，BindData和Page使用
+}
+
+// 创建排行榜 periods为写入的榜，为空时只写入总榜
+func (r *Redis) NewLeaderboard(key string, periods ...int) *Leaderboard {
+	if len(periods) == 0 {
+		periods = []int{LeaderboardTotal}
+	}
+	return &Leaderboard{
+		r:        r,
+		key:      key,
+		periods:  periods,
+		Epoch:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		TimeBits: 32,
+		Retain:   1,
+		Location: time.Local,
+	}
+}
+
+// 周期的开始时间
+func (lb *Leaderboard) periodStart(period int, t time.Time) time.Time {
+	t = t.In(lb.Location)
+	switch period {
+	case LeaderboardDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, lb.Location)
+	case LeaderboardWeekly:
+		wd := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-wd, 0, 0, 0, 0, lb.Location)
+	case LeaderboardMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, lb.Location)
+	}
+	return time.Time{}
+}
+
+// 周期开始时间之后n个周期的开始时间
+func (lb *Leaderboard) periodAdd(period int, start time.Time, n int) time.Time {
+	switch period {
+	case LeaderboardDaily:
+		return start.AddDate(0, 0, n)
+	case LeaderboardWeekly:
+		return start.AddDate(0, 0, 7*n)
+	case LeaderboardMonthly:
+		return start.AddDate(0, n, 0)
+	}
+	return start
+}
+
+// t时间所在的榜的key
+func (lb *Leaderboard) BoardKey(period int, t time.Time) string {
+	start := lb.periodStart(period, t)
+	switch period {
+	case LeaderboardDaily:
+		return lockSubKey(lb.key, ":d"+start.Format("20060102"))
+	case LeaderboardWeekly:
+		return lockSubKey(lb.key, ":w"+start.Format("20060102"))
+	case LeaderboardMonthly:
+		return lockSubKey(lb.key, ":m"+start.Format("200601"))
+	}
+	return lockSubKey(lb.key, "")
+}
+
+// 当前周期的榜
+func (lb *Leaderboard) Current(period int) string {
+	return lb.BoardKey(period, time.Now())
+}
+
+// 上一个周期的榜，用来结算
+func (lb *Leaderboard) Previous(period int) string {
+	return lb.BoardKey(period, lb.periodAdd(period, lb.periodStart(period, time.Now()), -1))
+}
+
+// 设置分数
+func (lb *Leaderboard) Set(ctx context.Context, member string, score int64) error {
+	_, err := lb.update(ctx, "set", member, score)
+	return err
+}
+
+// 增加分数 返回每个榜中的新分数，顺序和创建时的periods一致
+func (lb *Leaderboard) Incr(ctx context.Context, member string, delta int64) ([]int64, error) {
+	return lb.update(ctx, "incr", member, delta)
+}
+
+// 分数比已有的更好时才设置(降序榜更大 升序榜更小)，分数相同时保留先达到的 返回每个榜中的分数
+func (lb *Leaderboard) SetBest(ctx context.Context, member string, score int64) ([]int64, error) {
+	return lb.update(ctx, "best", member, score)
+}
+
+func (lb *Leaderboard) update(ctx context.Context, mode, member string, score int64) ([]int64, error) {
+	limit := int64(1) << (53 - lb.TimeBits)
+	if score >= limit || score <= -limit {
+		err := errors.New("leaderboard score overflow")
+		utils.LogCtx(log.Error(), ctx).Err(err).Str("key", lb.key).Str("member", member).Int64("score", score).Msg("Redis Leaderboard Param error")
+		return nil, err
+	}
+	now := time.Now()
+	keys := make([]string, 0, len(lb.periods))
+	args := []interface{}{mode, int64(1) << lb.TimeBits, lb.timePart(now), member, score, 0}
+	if lb.Asc {
+		args[5] = 1
+	}
+	for _, period := range lb.periods {
+		keys = append(keys, lb.BoardKey(period, now))
+		if period == LeaderboardTotal {
+			args = append(args, 0)
+		} else {
+			args = append(args, lb.periodAdd(period, lb.periodStart(period, now), 1+lb.Retain).Unix())
+		}
+	}
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "Leaderboard")
+	return lb.r.DoScript(ctx, leaderboardUpdateScript, keys, args...).Int64Slice()
+}
+
+// 组合分数的时间部分
+func (lb *Leaderboard) timePart(t time.Time) int64 {
+	mask := int64(1)<<lb.TimeBits - 1
+	elapsed := int64(t.Sub(lb.Epoch) / time.Second)
+	if elapsed < 0 {
+		elapsed = 0
+	} else if elapsed > mask {
+		elapsed = mask
+	}
+	if lb.Asc {
+		return elapsed
+	}
+	return mask - elapsed
+}
+
+// 解析组合分数
+func (lb *Leaderboard) decode(member string, v float64, rank int64) *LeaderboardEntry {
+	unit := float64(int64(1) << lb.TimeBits)
+	score := math.Floor(v / unit)
+	elapsed := int64(v - score*unit)
+	if !lb.Asc {
+		elapsed = int64(1)<<lb.TimeBits - 1 - elapsed
+	}
+	return &LeaderboardEntry{
+		Member: member,
+		Score:  int64(score),
+		Time:   lb.Epoch.Add(time.Duration(elapsed) * time.Second),
+		Rank:   rank,
+	}
+}
+
+// 从所有当前的榜中删除成员
+func (lb *Leaderboard) Remove(ctx context.Context, member string) error {
+	now := time.Now()
+	pipe := lb.r.NewPipeline()
+	for _, period := range lb.periods {
+		pipe.ZRem(ctx, lb.BoardKey(period, now), member)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 榜中的成员数量
+func (lb *Leaderboard) Count(ctx context.Context, board string) (int64, error) {
+	return lb.r.ZCard(ctx, board).Result()
+}
+
+// 成员的排名和分数，不在榜中返回nil
+func (lb *Leaderboard) Rank(ctx context.Context, board, member string) (*LeaderboardEntry, error) {
+	pipe := lb.r.NewPipeline()
+	var rankCmd *redis.IntCmd
+	if lb.Asc {
+		rankCmd = pipe.ZRank(ctx, board, member)
+	} else {
+		rankCmd = pipe.ZRevRank(ctx, board, member)
+	}
+	scoreCmd := pipe.ZScore(ctx, board, member)
+	_, err := pipe.ExecNoNil(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rankCmd.Err() == redis.Nil || scoreCmd.Err() == redis.Nil {
+		return nil, nil
+	}
+	return lb.decode(member, scoreCmd.Val(), rankCmd.Val()+1), nil
+}
+
+// 排名范围内的成员 start从0开始，包括stop
+func (lb *Leaderboard) Range(ctx context.Context, board string, start, stop int64) ([]*LeaderboardEntry, error) {
+	var zs []redis.Z
+	var err error
+	if lb.Asc {
+		zs, err = lb.r.ZRangeWithScores(ctx, board, start, stop).Result()
+	} else {
+		zs, err = lb.r.ZRevRangeWithScores(ctx, board, start, stop).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*LeaderboardEntry, 0, len(zs))
+	for i, z := range zs {
+		member, _ := z.Member.(string)
+		entries = append(entries, lb.decode(member, z.Score, start+int64(i)+1))
+	}
+	return entries, nil
+}
+
+// 前count名 offset从0开始
+func (lb *Leaderboard) Top(ctx context.Context, board string, offset, count int64) ([]*LeaderboardEntry, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	return lb.Range(ctx, board, offset, offset+count-1)
+}
+
+// 成员前后的排名 包括成员自己，不在榜中返回空
+func (lb *Leaderboard) Around(ctx context.Context, board, member string, before, after int64) ([]*LeaderboardEntry, error) {
+	var rank int64
+	var err error
+	if lb.Asc {
+		rank, err = lb.r.ZRank(CtxNonilErr(ctx), board, member).Result()
+	} else {
+		rank, err = lb.r.ZRevRank(CtxNonilErr(ctx), board, member).Result()
+	}
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	start := rank - before
+	if start < 0 {
+		start = 0
+	}
+	return lb.Range(ctx, board, start, rank+after)
+}
+
+// 分页读取 page从1开始，datas不为nil时读取成员数据，参考BindData
+func (lb *Leaderboard) Page(ctx context.Context, board string, page, size int64, datas interface{}) ([]*LeaderboardEntry, error) {
+	if page < 1 {
+		page = 1
+	}
+	entries, err := lb.Top(ctx, board, (page-1)*size, size)
+	if err != nil || datas == nil {
+		return entries, err
+	}
+	return entries, lb.BindData(ctx, entries, datas)
+}
+
+// 使用HMGetObj读取成员数据 key为DataKey(member)
+// datas为结构切片的地址 *[]T 或者 *[]*T，读取后长度和entries一致，结构的格式参考Redis.HMGetObj的说明
+func (lb *Leaderboard) BindData(ctx context.Context, entries []*LeaderboardEntry, datas interface{}) error {
+	vo := reflect.ValueOf(datas)
+	if vo.Kind() != reflect.Ptr || vo.Elem().Kind() != reflect.Slice || lb.DataKey == nil {
+		err := errors.New("datas must be *[]T or *[]*T and DataKey not nil")
+		utils.LogCtx(log.Error(), ctx).Err(err).Str("key", lb.key).Str("type", vo.Type().String()).Msg("Redis Leaderboard BindData Param error")
+		return err
+	}
+	slice := vo.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		err := errors.New("datas elem must be struct")
+		utils.LogCtx(log.Error(), ctx).Err(err).Str("key", lb.key).Str("type", vo.Type().String()).Msg("Redis Leaderboard BindData Param error")
+		return err
+	}
+	slice.Set(reflect.MakeSlice(slice.Type(), len(entries), len(entries)))
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ctx = CtxNonilErr(ctx)
+	pipe := lb.r.NewPipeline()
+	for i, entry := range entries {
+		elem := slice.Index(i)
+		if isPtr {
+			elem.Set(reflect.New(elemType))
+		} else {
+			elem = elem.Addr()
+		}
+		if err := pipe.HMGetObj(ctx, lb.DataKey(entry.Member), elem.Interface()); err != nil {
+			return err
+		}
+	}
+	_, err := pipe.ExecNoNil(ctx)
+	return err
+}
@@ -7,10 +7,13 @@ import (
 	"errors"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gobase/utils"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -295,3 +298,392 @@ func (r *Redis) Lock(ctx context.Context, key string, timeout time.Duration) (fu
 		}, nil
 	}
 }
+
+var ErrLockLost = errors.New("lock lost")
+
+// 加锁成功后递增栅栏令牌，令牌key不设置过期，保证单调递增
+var acquireLockScript = NewScript(`
+	if redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX') then
+		return redis.call('INCR', KEYS[2])
+	end
+	return 0
+`)
+
+var renewLockScript = NewScript(`
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+	return 0
+`)
+
+type LockOption struct {
+	TTL         time.Duration // 锁的过期时间，持有期间看门狗每TTL/3续期一次，<=0时默认10秒
+	WaitTimeout time.Duration // 加锁失败时等待的时间，<=0只尝试一次
+	Reentrant   bool          // 可重入，使用RedisLock.Context()继续加同一个key的锁时直接成功，Unlock次数相同时才真正解锁
+}
+
+type lockCtxKey struct {
+	r   *Redis
+	key string
+}
+
+// 带看门狗的分布式锁
+// 续期失败（锁被删除或者被其他持有）或者超过TTL没有续期成功，认为锁丢失了，Lost()会收到ErrLockLost，Context()会被取消
+type RedisLock struct {
+	r     *Redis
+	key   string
+	uuid  string
+	ttl   time.Duration
+	token int64
+
+	ctx    context.Context // 携带锁信息的ctx
+	cancel context.CancelFunc
+	lost   chan error
+
+	mu    sync.Mutex
+	holds int  // 重入次数
+	done  bool // 已经解锁或者丢失
+}
+
+// 锁的ctx，从context.Background()派生，只从调用者的ctx中查找其他的锁信息，嵌套加锁时也可以重入
+type lockCtx struct {
+	context.Context
+	parent context.Context
+}
+
+func (c lockCtx) Value(key interface{}) interface{} {
+	if _, ok := key.(lockCtxKey); ok && c.parent != nil {
+		return c.parent.Value(key)
+	}
+	return c.Context.Value(key)
+}
+
+// 锁使用的附属key，集群模式下和锁的key在同一个slot
+func lockSubKey(key, suffix string) string {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key + suffix
+		}
+	}
+	return "{" + key + "}" + suffix
+}
+
+// 加锁 成功后启动看门狗续期，使用完调用Unlock
+func (r *Redis) Acquire(ctx context.Context, key string, opt *LockOption) (*RedisLock, error) {
+	var o LockOption
+	if opt != nil {
+		o = *opt
+	}
+	if o.TTL <= 0 {
+		o.TTL = time.Second * 10
+	}
+	// 重入
+	if o.Reentrant && ctx != nil {
+		if l, ok := ctx.Value(lockCtxKey{r: r, key: key}).(*RedisLock); ok {
+			l.mu.Lock()
+			if !l.done {
+				l.holds++
+				l.mu.Unlock()
+				return l, nil
+			}
+			l.mu.Unlock()
+		}
+	}
+
+	uuid := utils.LocalIPString() + "-" + strconv.Itoa(os.Getpid()) + "-" + utils.RandString(16)
+
+	logOut := !utils.CtxHasNolog(ctx)
+	cmdCtx := utils.CtxSetNolog(ctx)                       // 命令传递下去不需要日志了
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_nonilerr, 1) // 不要nil错误
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_cmddesc, "Acquire")
+
+	entry := time.Now()
+	spinCnt := 0 // 自旋次数
+	var token int64
+	var err error
+	for {
+		spinCnt++
+		token, err = r.DoScript(cmdCtx, acquireLockScript, []string{key, lockSubKey(key, "_fence")}, uuid, o.TTL.Milliseconds()).Int64()
+		if err == nil && token > 0 {
+			break
+		}
+		if time.Since(entry) >= o.WaitTimeout {
+			if err == nil {
+				err = errors.New("lock time out")
+			}
+			break
+		}
+		select {
+		case <-cmdCtx.Done():
+			err = cmdCtx.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
+		if cmdCtx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		// Debug就行 毕竟可能是try
+		if logOut && zerolog.DebugLevel >= log.Logger.GetLevel() {
+			utils.LogCtx(log.Debug(), ctx).Err(err).Int32("elapsed", int32(time.Since(entry)/time.Millisecond)).
+				Str("key", key).
+				Str("uuid", uuid).
+				Int("spinCnt", spinCnt).
+				Msg("Redis Acquire Fail")
+		}
+		return nil, err
+	}
+	if logOut && zerolog.DebugLevel >= log.Logger.GetLevel() {
+		utils.LogCtx(log.Debug(), ctx).Int32("elapsed", int32(time.Since(entry)/time.Millisecond)).
+			Str("key", key).
+			Str("uuid", uuid).
+			Int64("token", token).
+			Int("spinCnt", spinCnt).
+			Msg("Redis Acquire Success")
+	}
+
+	l := &RedisLock{
+		r:     r,
+		key:   key,
+		uuid:  uuid,
+		ttl:   o.TTL,
+		token: token,
+		lost:  make(chan error, 1),
+		holds: 1,
+	}
+	// 锁的ctx只在解锁或者锁丢失时取消，不继承调用者ctx的取消
+	l.ctx, l.cancel = context.WithCancel(context.WithValue(lockCtx{Context: context.Background(), parent: ctx}, lockCtxKey{r: r, key: key}, l))
+	go l.watchdog(entry)
+	return l, nil
+}
+
+// 栅栏令牌，每次加锁成功后递增，写入MySQL等存储时带上，存储方拒绝比已写入令牌小的请求
+func (l *RedisLock) Token() int64 {
+	return l.token
+}
+
+func (l *RedisLock) Key() string {
+	return l.key
+}
+
+// 携带锁信息，可重入加锁时需要传递该ctx，只在解锁或者锁丢失时会被取消
+func (l *RedisLock) Context() context.Context {
+	return l.ctx
+}
+
+// 锁丢失时收到ErrLockLost，正常解锁不会收到
+func (l *RedisLock) Lost() <-chan error {
+	return l.lost
+}
+
+// 解锁 重入的锁Unlock次数和加锁次数相同时才真正解锁
+func (l *RedisLock) Unlock() error {
+	l.mu.Lock()
+	if l.done {
+		l.mu.Unlock()
+		return nil
+	}
+	l.holds--
+	if l.holds > 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.done = true
+	l.mu.Unlock()
+	l.cancel()
+
+	ctx := utils.CtxSetNolog(context.TODO())
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "Unlock")
+	return l.r.DoScript(ctx, deleteLockKeyScript, []string{l.key}, l.uuid).Err()
+}
+
+func (l *RedisLock) watchdog(renewed time.Time) {
+	defer utils.HandlePanic()
+	ctx := utils.CtxSetNolog(context.TODO())
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "Renew")
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		n, err := l.r.DoScript(ctx, renewLockScript, []string{l.key}, l.uuid, l.ttl.Milliseconds()).Int()
+		if err == nil && n == 1 {
+			renewed = now
+			continue
+		}
+		// 续期失败，出错时在过期之前还可以继续尝试
+		if err != nil && time.Since(renewed) < l.ttl {
+			continue
+		}
+		l.mu.Lock()
+		if l.done {
+			l.mu.Unlock()
+			return
+		}
+		l.done = true
+		l.mu.Unlock()
+		log.Error().Err(err).Str("key", l.key).Str("uuid", l.uuid).Int64("token", l.token).Msg("Redis Lock Lost")
+		l.lost <- ErrLockLost
+		l.cancel()
+		return
+	}
+}
+
+// 加锁等待 先尝试一次，失败后订阅channel，收到通知后再次尝试，异常或者超时后，返回错误
+// 持有者异常退出时没有通知，最长每秒也会尝试一次，等待持有者过期
+func (r *Redis) lockWait(ctx context.Context, name, key, uuid, channel string, wait time.Duration, try func() bool) error {
+	logOut := !utils.CtxHasNolog(ctx)
+
+	entry := time.Now()
+	logtime := entry
+	spinCnt := 0 // 自旋次数
+	var notify chan struct{}
+	var release func()
+	var err error
+	for {
+		spinCnt++
+		if try() {
+			break
+		}
+		if time.Since(entry) >= wait {
+			err = errors.New("lock time out")
+			break
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		if notify == nil {
+			notify, release, err = r.lockWatch(ctx, channel)
+			if err == nil {
+				continue // 订阅之后立即再尝试一次，防止漏掉订阅之前的通知
+			}
+			err = nil
+			time.Sleep(time.Millisecond * 10) // 订阅失败了 只能轮询
+		} else {
+			d := wait - time.Since(entry)
+			if d > time.Second {
+				d = time.Second
+			}
+			timer := time.NewTimer(d)
+			select {
+			case _, ok := <-notify:
+				if !ok { // 订阅断开了，重新订阅
+					release()
+					notify, release = nil, nil
+				}
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+			timer.Stop()
+		}
+
+		// 每2秒输出一个等待日志 Info级别，便于外部查问题
+		now := time.Now()
+		if now.Sub(logtime) >= time.Second*2 {
+			logtime = time.Now()
+			utils.LogCtx(log.Info(), ctx).Int32("elapsed", int32(now.Sub(entry)/time.Millisecond)).
+				Str("key", key).
+				Str("uuid", uuid).
+				Msg("Redis " + name + " Waiting")
+		}
+	}
+	if release != nil {
+		release()
+	}
+
+	if err != nil {
+		// Debug就行 超时是正常的
+		if logOut && zerolog.DebugLevel >= log.Logger.GetLevel() {
+			utils.LogCtx(log.Debug(), ctx).Err(err).Int32("elapsed", int32(time.Since(entry)/time.Millisecond)).
+				Str("key", key).
+				Str("uuid", uuid).
+				Int("spinCnt", spinCnt).
+				Msg("Redis " + name + " Fail")
+		}
+		return err
+	}
+	if logOut && zerolog.DebugLevel >= log.Logger.GetLevel() {
+		utils.LogCtx(log.Debug(), ctx).Int32("elapsed", int32(time.Since(entry)/time.Millisecond)).
+			Str("key", key).
+			Str("uuid", uuid).
+			Int("spinCnt", spinCnt).
+			Msg("Redis " + name + " Success")
+	}
+	return nil
+}
+
+// 加锁等待共享的订阅，同一个channel只订阅一次，收到通知后唤醒所有的等待者
+type lockNotify struct {
+	sub     *redis.PubSub
+	waiters map[chan struct{}]struct{}
+}
+
+// 等待channel的通知，返回的chan收到数据表示有通知，被关闭表示订阅断开了，不再等待时调用返回的func
+func (r *Redis) lockWatch(ctx context.Context, channel string) (chan struct{}, func(), error) {
+	r.lockNotifyMu.Lock()
+	defer r.lockNotifyMu.Unlock()
+	n := r.lockNotifys[channel]
+	if n == nil {
+		sub, err := r.subscribe(ctx, channel)
+		if err != nil {
+			return nil, nil, err
+		}
+		n = &lockNotify{sub: sub, waiters: map[chan struct{}]struct{}{}}
+		if r.lockNotifys == nil {
+			r.lockNotifys = map[string]*lockNotify{}
+		}
+		r.lockNotifys[channel] = n
+		go r.lockNotifyLoop(channel, n)
+	}
+	ch := make(chan struct{}, 1)
+	n.waiters[ch] = struct{}{}
+	return ch, func() {
+		r.lockNotifyMu.Lock()
+		defer r.lockNotifyMu.Unlock()
+		if _, ok := n.waiters[ch]; !ok {
+			return // 订阅断开时已经删除了
+		}
+		delete(n.waiters, ch)
+		if len(n.waiters) == 0 && r.lockNotifys[channel] == n {
+			delete(r.lockNotifys, channel)
+			n.sub.Close()
+		}
+	}, nil
+}
+
+func (r *Redis) lockNotifyLoop(channel string, n *lockNotify) {
+	defer utils.HandlePanic()
+	for {
+		msg, err := n.sub.Receive(context.Background())
+		r.lockNotifyMu.Lock()
+		if err != nil {
+			// 没有等待者时主动关闭的，或者订阅断开了，关闭所有等待者的chan，等待者会重新订阅
+			if r.lockNotifys[channel] == n {
+				delete(r.lockNotifys, channel)
+				n.sub.Close()
+				log.Warn().Err(err).Str("channel", channel).Msg("Redis lockNotify Receive fail")
+			}
+			for ch := range n.waiters {
+				close(ch)
+				delete(n.waiters, ch)
+			}
+			r.lockNotifyMu.Unlock()
+			return
+		}
+		if _, ok := msg.(*redis.Message); ok {
+			for ch := range n.waiters {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+		r.lockNotifyMu.Unlock()
+	}
+}
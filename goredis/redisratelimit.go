@@ -0,0 +1,163 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 分布式限流 多个实例共享限流状态，一次Lua脚本完成判断和扣减，使用Redis服务器时间
+// 令牌桶使用GCRA算法，只存储一个理论到达时间，占用空间小，允许burst个请求的突发
+// 滑动窗口使用zset记录窗口内的每次请求，精确但占用空间和limit成正比
+// 限流的key为 prefix+":"+key
+
+const (
+	RateLimitTokenBucket   = 1 // 令牌桶 GCRA
+	RateLimitSlidingWindow = 2 // 滑动窗口日志
+)
+
+// 时间单位都是微秒
+// ARGV[1]:产生一个令牌的间隔 ARGV[2]:突发容忍时间(间隔*burst) ARGV[3]:消耗的令牌数
+// 返回 是否允许 剩余数量 重试等待 完全恢复等待
+var rateLimitGCRAScript = NewScript(`
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+	local emission = tonumber(ARGV[1])
+	local tolerance = tonumber(ARGV[2])
+	local cost = tonumber(ARGV[3])
+	local tat = tonumber(redis.call('GET', KEYS[1]) or 0)
+	if tat < now then
+		tat = now
+	end
+	local newtat = tat + emission * cost
+	local diff = now - (newtat - tolerance)
+	if diff < 0 then
+		local retry = -diff
+		if emission * cost > tolerance then
+			retry = -1
+		end
+		return {0, math.floor((now - tat + tolerance) / emission), retry, tat - now}
+	end
+	redis.call('SET', KEYS[1], string.format('%.0f', newtat), 'PX', math.ceil((newtat - now) / 1000))
+	return {1, math.floor(diff / emission), 0, newtat - now}
+`)
+
+// ARGV[1]:窗口内最大数量 ARGV[2]:窗口时间 ARGV[3]:消耗的数量 ARGV[4]:成员的唯一前缀
+var rateLimitWindowScript = NewScript(`
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+	local limit = tonumber(ARGV[1])
+	local window = tonumber(ARGV[2])
+	local cost = tonumber(ARGV[3])
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+	local count = redis.call('ZCARD', KEYS[1])
+	if count + cost > limit then
+		local retry = -1
+		if cost <= limit then
+			local oldest = redis.call('ZRANGE', KEYS[1], count + cost - limit - 1, count + cost - limit - 1, 'WITHSCORES')
+			retry = tonumber(oldest[2]) + window - now
+		end
+		local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+		local reset = 0
+		if #newest > 0 then
+			reset = tonumber(newest[2]) + window - now
+		end
+		return {0, math.max(limit - count, 0), retry, reset}
+	end
+	for i = 1, cost do
+		redis.call('ZADD', KEYS[1], now, ARGV[4] .. i)
+	end
+	redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+	return {1, limit - count - cost, 0, window}
+`)
+
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int64         // 剩余可用数量
+	RetryAfter time.Duration // 被拒绝时需要等待的时间，-1表示请求的数量超过了容量，永远不会允许
+	ResetAfter time.Duration // 恢复到满容量需要的时间
+}
+
+type RateLimiter struct {
+	r      *Redis
+	prefix string
+	algo   int
+	limit  int64
+	period time.Duration
+	burst  int64
+}
+
+// 令牌桶 每period产生rate个令牌，桶容量为burst，burst<=0时等于rate
+func (r *Redis) NewTokenBucket(prefix string, rate int64, period time.Duration, burst int64) *RateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &RateLimiter{r: r, prefix: prefix, algo: RateLimitTokenBucket, limit: rate, period: period, burst: burst}
+}
+
+// 滑动窗口 任意window时间内最多limit个请求
+func (r *Redis) NewSlidingWindow(prefix string, limit int64, window time.Duration) *RateLimiter {
+	return &RateLimiter{r: r, prefix: prefix, algo: RateLimitSlidingWindow, limit: limit, period: window}
+}
+
+func (l *RateLimiter) Key(key string) string {
+	return l.prefix + ":" + key
+}
+
+// 请求一次
+func (l *RateLimiter) Allow(ctx context.Context, key string) (*RateLimitResult, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+// 请求n次
+func (l *RateLimiter) AllowN(ctx context.Context, key string, n int64) (*RateLimitResult, error) {
+	if l.limit <= 0 || l.period <= 0 {
+		err := errors.New("ratelimit param invalid")
+		utils.LogCtx(log.Error(), ctx).Err(err).Str("key", l.Key(key)).Int64("limit", l.limit).Dur("period", l.period).Msg("Redis RateLimit fail")
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "RateLimit")
+	var reply []interface{}
+	var err error
+	if l.algo == RateLimitTokenBucket {
+		emission := float64(l.period.Microseconds()) / float64(l.limit)
+		reply, err = l.r.DoScript(ctx, rateLimitGCRAScript, []string{l.Key(key)}, emission, emission*float64(l.burst), n).Slice()
+	} else {
+		reply, err = l.r.DoScript(ctx, rateLimitWindowScript, []string{l.Key(key)}, l.limit, l.period.Microseconds(), n, utils.RandString(8)+"-").Slice()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 4 {
+		return nil, errors.New("ratelimit reply invalid")
+	}
+	allowed, _ := reply[0].(int64)
+	remaining, _ := reply[1].(int64)
+	retry, _ := reply[2].(int64)
+	reset, _ := reply[3].(int64)
+	res := &RateLimitResult{
+		Allowed:    allowed == 1,
+		Remaining:  remaining,
+		RetryAfter: time.Duration(retry) * time.Microsecond,
+		ResetAfter: time.Duration(reset) * time.Microsecond,
+	}
+	if retry < 0 {
+		res.RetryAfter = -1
+	}
+	return res, nil
+}
+
+// 适配ginserver.RateLimiter和msger.RateLimiter接口
+func (l *RateLimiter) Limit(ctx context.Context, key string) (bool, time.Duration, error) {
+	res, err := l.Allow(ctx, key)
+	if err != nil {
+		return false, 0, err
+	}
+	return res.Allowed, res.RetryAfter, nil
+}
@@ -0,0 +1,165 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Redlock算法 多个独立的Redis实例（非主从，非集群）上同时加锁，超过半数成功才算加锁成功
+// 单个Redis主从切换时可能丢锁，对丢锁不可接受的临界区使用
+// 锁的有效时间 = TTL - 加锁耗时 - 时钟漂移，临界区需要在有效时间内完成，或者调用Extend续期
+type Redlock struct {
+	rs          []*Redis
+	quorum      int
+	DriftFactor float64       // 时钟漂移系数 默认0.01
+	Timeout     time.Duration // 单个实例的请求超时，默认50毫秒，需要远小于TTL
+}
+
+func NewRedlock(rs ...*Redis) *Redlock {
+	return &Redlock{
+		rs:          rs,
+		quorum:      len(rs)/2 + 1,
+		DriftFactor: 0.01,
+		Timeout:     time.Millisecond * 50,
+	}
+}
+
+type RedlockMutex struct {
+	rl    *Redlock
+	key   string
+	uuid  string
+	until time.Time
+}
+
+// 锁的有效截止时间
+func (m *RedlockMutex) Until() time.Time {
+	return m.until
+}
+
+// 所有实例上执行，返回成功的数量，每个实例使用Timeout超时的ctx，超时的请求会被取消
+func (rl *Redlock) doAll(ctx context.Context, f func(ctx context.Context, r *Redis) bool) int {
+	ch := make(chan bool, len(rl.rs))
+	for _, r := range rl.rs {
+		go func(r *Redis) {
+			defer utils.HandlePanic()
+			ctx, cancel := context.WithTimeout(ctx, rl.Timeout)
+			defer cancel()
+			ch <- f(ctx, r)
+		}(r)
+	}
+	timer := time.NewTimer(rl.Timeout)
+	defer timer.Stop()
+	n := 0
+	for i := 0; i < len(rl.rs); i++ {
+		select {
+		case ok := <-ch:
+			if ok {
+				n++
+			}
+		case <-timer.C:
+			return n // 超时的实例认为失败
+		}
+	}
+	return n
+}
+
+// 加锁 失败后随机等待一段时间重试，直到wait超时
+func (rl *Redlock) Lock(ctx context.Context, key string, ttl, wait time.Duration) (*RedlockMutex, error) {
+	if len(rl.rs) == 0 {
+		return nil, errors.New("redlock no redis")
+	}
+	uuid := utils.LocalIPString() + "-" + strconv.Itoa(os.Getpid()) + "-" + utils.RandString(16)
+
+	logOut := !utils.CtxHasNolog(ctx)
+	cmdCtx := utils.CtxSetNolog(ctx)                       // 命令传递下去不需要日志了
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_nonilerr, 1) // 不要nil错误
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_cmddesc, "Redlock")
+
+	entry := time.Now()
+	drift := time.Duration(float64(ttl)*rl.DriftFactor) + time.Millisecond*2
+	spinCnt := 0 // 自旋次数
+	for {
+		spinCnt++
+		start := time.Now()
+		n := rl.doAll(cmdCtx, func(ctx context.Context, r *Redis) bool {
+			ok, _ := r.Do(ctx, "SET", key, uuid, "PX", ttl.Milliseconds(), "NX").Text()
+			return ok == "OK"
+		})
+		validity := ttl - time.Since(start) - drift
+		if n >= rl.quorum && validity > 0 {
+			if logOut && zerolog.DebugLevel >= log.Logger.GetLevel() {
+				utils.LogCtx(log.Debug(), ctx).Int32("elapsed", int32(time.Since(entry)/time.Millisecond)).
+					Str("key", key).
+					Str("uuid", uuid).
+					Int("succ", n).
+					Int("spinCnt", spinCnt).
+					Msg("Redis Redlock Success")
+			}
+			return &RedlockMutex{rl: rl, key: key, uuid: uuid, until: start.Add(ttl - drift)}, nil
+		}
+		// 失败了 所有实例都要解锁，ctx可能已经取消了，使用新的ctx
+		unlockCtx := context.WithValue(utils.CtxSetNolog(context.TODO()), CtxKey_cmddesc, "RedlockUnlock")
+		rl.unlock(unlockCtx, key, uuid)
+
+		if time.Since(entry) >= wait || cmdCtx.Err() != nil {
+			break
+		}
+		select {
+		case <-cmdCtx.Done():
+		case <-time.After(time.Millisecond * time.Duration(10+rand.Intn(40))):
+		}
+	}
+
+	err := errors.New("redlock time out")
+	// Debug就行 超时是正常的
+	if logOut && zerolog.DebugLevel >= log.Logger.GetLevel() {
+		utils.LogCtx(log.Debug(), ctx).Err(err).Int32("elapsed", int32(time.Since(entry)/time.Millisecond)).
+			Str("key", key).
+			Str("uuid", uuid).
+			Int("spinCnt", spinCnt).
+			Msg("Redis Redlock Fail")
+	}
+	return nil, err
+}
+
+func (rl *Redlock) unlock(ctx context.Context, key, uuid string) int {
+	return rl.doAll(ctx, func(ctx context.Context, r *Redis) bool {
+		n, _ := r.DoScript(ctx, deleteLockKeyScript, []string{key}, uuid).Int()
+		return n == 1
+	})
+}
+
+// 续期 超过半数实例续期成功并且在有效期内才算成功
+func (m *RedlockMutex) Extend(ctx context.Context, ttl time.Duration) error {
+	ctx = utils.CtxSetNolog(ctx)
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "RedlockExtend")
+	start := time.Now()
+	n := m.rl.doAll(ctx, func(ctx context.Context, r *Redis) bool {
+		n, _ := r.DoScript(ctx, renewLockScript, []string{m.key}, m.uuid, ttl.Milliseconds()).Int()
+		return n == 1
+	})
+	drift := time.Duration(float64(ttl)*m.rl.DriftFactor) + time.Millisecond*2
+	if n < m.rl.quorum || time.Since(start)+drift >= ttl {
+		return ErrLockLost
+	}
+	m.until = start.Add(ttl - drift)
+	return nil
+}
+
+// 解锁 所有实例上都删除
+func (m *RedlockMutex) Unlock(ctx context.Context) {
+	ctx = utils.CtxSetNolog(ctx)
+	ctx = context.WithValue(ctx, CtxKey_cmddesc, "RedlockUnlock")
+	m.rl.unlock(ctx, m.key, m.uuid)
+}
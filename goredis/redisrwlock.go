@@ -0,0 +1,153 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"gobase/utils"
+)
+
+// 读锁 写锁不存在并且没有等待的写者时，清理过期的读者，加入读者集合
+// KEYS[1]:写锁 KEYS[2]:读者集合(zset score为过期时间) KEYS[3]:等待的写者集合(zset score为过期时间)
+var rLockScript = NewScript(`
+	if redis.call('EXISTS', KEYS[1]) == 1 then
+		return 0
+	end
+	local t = redis.call('TIME')
+	local now = t[1] * 1000 + math.floor(t[2] / 1000)
+	redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now)
+	if redis.call('ZCARD', KEYS[3]) > 0 then
+		return 0
+	end
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+	redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), ARGV[1])
+	if redis.call('PTTL', KEYS[2]) < tonumber(ARGV[2]) then
+		redis.call('PEXPIRE', KEYS[2], ARGV[2])
+	end
+	return 1
+`)
+
+// 写锁 没有有效的读者时才能加锁，加锁失败时加入等待的写者集合，阻止新的读者加锁，防止写者饥饿
+// ARGV[3]:等待标记的有效时间，等待期间每次尝试都会刷新
+var wLockScript = NewScript(`
+	local t = redis.call('TIME')
+	local now = t[1] * 1000 + math.floor(t[2] / 1000)
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+	if redis.call('ZCARD', KEYS[2]) == 0 and redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX') then
+		redis.call('ZREM', KEYS[3], ARGV[1])
+		return 1
+	end
+	redis.call('ZADD', KEYS[3], now + tonumber(ARGV[3]), ARGV[1])
+	if redis.call('PTTL', KEYS[3]) < tonumber(ARGV[3]) then
+		redis.call('PEXPIRE', KEYS[3], ARGV[3])
+	end
+	return 0
+`)
+
+// 写者放弃等待，删除等待标记，通知等待的读者
+var wCancelScript = NewScript(`
+	if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+		redis.call('PUBLISH', ARGV[2], 'wcancel')
+		return 1
+	end
+	return 0
+`)
+
+// 写者等待标记的有效时间，等待中的写者最长每秒尝试一次，异常退出时标记过期后读者可以继续加锁
+const rwLockPendingTTL = time.Second * 3
+
+// 读者全部退出时通知等待者
+var rUnlockScript = NewScript(`
+	if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 and redis.call('ZCARD', KEYS[1]) == 0 then
+		redis.call('PUBLISH', ARGV[2], 'runlock')
+	end
+	return 1
+`)
+
+var wUnlockScript = NewScript(`
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		redis.call('DEL', KEYS[1])
+		redis.call('PUBLISH', ARGV[2], 'unlock')
+		return 1
+	end
+	return 0
+`)
+
+// 分布式读写锁 多个读者可以同时持有，写者独占，有等待的写者时新的读者需要等待，写者优先
+// 持有者超过ttl没有解锁会自动释放，等待者通过订阅通知唤醒
+type RWLock struct {
+	r       *Redis
+	key     string
+	wkey    string // 写锁
+	rkey    string // 读者集合
+	wpkey   string // 等待的写者集合
+	channel string // 解锁通知
+	ttl     time.Duration
+}
+
+// ttl<=0时默认10秒
+func (r *Redis) NewRWLock(key string, ttl time.Duration) *RWLock {
+	if ttl <= 0 {
+		ttl = time.Second * 10
+	}
+	return &RWLock{
+		r:       r,
+		key:     key,
+		wkey:    lockSubKey(key, "_w"),
+		rkey:    lockSubKey(key, "_r"),
+		wpkey:   lockSubKey(key, "_wp"),
+		channel: key + "_notify",
+		ttl:     ttl,
+	}
+}
+
+// 加读锁 有写锁或者等待的写者时等待，异常或者超过wait后，返回错误
+func (l *RWLock) RLock(ctx context.Context, wait time.Duration) (func(), error) {
+	uuid := utils.LocalIPString() + "-" + strconv.Itoa(os.Getpid()) + "-" + utils.RandString(16)
+
+	cmdCtx := utils.CtxSetNolog(ctx)                       // 命令传递下去不需要日志了
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_nonilerr, 1) // 不要nil错误
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_cmddesc, "RLock")
+
+	err := l.r.lockWait(ctx, "RLock", l.key, uuid, l.channel, wait, func() bool {
+		ok, _ := l.r.DoScript(cmdCtx, rLockScript, []string{l.wkey, l.rkey, l.wpkey}, uuid, l.ttl.Milliseconds()).Int()
+		return ok == 1
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// 解锁时ctx可能已经取消了，使用新的ctx
+		ctx := context.WithValue(utils.CtxSetNolog(context.TODO()), CtxKey_cmddesc, "RUnlock")
+		l.r.DoScript(ctx, rUnlockScript, []string{l.rkey}, uuid, l.channel)
+	}, nil
+}
+
+// 加写锁 有读锁或者写锁时等待，异常或者超过wait后，返回错误
+func (l *RWLock) Lock(ctx context.Context, wait time.Duration) (func(), error) {
+	uuid := utils.LocalIPString() + "-" + strconv.Itoa(os.Getpid()) + "-" + utils.RandString(16)
+
+	cmdCtx := utils.CtxSetNolog(ctx)                       // 命令传递下去不需要日志了
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_nonilerr, 1) // 不要nil错误
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_cmddesc, "WLock")
+
+	err := l.r.lockWait(ctx, "WLock", l.key, uuid, l.channel, wait, func() bool {
+		ok, _ := l.r.DoScript(cmdCtx, wLockScript, []string{l.wkey, l.rkey, l.wpkey}, uuid, l.ttl.Milliseconds(), rwLockPendingTTL.Milliseconds()).Int()
+		return ok == 1
+	})
+	if err != nil {
+		// ctx可能已经取消了，使用新的ctx
+		cancelCtx := context.WithValue(utils.CtxSetNolog(context.TODO()), CtxKey_cmddesc, "WLockCancel")
+		l.r.DoScript(cancelCtx, wCancelScript, []string{l.wpkey}, uuid, l.channel)
+		return nil, err
+	}
+	return func() {
+		// 解锁时ctx可能已经取消了，使用新的ctx
+		ctx := context.WithValue(utils.CtxSetNolog(context.TODO()), CtxKey_cmddesc, "WUnlock")
+		l.r.DoScript(ctx, wUnlockScript, []string{l.wkey}, uuid, l.channel)
+	}, nil
+}
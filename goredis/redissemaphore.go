@@ -0,0 +1,84 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"gobase/utils"
+)
+
+// KEYS[1]:持有者集合(zset score为过期时间)
+var semaphoreAcquireScript = NewScript(`
+	local t = redis.call('TIME')
+	local now = t[1] * 1000 + math.floor(t[2] / 1000)
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+	if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+		return 0
+	end
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+	if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+	return 1
+`)
+
+var semaphoreReleaseScript = NewScript(`
+	if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+		redis.call('PUBLISH', ARGV[2], 'release')
+		return 1
+	end
+	return 0
+`)
+
+// 分布式信号量 最多limit个持有者
+// 持有者超过ttl没有释放会自动释放，等待者通过订阅通知唤醒
+type Semaphore struct {
+	r       *Redis
+	key     string
+	channel string // 释放通知
+	limit   int
+	ttl     time.Duration
+}
+
+// limit<=0时为1，ttl<=0时默认10秒
+func (r *Redis) NewSemaphore(key string, limit int, ttl time.Duration) *Semaphore {
+	if limit <= 0 {
+		limit = 1
+	}
+	if ttl <= 0 {
+		ttl = time.Second * 10
+	}
+	return &Semaphore{
+		r:       r,
+		key:     key,
+		channel: key + "_notify",
+		limit:   limit,
+		ttl:     ttl,
+	}
+}
+
+// 获取 已满时等待，异常或者超过wait后，返回错误
+func (s *Semaphore) Acquire(ctx context.Context, wait time.Duration) (func(), error) {
+	uuid := utils.LocalIPString() + "-" + strconv.Itoa(os.Getpid()) + "-" + utils.RandString(16)
+
+	cmdCtx := utils.CtxSetNolog(ctx)                       // 命令传递下去不需要日志了
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_nonilerr, 1) // 不要nil错误
+	cmdCtx = context.WithValue(cmdCtx, CtxKey_cmddesc, "Semaphore")
+
+	err := s.r.lockWait(ctx, "Semaphore", s.key, uuid, s.channel, wait, func() bool {
+		ok, _ := s.r.DoScript(cmdCtx, semaphoreAcquireScript, []string{s.key}, uuid, s.ttl.Milliseconds(), s.limit).Int()
+		return ok == 1
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// 释放时ctx可能已经取消了，使用新的ctx
+		ctx := context.WithValue(utils.CtxSetNolog(context.TODO()), CtxKey_cmddesc, "SemaphoreRelease")
+		s.r.DoScript(ctx, semaphoreReleaseScript, []string{s.key}, uuid, s.channel)
+	}, nil
+}
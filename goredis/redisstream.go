@@ -0,0 +1,292 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// 基于Redis Stream的可靠消息队列
+// 生产者Add写入消息，消息内容json格式化后写入data字段
+// 消费者使用消费组读取，处理完调用Ack确认，未确认的消息：
+//  1. 消费者重启后（相同的consumer名）会先读取自己未确认的消息
+//  2. 空闲超过ClaimIdle的消息会被其他消费者通过XAUTOCLAIM认领
+//  3. 投递次数超过MaxDeliver的消息写入死信队列 key+"_dead"，并确认原消息
+
+const streamDataField = "data"
+
+type Stream struct {
+	r   *Redis
+	key string
+
+	MaxLen     int64         // 生产时近似裁剪到的长度，0表示不裁剪
+	MaxDeliver int64         // 最大投递次数，超过后进入死信队列，默认5
+	ClaimIdle  time.Duration // 未确认的消息空闲超过该时间被其他消费者认领，默认30秒
+	Block      time.Duration // 读取时没有消息的阻塞时间，默认5秒
+}
+
+func (r *Redis) NewStream(key string) *Stream {
+	return &Stream{
+		r:          r,
+		key:        key,
+		MaxDeliver: 5,
+		ClaimIdle:  time.Second * 30,
+		Block:      time.Second * 5,
+	}
+}
+
+func (s *Stream) Key() string {
+	return s.key
+}
+
+// 死信队列的key
+func (s *Stream) DeadKey() string {
+	return s.key + "_dead"
+}
+
+// 写入消息 v会json格式化，返回消息ID
+func (s *Stream) Add(ctx context.Context, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		utils.LogCtx(log.Error(), ctx).Err(err).Str("key", s.key).Msg("Redis Stream Add Param error")
+		return "", err
+	}
+	args := &redis.XAddArgs{
+		Stream: s.key,
+		Values: []interface{}{streamDataField, b},
+	}
+	if s.MaxLen > 0 {
+		args.MaxLen = s.MaxLen
+		args.Approx = true
+	}
+	return s.r.XAdd(ctx, args).Result()
+}
+
+type StreamMessage struct {
+	ID         string
+	Data       string // json格式的消息内容
+	Deliveries int64  // 投递次数
+
+	c *StreamConsumer
+}
+
+// 绑定消息内容 参考RedisCommond.BindJsonObj
+func (m *StreamMessage) Bind(v interface{}) error {
+	return bindJsonData(m.c.ctx, m.c.s.key+" "+m.ID, m.Data, v)
+}
+
+// 使用RedisCommond.BindJsonObj绑定json数据
+func bindJsonData(ctx context.Context, desc, data string, v interface{}) error {
+	cmd := redis.NewCmd(ctx)
+	cmd.SetVal(data)
+	redisCmd := &RedisCommond{ctx: ctx, Cmd: cmd, CmdDesc: desc}
+	return redisCmd.BindJsonObj(v)
+}
+
+// 确认消息
+func (m *StreamMessage) Ack(ctx context.Context) error {
+	return m.c.s.r.XAck(ctx, m.c.s.key, m.c.group, m.ID).Err()
+}
+
+type StreamConsumer struct {
+	ctx      context.Context
+	s        *Stream
+	group    string
+	consumer string
+
+	history    string    // 读取自己未确认消息的游标，为空表示已经读完了
+	claimStart string    // XAUTOCLAIM的游标
+	claimTime  time.Time // 上次完整认领一轮的时间
+}
+
+// 创建消费者，消费组不存在时创建，新的消费组从最新的消息开始消费
+// 同一个消费组内consumer名需要唯一，重启后使用相同的名字可以继续处理未确认的消息
+func (s *Stream) NewConsumer(ctx context.Context, group, consumer string) (*StreamConsumer, error) {
+	// 先查询，防止BUSYGROUP的错误日志
+	exist := false
+	if n, _ := s.r.Exists(ctx, s.key).Result(); n == 1 {
+		groups, _ := s.r.XInfoGroups(ctx, s.key).Result()
+		for _, g := range groups {
+			if g.Name == group {
+				exist = true
+				break
+			}
+		}
+	}
+	if !exist {
+		err := s.r.XGroupCreateMkStream(ctx, s.key, group, "$").Err()
+		if err != nil && !redis.HasErrorPrefix(err, "BUSYGROUP") {
+			return nil, err
+		}
+	}
+	return &StreamConsumer{
+		ctx:        utils.CtxSetNolog(context.TODO()),
+		s:          s,
+		group:      group,
+		consumer:   consumer,
+		history:    "0",
+		claimStart: "0-0",
+	}, nil
+}
+
+// 读取消息 没有消息时最多阻塞Stream.Block，返回空
+func (c *StreamConsumer) Read(ctx context.Context, count int) ([]*StreamMessage, error) {
+	// 自己未确认的消息
+	if len(c.history) > 0 {
+		streams, err := c.s.r.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.consumer,
+			Streams:  []string{c.s.key, c.history},
+			Count:    int64(count),
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		var xmsgs []redis.XMessage
+		if len(streams) > 0 {
+			xmsgs = streams[0].Messages
+		}
+		if len(xmsgs) == 0 {
+			c.history = ""
+		} else {
+			c.history = xmsgs[len(xmsgs)-1].ID
+			msgs, err := c.deliver(ctx, xmsgs)
+			if err != nil || len(msgs) > 0 {
+				return msgs, err
+			}
+		}
+	}
+
+	// 认领其他消费者的超时消息
+	if time.Since(c.claimTime) >= c.s.ClaimIdle/2 {
+		xmsgs, start, err := c.s.r.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   c.s.key,
+			Group:    c.group,
+			Consumer: c.consumer,
+			MinIdle:  c.s.ClaimIdle,
+			Start:    c.claimStart,
+			Count:    int64(count),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		c.claimStart = start
+		if start == "0-0" {
+			c.claimTime = time.Now()
+		}
+		if len(xmsgs) > 0 {
+			msgs, err := c.deliver(ctx, xmsgs)
+			if err != nil || len(msgs) > 0 {
+				return msgs, err
+			}
+		}
+	}
+
+	// 新消息
+	streams, err := c.s.r.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.consumer,
+		Streams:  []string{c.s.key, ">"},
+		Count:    int64(count),
+		Block:    c.s.Block,
+	}).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var msgs []*StreamMessage
+	for _, s := range streams {
+		for _, xmsg := range s.Messages {
+			data, _ := xmsg.Values[streamDataField].(string)
+			msgs = append(msgs, &StreamMessage{ID: xmsg.ID, Data: data, Deliveries: 1, c: c})
+		}
+	}
+	return msgs, nil
+}
+
+// 重复投递的消息 查询投递次数，超过的写入死信队列
+func (c *StreamConsumer) deliver(ctx context.Context, xmsgs []redis.XMessage) ([]*StreamMessage, error) {
+	pending, err := c.s.r.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   c.s.key,
+		Group:    c.group,
+		Start:    xmsgs[0].ID,
+		End:      xmsgs[len(xmsgs)-1].ID,
+		Count:    int64(len(xmsgs)) * 2,
+		Consumer: c.consumer,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(pending))
+	for _, p := range pending {
+		counts[p.ID] = p.RetryCount
+	}
+
+	msgs := make([]*StreamMessage, 0, len(xmsgs))
+	for _, xmsg := range xmsgs {
+		data, ok := xmsg.Values[streamDataField].(string)
+		if !ok {
+			// 消息已经被删除了
+			c.s.r.XAck(ctx, c.s.key, c.group, xmsg.ID)
+			continue
+		}
+		msg := &StreamMessage{ID: xmsg.ID, Data: data, Deliveries: counts[xmsg.ID], c: c}
+		if c.s.MaxDeliver > 0 && msg.Deliveries > c.s.MaxDeliver {
+			c.dead(ctx, msg)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// 写入死信队列
+func (c *StreamConsumer) dead(ctx context.Context, msg *StreamMessage) {
+	err := c.s.r.XAdd(ctx, &redis.XAddArgs{
+		Stream: c.s.DeadKey(),
+		Values: []interface{}{streamDataField, msg.Data, "id", msg.ID, "group", c.group, "deliveries", msg.Deliveries},
+	}).Err()
+	if err != nil {
+		return // 下次再处理
+	}
+	msg.Ack(ctx)
+	utils.LogCtx(log.Warn(), ctx).Str("key", c.s.key).Str("group", c.group).Str("id", msg.ID).Int64("deliveries", msg.Deliveries).
+		Msg("Redis Stream Message Dead")
+}
+
+// 循环读取消息并回调，直到ctx结束，回调返回nil时确认消息
+// 回调返回错误或者崩溃时消息不确认，ClaimIdle后重新投递
+func (c *StreamConsumer) Consume(ctx context.Context, count int, f func(ctx context.Context, msg *StreamMessage) error) error {
+	for ctx.Err() == nil {
+		msgs, err := c.Read(utils.CtxSetNolog(ctx), count) // 轮询不需要日志
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			err := func() (err error) {
+				defer utils.HandlePanic2(func(r any) {
+					err = fmt.Errorf("%s handle panic", msg.ID)
+				})
+				return f(ctx, msg)
+			}()
+			if err == nil {
+				msg.Ack(ctx)
+			}
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,273 @@
+package goredis
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// 托管的订阅对象 协程安全
+// 支持订阅多个channel和pattern，消息按channel或者pattern路由到注册的回调
+// 回调在utils的ants协程池中执行，同一个channel或者pattern的消息顺序执行，积压超过MaxPending的消息丢弃
+// 连接断开后会自动重新订阅，可以通过OnResubscribe处理期间丢失的消息
+// 每条消息都会回调RegHook注册的函数，RedisCommond.Subscribe中填充统计信息
+
+// 订阅消息的统计
+type SubscribeStat struct {
+	Channel string
+	Pattern string        // 通过pattern订阅时填充
+	Lag     time.Duration // 消息从接收到开始处理的延迟
+	Pending int64         // 当前积压的消息数量
+	Dropped int64         // 累计丢弃的消息数量
+	Drop    bool          // 本条消息是否被丢弃
+}
+
+type SubscribeHandler func(ctx context.Context, channel, payload string)
+
+type subscribeRoute struct {
+	name    string
+	pattern bool
+	handler SubscribeHandler
+	seq     utils.Sequence
+	pending int64
+	dropped int64
+}
+
+type Subscriber struct {
+	// 不可修改
+	ctx context.Context
+	r   *Redis
+
+	MaxPending int64 // 每个channel或者pattern最多积压的消息数量，默认1000
+	// 订阅连接出错时回调，重新订阅确认后再回调，期间的消息可能丢失了，需要在Handle之前设置
+	OnResubscribe func()
+
+	mu       sync.Mutex
+	sub      *redis.PubSub
+	channels map[string]*subscribeRoute
+	patterns map[string]*subscribeRoute
+	run      bool
+	closed   bool
+}
+
+func (r *Redis) NewSubscriber() *Subscriber {
+	return &Subscriber{
+		ctx:        utils.CtxSetNolog(context.TODO()), // 不要日志
+		r:          r,
+		MaxPending: 1000,
+		channels:   map[string]*subscribeRoute{},
+		patterns:   map[string]*subscribeRoute{},
+	}
+}
+
+// 订阅channel，重复订阅会替换回调
+func (s *Subscriber) Handle(ctx context.Context, channel string, f SubscribeHandler) error {
+	return s.handle(ctx, channel, false, f)
+}
+
+// 订阅pattern，重复订阅会替换回调
+func (s *Subscriber) HandlePattern(ctx context.Context, pattern string, f SubscribeHandler) error {
+	return s.handle(ctx, pattern, true, f)
+}
+
+func (s *Subscriber) handle(ctx context.Context, name string, pattern bool, f SubscribeHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("subscriber closed")
+	}
+	if s.sub == nil {
+		s.sub = s.r.Subscribe(ctx)
+	}
+	var err error
+	if pattern {
+		err = s.sub.PSubscribe(ctx, name)
+	} else {
+		err = s.sub.Subscribe(ctx, name)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("channel", name).Bool("pattern", pattern).Msg("Redis Subscriber Subscribe fail")
+		return err
+	}
+	route := &subscribeRoute{name: name, pattern: pattern, handler: f}
+	if pattern {
+		s.patterns[name] = route
+	} else {
+		s.channels[name] = route
+	}
+	if !s.run {
+		s.run = true
+		go s.loop(s.sub)
+	}
+	return nil
+}
+
+// 取消订阅channel
+func (s *Subscriber) Unhandle(ctx context.Context, channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.channels, channel)
+	if s.sub == nil {
+		return nil
+	}
+	return s.sub.Unsubscribe(ctx, channel)
+}
+
+// 取消订阅pattern
+func (s *Subscriber) UnhandlePattern(ctx context.Context, pattern string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.patterns, pattern)
+	if s.sub == nil {
+		return nil
+	}
+	return s.sub.PUnsubscribe(ctx, pattern)
+}
+
+func (s *Subscriber) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.sub != nil {
+		s.sub.Close()
+		s.sub = nil
+	}
+}
+
+// 重新创建订阅对象，并订阅所有的channel和pattern
+func (s *Subscriber) resubscribe(old *redis.PubSub) *redis.PubSub {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if s.sub != old {
+		return s.sub // 已经被替换了
+	}
+	old.Close()
+	s.sub = s.r.Subscribe(s.ctx)
+	if len(s.channels) > 0 {
+		channels := make([]string, 0, len(s.channels))
+		for name := range s.channels {
+			channels = append(channels, name)
+		}
+		s.sub.Subscribe(s.ctx, channels...)
+	}
+	if len(s.patterns) > 0 {
+		patterns := make([]string, 0, len(s.patterns))
+		for name := range s.patterns {
+			patterns = append(patterns, name)
+		}
+		s.sub.PSubscribe(s.ctx, patterns...)
+	}
+	return s.sub
+}
+
+func (s *Subscriber) loop(sub *redis.PubSub) {
+	defer utils.HandlePanic()
+	resubscribed := false
+	for sub != nil {
+		msg, err := sub.Receive(s.ctx)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			// Redis发生重连时 会返回错误，需要重新订阅
+			log.Error().Err(err).Msg("Redis Subscriber Receive fail")
+			s.onResubscribe()
+			time.Sleep(time.Second)
+			sub = s.resubscribe(sub)
+			resubscribed = true
+			continue
+		}
+		if sm, ok := msg.(*redis.Subscription); ok {
+			// 重新订阅确认后再回调，确认前的消息可能丢失了
+			if resubscribed && (sm.Kind == "subscribe" || sm.Kind == "psubscribe") {
+				s.onResubscribe()
+			}
+			continue
+		}
+		m, ok := msg.(*redis.Message)
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		var route *subscribeRoute
+		if len(m.Pattern) > 0 {
+			route = s.patterns[m.Pattern]
+		} else {
+			route = s.channels[m.Channel]
+		}
+		s.mu.Unlock()
+		if route != nil {
+			s.dispatch(route, m)
+		}
+	}
+}
+
+func (s *Subscriber) onResubscribe() {
+	if s.OnResubscribe == nil {
+		return
+	}
+	defer utils.HandlePanic()
+	s.OnResubscribe()
+}
+
+func (s *Subscriber) dispatch(route *subscribeRoute, m *redis.Message) {
+	recv := time.Now()
+	if atomic.LoadInt64(&route.pending) >= s.MaxPending {
+		dropped := atomic.AddInt64(&route.dropped, 1)
+		s.callHook(m, &SubscribeStat{
+			Channel: m.Channel,
+			Pattern: m.Pattern,
+			Pending: atomic.LoadInt64(&route.pending),
+			Dropped: dropped,
+			Drop:    true,
+		})
+		return
+	}
+	atomic.AddInt64(&route.pending, 1)
+	route.seq.Submit(func() {
+		pending := atomic.AddInt64(&route.pending, -1)
+		s.callHook(m, &SubscribeStat{
+			Channel: m.Channel,
+			Pattern: m.Pattern,
+			Lag:     time.Since(recv),
+			Pending: pending,
+			Dropped: atomic.LoadInt64(&route.dropped),
+		})
+		defer utils.HandlePanic()
+		route.handler(s.ctx, m.Channel, m.Payload)
+	})
+}
+
+func (s *Subscriber) callHook(m *redis.Message, stat *SubscribeStat) {
+	if len(s.r.hook) == 0 {
+		return
+	}
+	cmd := redis.NewCmd(s.ctx, "message", m.Channel)
+	cmd.SetVal(m.Payload)
+	redisCmd := &RedisCommond{
+		ctx:       s.ctx,
+		Cmd:       cmd,
+		CmdDesc:   "Subscriber",
+		Elapsed:   stat.Lag,
+		Subscribe: stat,
+	}
+	defer utils.HandlePanic()
+	for _, f := range s.r.hook {
+		f(s.ctx, redisCmd)
+	}
+}
@@ -38,7 +38,10 @@ func ValueFmt(v reflect.Value) interface{} {
 		return nil
 	case reflect.Array:
 		if v.Type().Elem().Kind() == reflect.Uint8 {
-			return v.Interface()
+			// 转成[]byte，redis不支持直接写入数组
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return b
 		}
 		return nil
 	case reflect.Interface:
@@ -25,6 +25,9 @@ var (
 	redisCount   *prometheus.CounterVec
 	redisSum     *prometheus.CounterVec // 耗时之和
 
+	redisClientCacheCount *prometheus.CounterVec // 客户端缓存的命中统计
+	redisSubscribeDrop    *prometheus.CounterVec // Subscriber丢弃的消息统计
+
 	redisTraceCount *prometheus.CounterVec // 如果context中函有utils.CtxKey_traceName，会加入统计
 	redisTraceTime  *prometheus.CounterVec
 	redisKeyRegexp  []*regexp2.Regexp
@@ -60,6 +63,8 @@ func goredisHook(ctx context.Context, cmd *goredis.RedisCommond) {
 			redisCount = DefaultReg().NewCounterVec(prometheus.CounterOpts{Name: "redis_count"}, []string{"cmd", "key"})
 			redisSum = DefaultReg().NewCounterVec(prometheus.CounterOpts{Name: "redis_sum"}, []string{"cmd", "key"})
 		}
+		redisClientCacheCount = DefaultReg().NewCounterVec(prometheus.CounterOpts{Name: "redis_clientcache_count"}, []string{"cmd", "key", "result"})
+		redisSubscribeDrop = DefaultReg().NewCounterVec(prometheus.CounterOpts{Name: "redis_subscribe_drop"}, []string{"key"})
 		redisTraceCount = DefaultReg().NewCounterVec(prometheus.CounterOpts{Name: "redis_trace_count"}, []string{"name"})
 		redisTraceTime = DefaultReg().NewCounterVec(prometheus.CounterOpts{Name: "redis_trace_time"}, []string{"name"})
 	})
@@ -83,6 +88,12 @@ func goredisHook(ctx context.Context, cmd *goredis.RedisCommond) {
 		}
 		cmdName = strings.ToUpper(cmdName)
 
+		// 订阅消息丢弃了 只统计丢弃数量，处理的消息Elapsed为延迟
+		if cmd.Subscribe != nil && cmd.Subscribe.Drop {
+			redisSubscribeDrop.WithLabelValues(key).Inc()
+			return
+		}
+
 		if cmd.Cmd.Err() != nil && !goredis.IsNilError(cmd.Cmd.Err()) {
 			redisErrorCount.WithLabelValues(cmdName, key).Inc()
 		}
@@ -92,6 +103,12 @@ func goredisHook(ctx context.Context, cmd *goredis.RedisCommond) {
 			redisCount.WithLabelValues(cmdName, key).Inc()
 			redisSum.WithLabelValues(cmdName, key).Add(float64(cmd.Elapsed.Nanoseconds()))
 		}
+		switch cmd.ClientCache {
+		case goredis.ClientCacheHit:
+			redisClientCacheCount.WithLabelValues(cmdName, key, "hit").Inc()
+		case goredis.ClientCacheMiss:
+			redisClientCacheCount.WithLabelValues(cmdName, key, "miss").Inc()
+		}
 
 		// 消息统计
 		if ctx != nil {
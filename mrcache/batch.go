@@ -0,0 +1,199 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"gobase/utils"
+	"sync"
+	"time"
+)
+
+// 批量保存mysql
+// 修改操作写完Redis后，把修改的字段按数据key缓冲起来，同一个数据key多次修改只保留最新的值
+// 到达配置的时间间隔或者缓冲的key数量达到上限时，在一个事务中写入mysql，事务失败了逐条写入
+// 如果配置了持久化日志，缓冲前先写日志，写入mysql成功后删除，批量间隔应小于JournalReplayDelay
+
+type batchItem struct {
+	key        string // 加锁使用的key
+	dataKey    string // 数据存储的key
+	cond       TableConds
+	data       map[string]interface{} // 合并后的修改字段
+	journalIds []string               // 对应的持久化日志id
+	verCheck   bool                   // cond中带有版本号条件，影响的行数为0表示版本号不一致
+}
+
+type batchBuffer struct {
+	sync.Mutex
+	items map[string]*batchItem // key为dataKey
+	order []string              // 写入的顺序
+	timer *time.Timer
+
+	flushMutex sync.Mutex // 保证写入mysql的顺序
+}
+
+func (c *Cache) batchSave(ctx context.Context, cond TableConds, data map[string]interface{}, key, dataKey string, verCheck bool, call func(err error)) error {
+	journalId, ok := c.journalAppend(ctx, &journalEntry{Key: key, DataKey: dataKey, Op: journalOpSave, Cond: c.journalCond(cond), Data: c.journalData(data)})
+	if !ok {
+		// 日志写失败了，走同步保存
+		c.batchFlushKey(ctx, dataKey)
+		sqlStr, args := c.fmtSaveSQL(cond, data)
+		err := c.versionCheck(verCheck)(c.mysql.Update(ctx, sqlStr, args...))
+		if call != nil {
+			call(err)
+		}
+		return err
+	}
+
+	b := c.batch
+	b.Lock()
+	item, ok := b.items[dataKey]
+	if !ok {
+		item = &batchItem{key: key, dataKey: dataKey, cond: cond, data: make(map[string]interface{}, len(data)), verCheck: verCheck}
+		b.items[dataKey] = item
+		b.order = append(b.order, dataKey)
+	}
+	for tag, v := range data {
+		item.data[tag] = v
+	}
+	if len(journalId) > 0 {
+		item.journalIds = append(item.journalIds, journalId)
+	}
+	full := len(b.items) >= c.batchSize
+	if !full && b.timer == nil {
+		b.timer = time.AfterFunc(c.batchInterval, func() {
+			c.Flush(context.TODO())
+		})
+	}
+	b.Unlock()
+
+	if full {
+		utils.Submit(func() {
+			c.Flush(context.TODO())
+		})
+	}
+	// 已经写入缓冲，可以释放锁了，写mysql出错时会删除缓存
+	if call != nil {
+		call(nil)
+	}
+	return nil
+}
+
+// 把缓冲中的数据全部写入mysql，进程退出前需要调用
+func (c *Cache) Flush(ctx context.Context) error {
+	b := c.batch
+	if b == nil {
+		return nil
+	}
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	b.Lock()
+	items := make([]*batchItem, 0, len(b.order))
+	for _, dataKey := range b.order {
+		items = append(items, b.items[dataKey])
+	}
+	b.items = map[string]*batchItem{}
+	b.order = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.Unlock()
+
+	var flushErr error
+	for i := 0; i < len(items); i += c.batchSize {
+		end := i + c.batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		if err := c.batchWrite(ctx, items[i:end]); err != nil {
+			flushErr = err
+		}
+	}
+	return flushErr
+}
+
+// 把指定key的缓冲写入mysql，keys可以是数据key，也可以是加锁使用的key(CacheRows中为索引key，会写入索引下所有的数据)
+// 读mysql和删mysql前调用，防止读到旧数据或者删除后旧数据再写入
+func (c *Cache) batchFlushKey(ctx context.Context, keys ...string) error {
+	b := c.batch
+	if b == nil || len(keys) == 0 {
+		return nil
+	}
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	b.Lock()
+	var items []*batchItem
+	order := b.order[:0]
+	for _, dataKey := range b.order {
+		item := b.items[dataKey]
+		if utils.Contains(keys, item.dataKey) || utils.Contains(keys, item.key) {
+			items = append(items, item)
+			delete(b.items, dataKey)
+		} else {
+			order = append(order, dataKey)
+		}
+	}
+	b.order = order
+	b.Unlock()
+
+	return c.batchWrite(ctx, items)
+}
+
+func (c *Cache) batchWrite(ctx context.Context, items []*batchItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	// 先用事务写入
+	err := func() error {
+		tx, err := c.mysql.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			sqlStr, args := c.fmtSaveSQL(item.cond, item.data)
+			if len(sqlStr) == 0 {
+				continue
+			}
+			rst, err := tx.Exec(ctx, sqlStr, args...)
+			if err == nil && item.verCheck {
+				var n int64
+				n, err = rst.RowsAffected()
+				err = c.versionCheck(item.verCheck)(n, err)
+			}
+			if err != nil {
+				tx.Rollback(ctx)
+				return err
+			}
+		}
+		return tx.Commit(ctx)
+	}()
+	if err == nil {
+		for _, item := range items {
+			c.journalDone(ctx, item.journalIds...)
+		}
+		return nil
+	}
+
+	// 事务失败了逐条写入，防止一条数据影响其他的
+	var writeErr error
+	for _, item := range items {
+		sqlStr, args := c.fmtSaveSQL(item.cond, item.data)
+		if len(sqlStr) > 0 {
+			if err := c.versionCheck(item.verCheck)(c.mysql.Update(ctx, sqlStr, args...)); err != nil {
+				writeErr = err
+				// mysql错了 要删缓存，持久化日志保留等待重放
+				c.redis.Del(ctx, item.dataKey)
+				c.localDel(ctx, item.dataKey)
+				if item.key != item.dataKey {
+					c.redis.Del(ctx, item.key)
+				}
+				continue
+			}
+		}
+		c.journalDone(ctx, item.journalIds...)
+	}
+	return writeErr
+}
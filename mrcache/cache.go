@@ -5,11 +5,13 @@ package mrcache
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gobase/goredis"
 	"gobase/mysql"
 	"gobase/utils"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
@@ -39,6 +41,11 @@ type Cache struct {
 	keyFields      []string // 查询结果中唯一的字段tag，用来做key，区分大小写
 	keyFieldsIndex []int    // dataKeyField在tableInfo中的索引
 	keyFieldsLog   string   // log时专用
+	maxRows        int      // 数据数量上限，0表示不限制
+
+	// CacheColumn使用
+	dataValueField      string // 存储的值字段tag，hash结构中keyField对应的值
+	dataValueFieldIndex int    // dataValueField在tableInfo中的索引
 
 	// 其他配置参数
 	// 生成key时的hasgtag
@@ -50,6 +57,10 @@ type Cache struct {
 	incrementField      string         // mysql中自增字段tag名 区分大小写
 	incrementFieldIndex int            // 自增key在tableInfo中的索引
 
+	// 乐观锁版本号，Redis脚本中每次修改都会自增1，SetIfVersion、ModifyIfVersion时会校验版本号，为空表示不开启
+	versionField      string // mysql中版本号字段tag名 区分大小写
+	versionFieldIndex int    // versionField在tableInfo中的索引
+
 	// 缓存过期时间 单位秒 不设置默认为36h
 	expire int
 
@@ -61,6 +72,25 @@ type Cache struct {
 
 	lock         bool // 同步数据锁保护
 	toMysqlAsync bool // 异步保存到mysql
+
+	// 异步保存mysql时的持久化日志，nil表示不开启
+	journalRedis *goredis.Redis
+
+	// 批量保存mysql，batchInterval>0时开启，同一个数据key的修改在窗口期内合并，到时间或者数量满了通过事务统一写入
+	batchInterval time.Duration
+	batchSize     int
+	batch         *batchBuffer
+
+	// 数据变化事件的发布
+	eventSinks []EventSink
+
+	// 本地一级缓存，nil表示不开启
+	local *localCache
+
+	// 软删除，Del时设置删除时间，不真正删除，查找数据时自动过滤掉已删除的，为空表示不开启
+	softDelField      string // mysql中删除时间字段tag名 区分大小写
+	softDelFieldIndex int    // softDelField在tableInfo中的索引
+	archiveTable      string // Archive时归档的表名
 }
 
 func NewCache[T any](redis *goredis.Redis, mysql *mysql.MySQL, tableName string, tableCount, tableIndex int, condFields []string) (*Cache, error) {
@@ -79,8 +109,8 @@ func NewCache[T any](redis *goredis.Redis, mysql *mysql.MySQL, tableName string,
 		if idx == -1 {
 			return nil, fmt.Errorf("tag:%s not find in %s", f, table.T.String())
 		}
-		// 条件只能是基本的数据int 和 string 类型
-		if !table.IsBaseType(table.Fields[idx].Type) {
+		// 条件只能是基本的数据int 和 string 类型，或者注册了编码的类型
+		if !table.IsBaseType(table.Fields[idx].Type) && getKeyCodec(table.Fields[idx].Type) == nil {
 			err := fmt.Errorf("tag:%s(%s) type error", f, table.T.String())
 			return nil, err
 		}
@@ -164,11 +194,77 @@ func (c *Cache) ConfigIncrement(incrementReids *goredis.Redis, incrementField st
 	return nil
 }
 
+// 配置乐观锁版本号字段，字段类型必须是int或者uint，不能是条件字段和key字段
+// 开启后所有的修改操作都会让版本号自增1，版本号由内部维护，修改数据中的版本号字段会被忽略
+// versionField为空表示关闭
+func (c *Cache) ConfigVersion(versionField string) error {
+	if len(versionField) == 0 {
+		c.versionField = ""
+		return nil
+	}
+	idx := c.FindIndexByTag(versionField)
+	if idx == -1 {
+		return fmt.Errorf("tag:%s not find in %s", versionField, c.T.String())
+	}
+	switch c.Fields[idx].Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		break
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		break
+	default:
+		return fmt.Errorf("tag:%s not int or uint", versionField)
+	}
+	if c.saveIgnoreTag(versionField) {
+		return fmt.Errorf("tag:%s can not be cond or key field", versionField)
+	}
+
+	c.versionField = versionField
+	c.versionFieldIndex = idx
+	return nil
+}
+
 func (c *Cache) ConfigToMysqlAsync(async bool) error {
 	c.toMysqlAsync = async
 	return nil
 }
 
+// 配置异步保存mysql时的持久化日志，ConfigToMysqlAsync(true)或者ConfigBatchFlush开启时生效
+// 异步保存前先把要保存的内容写入journalRedis的stream中，保存成功后再删除，进程崩溃或重启时未保存的数据留在stream中
+// 启动时需要调用ReplayJournal把未完成的日志重放到mysql中
+func (c *Cache) ConfigJournal(journalRedis *goredis.Redis) error {
+	if journalRedis == nil {
+		return errors.New("journalRedis is nil")
+	}
+	c.journalRedis = journalRedis
+	return nil
+}
+
+// 配置批量保存mysql，开启后Set、Modify等修改操作不再立即写mysql，同一个数据key的修改字段在interval内合并
+// 到时间或者缓冲的key数量达到maxBatch时，在一个事务中写入，进程退出前需要调用Flush
+// interval<=0表示关闭，关闭时先写入缓冲中的数据，maxBatch<=0时默认为100
+func (c *Cache) ConfigBatchFlush(interval time.Duration, maxBatch int) error {
+	if interval <= 0 {
+		c.batchInterval = 0
+		return c.Flush(context.TODO()) // 先停止写入缓冲，再写入缓冲中的数据
+	}
+	if maxBatch <= 0 {
+		maxBatch = 100
+	}
+	c.batchInterval = interval
+	c.batchSize = maxBatch
+	if c.batch == nil {
+		c.batch = &batchBuffer{items: map[string]*batchItem{}}
+	}
+	return nil
+}
+
+// 配置数据变化事件的发布，添加、修改、删除成功后发布ChangeEvent，可以配置多个
+// 内置RedisStreamSink和ChanSink，不配置表示不发布
+func (c *Cache) ConfigEventSink(sinks ...EventSink) error {
+	c.eventSinks = sinks
+	return nil
+}
+
 // 配置生成key的前缀
 func (c *Cache) ConfigKeyPrefix(prefix, suffix string) error {
 	c.keyPrefix = prefix
@@ -242,6 +338,10 @@ func (c *Cache) checkCondValues(condValues []interface{}) error {
 		if err != nil {
 			return err
 		}
+		// #用来生成CacheRows的排序索引key，条件值中有#时生成的key可能和排序索引key重名
+		if strings.Contains(c.fmtKeyValue(v), "#") {
+			return fmt.Errorf("condValue can not contain # at tag:%s", c.Tags[at])
+		}
 	}
 	return nil
 }
@@ -330,14 +430,17 @@ func (c *Cache) genCondValuesKey(condValues []interface{}) string {
 		key.WriteString(c.keyPrefix + "_")
 	}
 	key.WriteString(c.tableName)
+	if len(c.dataValueField) > 0 {
+		key.WriteString(":" + c.dataValueField)
+	}
 	if len(c.keySuffix) > 0 {
 		key.WriteString("_" + c.keySuffix)
 	}
 	for i, v := range condValues {
 		if c.condFields[i] == c.hashTagField {
-			key.WriteString("_{" + c.fmtBaseType(v) + "}")
+			key.WriteString("_{" + c.fmtKeyValue(v) + "}")
 		} else {
-			key.WriteString("_" + c.fmtBaseType(v))
+			key.WriteString("_" + c.fmtKeyValue(v))
 		}
 	}
 	return key.String()
@@ -350,7 +453,7 @@ func (c *Cache) genKeyValuesStr(keyValues []interface{}) string {
 		if i > 0 {
 			flag.WriteByte(':')
 		}
-		flag.WriteString(c.fmtBaseType(v))
+		flag.WriteString(c.fmtKeyValue(v))
 	}
 	return flag.String()
 }
@@ -441,13 +544,18 @@ func (c *Cache) preLoadLock(ctx context.Context, key string) (func(), error) {
 		return func() {}, nil // 不需要锁，直接返回加锁成功
 	}
 
-	return c.redis.TryLockWait(utils.CtxSetNolog(ctx), key+"_lock_preLoads", time.Second*8)
+	return c.redis.TryLockWait(utils.CtxSetNolog(ctx), c.preLoadLockKey(key), time.Second*8)
 
 	// 若key已经存在了，加锁失败
 	// 这种不会存在加载的间隙，但会有两个问题 1：如果redis数据时错的 无法再次加载  2：针对CacheRows使用索引的方式，不能对索引加锁
 	// return c.redis.KeyLockWait(utils.CtxSetNolog(ctx), key, key+"_lock_preLoad", time.Second*8)
 }
 
+// mysql -> redis 的锁名，预热和preLoadLock共用
+func (c *Cache) preLoadLockKey(key string) string {
+	return key + "_lock_preLoads"
+}
+
 // redis -> mysql 的锁
 func (c *Cache) saveLock(ctx context.Context, key string) (func(), error) {
 	if !c.lock {
@@ -459,17 +567,74 @@ func (c *Cache) saveLock(ctx context.Context, key string) (func(), error) {
 
 // 往MySQL中添加一条数据，返回自增值，如果条件是=的，会设置为默认值
 func (c *Cache) addToMySQL(ctx context.Context, condValues []interface{}, data map[string]interface{}) (int64, error) {
-	var incrementId int64
+	sqlStr, args, increment, err := c.fmtAddSQL(ctx, condValues, data)
+	if err != nil {
+		return 0, err
+	}
+	incrementId := *increment
+
+	_, err = c.mysql.Exec(context.WithValue(ctx, mysql.CtxKey_NoDuplicate, 1), sqlStr, args...)
+
+	if err != nil {
+		// 自增ID冲突了 尝试获取最大的ID， 重新写入下
+		if len(c.incrementField) != 0 && utils.IsMatch("*Error 1062**Duplicate*PRIMARY*", err.Error()) {
+			var maxIncrement int64
+			err2 := c.mysql.Get(utils.CtxSetNolog(ctx), &maxIncrement, "SELECT MAX("+c.incrementField+") FROM "+c.TableName())
+			if err2 == nil {
+				incrementId = maxIncrement + 1000
+				if c.tableCount > 0 {
+					mod := incrementId % int64(c.tableCount)
+					if mod != int64(c.tableIndex) {
+						incrementId = incrementId - mod + int64(c.tableIndex)
+					}
+				}
+				*increment = incrementId
+				_, err := c.mysql.Exec(ctx, sqlStr, args...)
+				if err == nil {
+					c.incrementReids.Do(utils.CtxSetNolog(ctx), "HSET", IncrementKey, c.TableName(), incrementId) // 保存下最大的key
+					c.emitAddEvent(ctx, condValues, data, incrementId)
+					return incrementId, nil
+				}
+			}
+		}
+		// 唯一索引冲突了，可能是已经软删除的数据，归档后重新写入下
+		if len(c.softDelField) != 0 && utils.IsMatch("*Error 1062**Duplicate*", err.Error()) {
+			cond := NewConds().eqs(c.condFields, condValues)
+			for _, tag := range c.keyFields {
+				if v, ok := data[tag]; ok && tag != c.incrementField {
+					cond = cond.Eq(tag, v)
+				}
+			}
+			n, err2 := c.archiveToMySQL(ctx, c.TableName(), c.softDelDeleted(cond, time.Now()))
+			if err2 == nil && n > 0 {
+				_, err := c.mysql.Exec(ctx, sqlStr, args...)
+				if err == nil {
+					c.emitAddEvent(ctx, condValues, data, incrementId)
+					return incrementId, nil
+				}
+				return 0, err
+			}
+		}
+		return 0, err
+	}
+	c.emitAddEvent(ctx, condValues, data, incrementId)
+	return incrementId, nil
+}
+
+// 生成INSERT语句，需要自增值时会先获取自增值
+// 返回值：语句 参数 自增值的地址（参数中填充的是该地址，修改后再执行会使用新的值）
+func (c *Cache) fmtAddSQL(ctx context.Context, condValues []interface{}, data map[string]interface{}) (string, []interface{}, *int64, error) {
+	incrementId := new(int64)
 	if len(c.incrementField) != 0 {
 		// 如果结构中有自增字段，优先使用
 		if v, ok := data[c.incrementField]; ok && v != nil {
-			incrementId = c.int64Value(v)
+			*incrementId = c.int64Value(v)
 		}
-		if incrementId == 0 {
+		if *incrementId == 0 {
 			// 获取自增id
-			err := c.incrementReids.DoScript2(utils.CtxSetNolog(ctx), incrScript, []string{IncrementKey}, c.TableName(), c.tableCount, c.tableIndex).Bind(&incrementId)
+			err := c.incrementReids.DoScript2(utils.CtxSetNolog(ctx), incrScript, []string{IncrementKey}, c.TableName(), c.tableCount, c.tableIndex).Bind(incrementId)
 			if err != nil {
-				return 0, err
+				return "", nil, nil, err
 			}
 		}
 	}
@@ -479,7 +644,7 @@ func (c *Cache) addToMySQL(ctx context.Context, condValues []interface{}, data m
 	for i, tag := range c.Tags {
 		if len(c.incrementField) != 0 && tag == c.incrementField {
 			fields = append(fields, tag)
-			args = append(args, &incrementId) // 这里填充地址，下面如果自增主键冲突了，会再次修改，mysql内部支持*int的转化操作，Redis不会
+			args = append(args, incrementId) // 这里填充地址，如果自增主键冲突了，会再次修改，mysql内部支持*int的转化操作，Redis不会
 			continue
 		}
 		// 从条件变量中查找
@@ -513,36 +678,28 @@ func (c *Cache) addToMySQL(ctx context.Context, condValues []interface{}, data m
 	sqlStr.WriteString(") VALUES(")
 	sqlStr.WriteString(strings.Repeat("?,", len(fields)-1) + "?")
 	sqlStr.WriteString(")")
+	return sqlStr.String(), args, incrementId, nil
+}
 
-	_, err := c.mysql.Exec(context.WithValue(ctx, mysql.CtxKey_NoDuplicate, 1), sqlStr.String(), args...)
+// 删除MYSQL数据
+// keys：删除数据的key，批量保存时先把缓冲中的数据写入，防止删除后旧的修改再写入新添加的数据
+func (c *Cache) delToMySQL(ctx context.Context, cond TableConds, keys ...string) error {
+	c.batchFlushKey(ctx, keys...)
+
+	sqlStr, args := c.fmtDelSQL(cond)
+	_, err := c.mysql.Exec(ctx, sqlStr, args...)
 
 	if err != nil {
-		// 自增ID冲突了 尝试获取最大的ID， 重新写入下
-		if len(c.incrementField) != 0 && utils.IsMatch("*Error 1062**Duplicate*PRIMARY*", err.Error()) {
-			var maxIncrement int64
-			err2 := c.mysql.Get(utils.CtxSetNolog(ctx), &maxIncrement, "SELECT MAX("+c.incrementField+") FROM "+c.TableName())
-			if err2 == nil {
-				incrementId = maxIncrement + 1000
-				if c.tableCount > 0 {
-					mod := incrementId % int64(c.tableCount)
-					if mod != int64(c.tableIndex) {
-						incrementId = incrementId - mod + int64(c.tableIndex)
-					}
-				}
-				_, err := c.mysql.Exec(ctx, sqlStr.String(), args...)
-				if err == nil {
-					c.incrementReids.Do(utils.CtxSetNolog(ctx), "HSET", IncrementKey, c.TableName(), incrementId) // 保存下最大的key
-					return incrementId, nil
-				}
-			}
-		}
-		return 0, err
+		return err
 	}
-	return incrementId, nil
+	return nil
 }
 
-// 删除MYSQL数据
-func (c *Cache) delToMySQL(ctx context.Context, cond TableConds) error {
+// 生成删除语句，开启了软删除时生成设置删除时间的UPDATE语句
+func (c *Cache) fmtDelSQL(cond TableConds) (string, []interface{}) {
+	if len(c.softDelField) != 0 {
+		return c.fmtSoftDelSQL(cond)
+	}
 	var sqlStr strings.Builder
 	sqlStr.WriteString("DELETE FROM ")
 	sqlStr.WriteString(c.TableName())
@@ -552,13 +709,7 @@ func (c *Cache) delToMySQL(ctx context.Context, cond TableConds) error {
 		sqlStr.WriteString(" WHERE ")
 	}
 	args := cond.fmtCond(&sqlStr)
-
-	_, err := c.mysql.Exec(ctx, sqlStr.String(), args...)
-
-	if err != nil {
-		return err
-	}
-	return nil
+	return sqlStr.String(), args
 }
 
 // 读取mysql数据 返回的是 *T 会返回空错误
@@ -577,6 +728,7 @@ func (c *Cache) getFromMySQL(ctx context.Context, T reflect.Type, fields []strin
 	sqlStr.WriteString(c.TableName())
 
 	cond = append(cond, c.queryCond...)
+	cond = c.softDelExclude(cond)
 	if len(cond) > 0 {
 		sqlStr.WriteString(" WHERE ")
 	}
@@ -597,6 +749,12 @@ func (c *Cache) getFromMySQL(ctx context.Context, T reflect.Type, fields []strin
 // 读取mysql数据 返回的是 []*T  不会返回空错误
 // fields表示读取的字段名，内部为string类型
 func (c *Cache) getsFromMySQL(ctx context.Context, T reflect.Type, fields []string, cond TableConds) (interface{}, error) {
+	return c.getsFromMySQLOrder(ctx, T, fields, cond, "", 0, 0)
+}
+
+// 读取mysql数据 返回的是 []*T  不会返回空错误
+// orderBy：排序语句，为空不排序 limit：大于0时读取offset开始的limit条数据
+func (c *Cache) getsFromMySQLOrder(ctx context.Context, T reflect.Type, fields []string, cond TableConds, orderBy string, offset, limit int) (interface{}, error) {
 	var sqlStr strings.Builder
 	sqlStr.WriteString("SELECT ")
 
@@ -610,10 +768,18 @@ func (c *Cache) getsFromMySQL(ctx context.Context, T reflect.Type, fields []stri
 	sqlStr.WriteString(c.TableName())
 
 	cond = append(cond, c.queryCond...)
+	cond = c.softDelExclude(cond)
 	if len(cond) > 0 {
 		sqlStr.WriteString(" WHERE ")
 	}
 	args := cond.fmtCond(&sqlStr)
+	if len(orderBy) > 0 {
+		sqlStr.WriteString(" ORDER BY " + orderBy)
+	}
+	if limit > 0 {
+		sqlStr.WriteString(" LIMIT ?,?")
+		args = append(args, offset, limit)
+	}
 
 	t := reflect.New(reflect.SliceOf(reflect.PtrTo(T)))
 	err := c.mysql.Select(ctx, t.Interface(), sqlStr.String(), args...)
@@ -628,7 +794,63 @@ func (c *Cache) getsFromMySQL(ctx context.Context, T reflect.Type, fields []stri
 	return t.Elem().Interface(), nil
 }
 
-func (c *Cache) saveToMySQL(ctx context.Context, cond TableConds, data map[string]interface{}, key string, call func(err error)) error {
+// key：加锁使用的key dataKey：数据存储的key，CacheRow中两者一样，CacheRows中key为索引key
+func (c *Cache) saveToMySQL(ctx context.Context, cond TableConds, data map[string]interface{}, key, dataKey string, call func(err error)) error {
+	// 校验版本号的修改，mysql中也要带上版本号的条件
+	verCheck := false
+	if expect, ok := c.versionExpect(ctx); ok {
+		cond = cond.Eq(c.versionField, expect)
+		verCheck = true
+	}
+	sqlStr, args := c.fmtSaveSQL(cond, data)
+	if len(sqlStr) == 0 {
+		if call != nil {
+			call(nil)
+		}
+		return nil // 没啥可更新的
+	}
+
+	if c.batchInterval > 0 {
+		return c.batchSave(ctx, cond, data, key, dataKey, verCheck, call)
+	}
+
+	if c.toMysqlAsync {
+		// 先写持久化日志，写失败了走同步保存
+		journalId, ok := c.journalAppend(ctx, &journalEntry{Key: key, DataKey: dataKey, Op: journalOpSave, Cond: c.journalCond(cond), Data: c.journalData(data)})
+		if ok {
+			utils.Submit(func() {
+				// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0，校验版本号时版本号一定会变化
+				err := c.versionCheck(verCheck)(c.mysql.Update(ctx, sqlStr, args...))
+				if err == nil {
+					c.journalDone(ctx, journalId)
+				}
+				if call != nil {
+					call(err)
+				}
+			})
+			return nil
+		}
+	}
+	// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0，校验版本号时版本号一定会变化
+	err := c.versionCheck(verCheck)(c.mysql.Update(ctx, sqlStr, args...))
+	if call != nil {
+		call(err)
+	}
+	return err
+}
+
+// 校验版本号时，影响的行数为0表示mysql中的版本号不一致
+func (c *Cache) versionCheck(verCheck bool) func(n int64, err error) error {
+	return func(n int64, err error) error {
+		if err == nil && verCheck && n == 0 {
+			return ErrVersion
+		}
+		return err
+	}
+}
+
+// 生成UPDATE语句，没有可更新的字段返回空
+func (c *Cache) fmtSaveSQL(cond TableConds, data map[string]interface{}) (string, []interface{}) {
 	var sqlStr strings.Builder
 	sqlStr.WriteString("UPDATE ")
 	sqlStr.WriteString(c.TableName())
@@ -659,13 +881,16 @@ func (c *Cache) saveToMySQL(ctx context.Context, cond TableConds, data map[strin
 		}
 	}
 	if num == 0 {
-		if call != nil {
-			call(nil)
-		}
-		return nil // 没啥可更新的
+		return "", nil
 	}
 	sqlStr.WriteString(" WHERE ")
+	args = append(args, c.fmtSaveCond(&sqlStr, cond)...)
+	return sqlStr.String(), args
+}
 
+// 保存时的条件，只会有等于条件
+func (c *Cache) fmtSaveCond(sqlStr io.StringWriter, cond TableConds) []interface{} {
+	args := make([]interface{}, 0, len(cond))
 	for i, v := range cond {
 		if i > 0 {
 			if len(cond[i-1].link) > 0 {
@@ -678,28 +903,53 @@ func (c *Cache) saveToMySQL(ctx context.Context, cond TableConds, data map[strin
 		sqlStr.WriteString(v.op + "?")
 		args = append(args, v.value)
 	}
+	return args
+}
 
-	if c.toMysqlAsync {
-		utils.Submit(func() {
-			// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0
-			_, err := c.mysql.Update(ctx, sqlStr.String(), args...)
-			if call != nil {
-				call(err)
-			}
-		})
-		return nil
-	} else {
-		// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0
-		_, err := c.mysql.Update(ctx, sqlStr.String(), args...)
+// mysql的JSON_SEARCH 不支持数字类型的查找，这里明确添加的类型必须是string
+// data：同时直接设置的字段，比如版本号
+// key：加锁使用的key dataKey：数据存储的key
+func (c *Cache) jsonArrayToMySQL(ctx context.Context, cond TableConds, add, del map[string][]string, data map[string]interface{}, key, dataKey string, call func(err error)) error {
+	sqlStr, args := c.fmtJsonArraySQL(cond, add, del, data)
+	if len(sqlStr) == 0 {
 		if call != nil {
-			call(err)
+			call(nil)
 		}
-		return err
+		return nil // 没啥可更新的
+	}
+
+	if c.batchInterval > 0 {
+		// JsonArray的修改不合并，先把缓冲中的数据写入，保证顺序
+		c.batchFlushKey(ctx, dataKey)
 	}
+
+	if c.toMysqlAsync {
+		// 先写持久化日志，写失败了走同步保存
+		journalId, ok := c.journalAppend(ctx, &journalEntry{Key: key, DataKey: dataKey, Op: journalOpJsonArray, Cond: c.journalCond(cond), Data: c.journalData(data), Add: add, Del: del})
+		if ok {
+			utils.Submit(func() {
+				// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0
+				_, err := c.mysql.Update(ctx, sqlStr, args...)
+				if err == nil {
+					c.journalDone(ctx, journalId)
+				}
+				if call != nil {
+					call(err)
+				}
+			})
+			return nil
+		}
+	}
+	// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0
+	_, err := c.mysql.Update(ctx, sqlStr, args...)
+	if call != nil {
+		call(err)
+	}
+	return err
 }
 
-// mysql的JSON_SEARCH 不支持数字类型的查找，这里明确添加的类型必须是string
-func (c *Cache) jsonArrayToMySQL(ctx context.Context, cond TableConds, add, del map[string][]string, key string, call func(err error)) error {
+// 生成JsonArray的UPDATE语句，没有可更新的字段返回空
+func (c *Cache) fmtJsonArraySQL(cond TableConds, add, del map[string][]string, data map[string]interface{}) (string, []interface{}) {
 	var sqlStr strings.Builder
 	sqlStr.WriteString("UPDATE ")
 	sqlStr.WriteString(c.TableName())
@@ -707,6 +957,18 @@ func (c *Cache) jsonArrayToMySQL(ctx context.Context, cond TableConds, add, del
 
 	args := make([]interface{}, 0, 0)
 	num := 0
+	for tag, v := range data {
+		if c.saveIgnoreTag(tag) || v == nil {
+			continue
+		}
+		if num > 0 {
+			sqlStr.WriteString(",")
+		}
+		num++
+		sqlStr.WriteString(tag)
+		sqlStr.WriteString("=?")
+		args = append(args, v)
+	}
 	for tag, values := range add {
 		if len(values) == 0 {
 			continue
@@ -756,43 +1018,11 @@ func (c *Cache) jsonArrayToMySQL(ctx context.Context, cond TableConds, add, del
 	}
 
 	if num == 0 {
-		if call != nil {
-			call(nil)
-		}
-		return nil // 没啥可更新的
+		return "", nil
 	}
 	sqlStr.WriteString(" WHERE ")
-
-	for i, v := range cond {
-		if i > 0 {
-			if len(cond[i-1].link) > 0 {
-				sqlStr.WriteString(" " + cond[i-1].link + " ")
-			} else {
-				sqlStr.WriteString(" AND ")
-			}
-		}
-		sqlStr.WriteString(v.field)
-		sqlStr.WriteString(v.op + "?")
-		args = append(args, v.value)
-	}
-
-	if c.toMysqlAsync {
-		utils.Submit(func() {
-			// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0
-			_, err := c.mysql.Update(ctx, sqlStr.String(), args...)
-			if call != nil {
-				call(err)
-			}
-		})
-		return nil
-	} else {
-		// 不能判断返回影响的行数，如果更新的值相等，影响的行数也是0
-		_, err := c.mysql.Update(ctx, sqlStr.String(), args...)
-		if call != nil {
-			call(err)
-		}
-		return err
-	}
+	args = append(args, c.fmtSaveCond(&sqlStr, cond)...)
+	return sqlStr.String(), args
 }
 
 func (c *Cache) saveIgnoreTag(tag string) bool {
@@ -805,16 +1035,21 @@ func (c *Cache) saveIgnoreTag(tag string) bool {
 	if utils.Contains(c.keyFields, tag) {
 		return true // 忽略条件字段
 	}
+	if tag == c.softDelField {
+		return true // 忽略删除时间字段，只有Del时修改
+	}
 	return false
 }
 
 // params参数放到过期时间后面
-func (c *Cache) redisSetParam(param string, data map[string]interface{}) []interface{} {
-	redisParams := make([]interface{}, 0, 2+len(c.Tags)*3)
+func (c *Cache) redisSetParam(ctx context.Context, param string, data map[string]interface{}) []interface{} {
+	redisParams := make([]interface{}, 0, 5+len(c.Tags)*3)
 	redisParams = append(redisParams, c.expire)
 	redisParams = append(redisParams, param)
+	redisParams = c.redisGuardParam(ctx, redisParams)
+	redisParams = c.redisVersionParam(ctx, redisParams)
 	for tag, v := range data {
-		if c.saveIgnoreTag(tag) {
+		if c.saveIgnoreTag(tag) || tag == c.versionField {
 			continue
 		}
 		redisParams = append(redisParams, c.GetRedisTagByTag(tag)) // 真实填充的是redistag
@@ -832,13 +1067,15 @@ func (c *Cache) redisSetParam(param string, data map[string]interface{}) []inter
 
 // params参数放到过期时间后面
 // tags 表示填充data时 按tags来填充
-func (c *Cache) redisSetGetParam(param string, tags []string, data map[string]interface{}, numIncr bool) []interface{} {
-	redisParams := make([]interface{}, 0, 2+len(c.Tags)*3)
+func (c *Cache) redisSetGetParam(ctx context.Context, param string, tags []string, data map[string]interface{}, numIncr bool) []interface{} {
+	redisParams := make([]interface{}, 0, 5+len(c.Tags)*3)
 	redisParams = append(redisParams, c.expire)
 	redisParams = append(redisParams, param)
+	redisParams = c.redisGuardParam(ctx, redisParams)
+	redisParams = c.redisVersionParam(ctx, redisParams)
 	for _, tag := range tags {
 		redisParams = append(redisParams, c.GetRedisTagByTag(tag)) // 真实填充的是redistag
-		if c.saveIgnoreTag(tag) {
+		if c.saveIgnoreTag(tag) || tag == c.versionField {
 			redisParams = append(redisParams, "get") // 忽略的字段 只读取
 			redisParams = append(redisParams, nil)
 			continue
@@ -875,15 +1112,20 @@ func (c *Cache) redisSetGetParam(param string, tags []string, data map[string]in
 }
 
 // params参数放到过期时间后面
-func (c *Cache) redisJsonArrayParam(param string, add, del map[string][]string, duplicate bool) ([]string, []string, []interface{}) {
-	redisParams := make([]interface{}, 0, 2+len(c.Tags)*3)
+func (c *Cache) redisJsonArrayParam(ctx context.Context, param string, add, del map[string][]string, duplicate bool) ([]string, []string, []interface{}) {
+	redisParams := make([]interface{}, 0, 7+len(c.Tags)*3)
 	redisParams = append(redisParams, c.expire)
 	redisParams = append(redisParams, param)
 	redisParams = append(redisParams, utils.If(duplicate, 1, 0))
+	if len(c.versionField) > 0 {
+		// 版本号放在最前面 field ver 1 expect
+		expect, _ := c.versionExpect(ctx)
+		redisParams = append(redisParams, c.GetRedisTagByTag(c.versionField), "ver", 1, expect)
+	}
 	addFields := []string{}
 	delFields := []string{}
 	for tag, values := range add {
-		if c.saveIgnoreTag(tag) {
+		if c.saveIgnoreTag(tag) || tag == c.versionField {
 			continue
 		}
 		if len(values) == 0 {
@@ -898,7 +1140,7 @@ func (c *Cache) redisJsonArrayParam(param string, add, del map[string][]string,
 		addFields = append(addFields, tag)
 	}
 	for tag, values := range del {
-		if c.saveIgnoreTag(tag) {
+		if c.saveIgnoreTag(tag) || tag == c.versionField {
 			continue
 		}
 		if len(values) == 0 {
@@ -914,3 +1156,116 @@ func (c *Cache) redisJsonArrayParam(param string, add, del map[string][]string,
 	}
 	return addFields, delFields, redisParams
 }
+
+// 开启版本号时，版本号参数放到params参数后面，Redis脚本中先校验版本号再修改
+func (c *Cache) redisVersionParam(ctx context.Context, redisParams []interface{}) []interface{} {
+	if len(c.versionField) == 0 {
+		return redisParams
+	}
+	expect, _ := c.versionExpect(ctx)
+	return append(redisParams, c.GetRedisTagByTag(c.versionField), "ver", expect)
+}
+
+// 需要校验的版本号，SetIfVersion、ModifyIfVersion时通过ctx传递
+func (c *Cache) versionExpect(ctx context.Context) (string, bool) {
+	if len(c.versionField) == 0 {
+		return "", false
+	}
+	expect, ok := ctx.Value(ctxKey_version).(int64)
+	if !ok {
+		return "", false
+	}
+	return strconv.FormatInt(expect, 10), true
+}
+
+// 开启版本号时，在绑定列表的最前面添加版本号，用来接受Redis脚本返回的新版本号
+func (c *Cache) versionBind(values []reflect.Value) ([]reflect.Value, *int64) {
+	if len(c.versionField) == 0 {
+		return values, nil
+	}
+	ver := new(int64)
+	return append([]reflect.Value{reflect.ValueOf(ver).Elem()}, values...), ver
+}
+
+// 保存mysql的数据中设置上新的版本号，不修改原来的data
+func (c *Cache) versionData(data map[string]interface{}, ver *int64) map[string]interface{} {
+	if ver == nil {
+		return data
+	}
+	newData := make(map[string]interface{}, len(data)+1)
+	for tag, v := range data {
+		newData[tag] = v
+	}
+	newData[c.versionField] = *ver
+	return newData
+}
+
+// 修改条件参数放到params参数后面，在版本号的前面，Redis脚本中最先检查
+func (c *Cache) redisGuardParam(ctx context.Context, redisParams []interface{}) []interface{} {
+	guards, _ := ctx.Value(ctxKey_guard).([]*guardCond)
+	for _, g := range guards {
+		redisParams = append(redisParams, c.GetRedisTagByTag(g.field), "guard"+g.op)
+		vfmt := goredis.ValueFmt(reflect.ValueOf(g.value))
+		if vfmt == nil {
+			redisParams = append(redisParams, "")
+			continue
+		}
+		redisParams = append(redisParams, vfmt)
+	}
+	return redisParams
+}
+
+// ops中配置了修改条件时，检查条件字段并通过ctx传递给参数函数，Create无效
+func (c *Cache) guardOptions(ctx context.Context, ops *Options) (context.Context, *Options, error) {
+	if ops == nil || len(ops.guards) == 0 {
+		return ctx, ops, nil
+	}
+	for _, g := range ops.guards {
+		if c.FindIndexByTag(g.field) == -1 {
+			return ctx, ops, fmt.Errorf("guard tag:%s not find in %s", g.field, c.T.String())
+		}
+	}
+	return context.WithValue(ctx, ctxKey_guard, ops.guards), ops.withoutCreate(), nil
+}
+
+// 脚本通过redis.error_reply返回的错误码，Redis7开始没有空格的错误会添加ERR前缀
+func scriptErrorCode(err error) string {
+	return strings.TrimPrefix(err.Error(), "ERR ")
+}
+
+// Redis脚本返回的错误，版本号校验失败返回VERSION，修改条件不满足返回GUARD{条件字段的当前值}
+func (c *Cache) scriptError(err error) error {
+	if err == nil {
+		return err
+	}
+	code := scriptErrorCode(err)
+	if code == "VERSION" {
+		return ErrVersion
+	}
+	if strings.HasPrefix(code, "GUARD") {
+		cur := map[string]interface{}{}
+		if json.Unmarshal([]byte(code[5:]), &cur) != nil {
+			return err
+		}
+		guardErr := &ErrGuardFailed{Values: map[string]interface{}{}}
+		for i, tag := range c.Tags {
+			v, ok := cur[c.RedisTags[i]]
+			if !ok {
+				continue
+			}
+			s, ok := v.(string)
+			if !ok {
+				guardErr.Values[tag] = nil // 字段不存在
+				continue
+			}
+			value := reflect.New(c.Fields[i].Type).Elem()
+			if goredis.InterfaceToValue(s, value) != nil {
+				guardErr.Values[tag] = s
+				continue
+			}
+			guardErr.Values[tag] = value.Interface()
+		}
+		return guardErr
+	}
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gobase/goredis"
 	"gobase/mysql"
@@ -901,3 +902,317 @@ func BenchmarkRowsJsonArrayFieldAdd(b *testing.B) {
 	time.Sleep(time.Second * 2)
 
 }
+
+func BenchmarkRowJournalReplay(b *testing.B) {
+	if cacheRow == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	cacheRow.ConfigJournal(goredis.DefaultRedis())
+	cacheRow.ConfigToMysqlAsync(true)
+	defer cacheRow.ConfigToMysqlAsync(false)
+
+	sm := map[string]interface{}{
+		"Name": "Journal",
+		"Age":  88,
+	}
+	cacheRow.Set(context.TODO(), []interface{}{123, 8}, sm, NoRespOptions())
+	cacheRow.Modify(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Age": 1}, NoRespOptions())
+	time.Sleep(time.Second * 2)
+
+	// 重放所有日志
+	JournalReplayDelay = 0
+	cacheRow.ReplayJournal(context.TODO())
+}
+
+func BenchmarkRowBatchFlush(b *testing.B) {
+	if cacheRow == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	cacheRow.ConfigBatchFlush(time.Second, 100)
+	defer cacheRow.ConfigBatchFlush(0, 0)
+
+	// 多次修改合并成一条UPDATE
+	for i := 0; i < 10; i++ {
+		cacheRow.Modify(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Age": 1}, NoRespOptions())
+		cacheRow.Modify(context.TODO(), []interface{}{123, 9}, map[string]interface{}{"Age": 1}, NoRespOptions())
+	}
+	time.Sleep(time.Second * 2)
+
+	cacheRow.Set(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Name": "Batch"}, NoRespOptions())
+	cacheRow.Flush(context.TODO())
+}
+
+func BenchmarkColumn(b *testing.B) {
+	if cacheRow == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	cacheColumn, err := NewCacheColumn[Test](goredis.DefaultRedis(), mysql.DefaultMySQL(), "test", 0, 0, []string{"UID"}, "Type", "Age")
+	if err != nil {
+		log.Error().Err(err).Msg("NewCacheColumn Err")
+		return
+	}
+	cacheColumn.ConfigHashTag("UID")
+
+	// 先删除
+	cacheColumn.DelCache(context.TODO(), []interface{}{123})
+	// 读取
+	cacheColumn.GetAll(context.TODO(), []interface{}{123})
+	cacheColumn.Get(context.TODO(), []interface{}{123}, 8)
+	// 读取一个不存在的
+	cacheColumn.Get(context.TODO(), []interface{}{123}, 110)
+
+	cacheColumn.Incr(context.TODO(), []interface{}{123}, 8, 10, nil)
+	cacheColumn.Set(context.TODO(), []interface{}{123}, 8, 100, nil)
+	// 不存在的创建
+	cacheColumn.Incr(context.TODO(), []interface{}{123}, 20, 1, CreateOptions())
+	time.Sleep(time.Second * 2)
+}
+
+func BenchmarkRowsGetPage(b *testing.B) {
+	if cacheRows == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	// 先删除缓存，从MySQL中读取
+	cacheRows.DelAllCache(context.TODO(), []interface{}{123})
+	cacheRows.GetPage(context.TODO(), []interface{}{123}, "Age DESC", 0, 3)
+	time.Sleep(time.Second)
+
+	// 从缓存中读取
+	cacheRows.GetPage(context.TODO(), []interface{}{123}, "Age DESC", 0, 3)
+	cacheRows.GetPage(context.TODO(), []interface{}{123}, "Age", 3, 3)
+	cacheRows.GetRange(context.TODO(), []interface{}{123}, "Age", 20, 50)
+
+	// 修改后排序索引同步修改
+	cacheRows.Modify(context.TODO(), []interface{}{123}, map[string]interface{}{"Type": 1, "GroupType": "G0", "Age": 100}, NoRespOptions())
+	cacheRows.GetPage(context.TODO(), []interface{}{123}, "Age DESC", 0, 3)
+	time.Sleep(time.Second * 2)
+}
+
+func BenchmarkRowsCount(b *testing.B) {
+	if cacheRows == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	// 先删除缓存，只加载索引
+	cacheRows.DelAllCache(context.TODO(), []interface{}{123})
+	cacheRows.Count(context.TODO(), []interface{}{123})
+	// 从缓存中读取
+	cacheRows.Count(context.TODO(), []interface{}{123})
+
+	// 数量上限
+	cacheRows.ConfigMaxRows(10)
+	defer cacheRows.ConfigMaxRows(0)
+	sm := map[string]interface{}{
+		"Name":      "Hello20",
+		"Age":       20,
+		"Type":      20,
+		"GroupType": "G1",
+	}
+	_, _, err := cacheRows.Add(context.TODO(), []interface{}{123}, sm, NoRespOptions())
+	if err == ErrMaxRows {
+		log.Info().Msg("exceed max rows")
+	}
+}
+
+func BenchmarkRowVersion(b *testing.B) {
+	if cacheRow == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	// 用Age字段做版本号
+	cacheRow.ConfigVersion("Age")
+	defer cacheRow.ConfigVersion("")
+
+	rst, err := cacheRow.Get(context.TODO(), []interface{}{123, 8})
+	if err != nil {
+		return
+	}
+	version := int64(rst.Age)
+	// 版本号一致 修改成功
+	_, err = cacheRow.SetIfVersion(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Name": "Version"}, version, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("SetIfVersion Err")
+	}
+	// 版本号已经变化了 修改失败
+	_, err = cacheRow.ModifyIfVersion(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Type": 1}, version, NoRespOptions())
+	if err == ErrVersion {
+		log.Info().Msg("version mismatch")
+	}
+	// 普通的修改也会增加版本号
+	cacheRows.ConfigVersion("Age")
+	defer cacheRows.ConfigVersion("")
+	cacheRows.JsonArrayFieldAdd(context.TODO(), []interface{}{123}, []interface{}{9, "G1"}, map[string][]string{"Strs": {"V"}}, nil)
+	time.Sleep(time.Second * 2)
+}
+
+func BenchmarkRowModifyGuard(b *testing.B) {
+	if cacheRow == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	// Age >= 10 时才扣除10
+	_, _, err := cacheRow.Modify(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Age": -10}, NewOptions().GuardGe("Age", 10))
+	var guardErr *ErrGuardFailed
+	if errors.As(err, &guardErr) {
+		log.Info().Interface("values", guardErr.Values).Msg("guard failed")
+	}
+	// 多个条件
+	cacheRow.Modify(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Age": 1}, NoRespOptions().GuardLt("Age", 100).GuardEq("Name", "Hello"))
+	time.Sleep(time.Second * 2)
+}
+
+func BenchmarkRowEvent(b *testing.B) {
+	if cacheRow == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	chanSink := NewChanSink(128)
+	cacheRow.ConfigEventSink(chanSink, NewRedisStreamSink(goredis.DefaultRedis(), "mrcache_event_test", 1000))
+	defer cacheRow.ConfigEventSink()
+
+	cacheRow.Modify(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Age": 1}, NoRespOptions())
+	cacheRow.Set(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Name": "Event"}, NoRespOptions())
+	for {
+		select {
+		case e := <-chanSink.C:
+			log.Info().Interface("event", e).Msg("ChangeEvent")
+			continue
+		default:
+		}
+		break
+	}
+}
+
+func BenchmarkRowLocalCache(b *testing.B) {
+	if cacheRow == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	cacheRow.ConfigLocalCache(1000, time.Second*10)
+	defer cacheRow.ConfigLocalCache(0, 0)
+
+	// 第一次从Redis读取，后面从本地读取
+	cacheRow.Get(context.TODO(), []interface{}{123, 8})
+	for i := 0; i < b.N; i++ {
+		cacheRow.Get(context.TODO(), []interface{}{123, 8})
+	}
+	// 修改后本地缓存删除
+	cacheRow.Modify(context.TODO(), []interface{}{123, 8}, map[string]interface{}{"Age": 1}, NoRespOptions())
+	cacheRow.Get(context.TODO(), []interface{}{123, 8})
+}
+
+func BenchmarkEnsureSchema(b *testing.B) {
+	if cacheRows == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	// 拆表
+	cache, err := NewCacheRows[Test](goredis.DefaultRedis(), mysql.DefaultMySQL(), "test_schema", 2, 0, []string{"UID"}, []string{"Type", "GroupType"})
+	if err != nil {
+		return
+	}
+	cache.ConfigIncrement(goredis.DefaultRedis(), "Id")
+	cache.EnsureSchemaDryRun(context.TODO())
+	cache.EnsureSchema(context.TODO())
+	// 已经存在的表没有变化
+	cache.EnsureSchemaDryRun(context.TODO())
+}
+
+func BenchmarkWarmup(b *testing.B) {
+	if cacheRow == nil || cacheRows == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	cacheRow.ResetWarmup(context.TODO(), nil)
+	cacheRow.Warmup(context.TODO(), nil, 4, 0)
+	cacheRows.Warmup(context.TODO(), NewConds().Eq("UID", 123), 2, 1000)
+}
+
+func BenchmarkVerify(b *testing.B) {
+	if cacheRow == nil || cacheRows == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	report, err := cacheRow.Verify(context.TODO(), nil, RepairNone, 0)
+	if err == nil {
+		for _, diff := range report.Diffs {
+			log.Info().Interface("cond", diff.CondValues).Strs("fields", diff.Fields).Interface("redis", diff.Redis).Interface("mysql", diff.MySQL).Msg("diff")
+		}
+	}
+	// 以mysql为准修复
+	cacheRows.Verify(context.TODO(), NewConds().Eq("UID", 123), RepairMySQLWins, 1000)
+}
+
+func BenchmarkSoftDelete(b *testing.B) {
+	if cacheRows == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	cache, err := NewCacheRows[Test](goredis.DefaultRedis(), mysql.DefaultMySQL(), "test_softdel", 0, 0, []string{"UID"}, []string{"Type", "GroupType"})
+	if err != nil {
+		return
+	}
+	cache.ConfigIncrement(goredis.DefaultRedis(), "Id")
+	err = cache.ConfigSoftDelete("update_time", "")
+	if err != nil {
+		log.Error().Err(err).Msg("ConfigSoftDelete")
+		return
+	}
+	cache.Del(context.TODO(), []interface{}{123}, []interface{}{1, 2})
+	cache.Archive(context.TODO(), time.Hour*24*30)
+}
+
+func BenchmarkTx(b *testing.B) {
+	if cacheRow == nil || cacheRows == nil {
+		log.Error().Msg("init not success")
+		return
+	}
+
+	// 扣除cacheRow的年龄，给cacheRows的两个数据转移
+	err := NewTx().
+		Modify(cacheRow, []interface{}{123, 8}, nil, map[string]interface{}{"Age": -1}).
+		Modify(cacheRows, []interface{}{123}, []interface{}{1, "1"}, map[string]interface{}{"Age": 1}).
+		Del(cacheRows, []interface{}{123}, []interface{}{1, "2"}).
+		Exec(context.TODO())
+	if err != nil {
+		log.Error().Err(err).Msg("Tx")
+	}
+}
+
+type TestCodec struct {
+	Id   int       `db:"Id"`
+	UUID [16]byte  `db:"UUID"`
+	Day  time.Time `db:"Day"`
+	Num  int       `db:"Num"`
+}
+
+func BenchmarkKeyCodec(b *testing.B) {
+	cache, err := NewCacheRow[TestCodec](goredis.DefaultRedis(), mysql.DefaultMySQL(), "test_codec", 0, 0, []string{"UUID", "Day"})
+	if err != nil {
+		log.Error().Err(err).Msg("NewCacheRow")
+		return
+	}
+	condValues := []interface{}{[16]byte{1, 2, 3}, time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)}
+	log.Info().Str("key", cache.genCondValuesKey(condValues)).Msg("key")
+	if cacheRow == nil {
+		return
+	}
+	cache.Modify(context.TODO(), condValues, map[string]interface{}{"Num": 1}, CreateOptions())
+}
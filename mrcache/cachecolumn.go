@@ -0,0 +1,520 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gobase/goredis"
+	"gobase/mysql"
+	"gobase/utils"
+	"reflect"
+
+	"github.com/rs/zerolog"
+)
+
+// T 为数据库结构类型
+// 使用场景：查询条件condFields对应多个结果 每个结果用keyField来唯一定位，只关心其中一个值字段valueField，比如(uid,itemId,count)
+// condFields 和 keyField 数据类型只能为基本的数据类型，condFields和keyField对应的数据要唯一，最好有唯一索引
+// key：一个hash结构，field为keyField的值，value为valueField的值，key的命名中会添加上:valueField
+// 空值的数据不会写入Redis，读取时当做不存在
+// 使用数据时，都判断数据是否存在，不存在就尝试加载下，加载时判断是否设置了pass，防止击穿到mysql
+type CacheColumn[T any] struct {
+	*Cache
+}
+
+// key不存在，需要预加载
+var errColumnNoKey = errors.New("column key not exist")
+
+// condFields：查询字段，不可为空 keyField：数据的唯一字段 valueField：存储的值字段
+func NewCacheColumn[T any](redis *goredis.Redis, mysql *mysql.MySQL, tableName string, tableCount, tableIndex int, condFields []string, keyField, valueField string) (*CacheColumn[T], error) {
+	cache, err := NewCache[T](redis, mysql, tableName, tableCount, tableIndex, condFields)
+	if err != nil {
+		return nil, err
+	}
+	cache.keyPrefix = "mrc"
+
+	// keyField 只能是基本的数据类型
+	keyIdx := cache.FindIndexByTag(keyField)
+	if keyIdx == -1 {
+		return nil, fmt.Errorf("tag:%s not find in %s", keyField, cache.T.String())
+	}
+	if !cache.IsBaseType(cache.Fields[keyIdx].Type) && getKeyCodec(cache.Fields[keyIdx].Type) == nil {
+		return nil, fmt.Errorf("tag:%s(%s) as keyField type error", keyField, cache.T.String())
+	}
+	if utils.Contains(cache.condFields, keyField) {
+		return nil, fmt.Errorf("tag:%s(%s) as keyField can not in condFields", keyField, cache.T.String())
+	}
+	// valueField 只能是基本的数据类型或者浮点数
+	valueIdx := cache.FindIndexByTag(valueField)
+	if valueIdx == -1 {
+		return nil, fmt.Errorf("tag:%s not find in %s", valueField, cache.T.String())
+	}
+	valueKind := cache.Fields[valueIdx].Type.Kind()
+	if !cache.IsBaseType(cache.Fields[valueIdx].Type) && valueKind != reflect.Float32 && valueKind != reflect.Float64 {
+		return nil, fmt.Errorf("tag:%s(%s) as valueField type error", valueField, cache.T.String())
+	}
+	if valueField == keyField || utils.Contains(cache.condFields, valueField) {
+		return nil, fmt.Errorf("tag:%s(%s) as valueField can not in condFields or keyField", valueField, cache.T.String())
+	}
+
+	cache.keyFields = []string{keyField}
+	cache.keyFieldsIndex = []int{keyIdx}
+	cache.keyFieldsLog = "[" + keyField + "]"
+	cache.dataValueField = valueField
+	cache.dataValueFieldIndex = valueIdx
+
+	c := &CacheColumn[T]{
+		Cache: cache,
+	}
+	return c, nil
+}
+
+// 保存mysql时使用的数据key，Redis中并不存在，用来区分同一个key下的不同数据
+func (c *CacheColumn[T]) genDataKey(key, field string) string {
+	return key + "_" + field
+}
+
+// 读取符合condValues的全部数据
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// 返回值：是T结构类型的指针列表，只填充condFields keyField valueField
+func (c *CacheColumn[T]) GetAll(ctx context.Context, condValues []interface{}) (_rst_ []*T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Err(_err_).Array("rst", utils.TruncatedLog(_rst_)).Msgf("CacheColumn %s GetAll", c.TableName())
+	})()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return nil, err
+	}
+
+	// 从Redis中读取
+	dest, err := c.redisGetAll(ctx, key, condValues)
+	if err == nil {
+		return dest, nil
+	}
+
+	// 其他情况不处理执行下面的预加载
+	preData, err := c.preLoadAll(ctx, key, condValues)
+	if err != nil {
+		return nil, err
+	}
+	if preData != nil { // 执行了预加载
+		return preData, nil
+	}
+
+	// 如果不是自己执行的预加载，这里重新读取下
+	dest, err = c.redisGetAll(ctx, key, condValues)
+	if err == nil {
+		return dest, nil
+	} else if err == ErrNullData {
+		return make([]*T, 0), nil
+	} else {
+		return nil, err
+	}
+}
+
+// 读取一条数据 会返回空错误
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// keyValue：keyField对应的值
+// 返回值：是T结构类型的指针，只填充condFields keyField valueField
+func (c *CacheColumn[T]) Get(ctx context.Context, condValues []interface{}, keyValue interface{}) (_rst_ *T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		if _err_ != nil && _err_ != ErrNullData {
+			l.Err(_err_)
+		}
+		l.Interface(c.condFieldsLog, condValues).Interface(c.keyFieldsLog, keyValue).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheColumn %s Get", c.TableName())
+	}, ErrNullData)()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return nil, err
+	}
+	field, err := c.checkKeyValuesGenStr([]interface{}{keyValue})
+	if err != nil {
+		return nil, err
+	}
+
+	// 从Redis中读取
+	dest, err := c.redisGet(ctx, key, condValues, field, keyValue)
+	if err != errColumnNoKey {
+		return dest, err
+	}
+
+	// 其他情况不处理执行下面的预加载
+	preData, err := c.preLoadAll(ctx, key, condValues)
+	if err != nil {
+		return nil, err
+	}
+	if preData != nil { // 执行了预加载
+		for _, data := range preData {
+			dataInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
+			if c.fmtKeyValue(c.keyValueOf(dataInfo.Elemts[c.keyFieldsIndex[0]])) == field {
+				return data, nil
+			}
+		}
+		return nil, ErrNullData
+	}
+
+	// 如果不是自己执行的预加载，这里重新读取下
+	dest, err = c.redisGet(ctx, key, condValues, field, keyValue)
+	if err == errColumnNoKey {
+		return nil, ErrNullData
+	}
+	return dest, err
+}
+
+// 设置一条数据的值
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// keyValue：keyField对应的值  value：valueField对应的值
+// ops：选项，noExistCreate数据不存在时创建
+// 返回值：error 数据不存在且不创建时返回ErrNullData
+func (c *CacheColumn[T]) Set(ctx context.Context, condValues []interface{}, keyValue, value interface{}, ops *Options) (_err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Interface(c.keyFieldsLog, keyValue).Interface("value", value).Err(_err_).Msgf("CacheColumn %s Set", c.TableName())
+	})()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return err
+	}
+	field, err := c.checkKeyValuesGenStr([]interface{}{keyValue})
+	if err != nil {
+		return err
+	}
+	err = c.checkFiledValue(c.dataValueFieldIndex, value)
+	if err != nil {
+		return err
+	}
+
+	err = c.setSave(ctx, key, condValues, field, keyValue, value)
+	if err == errColumnNoKey {
+		// 预加载 尝试从数据库中读取
+		_, err = c.preLoadAll(ctx, key, condValues)
+		if err != nil {
+			return err
+		}
+		// 再次写数据
+		err = c.setSave(ctx, key, condValues, field, keyValue, value)
+		if err == errColumnNoKey {
+			err = ErrNullData
+		}
+	}
+	if err == ErrNullData && ops != nil && ops.noExistCreate {
+		return c.add(ctx, key, condValues, field, keyValue, value)
+	}
+	return err
+}
+
+// 增加一条数据的值，valueField必须是数字类型
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// keyValue：keyField对应的值  incr：增加的值
+// ops：选项，noExistCreate数据不存在时创建，值为incr
+// 返回值：是T结构类型的指针，只填充condFields keyField valueField，valueField为增加后的值
+func (c *CacheColumn[T]) Incr(ctx context.Context, condValues []interface{}, keyValue, incr interface{}, ops *Options) (_rst_ *T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Interface(c.keyFieldsLog, keyValue).Interface("incr", incr).Err(_err_).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheColumn %s Incr", c.TableName())
+	})()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return nil, err
+	}
+	field, err := c.checkKeyValuesGenStr([]interface{}{keyValue})
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkFiledValue(c.dataValueFieldIndex, incr)
+	if err != nil {
+		return nil, err
+	}
+	valueKind := reflect.TypeOf(incr).Kind()
+	isFloat := valueKind == reflect.Float32 || valueKind == reflect.Float64
+	if !isFloat && !c.IsNumType(reflect.TypeOf(incr)) {
+		return nil, fmt.Errorf("tag:%s(%s) not num type", c.dataValueField, c.T.String())
+	}
+
+	dest, err := c.incrSave(ctx, key, condValues, field, keyValue, incr, isFloat)
+	if err == errColumnNoKey {
+		// 预加载 尝试从数据库中读取
+		_, err = c.preLoadAll(ctx, key, condValues)
+		if err != nil {
+			return nil, err
+		}
+		// 再次写数据
+		dest, err = c.incrSave(ctx, key, condValues, field, keyValue, incr, isFloat)
+		if err == errColumnNoKey {
+			err = ErrNullData
+		}
+	}
+	if err == ErrNullData && ops != nil && ops.noExistCreate {
+		err = c.add(ctx, key, condValues, field, keyValue, incr)
+		if err != nil {
+			return nil, err
+		}
+		return c.genT(condValues, keyValue, incr), nil
+	}
+	return dest, err
+}
+
+// 只Cache删除数据
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// 返回值：error
+func (c *CacheColumn[T]) DelCache(ctx context.Context, condValues []interface{}) (_err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Err(_err_).Msgf("CacheColumn %s DelCache", c.TableName())
+	})()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return err
+	}
+
+	err = c.redis.Del(ctx, key).Err()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *CacheColumn[T]) setSave(ctx context.Context, key string, condValues []interface{}, field string, keyValue, value interface{}) error {
+	// 加锁
+	unlock, err := c.saveLock(ctx, key)
+	if err != nil {
+		return err
+	}
+	mysqlUnlock := false
+	defer func() {
+		if !mysqlUnlock {
+			unlock()
+		}
+	}()
+
+	cmd := c.redis.DoScript(goredis.CtxNonilErrIgnore(ctx), columnSetScript, []string{key}, c.expire, field, goredis.ValueFmt(reflect.ValueOf(value)))
+	if cmd.Err() == nil {
+		if n, ok := cmd.Val().(int64); ok && n == 0 {
+			return ErrNullData
+		}
+		// 同步mysql，添加上数据key字段
+		mysqlUnlock = true
+		return c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, []interface{}{keyValue}), map[string]interface{}{c.dataValueField: value}, key, c.genDataKey(key, field), func(err error) {
+			defer unlock()
+			if err != nil {
+				c.redis.Del(ctx, key) // mysql错了 要删缓存
+			}
+		})
+	} else {
+		if goredis.IsNilError(cmd.Err()) {
+			return errColumnNoKey
+		}
+		return cmd.Err()
+	}
+}
+
+func (c *CacheColumn[T]) incrSave(ctx context.Context, key string, condValues []interface{}, field string, keyValue, incr interface{}, isFloat bool) (*T, error) {
+	// 加锁
+	unlock, err := c.saveLock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	mysqlUnlock := false
+	defer func() {
+		if !mysqlUnlock {
+			unlock()
+		}
+	}()
+
+	reply := make([]interface{}, 0, 2)
+	err = c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), columnIncrScript, []string{key}, c.expire, field, incr, utils.If(isFloat, 1, 0)).BindSlice(&reply)
+	if err == nil {
+		if len(reply) != 2 {
+			return nil, ErrNullData
+		}
+		value := reflect.New(c.Fields[c.dataValueFieldIndex].Type).Elem()
+		err := goredis.InterfaceToValue(reply[1], value)
+		if err != nil {
+			// redis中的数据和mysql不一致了，删除key返回错误
+			c.redis.Del(ctx, key)
+			return nil, err
+		}
+		// 同步mysql，添加上数据key字段
+		mysqlUnlock = true
+		err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, []interface{}{keyValue}), map[string]interface{}{c.dataValueField: value.Interface()}, key, c.genDataKey(key, field), func(err error) {
+			defer unlock()
+			if err != nil {
+				c.redis.Del(ctx, key) // mysql错了 要删缓存
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return c.genT(condValues, keyValue, value.Interface()), nil
+	} else {
+		if goredis.IsNilError(err) {
+			return nil, errColumnNoKey
+		}
+		return nil, err
+	}
+}
+
+// 添加一条数据
+func (c *CacheColumn[T]) add(ctx context.Context, key string, condValues []interface{}, field string, keyValue, value interface{}) error {
+	// 加锁
+	unlock, err := c.saveLock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = c.addToMySQL(ctx, condValues, map[string]interface{}{c.keyFields[0]: keyValue, c.dataValueField: value})
+	if err != nil {
+		return err
+	}
+	DelPass(key)
+
+	// key存在时才写入，不存在下次读取时会预加载
+	cmd := c.redis.DoScript(ctx, columnAddFieldScript, []string{key}, c.expire, field, goredis.ValueFmt(reflect.ValueOf(value)))
+	if cmd.Err() != nil && !goredis.IsNilError(cmd.Err()) {
+		c.redis.Del(ctx, key) // 失败了，删除键
+	}
+	return nil
+}
+
+// 预加载全部数据，确保写到Redis中 不会返回空错误
+// 返回值
+// []*T： 因为preLoadLock是加锁失败等待，!= nil 表示是本逻辑执行了加载，否则没有执行加载
+// error： 执行结果
+func (c *CacheColumn[T]) preLoadAll(ctx context.Context, key string, condValues []interface{}) ([]*T, error) {
+	// 先判断是否设置了pass
+	if GetPass(key) {
+		return make([]*T, 0), nil
+	}
+	// 加锁
+	unlock, err := c.preLoadLock(ctx, key)
+	if err != nil || unlock == nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c.batchFlushKey(ctx, key) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+
+	cond := NewConds().eqs(c.condFields, condValues)
+	// 加载，只读取keyField和valueField
+	all, err := c.getsFromMySQL(ctx, c.T, []string{c.keyFields[0], c.dataValueField}, cond)
+	if err != nil {
+		return nil, err
+	}
+	allData := all.([]*T)
+
+	// redis参数
+	redisParams := make([]interface{}, 0, 1+2*len(allData))
+	redisParams = append(redisParams, c.expire)
+	for _, data := range allData {
+		dataInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
+		for i, v := range condValues {
+			c.setElem(dataInfo.Elemts[c.condFieldsIndex[i]], v)
+		}
+		vfmt := goredis.ValueFmt(dataInfo.Elemts[c.dataValueFieldIndex])
+		if vfmt == nil {
+			continue // 空的不填充，redis处理空会写成string类型，后续incr会出错
+		}
+		redisParams = append(redisParams, c.fmtKeyValue(c.keyValueOf(dataInfo.Elemts[c.keyFieldsIndex[0]])))
+		redisParams = append(redisParams, vfmt)
+	}
+	if len(redisParams) == 1 {
+		SetPass(key)
+		return allData, nil
+	}
+
+	cmd := c.redis.DoScript(ctx, columnAddScript, []string{key}, redisParams...)
+	if cmd.Err() != nil {
+		c.redis.Del(ctx, key) // 失败了，删除键
+		return nil, cmd.Err()
+	}
+	return allData, nil
+}
+
+func (c *CacheColumn[T]) redisGetAll(ctx context.Context, key string, condValues []interface{}) ([]*T, error) {
+	reply := make([]interface{}, 0)
+	err := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), columnGetAllScript, []string{key}, c.expire).BindSlice(&reply)
+	if err == nil {
+		res := make([]*T, 0, len(reply)/2)
+		for i := 0; i+1 < len(reply); i += 2 {
+			dest := new(T)
+			destInfo, _ := utils.GetStructInfoByStructType(dest, c.StructType) // 这里不用判断err了
+			for i, v := range condValues {
+				c.setElem(destInfo.Elemts[c.condFieldsIndex[i]], v)
+			}
+			err := decodeKeyValue(reply[i], destInfo.Elemts[c.keyFieldsIndex[0]]) // field是编码后的key值
+			if err != nil {
+				return nil, err
+			}
+			err = goredis.InterfaceToValue(reply[i+1], destInfo.Elemts[c.dataValueFieldIndex])
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, dest)
+		}
+		return res, nil
+	} else {
+		if goredis.IsNilError(err) {
+			return nil, ErrNullData
+		}
+		return nil, err
+	}
+}
+
+// 返回值 errColumnNoKey：key不存在 ErrNullData：数据不存在
+func (c *CacheColumn[T]) redisGet(ctx context.Context, key string, condValues []interface{}, field string, keyValue interface{}) (*T, error) {
+	reply := make([]interface{}, 0, 2)
+	err := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), columnGetScript, []string{key}, c.expire, field).BindSlice(&reply)
+	if err == nil {
+		if len(reply) != 2 {
+			return nil, ErrNullData
+		}
+		value := reflect.New(c.Fields[c.dataValueFieldIndex].Type).Elem()
+		err := goredis.InterfaceToValue(reply[1], value)
+		if err != nil {
+			return nil, err
+		}
+		return c.genT(condValues, keyValue, value.Interface()), nil
+	} else {
+		if goredis.IsNilError(err) {
+			return nil, errColumnNoKey
+		}
+		return nil, err
+	}
+}
+
+// 生成T，只填充condFields keyField valueField
+func (c *CacheColumn[T]) genT(condValues []interface{}, keyValue, value interface{}) *T {
+	dest := new(T)
+	destInfo, _ := utils.GetStructInfoByStructType(dest, c.StructType)
+	for i, v := range condValues {
+		c.setElem(destInfo.Elemts[c.condFieldsIndex[i]], v)
+	}
+	c.setElem(destInfo.Elemts[c.keyFieldsIndex[0]], keyValue)
+	c.setElem(destInfo.Elemts[c.dataValueFieldIndex], value)
+	return dest
+}
+
+// 设置结构中的字段值，字段为指针类型时v可以是指针指向的类型
+func (c *CacheColumn[T]) setElem(elem reflect.Value, v interface{}) {
+	if v == nil {
+		return
+	}
+	vo := reflect.ValueOf(v)
+	if vo.Type() == elem.Type() {
+		elem.Set(vo)
+	} else if elem.Kind() == reflect.Pointer && vo.Type() == elem.Type().Elem() {
+		p := reflect.New(vo.Type())
+		p.Elem().Set(vo)
+		elem.Set(p)
+	}
+}
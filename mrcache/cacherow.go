@@ -4,6 +4,7 @@ package mrcache
 
 import (
 	"context"
+	"errors"
 	"gobase/goredis"
 	"gobase/mysql"
 	"gobase/utils"
@@ -93,6 +94,24 @@ func (c *CacheRow[T]) GetFromSQL(ctx context.Context, condValues []interface{})
 
 // redis: 是否从redis加载
 func (c *CacheRow[T]) get(ctx context.Context, key string, condValues []interface{}, redis, proLoad bool) (_rst_ *T, _err_ error) {
+	// 本地缓存
+	local := c.local
+	var localGen uint64
+	if redis && local != nil {
+		v, gen, ok := local.get(key)
+		if ok {
+			dest := *(v.(*T)) // 拷贝一份，防止外部修改
+			return &dest, nil
+		}
+		localGen = gen
+		defer func() {
+			if _err_ == nil && _rst_ != nil {
+				v := *_rst_
+				local.set(key, &v, localGen)
+			}
+		}()
+	}
+
 	if redis {
 		// 从Redis中读取
 		redisParams := make([]interface{}, 0, 1+len(c.Tags))
@@ -217,6 +236,7 @@ func (c *CacheRow[T]) GetsBySQLField(ctx context.Context, condFieldValues map[st
 	}
 
 	// 先读取条件字段所有的值
+	c.Flush(ctx) // 条件不是缓存的key，批量保存时先把缓冲中的数据全部写入，防止读到旧数据
 	t, err := c.getsFromMySQL(ctx, c.T, c.condFields, NewConds().eqs(condFields, condValues))
 	if err != nil {
 		return nil, err
@@ -231,7 +251,7 @@ func (c *CacheRow[T]) GetsBySQLField(ctx context.Context, condFieldValues map[st
 		tInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
 		condValues := make([]interface{}, 0, len(c.condFields))
 		for i := 0; i < len(c.condFields); i++ {
-			condValues = append(condValues, goredis.ValueFmt(tInfo.Elemts[c.condFieldsIndex[i]]))
+			condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
 		}
 		condValuess = append(condValuess, condValues)
 	}
@@ -445,6 +465,7 @@ func (c *CacheRow[T]) Del(ctx context.Context, condValues []interface{}) (_err_
 	}
 
 	cmd := c.redis.Del(ctx, key) // 删缓存
+	c.localDel(ctx, key)
 	if cmd.Err() != nil {
 		return cmd.Err()
 	}
@@ -453,10 +474,11 @@ func (c *CacheRow[T]) Del(ctx context.Context, condValues []interface{}) (_err_
 		return nil
 	}
 
-	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues)) // 删mysql
+	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues), key) // 删mysql
 	if err != nil {
 		return err
 	}
+	c.emitEvent(ctx, &ChangeEvent{Op: EventDel, CondValues: condValues})
 
 	// 删除后 标记下数据pass
 	SetPass(key)
@@ -486,6 +508,7 @@ func (c *CacheRow[T]) Dels(ctx context.Context, condValuess ...[]interface{}) (_
 	}
 
 	cmd := c.redis.Del(ctx, keys...) // 删缓存
+	c.localDel(ctx, keys...)
 	if cmd.Err() != nil {
 		return cmd.Err()
 	}
@@ -494,10 +517,13 @@ func (c *CacheRow[T]) Dels(ctx context.Context, condValuess ...[]interface{}) (_
 		return nil
 	}
 
-	err := c.delToMySQL(ctx, NewConds().Ins(c.condFields, condValuess...)) // 删mysql
+	err := c.delToMySQL(ctx, NewConds().Ins(c.condFields, condValuess...), keys...) // 删mysql
 	if err != nil {
 		return err
 	}
+	for _, condValues := range condValuess {
+		c.emitEvent(ctx, &ChangeEvent{Op: EventDel, CondValues: condValues})
+	}
 
 	// 删除后 标记下数据pass
 	for _, key := range keys {
@@ -526,6 +552,7 @@ func (c *CacheRow[T]) DelsBySQLField(ctx context.Context, condFieldValues map[st
 	cond := NewConds().eqs(condFields, condValues)
 
 	// 先读取条件字段所有的值
+	c.Flush(ctx) // 条件不是缓存的key，批量保存时先把缓冲中的数据全部写入，防止读到旧数据
 	t, err := c.getsFromMySQL(ctx, c.T, c.condFields, cond)
 	if err != nil {
 		return err
@@ -536,23 +563,29 @@ func (c *CacheRow[T]) DelsBySQLField(ctx context.Context, condFieldValues map[st
 	}
 
 	var keys []string
+	var condValuess [][]interface{}
 	for _, data := range datas {
 		tInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
 		condValues := make([]interface{}, 0, len(c.condFields))
 		for i := 0; i < len(c.condFields); i++ {
-			condValues = append(condValues, goredis.ValueFmt(tInfo.Elemts[c.condFieldsIndex[i]]))
+			condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
 		}
 		keys = append(keys, c.genCondValuesKey(condValues))
+		condValuess = append(condValuess, condValues)
 	}
 
 	cmd := c.redis.Del(ctx, keys...) // 删缓存
+	c.localDel(ctx, keys...)
 	if cmd.Err() != nil {
 		return cmd.Err()
 	}
-	err = c.delToMySQL(ctx, cond) // 删mysql
+	err = c.delToMySQL(ctx, cond, keys...) // 删mysql
 	if err != nil {
 		return err
 	}
+	for _, condValues := range condValuess {
+		c.emitEvent(ctx, &ChangeEvent{Op: EventDel, CondValues: condValues})
+	}
 	return nil
 }
 
@@ -571,6 +604,7 @@ func (c *CacheRow[T]) DelCache(ctx context.Context, condValues []interface{}) (_
 	}
 
 	cmd := c.redis.Del(ctx, key) // 删缓存
+	c.localDel(ctx, key)
 	if cmd.Err() != nil {
 		return cmd.Err()
 	}
@@ -597,6 +631,7 @@ func (c *CacheRow[T]) DelsCache(ctx context.Context, condValuess ...[]interface{
 	}
 
 	cmd := c.redis.Del(ctx, keys...) // 删缓存
+	c.localDel(ctx, keys...)
 	if cmd.Err() != nil {
 		return cmd.Err()
 	}
@@ -621,6 +656,7 @@ func (c *CacheRow[T]) DelsCacheBySQLField(ctx context.Context, condFieldValues m
 	}
 
 	// 先读取条件字段所有的值
+	c.Flush(ctx) // 条件不是缓存的key，批量保存时先把缓冲中的数据全部写入，防止读到旧数据
 	t, err := c.getsFromMySQL(ctx, c.T, c.condFields, NewConds().eqs(condFields, condValues))
 	if err != nil {
 		return err
@@ -635,12 +671,13 @@ func (c *CacheRow[T]) DelsCacheBySQLField(ctx context.Context, condFieldValues m
 		tInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
 		condValues := make([]interface{}, 0, len(c.condFields))
 		for i := 0; i < len(c.condFields); i++ {
-			condValues = append(condValues, goredis.ValueFmt(tInfo.Elemts[c.condFieldsIndex[i]]))
+			condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
 		}
 		keys = append(keys, c.genCondValuesKey(condValues))
 	}
 
 	cmd := c.redis.Del(ctx, keys...) // 删缓存
+	c.localDel(ctx, keys...)
 	if cmd.Err() != nil {
 		return cmd.Err()
 	}
@@ -685,6 +722,11 @@ func (c *CacheRow[T]) set(ctx context.Context, condValues []interface{}, data ma
 	if err != nil {
 		return nil, nil, err
 	}
+	// 修改条件
+	ctx, ops, err = c.guardOptions(ctx, ops)
+	if err != nil {
+		return nil, nil, err
+	}
 	nr := ops != nil && ops.noResp
 
 	var dest *T
@@ -742,15 +784,25 @@ func (c *CacheRow[T]) setSave(ctx context.Context, key string, condValues []inte
 	}()
 
 	// redis参数
-	redisParams := c.redisSetParam("null", data)
+	redisParams := c.redisSetParam(ctx, "null", data)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowModifyScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
+		c.localDel(ctx, key)
+		// 开启版本号时，脚本返回新的版本号
+		var ver *int64
+		if len(c.versionField) > 0 {
+			ver = new(int64)
+			cmd.Bind(ver)
+		}
 		// 同步mysql
 		mysqlUnlock = true
-		err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), data, key, func(err error) {
+		err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), c.versionData(data, ver), key, key, func(err error) {
 			defer unlock()
 			if err != nil {
 				c.redis.Del(ctx, key) // mysql错了 要删缓存
+				c.localDel(ctx, key)
+			} else {
+				c.emitEvent(ctx, &ChangeEvent{Op: EventModify, CondValues: condValues, KeyValues: nil, New: c.versionData(data, ver)})
 			}
 		})
 		if err != nil {
@@ -761,7 +813,7 @@ func (c *CacheRow[T]) setSave(ctx context.Context, key string, condValues []inte
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return ErrNullData
 		}
-		return cmd.Cmd.Err()
+		return c.scriptError(cmd.Cmd.Err())
 	}
 }
 
@@ -780,19 +832,24 @@ func (c *CacheRow[T]) setGetTSave(ctx context.Context, key string, condValues []
 	}()
 
 	// redis参数
-	redisParams := c.redisSetGetParam("null", c.Tags, data, false)
+	redisParams := c.redisSetGetParam(ctx, "null", c.Tags, data, false)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowModifyGetScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
+		c.localDel(ctx, key)
 		dest := new(T)
 		destInfo, _ := utils.GetStructInfoByStructType(dest, c.StructType)
-		err := cmd.BindValues(destInfo.Elemts)
+		values, ver := c.versionBind(destInfo.Elemts)
+		err := cmd.BindValues(values)
 		if err == nil {
 			// 同步mysql
 			mysqlUnlock = true
-			err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), data, key, func(err error) {
+			err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), c.versionData(data, ver), key, key, func(err error) {
 				defer unlock()
 				if err != nil {
 					c.redis.Del(ctx, key) // mysql错了 要删缓存
+					c.localDel(ctx, key)
+				} else {
+					c.emitEvent(ctx, &ChangeEvent{Op: EventModify, CondValues: condValues, KeyValues: nil, New: c.versionData(data, ver)})
 				}
 			})
 			if err != nil {
@@ -802,13 +859,50 @@ func (c *CacheRow[T]) setGetTSave(ctx context.Context, key string, condValues []
 		} else {
 			// 绑定失败 redis中的数据和mysql不一致了，删除key返回错误
 			c.redis.Del(ctx, key)
+			c.localDel(ctx, key)
 			return nil, err
 		}
 	} else {
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return nil, ErrNullData
 		}
-		return nil, cmd.Cmd.Err()
+		return nil, c.scriptError(cmd.Cmd.Err())
+	}
+}
+
+// 写数据，版本号一致时才修改，修改后版本号自增1，需要先调用ConfigVersion
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// data：修改内容 和Set一致
+// version：期望的版本号，Redis或者mysql中的版本号不一致时返回ErrVersion
+// ops：Create无效，数据不存在返回ErrNullData
+// 返回值
+// _rst_ ： 是T结构类型的指针，修改后的值，设置ops.NoResp()时不返回值 优化性能
+// _err_ ： 操作失败
+func (c *CacheRow[T]) SetIfVersion(ctx context.Context, condValues []interface{}, data interface{}, version int64, ops *Options) (_rst_ *T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Int64("version", version).Err(_err_).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRow %s SetIfVersion", c.TableName())
+	})()
+
+	if len(c.versionField) == 0 {
+		return nil, errors.New("version not config")
+	}
+	ctx = context.WithValue(ctx, ctxKey_version, version)
+	if dataM, ok := data.(map[string]interface{}); ok {
+		// 检查data数据
+		err := c.checkMapData(dataM)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.set(ctx, condValues, dataM, ops.withoutCreate())
+		return rst, err
+	} else {
+		// 检查data数据
+		dataInfo, err := c.checkStructData(data)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.set(ctx, condValues, dataInfo.TagElemsMap(), ops.withoutCreate())
+		return rst, err
 	}
 }
 
@@ -850,6 +944,11 @@ func (c *CacheRow[T]) modify(ctx context.Context, condValues []interface{}, data
 	if err != nil {
 		return nil, nil, err
 	}
+	// 修改条件
+	ctx, ops, err = c.guardOptions(ctx, ops)
+	if err != nil {
+		return nil, nil, err
+	}
 	nr := ops != nil && ops.noResp
 
 	// 按c.Tags的顺序构造 有顺序
@@ -903,6 +1002,42 @@ func (c *CacheRow[T]) modify(ctx context.Context, condValues []interface{}, data
 	}
 }
 
+// 增量修改数据，版本号一致时才修改，修改后版本号自增1，需要先调用ConfigVersion
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// data：修改内容 和Modify一致
+// version：期望的版本号，Redis或者mysql中的版本号不一致时返回ErrVersion
+// ops：Create无效，数据不存在返回ErrNullData
+// 返回值
+// _rst_ ： 是T结构类型的指针，修改后的值，设置ops.NoResp()时不返回值 优化性能
+// _err_ ： 操作失败
+func (c *CacheRow[T]) ModifyIfVersion(ctx context.Context, condValues []interface{}, data interface{}, version int64, ops *Options) (_rst_ *T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Int64("version", version).Err(_err_).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRow %s ModifyIfVersion", c.TableName())
+	})()
+
+	if len(c.versionField) == 0 {
+		return nil, errors.New("version not config")
+	}
+	ctx = context.WithValue(ctx, ctxKey_version, version)
+	if dataM, ok := data.(map[string]interface{}); ok {
+		// 检查data数据
+		err := c.checkMapData(dataM)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.modify(ctx, condValues, dataM, ops.withoutCreate())
+		return rst, err
+	} else {
+		// 检查data数据
+		dataInfo, err := c.checkStructData(data)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.modify(ctx, condValues, dataInfo.TagElemsMap(), ops.withoutCreate())
+		return rst, err
+	}
+}
+
 // 增量修改数据 返回的类型和data一致，填充修改后的值
 // condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
 // data：修改内容
@@ -985,6 +1120,11 @@ func (c *CacheRow[T]) modify2(ctx context.Context, condValues []interface{}, dat
 	if err != nil {
 		return nil, err
 	}
+	// 修改条件
+	ctx, ops, err = c.guardOptions(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
 
 	// 写数据
 	err = c.modifyGetSave(ctx, key, condValues, modifydata)
@@ -1033,17 +1173,22 @@ func (c *CacheRow[T]) modifyGetSave(ctx context.Context, key string, condValues
 	}()
 
 	// redis参数
-	redisParams := c.redisSetGetParam("null", modifydata.tags, modifydata.data, true)
+	redisParams := c.redisSetGetParam(ctx, "null", modifydata.tags, modifydata.data, true)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowModifyGetScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
-		err := cmd.BindValues(modifydata.rsts)
+		c.localDel(ctx, key)
+		values, ver := c.versionBind(modifydata.rsts)
+		err := cmd.BindValues(values)
 		if err == nil {
 			// 同步mysql
 			mysqlUnlock = true
-			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), modifydata.TagsRstsMap(), key, func(err error) {
+			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), c.versionData(modifydata.TagsRstsMap(), ver), key, key, func(err error) {
 				defer unlock()
 				if err != nil {
 					c.redis.Del(ctx, key) // mysql错了 要删缓存
+					c.localDel(ctx, key)
+				} else {
+					c.emitModifyEvent(ctx, condValues, nil, modifydata, ver)
 				}
 			})
 			if err != nil {
@@ -1053,13 +1198,14 @@ func (c *CacheRow[T]) modifyGetSave(ctx context.Context, key string, condValues
 		} else {
 			// 绑定失败 redis中的数据和mysql不一致了，删除key返回错误
 			c.redis.Del(ctx, key)
+			c.localDel(ctx, key)
 			return err
 		}
 	} else {
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return ErrNullData
 		}
-		return cmd.Cmd.Err()
+		return c.scriptError(cmd.Cmd.Err())
 	}
 }
 
@@ -1079,20 +1225,25 @@ func (c *CacheRow[T]) modifyGetTSave(ctx context.Context, key string, condValues
 	}()
 
 	// redis参数
-	redisParams := c.redisSetGetParam("null", c.Tags, modifydata.data, true)
+	redisParams := c.redisSetGetParam(ctx, "null", c.Tags, modifydata.data, true)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowModifyGetScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
+		c.localDel(ctx, key)
 		dest := new(T)
 		destInfo, _ := utils.GetStructInfoByStructType(dest, c.StructType)
-		err := cmd.BindValues(destInfo.Elemts)
+		values, ver := c.versionBind(destInfo.Elemts)
+		err := cmd.BindValues(values)
 		if err == nil {
 			// 同步mysql，把T结构的值 拷贝到新创建的resInfo中再保存，否则会保存整个T结构
 			modifydata.RstsFrom(destInfo)
 			mysqlUnlock = true
-			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), modifydata.TagsRstsMap(), key, func(err error) {
+			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues), c.versionData(modifydata.TagsRstsMap(), ver), key, key, func(err error) {
 				defer unlock()
 				if err != nil {
 					c.redis.Del(ctx, key) // mysql错了 要删缓存
+					c.localDel(ctx, key)
+				} else {
+					c.emitModifyEvent(ctx, condValues, nil, modifydata, ver)
 				}
 			})
 			if err != nil {
@@ -1102,13 +1253,14 @@ func (c *CacheRow[T]) modifyGetTSave(ctx context.Context, key string, condValues
 		} else {
 			// 绑定失败 redis中的数据和mysql不一致了，删除key返回错误
 			c.redis.Del(ctx, key)
+			c.localDel(ctx, key)
 			return nil, err
 		}
 	} else {
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return nil, ErrNullData
 		}
-		return nil, cmd.Cmd.Err()
+		return nil, c.scriptError(cmd.Cmd.Err())
 	}
 }
 
@@ -1126,6 +1278,8 @@ func (c *CacheRow[T]) preLoad(ctx context.Context, key string, condValues []inte
 	}
 	defer unlock()
 
+	c.batchFlushKey(ctx, key) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+
 	var incrValue interface{}
 	cond := NewConds().eqs(c.condFields, condValues)
 
@@ -1187,9 +1341,12 @@ func (c *CacheRow[T]) preLoads(ctx context.Context, condValuess map[string][]int
 	}
 
 	condValuess2 := make([][]interface{}, 0, len(queryCondValuess))
-	for _, v := range queryCondValuess {
+	keys := make([]string, 0, len(queryCondValuess))
+	for k, v := range queryCondValuess {
 		condValuess2 = append(condValuess2, v)
+		keys = append(keys, k)
 	}
+	c.batchFlushKey(ctx, keys...) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
 	t, err := c.getsFromMySQL(ctx, c.T, c.Tags, NewConds().Ins(c.condFields, condValuess2...))
 	if err != nil {
 		return nil, err
@@ -1202,7 +1359,7 @@ func (c *CacheRow[T]) preLoads(ctx context.Context, condValuess map[string][]int
 		tInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
 		condValues := make([]interface{}, 0, len(c.condFields))
 		for i := 0; i < len(c.condFields); i++ {
-			condValues = append(condValues, goredis.ValueFmt(tInfo.Elemts[c.condFieldsIndex[i]]))
+			condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
 		}
 		key := c.genCondValuesKey(condValues)
 
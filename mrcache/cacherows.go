@@ -11,7 +11,9 @@ import (
 	"gobase/mysql"
 	"gobase/utils"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -22,6 +24,7 @@ import (
 // 索引key：存储所有的keyValuesStr，set结构
 // keyValuesStr: keyValues格式化的字符串值，多个keyValue用:连接
 // dataKey：存储一条mysql数据，存储方式和CacheRow一样，dataKey命名：key_keyValuesStr
+// 排序索引：GetPage和GetRange使用，每个排序字段一个zset，命名：key#z#field，已建立排序索引的字段记录在key#z中，条件值中不能有#
 // 使用数据时，都判断数据是否存在，不存在就尝试加载下，加载时判断是否设置了pass，防止击穿到mysql
 type CacheRows[T any] struct {
 	*Cache
@@ -47,8 +50,8 @@ func NewCacheRows[T any](redis *goredis.Redis, mysql *mysql.MySQL, tableName str
 			err := fmt.Errorf("tag:%s not find in %s", f, cache.T.String())
 			return nil, err
 		}
-		// 只能是基本的数据int 和 string 类型
-		if !cache.IsBaseType(cache.Fields[idx].Type) {
+		// 只能是基本的数据int 和 string 类型，或者注册了编码的类型
+		if !cache.IsBaseType(cache.Fields[idx].Type) && getKeyCodec(cache.Fields[idx].Type) == nil {
 			err := fmt.Errorf("tag:%s(%s) as keyFields type error", f, cache.T.String())
 			return nil, err
 		}
@@ -65,6 +68,16 @@ func NewCacheRows[T any](redis *goredis.Redis, mysql *mysql.MySQL, tableName str
 	return c, nil
 }
 
+// 配置数据数量上限，添加数据时超过上限返回ErrMaxRows，0表示不限制
+// 上限检查在Redis中原子执行，添加前先在索引中占用位置
+func (c *CacheRows[T]) ConfigMaxRows(maxRows int) error {
+	if maxRows < 0 {
+		return errors.New("maxRows invalid")
+	}
+	c.maxRows = maxRows
+	return nil
+}
+
 // dataKey是有 索引key和keyValuesStr组合成的
 func (c *CacheRows[T]) genDataKey(key, keyValuesStr string) string {
 	return key + "_" + keyValuesStr
@@ -254,6 +267,194 @@ func (c *CacheRows[T]) GetAllMultiFromRedis(ctx context.Context, condValuess ...
 	return res, nil
 }
 
+// 分页读取符合condValues的数据
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// orderField：排序字段，只能是数字或者时间类型，后面添加 DESC 表示倒序，如 "create_time DESC"
+// offset limit：读取的位置和数量
+// Redis中为每个排序字段维护一个zset排序索引，第一次读取时建立，缓存不完整时直接从MySQL中ORDER BY LIMIT读取
+// 返回值：是T结构类型的指针列表
+func (c *CacheRows[T]) GetPage(ctx context.Context, condValues []interface{}, orderField string, offset, limit int) (_rst_ []*T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Str("order", orderField).Int("offset", offset).Int("limit", limit).Err(_err_).Array("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRows %s GetPage", c.TableName())
+	})()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return nil, err
+	}
+	// 检查排序字段
+	field, desc, err := c.checkOrderField(orderField)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || limit <= 0 {
+		return nil, errors.New("offset or limit invalid")
+	}
+
+	// 从Redis中读取
+	dest, err := c.redisSortGet(ctx, key, field, desc, "page", offset, limit)
+	if err == nil {
+		return dest, nil
+	} else if err != ErrNullData {
+		return nil, err
+	}
+
+	// 缓存中没有或者不完整，直接从MySQL中读取，同时后台加载全部数据到缓存中
+	if GetPass(key) {
+		return make([]*T, 0), nil
+	}
+	utils.Submit(func() {
+		c.preLoadAll(context.TODO(), key, condValues)
+	})
+	c.batchFlushKey(ctx, key) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+	all, err := c.getsFromMySQLOrder(ctx, c.T, c.Tags, NewConds().eqs(c.condFields, condValues), c.fmtOrderBy(field, desc), offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return all.([]*T), nil
+}
+
+// 读取field值在[min,max]范围内的数据，按field升序排列
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// field：范围字段，只能是数字或者时间类型，和GetPage共用排序索引
+// min max：范围值，类型和field对应的类型一致
+// 返回值：是T结构类型的指针列表
+func (c *CacheRows[T]) GetRange(ctx context.Context, condValues []interface{}, field string, min, max interface{}) (_rst_ []*T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Str("field", field).Interface("min", min).Interface("max", max).Err(_err_).Array("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRows %s GetRange", c.TableName())
+	})()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return nil, err
+	}
+	// 检查排序字段
+	field, _, err = c.checkOrderField(field)
+	if err != nil {
+		return nil, err
+	}
+	at := c.FindIndexByTag(field)
+	if err := c.checkFiledValue(at, min); err != nil {
+		return nil, err
+	}
+	if err := c.checkFiledValue(at, max); err != nil {
+		return nil, err
+	}
+
+	// 从Redis中读取
+	dest, err := c.redisSortGet(ctx, key, field, false, "range", goredis.ValueFmt(reflect.ValueOf(min)), goredis.ValueFmt(reflect.ValueOf(max)))
+	if err == nil {
+		return dest, nil
+	} else if err != ErrNullData {
+		return nil, err
+	}
+
+	// 缓存中没有或者不完整，直接从MySQL中读取，同时后台加载全部数据到缓存中
+	if GetPass(key) {
+		return make([]*T, 0), nil
+	}
+	utils.Submit(func() {
+		c.preLoadAll(context.TODO(), key, condValues)
+	})
+	c.batchFlushKey(ctx, key) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+	all, err := c.getsFromMySQLOrder(ctx, c.T, c.Tags, NewConds().eqs(c.condFields, condValues).Ge(field, min).Le(field, max), c.fmtOrderBy(field, false), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return all.([]*T), nil
+}
+
+// 检查排序字段，返回字段名和是否倒序
+func (c *CacheRows[T]) checkOrderField(orderField string) (string, bool, error) {
+	strs := strings.Fields(orderField)
+	if len(strs) == 0 || len(strs) > 2 {
+		return "", false, fmt.Errorf("orderField:%s invalid", orderField)
+	}
+	desc := false
+	if len(strs) == 2 {
+		switch strings.ToUpper(strs[1]) {
+		case "ASC":
+		case "DESC":
+			desc = true
+		default:
+			return "", false, fmt.Errorf("orderField:%s invalid", orderField)
+		}
+	}
+	at := c.FindIndexByTag(strs[0])
+	if at == -1 {
+		return "", false, fmt.Errorf("tag:%s not find in %s", strs[0], c.T.String())
+	}
+	tp := c.Fields[at].Type
+	if tp.Kind() == reflect.Pointer {
+		tp = tp.Elem()
+	}
+	if !c.IsNumType(tp) && tp.Kind() != reflect.Float32 && tp.Kind() != reflect.Float64 && tp != reflect.TypeOf(time.Time{}) {
+		return "", false, fmt.Errorf("tag:%s(%s) as orderField type error", strs[0], c.T.String())
+	}
+	return strs[0], desc, nil
+}
+
+// MySQL的排序语句，添加上keyFields保证顺序稳定
+func (c *CacheRows[T]) fmtOrderBy(field string, desc bool) string {
+	var orderBy strings.Builder
+	orderBy.WriteString(field)
+	if desc {
+		orderBy.WriteString(" DESC")
+	}
+	for _, tag := range c.keyFields {
+		orderBy.WriteString("," + tag)
+		if desc {
+			orderBy.WriteString(" DESC")
+		}
+	}
+	return orderBy.String()
+}
+
+// 读取符合condValues的数据数量
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// 数量就是Redis中索引key的元素个数，缓存中没有时只加载索引
+func (c *CacheRows[T]) Count(ctx context.Context, condValues []interface{}) (_rst_ int, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Err(_err_).Int("rst", _rst_).Msgf("CacheRows %s Count", c.TableName())
+	})()
+
+	// 检查条件变量
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		return 0, err
+	}
+
+	// 从Redis中读取
+	var count int
+	err = c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsCountScript, []string{key}, c.expire).Bind(&count)
+	if err == nil {
+		return count, nil
+	} else if !goredis.IsNilError(err) {
+		return 0, err
+	}
+
+	// 只加载索引
+	n, err := c.preLoadIndex(ctx, key, condValues)
+	if err != nil {
+		return 0, err
+	}
+	if n >= 0 { // 执行了预加载
+		return n, nil
+	}
+
+	// 如果不是自己执行的预加载，这里重新读取下
+	err = c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsCountScript, []string{key}, c.expire).Bind(&count)
+	if err == nil {
+		return count, nil
+	} else if goredis.IsNilError(err) {
+		return 0, nil
+	} else {
+		return 0, err
+	}
+}
+
 // 读取符合condValues的部分数据
 // condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
 // dataKeyValues 填充dataKeyField类型的值，要查询的值
@@ -405,6 +606,7 @@ func (c *CacheRows[T]) GetBySQLField(ctx context.Context, condFieldValues map[st
 
 	// 先读取条件字段和key字段所有的值
 	fields := append(c.condFields, c.keyFields...)
+	c.Flush(ctx) // 条件不是缓存的key，批量保存时先把缓冲中的数据全部写入，防止读到旧数据
 	t, err := c.getFromMySQL(ctx, c.T, fields, NewConds().eqs(condFields, condValues))
 	if err != nil {
 		return nil, err
@@ -415,11 +617,11 @@ func (c *CacheRows[T]) GetBySQLField(ctx context.Context, condFieldValues map[st
 	tInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
 	condValues_ := make([]interface{}, 0, len(c.condFields))
 	for i := 0; i < len(c.condFields); i++ {
-		condValues_ = append(condValues_, goredis.ValueFmt(tInfo.Elemts[c.condFieldsIndex[i]]))
+		condValues_ = append(condValues_, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
 	}
 	keyValues_ := make([]interface{}, 0, len(c.keyFields))
 	for i := 0; i < len(c.keyFields); i++ {
-		keyValues_ = append(keyValues_, goredis.ValueFmt(tInfo.Elemts[c.keyFieldsIndex[i]]))
+		keyValues_ = append(keyValues_, c.keyValueOf(tInfo.Elemts[c.keyFieldsIndex[i]]))
 	}
 
 	// 检查条件变量
@@ -543,7 +745,7 @@ func (c *CacheRows[T]) add(ctx context.Context, condValues []interface{}, data m
 		return nil, nil, err
 	}
 
-	incrValue, err := c.addToMySQL(ctx, condValues, data)
+	incrValue, err := c.addRowToMySQL(ctx, key, condValues, keyValuesStr, data)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -588,10 +790,11 @@ func (c *CacheRows[T]) DelAll(ctx context.Context, condValues []interface{}) (_e
 		return nil
 	}
 
-	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues)) // 删mysql
+	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues), key) // 删mysql
 	if err != nil {
 		return err
 	}
+	c.emitEvent(ctx, &ChangeEvent{Op: EventDel, CondValues: condValues})
 
 	// 删除后 标记下数据pass
 	SetPass(key)
@@ -628,10 +831,11 @@ func (c *CacheRows[T]) Del(ctx context.Context, condValues []interface{}, keyVal
 		return nil
 	}
 
-	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues)) // 删mysql
+	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), dataKey) // 删mysql
 	if err != nil {
 		return err
 	}
+	c.emitEvent(ctx, &ChangeEvent{Op: EventDel, CondValues: condValues, KeyValues: keyValues})
 
 	// 删除后 标记下数据pass
 	SetPass(dataKey)
@@ -677,10 +881,13 @@ func (c *CacheRows[T]) Dels(ctx context.Context, condValues []interface{}, keyVa
 		return nil
 	}
 
-	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues).Ins(c.keyFields, keyValuess...)) // 删mysql
+	err = c.delToMySQL(ctx, NewConds().eqs(c.condFields, condValues).Ins(c.keyFields, keyValuess...), dataKeys...) // 删mysql
 	if err != nil {
 		return err
 	}
+	for _, keyValues := range keyValuess {
+		c.emitEvent(ctx, &ChangeEvent{Op: EventDel, CondValues: condValues, KeyValues: keyValues})
+	}
 
 	// 删除后 标记下数据pass
 	for _, key := range dataKeys {
@@ -776,6 +983,11 @@ func (c *CacheRows[T]) set(ctx context.Context, condValues []interface{}, data m
 	if err != nil {
 		return nil, nil, err
 	}
+	// 修改条件
+	ctx, ops, err = c.guardOptions(ctx, ops)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// 判断data中是否含有keyFields字段
 	keyValuesStr, keyValues, err := c.checkKeyValuesGenStrByMap(data)
@@ -835,15 +1047,23 @@ func (c *CacheRows[T]) setSave(ctx context.Context, key string, condValues []int
 	}()
 
 	// 获取Redis参数
-	redisParams := c.redisSetParam(keyValuesStr, data)
+	redisParams := c.redisSetParam(ctx, keyValuesStr, data)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsModifyScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
+		// 开启版本号时，脚本返回新的版本号
+		var ver *int64
+		if len(c.versionField) > 0 {
+			ver = new(int64)
+			cmd.Bind(ver)
+		}
 		// 同步mysql，添加上数据key字段
 		mysqlUnlock = true
-		err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), data, key, func(err error) {
+		err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), c.versionData(data, ver), key, c.genDataKey(key, keyValuesStr), func(err error) {
 			defer unlock()
 			if err != nil {
 				c.redis.Del(ctx, c.genDataKey(key, keyValuesStr)) // mysql错了 删除数据键
+			} else {
+				c.emitEvent(ctx, &ChangeEvent{Op: EventModify, CondValues: condValues, KeyValues: keyValues, New: c.versionData(data, ver)})
 			}
 		})
 		if err != nil {
@@ -854,7 +1074,7 @@ func (c *CacheRows[T]) setSave(ctx context.Context, key string, condValues []int
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return ErrNullData
 		}
-		return cmd.Cmd.Err()
+		return c.scriptError(cmd.Cmd.Err())
 	}
 }
 
@@ -873,19 +1093,22 @@ func (c *CacheRows[T]) setGetTSave(ctx context.Context, key string, condValues [
 	}()
 
 	// 获取Redis参数
-	redisParams := c.redisSetGetParam(keyValuesStr, c.Tags, data, false)
+	redisParams := c.redisSetGetParam(ctx, keyValuesStr, c.Tags, data, false)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsModifyGetScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
 		dest := new(T)
 		destInfo, _ := utils.GetStructInfoByStructType(dest, c.StructType)
-		err := cmd.BindValues(destInfo.Elemts)
+		values, ver := c.versionBind(destInfo.Elemts)
+		err := cmd.BindValues(values)
 		if err == nil {
 			// 同步mysql，添加上数据key字段
 			mysqlUnlock = true
-			err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), data, key, func(err error) {
+			err := c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), c.versionData(data, ver), key, c.genDataKey(key, keyValuesStr), func(err error) {
 				defer unlock()
 				if err != nil {
 					c.redis.Del(ctx, c.genDataKey(key, keyValuesStr)) // mysql错了 删除数据键
+				} else {
+					c.emitEvent(ctx, &ChangeEvent{Op: EventModify, CondValues: condValues, KeyValues: keyValues, New: c.versionData(data, ver)})
 				}
 			})
 			if err != nil {
@@ -901,7 +1124,43 @@ func (c *CacheRows[T]) setGetTSave(ctx context.Context, key string, condValues [
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return nil, ErrNullData
 		}
-		return nil, cmd.Cmd.Err()
+		return nil, c.scriptError(cmd.Cmd.Err())
+	}
+}
+
+// 写数据，版本号一致时才修改，修改后版本号自增1，需要先调用ConfigVersion
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// data：修改内容 和Set一致，内部必须要有keyFields字段
+// version：期望的版本号，Redis或者mysql中的版本号不一致时返回ErrVersion
+// ops：Create无效，数据不存在返回ErrNullData
+// 返回值
+// _rst_ ： 是T结构类型的指针，修改后的值，设置ops.NoResp()时不返回值 优化性能
+// _err_ ： 操作失败
+func (c *CacheRows[T]) SetIfVersion(ctx context.Context, condValues []interface{}, data interface{}, version int64, ops *Options) (_rst_ *T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Interface("data", data).Int64("version", version).Err(_err_).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRows %s SetIfVersion", c.TableName())
+	})()
+
+	if len(c.versionField) == 0 {
+		return nil, errors.New("version not config")
+	}
+	ctx = context.WithValue(ctx, ctxKey_version, version)
+	if dataM, ok := data.(map[string]interface{}); ok {
+		// 检查data数据
+		err := c.checkMapData(dataM)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.set(ctx, condValues, dataM, ops.withoutCreate())
+		return rst, err
+	} else {
+		// 检查data数据
+		dataInfo, err := c.checkStructData(data)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.set(ctx, condValues, dataInfo.TagElemsMap(), ops.withoutCreate())
+		return rst, err
 	}
 }
 
@@ -943,6 +1202,11 @@ func (c *CacheRows[T]) modify(ctx context.Context, condValues []interface{}, dat
 	if err != nil {
 		return nil, nil, err
 	}
+	// 修改条件
+	ctx, ops, err = c.guardOptions(ctx, ops)
+	if err != nil {
+		return nil, nil, err
+	}
 	// 判断data中是否含有keyFields字段
 	keyValuesStr, keyValues, err := c.checkKeyValuesGenStrByMap(data)
 	if err != nil {
@@ -1001,6 +1265,42 @@ func (c *CacheRows[T]) modify(ctx context.Context, condValues []interface{}, dat
 	}
 }
 
+// 增量修改数据，版本号一致时才修改，修改后版本号自增1，需要先调用ConfigVersion
+// condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
+// data：修改内容 和Modify一致，内部必须要有keyFields字段
+// version：期望的版本号，Redis或者mysql中的版本号不一致时返回ErrVersion
+// ops：Create无效，数据不存在返回ErrNullData
+// 返回值
+// _rst_ ： 是T结构类型的指针，修改后的值，设置ops.NoResp()时不返回值 优化性能
+// _err_ ： 操作失败
+func (c *CacheRows[T]) ModifyIfVersion(ctx context.Context, condValues []interface{}, data interface{}, version int64, ops *Options) (_rst_ *T, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Interface(c.condFieldsLog, condValues).Interface("data", data).Int64("version", version).Err(_err_).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRows %s ModifyIfVersion", c.TableName())
+	})()
+
+	if len(c.versionField) == 0 {
+		return nil, errors.New("version not config")
+	}
+	ctx = context.WithValue(ctx, ctxKey_version, version)
+	if dataM, ok := data.(map[string]interface{}); ok {
+		// 检查data数据
+		err := c.checkMapData(dataM)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.modify(ctx, condValues, dataM, ops.withoutCreate())
+		return rst, err
+	} else {
+		// 检查data数据
+		dataInfo, err := c.checkStructData(data)
+		if err != nil {
+			return nil, err
+		}
+		rst, _, err := c.modify(ctx, condValues, dataInfo.TagElemsMap(), ops.withoutCreate())
+		return rst, err
+	}
+}
+
 // 增量修改数据 返回的类型和data一致，填充修改后的值
 // condValues：查询条件变量 condFields对应的值 顺序和对应的类型要一致
 // data：修改内容
@@ -1083,6 +1383,11 @@ func (c *CacheRows[T]) modify2(ctx context.Context, condValues []interface{}, da
 	if err != nil {
 		return nil, err
 	}
+	// 修改条件
+	ctx, ops, err = c.guardOptions(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
 
 	// 判断data中是否含有keyFields字段
 	keyValuesStr, keyValues, err := c.checkKeyValuesGenStrByMap(data)
@@ -1137,17 +1442,20 @@ func (c *CacheRows[T]) modifyGetSave(ctx context.Context, key string, condValues
 	}()
 
 	// 获取Redis参数
-	redisParams := c.redisSetGetParam(keyValuesStr, modifydata.tags, modifydata.data, true)
+	redisParams := c.redisSetGetParam(ctx, keyValuesStr, modifydata.tags, modifydata.data, true)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsModifyGetScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
-		err := cmd.BindValues(modifydata.rsts)
+		values, ver := c.versionBind(modifydata.rsts)
+		err := cmd.BindValues(values)
 		if err == nil {
 			// 同步mysql
 			mysqlUnlock = true
-			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), modifydata.TagsRstsMap(), key, func(err error) {
+			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), c.versionData(modifydata.TagsRstsMap(), ver), key, c.genDataKey(key, keyValuesStr), func(err error) {
 				defer unlock()
 				if err != nil {
 					c.redis.Del(ctx, key) // mysql错了 要删缓存
+				} else {
+					c.emitModifyEvent(ctx, condValues, keyValues, modifydata, ver)
 				}
 			})
 			if err != nil {
@@ -1163,7 +1471,7 @@ func (c *CacheRows[T]) modifyGetSave(ctx context.Context, key string, condValues
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return ErrNullData
 		}
-		return cmd.Cmd.Err()
+		return c.scriptError(cmd.Cmd.Err())
 	}
 }
 
@@ -1183,20 +1491,23 @@ func (c *CacheRows[T]) modifyGetTSave(ctx context.Context, key string, condValue
 	}()
 
 	// redis参数
-	redisParams := c.redisSetGetParam(keyValuesStr, c.Tags, modifydata.data, true)
+	redisParams := c.redisSetGetParam(ctx, keyValuesStr, c.Tags, modifydata.data, true)
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsModifyGetScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
 		dest := new(T)
 		destInfo, _ := utils.GetStructInfoByStructType(dest, c.StructType)
-		err := cmd.BindValues(destInfo.Elemts)
+		values, ver := c.versionBind(destInfo.Elemts)
+		err := cmd.BindValues(values)
 		if err == nil {
 			// 同步mysql，把T结构的值 拷贝到新创建的resInfo中再保存，否则会保存整个T结构
 			modifydata.RstsFrom(destInfo)
 			mysqlUnlock = true
-			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), modifydata.TagsRstsMap(), key, func(err error) {
+			err = c.saveToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), c.versionData(modifydata.TagsRstsMap(), ver), key, c.genDataKey(key, keyValuesStr), func(err error) {
 				defer unlock()
 				if err != nil {
 					c.redis.Del(ctx, c.genDataKey(key, keyValuesStr)) // mysql错了 要删缓存
+				} else {
+					c.emitModifyEvent(ctx, condValues, keyValues, modifydata, ver)
 				}
 			})
 			if err != nil {
@@ -1212,7 +1523,7 @@ func (c *CacheRows[T]) modifyGetTSave(ctx context.Context, key string, condValue
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return nil, ErrNullData
 		}
-		return nil, cmd.Cmd.Err()
+		return nil, c.scriptError(cmd.Cmd.Err())
 	}
 }
 
@@ -1234,6 +1545,8 @@ func (c *CacheRows[T]) preLoadAll(ctx context.Context, key string, condValues []
 	}
 	defer unlock()
 
+	c.batchFlushKey(ctx, key) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+
 	cond := NewConds().eqs(c.condFields, condValues)
 	// 加载
 	all, err := c.getsFromMySQL(ctx, c.T, c.Tags, cond)
@@ -1309,6 +1622,8 @@ func (c *CacheRows[T]) preLoads(ctx context.Context, key string, condValues []in
 	}
 	defer unlock()
 
+	c.batchFlushKey(ctx, queryDataKeys...) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+
 	cond := NewConds().eqs(c.condFields, condValues)
 	// 查询到要读取的数据
 	all, err := c.getsFromMySQL(ctx, c.T, c.Tags, cond.Ins(c.keyFields, keyValuess...))
@@ -1410,6 +1725,8 @@ func (c *CacheRows[T]) preLoad(ctx context.Context, key string, condValues []int
 	}
 	defer unlock()
 
+	c.batchFlushKey(ctx, dataKey) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+
 	var incrValue interface{}
 	cond := NewConds().eqs(c.condFields, condValues)
 
@@ -1420,7 +1737,7 @@ func (c *CacheRows[T]) preLoad(ctx context.Context, key string, condValues []int
 		if err != nil {
 			if err == ErrNullData {
 				// 创建数据
-				incrValue, err = c.addToMySQL(ctx, condValues, ncData)
+				incrValue, err = c.addRowToMySQL(ctx, key, condValues, keyValuesStr, ncData)
 				if err != nil {
 					return nil, nil, err
 				}
@@ -1527,6 +1844,134 @@ func (c *CacheRows[T]) redisGetAll(ctx context.Context, key string) ([]*T, error
 	}
 }
 
+// 添加一条数据到MySQL，配置了数量上限时先在Redis索引中占用位置，添加失败了再释放
+func (c *CacheRows[T]) addRowToMySQL(ctx context.Context, key string, condValues []interface{}, keyValuesStr string, data map[string]interface{}) (int64, error) {
+	if c.maxRows <= 0 {
+		return c.addToMySQL(ctx, condValues, data)
+	}
+
+	rst, err := c.reserveRow(ctx, key, condValues, keyValuesStr)
+	if err != nil {
+		return 0, err
+	}
+	if rst == 0 {
+		return 0, ErrMaxRows
+	}
+	incrValue, err := c.addToMySQL(ctx, condValues, data)
+	if err != nil && rst == 1 {
+		c.redis.DoScript(ctx, rowsDelsScript, []string{key}, keyValuesStr) // 释放占用的位置
+	}
+	return incrValue, err
+}
+
+// 在索引中占用位置 返回值 0：超过上限 1：成功 2：已经存在
+func (c *CacheRows[T]) reserveRow(ctx context.Context, key string, condValues []interface{}, keyValuesStr string) (int, error) {
+	create := 0 // 索引不存在时是否允许创建
+	for i := 0; i < 3; i++ {
+		var rst int
+		err := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsReserveScript, []string{key}, c.expire, c.maxRows, keyValuesStr, create).Bind(&rst)
+		if err == nil {
+			return rst, nil
+		} else if !goredis.IsNilError(err) {
+			return 0, err
+		}
+
+		// 索引不存在，先加载索引，其他进程加载完成后索引也可能已经过期或者被删除了，重新加载后再试
+		n, err := c.preLoadIndex(ctx, key, condValues)
+		if err != nil {
+			return 0, err
+		}
+		// MySQL中没有数据时，允许创建索引
+		create = utils.If(n == 0, 1, 0)
+	}
+	return 0, errors.New("rows index not exist")
+}
+
+// 只预加载索引，不加载数据
+// 返回值
+// int： 因为preLoadLock是加锁失败等待，>=0 表示是本逻辑执行了加载，值为数据数量，否则没有执行加载
+// error： 执行结果
+func (c *CacheRows[T]) preLoadIndex(ctx context.Context, key string, condValues []interface{}) (int, error) {
+	// 先判断是否设置了pass
+	if GetPass(key) {
+		return 0, nil
+	}
+	// 加锁
+	unlock, err := c.preLoadLock(ctx, key)
+	if err != nil || unlock == nil {
+		return -1, err
+	}
+	defer unlock()
+
+	c.batchFlushKey(ctx, key) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+
+	// 只读取keyFields对应的值
+	allKey, err := c.getsFromMySQL(ctx, c.T, c.keyFields, NewConds().eqs(c.condFields, condValues))
+	if err != nil {
+		return -1, err
+	}
+	allKeyValues := allKey.([]*T)
+	if len(allKeyValues) == 0 {
+		SetPass(key)
+		return 0, nil
+	}
+
+	// redis参数
+	redisParams := make([]interface{}, 0, 1+2*len(allKeyValues))
+	redisParams = append(redisParams, c.expire)
+	for _, data := range allKeyValues {
+		dataInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
+		redisParams = append(redisParams, c.genKeyValuesStrByTInfo(dataInfo))
+		redisParams = append(redisParams, 0)
+	}
+
+	cmd := c.redis.DoScript(ctx, rowsAddScript, []string{key}, redisParams...)
+	if cmd.Err() != nil {
+		c.redis.Del(ctx, key) // 失败了，删除索引
+		return -1, cmd.Err()
+	}
+	return len(allKeyValues), nil
+}
+
+// 按排序索引读取数据
+// mode：page时a b为offset limit，range时a b为min max
+func (c *CacheRows[T]) redisSortGet(ctx context.Context, key string, field string, desc bool, mode string, a, b interface{}) ([]*T, error) {
+	redisParams := make([]interface{}, 0, 6+len(c.Tags))
+	redisParams = append(redisParams, c.expire)
+	redisParams = append(redisParams, c.GetRedisTagByTag(field))
+	redisParams = append(redisParams, utils.If(desc, 1, 0))
+	redisParams = append(redisParams, mode)
+	redisParams = append(redisParams, a)
+	redisParams = append(redisParams, b)
+	redisParams = append(redisParams, c.RedisTagsInterface()...)
+
+	reply := make([][]interface{}, 0)
+	err := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsSortGetScript, []string{key}, redisParams...).BindSlice(&reply)
+	if err == nil {
+		res := make([]*T, 0, len(reply))
+		for _, r := range reply {
+			dest := new(T)
+			destInfo, _ := utils.GetStructInfoByStructType(dest, c.StructType) // 这里不用判断err了
+			for i, v := range r {
+				if v == nil {
+					continue
+				}
+				err := goredis.InterfaceToValue(v, destInfo.Elemts[i])
+				if err != nil {
+					return nil, err
+				}
+			}
+			res = append(res, dest)
+		}
+		return res, nil
+	} else {
+		if goredis.IsNilError(err) {
+			return nil, ErrNullData
+		}
+		return nil, err
+	}
+}
+
 // 解析Redis数据，reply的长度就是数据的数量
 // 按T来解析
 func (c *CacheRows[T]) redisGets(ctx context.Context, key string, keyValuesStrs []string) ([]*T, error) {
@@ -1595,6 +2040,10 @@ func (c *CacheRows[T]) JsonArrayFieldAdd(ctx context.Context, condValues []inter
 	if err != nil {
 		return nil, err
 	}
+	// 修改条件不支持
+	if ops != nil && len(ops.guards) > 0 {
+		return nil, errors.New("JsonArray not support guard")
+	}
 
 	// 修改
 	err = c.jsonArrayFieldSave(ctx, key, condValues, keyValuesStr, keyValues, fieldValues, nil, ops)
@@ -1664,6 +2113,10 @@ func (c *CacheRows[T]) JsonArrayFieldDel(ctx context.Context, condValues []inter
 	if err != nil {
 		return err
 	}
+	// 修改条件不支持
+	if ops != nil && len(ops.guards) > 0 {
+		return errors.New("JsonArray not support guard")
+	}
 
 	// 修改
 	err = c.jsonArrayFieldSave(ctx, key, condValues, keyValuesStr, keyValues, nil, fieldValues, ops)
@@ -1712,7 +2165,7 @@ func (c *CacheRows[T]) jsonArrayFieldSave(ctx context.Context, key string, condV
 
 	duplicate := utils.If(ops != nil && ops.jsonArrayDuplicate, true, false)
 	// 获取Redis参数
-	addFields, delFields, redisParams := c.redisJsonArrayParam(keyValuesStr, add, del, duplicate)
+	addFields, delFields, redisParams := c.redisJsonArrayParam(ctx, keyValuesStr, add, del, duplicate)
 
 	cmd := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowsJsonArrayModifyScript, []string{key}, redisParams...)
 	if cmd.Cmd.Err() == nil {
@@ -1721,6 +2174,13 @@ func (c *CacheRows[T]) jsonArrayFieldSave(ctx context.Context, key string, condV
 		if err != nil {
 			return err
 		}
+		// 开启版本号时，第一个返回值是新的版本号
+		var data map[string]interface{}
+		if len(c.versionField) > 0 && len(rst) > 0 && len(rst[0]) == 1 {
+			ver, _ := strconv.ParseInt(rst[0][0], 10, 64)
+			data = c.versionData(nil, &ver)
+			rst = rst[1:]
+		}
 		if len(addFields)+len(delFields) != len(rst) {
 			return errors.New("未知错误")
 		}
@@ -1738,10 +2198,12 @@ func (c *CacheRows[T]) jsonArrayFieldSave(ctx context.Context, key string, condV
 
 		// 同步mysql，添加上数据key字段
 		mysqlUnlock = true
-		err = c.jsonArrayToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), add_, del_, key, func(err error) {
+		err = c.jsonArrayToMySQL(ctx, NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues), add_, del_, data, key, c.genDataKey(key, keyValuesStr), func(err error) {
 			defer unlock()
 			if err != nil {
 				c.redis.Del(ctx, c.genDataKey(key, keyValuesStr)) // mysql错了 删除数据键
+			} else {
+				c.emitEvent(ctx, &ChangeEvent{Op: EventModify, CondValues: condValues, KeyValues: keyValues, New: data, JsonAdd: add_, JsonDel: del_})
 			}
 		})
 		if err != nil {
@@ -1752,6 +2214,6 @@ func (c *CacheRows[T]) jsonArrayFieldSave(ctx context.Context, key string, condV
 		if goredis.IsNilError(cmd.Cmd.Err()) {
 			return ErrNullData
 		}
-		return cmd.Cmd.Err()
+		return c.scriptError(cmd.Cmd.Err())
 	}
 }
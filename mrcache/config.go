@@ -4,6 +4,8 @@ package mrcache
 
 import (
 	"errors"
+	"fmt"
+	"gobase/utils"
 	"sync"
 	"time"
 )
@@ -14,6 +16,21 @@ var DBNolog = true
 // 读写单条数据时，不存在返回空错误，读取多条数据时不会返回空错误
 var ErrNullData = errors.New("null")
 
+// CacheRows配置了数据数量上限，添加数据时超过上限返回的错误
+var ErrMaxRows = errors.New("exceed max rows")
+
+// 配置了版本号，SetIfVersion、ModifyIfVersion时版本号不一致返回的错误
+var ErrVersion = errors.New("version mismatch")
+
+// Options配置了修改条件，条件不满足时返回的错误，Values为条件字段修改前的当前值，Redis中没有该字段时为nil
+type ErrGuardFailed struct {
+	Values map[string]interface{}
+}
+
+func (e *ErrGuardFailed) Error() string {
+	return fmt.Sprintf("guard failed %v", e.Values)
+}
+
 // 结构中存储的tag名
 const DBTag = "db"
 
@@ -21,14 +38,41 @@ const DBTag = "db"
 // 如果不设置默认是用的DBTag
 const RedisTag = "redis"
 
+// EnsureSchema时指定字段的mysql类型，不设置时根据字段类型推导
+const SQLTypeTag = "sqltype"
+
 var Expire = 36 * 3600 // 支持修改
 
 var IncrementKey = "_mrcache_increment_" // 自增key，hash结构，field使用table名
 
+var JournalKey = "mrcache_journal" // 异步保存mysql的持久化日志key，stream结构，完整的key会添加上前后缀和表名
+
+var JournalReplayDelay = 60 // 重放持久化日志时，只重放多少秒之前的日志，防止和正在异步保存的数据冲突 支持修改
+
+var WarmupKey = "mrcache_warmup" // 预热的断点key，hash结构，field为预热条件，完整的key会添加上前后缀和表名
+
+var WarmupChunk = 500 // 预热时每次从mysql读取的数据条数 支持修改
+
+var EventStreamQueue = 4096 // RedisStreamSink的缓冲队列大小，创建前修改有效
+
+// 需要校验的版本号 值：int64 内部使用
+const ctxKey_version = utils.CtxKey("_mrcache_version_")
+
+// 修改时的检查条件 值：[]*guardCond 内部使用
+const ctxKey_guard = utils.CtxKey("_mrcache_guard_")
+
+// 修改时的检查条件，在修改的Redis脚本中检查修改前的值
+type guardCond struct {
+	field string
+	op    string
+	value interface{}
+}
+
 type Options struct {
-	noResp             bool // 不需要返回值，有时为了优化性能不需要返回值
-	noExistCreate      bool // 不存在就创建
-	jsonArrayDuplicate bool // JsonArray去重
+	noResp             bool         // 不需要返回值，有时为了优化性能不需要返回值
+	noExistCreate      bool         // 不存在就创建
+	jsonArrayDuplicate bool         // JsonArray去重
+	guards             []*guardCond // 修改条件，Set、Modify时有效
 }
 
 func NewOptions() *Options {
@@ -57,6 +101,43 @@ func (o *Options) JsonArrayDuplicate() *Options {
 	return o
 }
 
+// 修改条件，修改前字段的值满足条件才会修改，多个条件之间是与的关系，不满足时返回*ErrGuardFailed
+// 数值类型按数值比较，Eq和Ne对非数值按字符串比较，Redis中没有该字段时数值按0处理
+// 配置后Create无效，数据不存在返回ErrNullData，JsonArray的修改不支持，配置了会返回错误
+func (o *Options) GuardGe(field string, value interface{}) *Options {
+	return o.guard(field, ">=", value)
+}
+func (o *Options) GuardGt(field string, value interface{}) *Options {
+	return o.guard(field, ">", value)
+}
+func (o *Options) GuardLe(field string, value interface{}) *Options {
+	return o.guard(field, "<=", value)
+}
+func (o *Options) GuardLt(field string, value interface{}) *Options {
+	return o.guard(field, "<", value)
+}
+func (o *Options) GuardEq(field string, value interface{}) *Options {
+	return o.guard(field, "==", value)
+}
+func (o *Options) GuardNe(field string, value interface{}) *Options {
+	return o.guard(field, "~=", value)
+}
+
+func (o *Options) guard(field, op string, value interface{}) *Options {
+	o.guards = append(o.guards, &guardCond{field: field, op: op, value: value})
+	return o
+}
+
+// 复制一份不创建数据的配置，校验版本号时使用
+func (o *Options) withoutCreate() *Options {
+	if o == nil {
+		return nil
+	}
+	no := *o
+	no.noExistCreate = false
+	return &no
+}
+
 // 查询数据不存在的缓存，防止缓存穿透
 // 这里的防的是穿透到mysql，redis层没防穿透逻辑
 var passCache sync.Map
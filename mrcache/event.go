@@ -0,0 +1,206 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gobase/goredis"
+	"gobase/utils"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 数据变化事件
+// CacheRow、CacheRows的数据添加、修改、删除成功后，发布一条变化记录到配置的EventSink中
+// 都在mysql执行成功后发布，异步保存mysql时在保存完成的回调中发布
+// 其他服务可以订阅做排行榜、审计、搜索索引等
+
+// 变化类型
+const (
+	EventAdd    = "add"
+	EventModify = "modify"
+	EventDel    = "del"
+)
+
+type ChangeEvent struct {
+	Table      string                 `json:"table"`             // 表名
+	Op         string                 `json:"op"`                // 变化类型
+	CondValues []interface{}          `json:"cond"`              // condFields对应的值
+	KeyValues  []interface{}          `json:"key,omitempty"`     // CacheRows中keyFields对应的值，DelAll时为空
+	Fields     []string               `json:"fields,omitempty"`  // 变化的字段
+	Old        map[string]interface{} `json:"old,omitempty"`     // 修改前的值，只有Modify数值增量的字段可以推算出来
+	New        map[string]interface{} `json:"new,omitempty"`     // 修改后的值，添加时为添加的数据
+	JsonAdd    map[string][]string    `json:"jsonadd,omitempty"` // JsonArray添加成功的值
+	JsonDel    map[string][]string    `json:"jsondel,omitempty"` // JsonArray删除成功的值
+	Time       int64                  `json:"time"`              // 毫秒
+}
+
+// 事件的发布接口，Publish在修改的流程中同步调用（可能持有保存锁），不要阻塞
+type EventSink interface {
+	Publish(ctx context.Context, e *ChangeEvent) error
+}
+
+// 发布到Redis的stream中，每条消息只有一个字段e，值为ChangeEvent的json格式
+// Publish只放入缓冲队列，由一个协程按顺序写入stream，队列满了丢弃并返回错误
+type RedisStreamSink struct {
+	redis  *goredis.Redis
+	key    string
+	maxLen int64 // stream的最大长度，<=0表示不限制
+	queue  chan []byte
+	once   sync.Once
+}
+
+func NewRedisStreamSink(redis *goredis.Redis, key string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{redis: redis, key: key, maxLen: maxLen, queue: make(chan []byte, EventStreamQueue)}
+}
+
+func (s *RedisStreamSink) Publish(ctx context.Context, e *ChangeEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.once.Do(func() { go s.loop() })
+	select {
+	case s.queue <- data:
+		return nil
+	default:
+		return errors.New("stream sink full")
+	}
+}
+
+func (s *RedisStreamSink) loop() {
+	defer utils.HandlePanic()
+	ctx := utils.CtxSetNolog(context.Background())
+	for data := range s.queue {
+		args := make([]interface{}, 0, 8)
+		args = append(args, "XADD", s.key)
+		if s.maxLen > 0 {
+			args = append(args, "MAXLEN", "~", s.maxLen)
+		}
+		args = append(args, "*", "e", data)
+		if err := s.redis.Do(ctx, args...).Err(); err != nil {
+			log.Error().Err(err).Str("key", s.key).Msg("RedisStreamSink XADD fail")
+		}
+	}
+}
+
+// 发布到进程内的channel中，channel满了丢弃并返回错误
+type ChanSink struct {
+	C chan *ChangeEvent
+}
+
+func NewChanSink(size int) *ChanSink {
+	return &ChanSink{C: make(chan *ChangeEvent, size)}
+}
+
+func (s *ChanSink) Publish(ctx context.Context, e *ChangeEvent) error {
+	select {
+	case s.C <- e:
+		return nil
+	default:
+		return errors.New("chan sink full")
+	}
+}
+
+// 发布事件，自动填充表名、时间和变化的字段
+func (c *Cache) emitEvent(ctx context.Context, e *ChangeEvent) {
+	if len(c.eventSinks) == 0 {
+		return
+	}
+	e.Table = c.TableName()
+	e.Time = time.Now().UnixMilli()
+	if e.Fields == nil {
+		for _, tag := range c.Tags {
+			_, ok1 := e.New[tag]
+			_, ok2 := e.JsonAdd[tag]
+			_, ok3 := e.JsonDel[tag]
+			if (ok1 || ok2 || ok3) && !c.saveIgnoreTag(tag) {
+				e.Fields = append(e.Fields, tag)
+			}
+		}
+	}
+	for _, sink := range c.eventSinks {
+		if err := sink.Publish(ctx, e); err != nil {
+			log.Error().Err(err).Str("table", e.Table).Str("op", e.Op).Msg("Cache emitEvent fail")
+		}
+	}
+}
+
+// 添加数据的事件，keyValues从data中读取
+func (c *Cache) emitAddEvent(ctx context.Context, condValues []interface{}, data map[string]interface{}, incrementId int64) {
+	if len(c.eventSinks) == 0 {
+		return
+	}
+	var keyValues []interface{}
+	for _, tag := range c.keyFields {
+		keyValues = append(keyValues, data[tag])
+	}
+	newData := make(map[string]interface{}, len(data)+1)
+	for tag, v := range data {
+		newData[tag] = v
+	}
+	if len(c.incrementField) != 0 {
+		newData[c.incrementField] = incrementId
+		if at := utils.IndexOf(c.keyFields, c.incrementField); at != -1 {
+			keyValues[at] = incrementId
+		}
+	}
+	c.emitEvent(ctx, &ChangeEvent{Op: EventAdd, CondValues: condValues, KeyValues: keyValues, New: newData})
+}
+
+// 增量修改的事件，数值增量的字段推算出修改前的值
+func (c *Cache) emitModifyEvent(ctx context.Context, condValues, keyValues []interface{}, modifydata *ModifyData, ver *int64) {
+	if len(c.eventSinks) == 0 {
+		return
+	}
+	old := map[string]interface{}{}
+	for i, tag := range modifydata.tags {
+		if tag == c.versionField || c.saveIgnoreTag(tag) {
+			continue
+		}
+		if v, ok := eventIncrOld(modifydata.rsts[i], modifydata.values[i]); ok {
+			old[tag] = v
+		}
+	}
+	c.emitEvent(ctx, &ChangeEvent{Op: EventModify, CondValues: condValues, KeyValues: keyValues, Old: old, New: c.versionData(modifydata.TagsRstsMap(), ver)})
+}
+
+// 修改后的值减去增量，得到修改前的值
+func eventIncrOld(newValue reflect.Value, incr interface{}) (interface{}, bool) {
+	iv := reflect.ValueOf(incr)
+	for iv.IsValid() && iv.Kind() == reflect.Ptr {
+		iv = iv.Elem()
+	}
+	if !iv.IsValid() || !newValue.IsValid() {
+		return nil, false
+	}
+	var di int64
+	var df float64
+	switch iv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		di, df = iv.Int(), float64(iv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		di, df = int64(iv.Uint()), float64(iv.Uint())
+	case reflect.Float32, reflect.Float64:
+		di, df = int64(iv.Float()), iv.Float()
+	default:
+		return nil, false
+	}
+	old := reflect.New(newValue.Type()).Elem()
+	switch newValue.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		old.SetInt(newValue.Int() - di)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		old.SetUint(newValue.Uint() - uint64(di))
+	case reflect.Float32, reflect.Float64:
+		old.SetFloat(newValue.Float() - df)
+	default:
+		return nil, false
+	}
+	return old.Interface(), true
+}
@@ -0,0 +1,423 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gobase/goredis"
+	"gobase/utils"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// 异步保存mysql的持久化日志
+// 开启后，异步保存mysql前先把保存的内容追加到stream中，保存成功后再从stream中删除
+// 进程崩溃或者重启时，未保存成功的日志保留在stream中，启动时调用ReplayJournal重放
+// stream中每条日志只有一个字段e，值为journalEntry的json格式
+
+const (
+	journalOpSave      = "save"      // 对应saveToMySQL
+	journalOpJsonArray = "jsonarray" // 对应jsonArrayToMySQL
+)
+
+// 保存时的条件
+type journalCond struct {
+	Field string  `json:"f"`
+	Op    string  `json:"o"`
+	Value *string `json:"v"`
+}
+
+type journalEntry struct {
+	id      string              // stream中的id
+	Key     string              `json:"k"`           // 保存加锁使用的key
+	DataKey string              `json:"h"`           // 数据存储的key，hash结构
+	Op      string              `json:"op"`          // 操作类型
+	Cond    []*journalCond      `json:"c"`           // 保存的条件
+	Data    map[string]*string  `json:"d,omitempty"` // save的数据，格式化成字符串，nil表示空数据
+	Add     map[string][]string `json:"a,omitempty"` // jsonarray添加的数据
+	Del     map[string][]string `json:"r,omitempty"` // jsonarray删除的数据
+}
+
+// 持久化日志的key，命名: [keyPrefix_]JournalKey_表名[_keySuffix]
+func (c *Cache) journalKey() string {
+	var key strings.Builder
+	if len(c.keyPrefix) > 0 {
+		key.WriteString(c.keyPrefix + "_")
+	}
+	key.WriteString(JournalKey + "_" + c.TableName())
+	if len(c.keySuffix) > 0 {
+		key.WriteString("_" + c.keySuffix)
+	}
+	return key.String()
+}
+
+// 值格式化成字符串，和写入Redis的格式一致，空数据返回nil
+func (c *Cache) journalFmt(v interface{}) *string {
+	vfmt := goredis.ValueFmt(reflect.ValueOf(v))
+	if vfmt == nil {
+		return nil
+	}
+	s := c.fmtBaseType(vfmt)
+	return &s
+}
+
+// 格式化的字符串还原成tag对应的类型
+func (c *Cache) journalValue(tag string, s *string) (interface{}, error) {
+	at := c.FindIndexByTag(tag)
+	if at == -1 {
+		return nil, fmt.Errorf("tag:%s not find in %s", tag, c.T.String())
+	}
+	if s == nil {
+		return nil, nil
+	}
+	v := reflect.New(c.Fields[at].Type).Elem()
+	err := goredis.InterfaceToValue(*s, v)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+func (c *Cache) journalCond(cond TableConds) []*journalCond {
+	jcond := make([]*journalCond, 0, len(cond))
+	for _, v := range cond {
+		jcond = append(jcond, &journalCond{Field: v.field, Op: v.op, Value: c.journalFmt(v.value)})
+	}
+	return jcond
+}
+
+func (c *Cache) journalData(data map[string]interface{}) map[string]*string {
+	jdata := make(map[string]*string, len(data))
+	for tag, v := range data {
+		if c.saveIgnoreTag(tag) {
+			continue
+		}
+		jdata[tag] = c.journalFmt(v)
+	}
+	return jdata
+}
+
+// 追加日志
+// 返回值 string：日志id  bool：是否可以异步保存，未开启日志直接返回true，开启了日志写入失败返回false
+func (c *Cache) journalAppend(ctx context.Context, entry *journalEntry) (string, bool) {
+	if c.journalRedis == nil {
+		return "", true
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", false
+	}
+	id, err := c.journalRedis.Do(utils.CtxSetNolog(ctx), "XADD", c.journalKey(), "*", "e", data).Text()
+	if err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// 日志保存完成，删除
+func (c *Cache) journalDone(ctx context.Context, ids ...string) {
+	if c.journalRedis == nil || len(ids) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, 2+len(ids))
+	args = append(args, "XDEL", c.journalKey())
+	for _, id := range ids {
+		if len(id) > 0 {
+			args = append(args, id)
+		}
+	}
+	if len(args) > 2 {
+		c.journalRedis.Do(utils.CtxSetNolog(ctx), args...)
+	}
+}
+
+// 重放持久化日志，一般在启动时调用，多个进程同时调用时只有一个会执行
+// 只重放JournalReplayDelay秒之前的日志，同一个数据key的多条日志合并成一条UPDATE
+// 优先使用Redis中的最新值写入mysql，Redis中不存在时按日志顺序写入日志中的值，并删除缓存
+// 返回值：重放成功的日志条数
+func (c *Cache) ReplayJournal(ctx context.Context) (_n_ int, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Int("n", _n_).Msgf("Cache %s ReplayJournal", c.TableName())
+	})()
+
+	if c.journalRedis == nil {
+		return 0, errors.New("journal not config")
+	}
+	key := c.journalKey()
+
+	// 重放的时间不确定，加锁后定时续期
+	lost, unlock, err := c.journalReplayLock(ctx, key+"_lock_replay")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	end := strconv.FormatInt(time.Now().Add(-time.Second*time.Duration(JournalReplayDelay)).UnixMilli(), 10)
+	start := "-"
+	var replayErr error
+	for {
+		if lost() {
+			return _n_, errors.New("journal replay lock lost") // 锁丢失了，其他进程可能在重放
+		}
+		msgs, err := c.journalRedis.XRangeN(utils.CtxSetNolog(ctx), key, start, end, 256).Result()
+		if err != nil {
+			return _n_, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		entries := make([]*journalEntry, 0, len(msgs))
+		for _, msg := range msgs {
+			data, _ := msg.Values["e"].(string)
+			entry := &journalEntry{}
+			if err := json.Unmarshal(utils.StringToBytes(data), entry); err != nil {
+				// 格式错误的日志直接删除
+				c.journalDone(ctx, msg.ID)
+				continue
+			}
+			entry.id = msg.ID
+			entries = append(entries, entry)
+		}
+		n, err := c.replayJournalEntries(ctx, entries)
+		_n_ += n
+		if err != nil {
+			replayErr = err
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+	return _n_, replayErr
+}
+
+// 重放锁 只尝试一次，成功后每ttl/3续期一次，续期失败认为锁丢失了
+// 返回值：锁是否丢失 解锁函数
+func (c *Cache) journalReplayLock(ctx context.Context, lockKey string) (func() bool, func(), error) {
+	const ttl = time.Second * 10
+	uuid := utils.LocalIPString() + "-" + strconv.Itoa(os.Getpid()) + "-" + utils.RandString(16)
+	ok, err := c.journalRedis.SetNX(utils.CtxSetNolog(ctx), lockKey, uuid, ttl).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, errors.New("journal replaying")
+	}
+
+	var lost int32
+	done := make(chan struct{})
+	go func() {
+		defer utils.HandlePanic()
+		renewCtx := utils.CtxSetNolog(context.TODO())
+		renewed := time.Now()
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			n, err := c.journalRedis.DoScript(renewCtx, journalLockRenewScript, []string{lockKey}, uuid, ttl.Milliseconds()).Int()
+			if err == nil && n == 1 {
+				renewed = time.Now()
+				continue
+			}
+			// 出错时在过期之前还可以继续尝试
+			if err != nil && time.Since(renewed) < ttl {
+				continue
+			}
+			atomic.StoreInt32(&lost, 1)
+			return
+		}
+	}()
+	isLost := func() bool {
+		return atomic.LoadInt32(&lost) == 1
+	}
+	unlock := func() {
+		close(done)
+		c.journalRedis.DoScript(utils.CtxSetNolog(context.TODO()), journalLockDelScript, []string{lockKey}, uuid)
+	}
+	return isLost, unlock, nil
+}
+
+// 按DataKey分组重放
+func (c *Cache) replayJournalEntries(ctx context.Context, entries []*journalEntry) (int, error) {
+	groups := map[string][]*journalEntry{}
+	order := []string{}
+	for _, entry := range entries {
+		if _, ok := groups[entry.DataKey]; !ok {
+			order = append(order, entry.DataKey)
+		}
+		groups[entry.DataKey] = append(groups[entry.DataKey], entry)
+	}
+
+	n := 0
+	var replayErr error
+	for _, dataKey := range order {
+		group := groups[dataKey]
+		err := func() error {
+			unlock, err := c.saveLock(ctx, group[0].Key)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			return c.replayJournalGroup(ctx, group)
+		}()
+		if err != nil {
+			replayErr = err
+			continue
+		}
+		ids := make([]string, 0, len(group))
+		for _, entry := range group {
+			ids = append(ids, entry.id)
+		}
+		c.journalDone(ctx, ids...)
+		n += len(group)
+	}
+	return n, replayErr
+}
+
+// 重放同一个DataKey的日志
+func (c *Cache) replayJournalGroup(ctx context.Context, group []*journalEntry) error {
+	cond := TableConds{}
+	for _, jc := range group[0].Cond {
+		v, err := c.journalValue(jc.Field, jc.Value)
+		if err != nil {
+			return err
+		}
+		cond = append(cond, &TableCond{field: jc.Field, op: jc.Op, value: v})
+	}
+
+	// 涉及的字段
+	tags := []string{}
+	for _, entry := range group {
+		for tag := range entry.Data {
+			if !utils.Contains(tags, tag) && c.FindIndexByTag(tag) != -1 {
+				tags = append(tags, tag)
+			}
+		}
+		for tag := range entry.Add {
+			if !utils.Contains(tags, tag) && c.FindIndexByTag(tag) != -1 {
+				tags = append(tags, tag)
+			}
+		}
+		for tag := range entry.Del {
+			if !utils.Contains(tags, tag) && c.FindIndexByTag(tag) != -1 {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// 先从Redis中读取最新值
+	redisParams := make([]interface{}, 0, 1+len(tags))
+	redisParams = append(redisParams, c.expire)
+	for _, tag := range tags {
+		redisParams = append(redisParams, c.GetRedisTagByTag(tag))
+	}
+	reply := make([]interface{}, 0)
+	err := c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), rowGetScript, []string{group[0].DataKey}, redisParams...).BindSlice(&reply)
+	if err == nil && len(reply) == len(tags) {
+		// 日志中每个字段最后写入的值
+		last := map[string]*string{}
+		for _, entry := range group {
+			for tag, s := range entry.Data {
+				last[tag] = s
+			}
+		}
+		data := make(map[string]interface{}, len(tags))
+		for i, tag := range tags {
+			if reply[i] == nil {
+				// Redis中没有这个字段，使用日志中的值，日志中也没有的不修改
+				s, ok := last[tag]
+				if !ok {
+					continue
+				}
+				v, err := c.journalValue(tag, s)
+				if err != nil {
+					return err
+				}
+				data[tag] = v
+				continue
+			}
+			v := reflect.New(c.Fields[c.FindIndexByTag(tag)].Type).Elem()
+			if err := goredis.InterfaceToValue(reply[i], v); err != nil {
+				return err
+			}
+			data[tag] = v.Interface()
+		}
+		sqlStr, args := c.fmtSaveSQL(cond, data)
+		if len(sqlStr) == 0 {
+			return nil
+		}
+		_, err := c.mysql.Update(ctx, sqlStr, args...)
+		return err
+	} else if err != nil && !goredis.IsNilError(err) {
+		return err
+	}
+
+	// Redis中没有数据了，按顺序写入日志中的值，相邻的save合并
+	data := map[string]interface{}{}
+	flush := func() error {
+		if len(data) == 0 {
+			return nil
+		}
+		sqlStr, args := c.fmtSaveSQL(cond, data)
+		data = map[string]interface{}{}
+		if len(sqlStr) == 0 {
+			return nil
+		}
+		_, err := c.mysql.Update(ctx, sqlStr, args...)
+		return err
+	}
+	for _, entry := range group {
+		switch entry.Op {
+		case journalOpSave:
+			for tag, s := range entry.Data {
+				v, err := c.journalValue(tag, s)
+				if err != nil {
+					return err
+				}
+				data[tag] = v
+			}
+		case journalOpJsonArray:
+			if err := flush(); err != nil {
+				return err
+			}
+			jdata := make(map[string]interface{}, len(entry.Data))
+			for tag, s := range entry.Data {
+				v, err := c.journalValue(tag, s)
+				if err != nil {
+					return err
+				}
+				jdata[tag] = v
+			}
+			sqlStr, args := c.fmtJsonArraySQL(cond, entry.Add, entry.Del, jdata)
+			if len(sqlStr) == 0 {
+				continue
+			}
+			if _, err := c.mysql.Update(ctx, sqlStr, args...); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	// mysql中的数据变化了，删除缓存
+	c.redis.Del(ctx, group[0].DataKey)
+	c.localDel(ctx, group[0].DataKey)
+	if group[0].Key != group[0].DataKey {
+		c.redis.Del(ctx, group[0].Key)
+	}
+	return nil
+}
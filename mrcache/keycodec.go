@@ -0,0 +1,214 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"gobase/goredis"
+	"gobase/utils"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 条件字段和key字段的编码
+// 默认条件字段和key字段只支持int和string等基础类型，注册了编码的类型也可以使用
+// 内置支持 time.Time、[N]byte（如UUID）、sql.Null* 类型，其他类型可以通过RegisterKeyCodec注册
+
+type KeyCodec interface {
+	// 编码成生成Redis key使用的字符串，相同的值必须编码成相同的字符串，不要包含 _ : { } 字符
+	EncodeKey(v reflect.Value) string
+	// 转换成mysql的参数
+	SQLValue(v reflect.Value) interface{}
+	// EncodeKey的逆操作，CacheColumn的key字段作为Redis的field，读取时需要解码，v可以设置
+	DecodeKey(s string, v reflect.Value) error
+}
+
+var keyCodecs sync.Map // reflect.Type:KeyCodec
+
+// 注册编码，需要在NewCacheRow、NewCacheRows之前注册
+func RegisterKeyCodec(t reflect.Type, codec KeyCodec) {
+	keyCodecs.Store(t, codec)
+}
+
+func init() {
+	RegisterKeyCodec(timeType, timeKeyCodec{})
+	for _, t := range []reflect.Type{
+		reflect.TypeOf(sql.NullString{}),
+		reflect.TypeOf(sql.NullInt64{}),
+		reflect.TypeOf(sql.NullInt32{}),
+		reflect.TypeOf(sql.NullInt16{}),
+		reflect.TypeOf(sql.NullByte{}),
+		reflect.TypeOf(sql.NullFloat64{}),
+		reflect.TypeOf(sql.NullBool{}),
+		reflect.TypeOf(sql.NullTime{}),
+	} {
+		RegisterKeyCodec(t, nullKeyCodec{})
+	}
+}
+
+// 获取类型的编码，没有返回nil
+func getKeyCodec(t reflect.Type) KeyCodec {
+	if t == nil {
+		return nil
+	}
+	if codec, ok := keyCodecs.Load(t); ok {
+		return codec.(KeyCodec)
+	}
+	if t.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8 {
+		return bytesKeyCodec{}
+	}
+	return nil
+}
+
+// 从结构中读取条件字段和key字段的值，有编码的类型保留原始值，其他的和写入Redis的格式一致
+func (c *Cache) keyValueOf(v reflect.Value) interface{} {
+	if getKeyCodec(v.Type()) != nil {
+		return v.Interface()
+	}
+	return goredis.ValueFmt(v)
+}
+
+// 条件值和key值格式化成生成key使用的字符串
+func (c *Cache) fmtKeyValue(v interface{}) string {
+	if codec := getKeyCodec(reflect.TypeOf(v)); codec != nil {
+		return codec.EncodeKey(reflect.ValueOf(v))
+	}
+	return c.fmtBaseType(v)
+}
+
+// 从Redis中读取的编码后的key值写入v，没有编码的类型和读取普通数据一致
+func decodeKeyValue(r interface{}, v reflect.Value) error {
+	if codec := getKeyCodec(v.Type()); codec != nil {
+		s, ok := r.(string)
+		if !ok {
+			return fmt.Errorf("%s can not decode key from %T", v.Type().String(), r)
+		}
+		return codec.DecodeKey(s, v)
+	}
+	return goredis.InterfaceToValue(r, v)
+}
+
+// 条件值和key值转换成mysql的参数
+func keySQLValue(v interface{}) interface{} {
+	if codec := getKeyCodec(reflect.TypeOf(v)); codec != nil {
+		return codec.SQLValue(reflect.ValueOf(v))
+	}
+	return v
+}
+
+// time.Time 编码成毫秒时间戳，和写入Redis的格式一致
+type timeKeyCodec struct{}
+
+func (timeKeyCodec) EncodeKey(v reflect.Value) string {
+	return strconv.FormatInt(v.Interface().(time.Time).UnixMilli(), 10)
+}
+
+func (timeKeyCodec) SQLValue(v reflect.Value) interface{} {
+	return v.Interface()
+}
+
+func (timeKeyCodec) DecodeKey(s string, v reflect.Value) error {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(time.UnixMilli(ms)))
+	return nil
+}
+
+// [N]byte 编码成16进制，mysql参数为[]byte
+type bytesKeyCodec struct{}
+
+func (bytesKeyCodec) EncodeKey(v reflect.Value) string {
+	return hex.EncodeToString(arrayBytes(v))
+}
+
+func (bytesKeyCodec) SQLValue(v reflect.Value) interface{} {
+	return arrayBytes(v)
+}
+
+func (bytesKeyCodec) DecodeKey(s string, v reflect.Value) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != v.Len() {
+		return fmt.Errorf("%s decode key len err", v.Type().String())
+	}
+	reflect.Copy(v, reflect.ValueOf(b))
+	return nil
+}
+
+func arrayBytes(v reflect.Value) []byte {
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
+
+// sql.Null* 无效时编码成n，有效时编码成v+值，字符串和[]byte使用16进制，mysql参数为原值
+type nullKeyCodec struct{}
+
+func (nullKeyCodec) EncodeKey(v reflect.Value) string {
+	value, err := v.Interface().(driver.Valuer).Value()
+	if err != nil || value == nil {
+		return "n"
+	}
+	// driver.Value只有这几种类型
+	switch val := value.(type) {
+	case int64:
+		return "v" + strconv.FormatInt(val, 10)
+	case float64:
+		return "v" + strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return "v" + strconv.FormatBool(val)
+	case []byte:
+		return "v" + hex.EncodeToString(val)
+	case string:
+		return "v" + hex.EncodeToString(utils.StringToBytes(val))
+	case time.Time:
+		return "v" + strconv.FormatInt(val.UnixMilli(), 10)
+	}
+	return "n"
+}
+
+func (nullKeyCodec) SQLValue(v reflect.Value) interface{} {
+	return v.Interface()
+}
+
+func (nullKeyCodec) DecodeKey(s string, v reflect.Value) error {
+	if s == "n" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if len(s) == 0 || s[0] != 'v' {
+		return fmt.Errorf("%s decode key err", v.Type().String())
+	}
+	s = s[1:]
+	switch v.Type() {
+	case nullTimeType:
+		// 时间编码的是毫秒时间戳
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(sql.NullTime{Time: time.UnixMilli(ms), Valid: true}))
+		return nil
+	case nullStringType:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(sql.NullString{String: string(b), Valid: true}))
+		return nil
+	}
+	scanner, ok := v.Addr().Interface().(sql.Scanner)
+	if !ok {
+		return fmt.Errorf("%s not sql.Scanner", v.Type().String())
+	}
+	return scanner.Scan(s)
+}
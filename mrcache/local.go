@@ -0,0 +1,176 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"gobase/goredis"
+	"gobase/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 进程内的一级缓存，放在Redis前面，目前只有CacheRow的Get和GetFromRedis使用
+// LRU淘汰，有数量上限和过期时间，适合读取非常频繁、修改很少的数据
+// 修改Redis数据的操作会删除本地缓存，并通过Redis的发布订阅通知其他进程删除
+// 使用goredis.Subscriber订阅，连接断开和重新订阅后都清空全部本地缓存，期间可能会丢失通知
+
+type localItem struct {
+	key    string
+	value  interface{}
+	expire int64 // 过期时间 毫秒
+}
+
+type localCache struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	lru   *list.List // 最近使用的在前面
+	gen   uint64     // 每次删除都增加，防止读取Redis过程中数据被修改了，把旧数据写入本地缓存
+
+	channel string              // 通知删除的频道
+	sub     *goredis.Subscriber // 订阅对象，关闭时一起关闭
+}
+
+func newLocalCache(size int, ttl time.Duration, channel string) *localCache {
+	return &localCache{
+		size:    size,
+		ttl:     ttl,
+		items:   map[string]*list.Element{},
+		lru:     list.New(),
+		channel: channel,
+	}
+}
+
+func (l *localCache) get(key string) (interface{}, uint64, bool) {
+	l.Lock()
+	defer l.Unlock()
+	e, ok := l.items[key]
+	if !ok {
+		return nil, l.gen, false
+	}
+	item := e.Value.(*localItem)
+	if time.Now().UnixMilli() >= item.expire {
+		l.lru.Remove(e)
+		delete(l.items, key)
+		return nil, l.gen, false
+	}
+	l.lru.MoveToFront(e)
+	return item.value, l.gen, true
+}
+
+// gen为读取数据前get返回的值，期间有删除操作就不写入了
+func (l *localCache) set(key string, value interface{}, gen uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if gen != l.gen {
+		return
+	}
+	expire := time.Now().Add(l.ttl).UnixMilli()
+	if e, ok := l.items[key]; ok {
+		item := e.Value.(*localItem)
+		item.value = value
+		item.expire = expire
+		l.lru.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.lru.PushFront(&localItem{key: key, value: value, expire: expire})
+	for l.lru.Len() > l.size {
+		e := l.lru.Back()
+		l.lru.Remove(e)
+		delete(l.items, e.Value.(*localItem).key)
+	}
+}
+
+func (l *localCache) del(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+	l.gen++
+	for _, key := range keys {
+		if e, ok := l.items[key]; ok {
+			l.lru.Remove(e)
+			delete(l.items, key)
+		}
+	}
+}
+
+func (l *localCache) clear() {
+	l.Lock()
+	defer l.Unlock()
+	l.gen++
+	l.items = map[string]*list.Element{}
+	l.lru.Init()
+}
+
+// 收到其他进程的删除通知
+func (l *localCache) onMessage(ctx context.Context, channel, payload string) {
+	var keys []string
+	if json.Unmarshal(utils.StringToBytes(payload), &keys) != nil {
+		l.clear()
+		return
+	}
+	l.del(keys...)
+}
+
+func (l *localCache) close() {
+	l.sub.Close()
+	l.clear()
+}
+
+// 配置本地一级缓存，size：最大数量 ttl：过期时间
+// 会订阅Redis频道接受其他进程的删除通知，频道命名: [keyPrefix_]mrcache_local_表名[_keySuffix]，需要在ConfigKeyPrefix之后调用
+// size<=0或者ttl<=0表示关闭，重新配置或者关闭时会取消之前的订阅
+func (c *Cache) ConfigLocalCache(size int, ttl time.Duration) error {
+	if size <= 0 || ttl <= 0 {
+		if c.local != nil {
+			c.local.close()
+			c.local = nil
+		}
+		return nil
+	}
+
+	var channel strings.Builder
+	if len(c.keyPrefix) > 0 {
+		channel.WriteString(c.keyPrefix + "_")
+	}
+	channel.WriteString("mrcache_local_" + c.TableName())
+	if len(c.keySuffix) > 0 {
+		channel.WriteString("_" + c.keySuffix)
+	}
+
+	local := newLocalCache(size, ttl, channel.String())
+	local.sub = c.redis.NewSubscriber()
+	local.sub.OnResubscribe = local.clear // 订阅断开期间可能丢失了通知
+	err := local.sub.Handle(context.TODO(), local.channel, local.onMessage)
+	if err != nil {
+		local.sub.Close()
+		log.Error().Err(err).Str("channel", local.channel).Msg("Cache ConfigLocalCache Subscribe fail")
+		return err
+	}
+
+	if c.local != nil {
+		c.local.close()
+	}
+	c.local = local
+	return nil
+}
+
+// 删除本地缓存，并通知其他进程
+func (c *Cache) localDel(ctx context.Context, keys ...string) {
+	local := c.local
+	if local == nil || len(keys) == 0 {
+		return
+	}
+	local.del(keys...)
+	msg, _ := json.Marshal(keys)
+	err := c.redis.Publish(utils.CtxSetNolog(ctx), local.channel, msg).Err()
+	if err != nil {
+		log.Error().Err(err).Str("channel", local.channel).Msg("Cache localDel Publish fail")
+	}
+}
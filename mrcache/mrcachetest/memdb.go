@@ -0,0 +1,848 @@
+package mrcachetest
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// 内存实现的mysql驱动，通过database/sql使用，Source为库名，相同的库名共享数据
+// 支持mrcache生成的语句：建表 加字段 增删改查 聚合函数 JSON函数 事务
+// 主键、唯一索引、NOT NULL、默认值、AUTO_INCREMENT、ON UPDATE CURRENT_TIMESTAMP和mysql的行为一致，错误返回*mysql.MySQLError
+// 和mysql的差异：
+// 1. 事务的隔离级别为读未提交，回滚时撤销事务中修改的行
+// 2. 普通索引不处理，没有ORDER BY时按主键排序返回
+// 3. 时间类型按time.Local返回，对应连接参数 parseTime=true&loc=Local
+
+const DriverName = "mrcachetest"
+
+type mysqlError = mysqldriver.MySQLError
+
+func init() {
+	sql.Register(DriverName, &memDriver{})
+}
+
+var memDBs sync.Map // name:*memDB
+
+func getMemDB(name string) *memDB {
+	if i := strings.IndexByte(name, '?'); i != -1 {
+		name = name[:i]
+	}
+	db, _ := memDBs.LoadOrStore(name, &memDB{name: name, tables: map[string]*memTable{}})
+	return db.(*memDB)
+}
+
+// 删除内存库
+func DropMemDB(name string) {
+	memDBs.Delete(name)
+}
+
+type memColumn struct {
+	name        string
+	typ         string // 类型名 大写
+	kind        colKind
+	fsp         int  // 时间的小数位数
+	notNull     bool // NOT NULL
+	def         expr // 默认值 nil表示没有默认值
+	autoInc     bool // AUTO_INCREMENT
+	onUpdateNow bool // ON UPDATE CURRENT_TIMESTAMP
+}
+
+type memIndex struct {
+	name string
+	cols []int
+}
+
+// 一行数据，修改时整行替换，指针用来标识行
+type memRow struct {
+	vals []interface{}
+}
+
+type memTable struct {
+	name    string
+	columns []*memColumn
+	primary *memIndex
+	uniques []*memIndex // 包括主键
+	rows    []*memRow
+	autoInc int64 // 下一个自增值
+}
+
+func (t *memTable) columnIndex(name string) int {
+	for i, col := range t.columns {
+		if strings.EqualFold(col.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *memTable) rowIndex(r *memRow) int {
+	for i, row := range t.rows {
+		if row == r {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *memTable) clone(name string) *memTable {
+	cp := &memTable{name: name, primary: t.primary, uniques: t.uniques, autoInc: 1}
+	for _, col := range t.columns {
+		c := *col
+		cp.columns = append(cp.columns, &c)
+	}
+	return cp
+}
+
+// 检查唯一索引冲突，except为修改的行
+func (t *memTable) checkUnique(vals []interface{}, except *memRow) error {
+	for _, idx := range t.uniques {
+		for _, row := range t.rows {
+			if row == except {
+				continue
+			}
+			dup := true
+			for _, c := range idx.cols {
+				if vals[c] == nil || row.vals[c] == nil || compareValues(vals[c], row.vals[c]) != 0 {
+					dup = false
+					break
+				}
+			}
+			if dup {
+				entry := make([]string, 0, len(idx.cols))
+				for _, c := range idx.cols {
+					entry = append(entry, toString(vals[c]))
+				}
+				return sqlError(1062, "23000", "Duplicate entry '%s' for key '%s.%s'", strings.Join(entry, "-"), t.name, idx.name)
+			}
+		}
+	}
+	return nil
+}
+
+// 检查非空字段
+func (t *memTable) checkNotNull(vals []interface{}) error {
+	for i, col := range t.columns {
+		if col.notNull && vals[i] == nil {
+			return sqlError(1048, "23000", "Column '%s' cannot be null", col.name)
+		}
+	}
+	return nil
+}
+
+// 修改记录，用来回滚语句和事务
+// 插入：old为空 删除：new为空 修改：都不为空
+type undoOp struct {
+	table    *memTable
+	old, new *memRow
+}
+
+func rollback(undo []undoOp) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		op := undo[i]
+		t := op.table
+		switch {
+		case op.old == nil:
+			if at := t.rowIndex(op.new); at != -1 {
+				t.rows = append(t.rows[:at], t.rows[at+1:]...)
+			}
+		case op.new == nil:
+			t.rows = append(t.rows, op.old)
+		default:
+			if at := t.rowIndex(op.new); at != -1 {
+				t.rows[at] = op.old
+			}
+		}
+	}
+}
+
+type memDB struct {
+	name   string
+	mu     sync.Mutex
+	tables map[string]*memTable
+}
+
+type memResult struct {
+	lastInsertId int64
+	rowsAffected int64
+}
+
+func (r *memResult) LastInsertId() (int64, error) {
+	return r.lastInsertId, nil
+}
+
+func (r *memResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type memRows struct {
+	columns []string
+	rows    [][]interface{}
+	at      int
+}
+
+func (r *memRows) Columns() []string {
+	return r.columns
+}
+
+func (r *memRows) Close() error {
+	return nil
+}
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if r.at >= len(r.rows) {
+		return io.EOF
+	}
+	for i, v := range r.rows[r.at] {
+		dest[i] = driverValue(v)
+	}
+	r.at++
+	return nil
+}
+
+func (db *memDB) table(name string) (*memTable, error) {
+	t, ok := db.tables[name]
+	if !ok {
+		return nil, sqlError(1146, "42S02", "Table '%s.%s' doesn't exist", db.name, name)
+	}
+	return t, nil
+}
+
+// 执行语句，undo不为空时记录修改
+func (db *memDB) exec(query string, args []interface{}, undo *[]undoOp) (*memResult, *memRows, error) {
+	s, nparam, err := parse(query)
+	if err != nil {
+		return nil, nil, sqlError(1064, "42000", "%s", err.Error())
+	}
+	if nparam != len(args) {
+		return nil, nil, fmt.Errorf("sql: expected %d arguments, got %d", nparam, len(args))
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 语句出错时撤销语句的修改
+	var stmtUndo []undoOp
+	e := &evaluator{db: db, args: args, now: time.Now()}
+	result := &memResult{}
+	var rows *memRows
+	switch s := s.(type) {
+	case *createDatabaseStmt:
+	case *createTableStmt:
+		err = db.createTable(s)
+	case *alterTableStmt:
+		err = db.alterTable(s, e)
+	case *dropTableStmt:
+		for _, name := range s.names {
+			if _, ok := db.tables[name]; !ok && !s.ifExists {
+				err = sqlError(1051, "42S02", "Unknown table '%s.%s'", db.name, name)
+				break
+			}
+			delete(db.tables, name)
+		}
+	case *truncateStmt:
+		var t *memTable
+		if t, err = db.table(s.name); err == nil {
+			t.rows = nil
+			t.autoInc = 1
+		}
+	case *selectStmt:
+		rows, err = db.query(s, e)
+	case *insertStmt:
+		err = db.insert(s, e, result, &stmtUndo)
+	case *updateStmt:
+		err = db.update(s, e, result, &stmtUndo)
+	case *deleteStmt:
+		err = db.delete(s, e, result, &stmtUndo)
+	}
+	if err != nil {
+		rollback(stmtUndo)
+		return nil, nil, err
+	}
+	if undo != nil {
+		*undo = append(*undo, stmtUndo...)
+	}
+	if rows == nil {
+		rows = &memRows{}
+	}
+	return result, rows, nil
+}
+
+func (db *memDB) createTable(s *createTableStmt) error {
+	if _, ok := db.tables[s.name]; ok {
+		if s.ifNotExists {
+			return nil
+		}
+		return sqlError(1050, "42S01", "Table '%s' already exists", s.name)
+	}
+	if len(s.like) > 0 {
+		src, err := db.table(s.like)
+		if err != nil {
+			return err
+		}
+		db.tables[s.name] = src.clone(s.name)
+		return nil
+	}
+	t := &memTable{name: s.name, columns: s.columns, autoInc: 1}
+	if s.autoInc > 0 {
+		t.autoInc = s.autoInc
+	}
+	indexCols := func(names []string) ([]int, error) {
+		cols := make([]int, 0, len(names))
+		for _, name := range names {
+			i := t.columnIndex(name)
+			if i == -1 {
+				return nil, sqlError(1072, "42000", "Key column '%s' doesn't exist in table", name)
+			}
+			cols = append(cols, i)
+		}
+		return cols, nil
+	}
+	if len(s.primary) > 0 {
+		cols, err := indexCols(s.primary)
+		if err != nil {
+			return err
+		}
+		for _, c := range cols {
+			t.columns[c].notNull = true
+		}
+		t.primary = &memIndex{name: "PRIMARY", cols: cols}
+		t.uniques = append(t.uniques, t.primary)
+	}
+	for _, u := range s.uniques {
+		cols, err := indexCols(u.cols)
+		if err != nil {
+			return err
+		}
+		name := u.name
+		if len(name) == 0 {
+			name = u.cols[0]
+		}
+		t.uniques = append(t.uniques, &memIndex{name: name, cols: cols})
+	}
+	db.tables[s.name] = t
+	return nil
+}
+
+func (db *memDB) alterTable(s *alterTableStmt, e *evaluator) error {
+	t, err := db.table(s.name)
+	if err != nil {
+		return err
+	}
+	if t.columnIndex(s.column.name) != -1 {
+		return sqlError(1060, "42S21", "Duplicate column name '%s'", s.column.name)
+	}
+	// 已有的数据填充默认值
+	var def interface{}
+	if s.column.def != nil {
+		v, err := e.eval(s.column.def)
+		if err != nil {
+			return err
+		}
+		if def, err = convertValue(s.column, v); err != nil {
+			return err
+		}
+	} else if s.column.notNull {
+		def = zeroValue(s.column)
+	}
+	t.columns = append(t.columns, s.column)
+	for i, row := range t.rows {
+		t.rows[i] = &memRow{vals: append(append([]interface{}{}, row.vals...), def)}
+	}
+	return nil
+}
+
+// NOT NULL没有默认值的字段加到已有表时的值
+func zeroValue(col *memColumn) interface{} {
+	switch col.kind {
+	case kindInt:
+		return int64(0)
+	case kindFloat:
+		return float64(0)
+	case kindTime, kindDate:
+		return time.Time{}
+	case kindBytes:
+		return []byte{}
+	case kindJSON:
+		return jsonText("null")
+	}
+	return ""
+}
+
+// information_schema中的表
+func (db *memDB) schemaTable(name string) (*memTable, error) {
+	names := make([]string, 0, len(db.tables))
+	for n := range db.tables {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	strCol := func(name string) *memColumn { return &memColumn{name: name, typ: "VARCHAR"} }
+	switch strings.ToUpper(name) {
+	case "TABLES":
+		t := &memTable{name: name, columns: []*memColumn{strCol("TABLE_SCHEMA"), strCol("TABLE_NAME"), {name: "AUTO_INCREMENT", typ: "BIGINT", kind: kindInt}}}
+		for _, n := range names {
+			t.rows = append(t.rows, &memRow{vals: []interface{}{db.name, n, db.tables[n].autoInc}})
+		}
+		return t, nil
+	case "COLUMNS":
+		t := &memTable{name: name, columns: []*memColumn{strCol("TABLE_SCHEMA"), strCol("TABLE_NAME"), strCol("COLUMN_NAME"),
+			{name: "ORDINAL_POSITION", typ: "BIGINT", kind: kindInt}, strCol("DATA_TYPE"), strCol("IS_NULLABLE")}}
+		for _, n := range names {
+			for i, col := range db.tables[n].columns {
+				nullable := "YES"
+				if col.notNull {
+					nullable = "NO"
+				}
+				t.rows = append(t.rows, &memRow{vals: []interface{}{db.name, n, col.name, int64(i + 1), strings.ToLower(col.typ), nullable}})
+			}
+		}
+		return t, nil
+	}
+	return nil, sqlError(1109, "42S02", "Unknown table '%s' in information_schema", name)
+}
+
+// 满足条件的行
+func (db *memDB) filter(t *memTable, where expr, e *evaluator) ([]*memRow, error) {
+	rows := make([]*memRow, 0, len(t.rows))
+	for _, row := range t.rows {
+		if where != nil {
+			sub := &evaluator{db: db, table: t, row: row.vals, args: e.args, now: e.now}
+			v, err := sub.eval(where)
+			if err != nil {
+				return nil, err
+			}
+			if !truthy(v) {
+				continue
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (db *memDB) query(s *selectStmt, e *evaluator) (*memRows, error) {
+	var t *memTable
+	var err error
+	switch {
+	case len(s.table) == 0:
+		t = &memTable{rows: []*memRow{{}}} // 没有FROM 返回一行
+	case strings.EqualFold(s.schema, "information_schema"):
+		t, err = db.schemaTable(s.table)
+	default:
+		t, err = db.table(s.table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	matched, err := db.filter(t, s.where, e)
+	if err != nil {
+		return nil, err
+	}
+
+	rst := &memRows{}
+	for _, item := range s.items {
+		if item.star {
+			for _, col := range t.columns {
+				rst.columns = append(rst.columns, col.name)
+			}
+			continue
+		}
+		rst.columns = append(rst.columns, item.name)
+	}
+	project := func(row []interface{}, group [][]interface{}) ([]interface{}, error) {
+		sub := &evaluator{db: db, table: t, row: row, args: e.args, group: group, now: e.now}
+		vals := make([]interface{}, 0, len(rst.columns))
+		for _, item := range s.items {
+			if item.star {
+				vals = append(vals, row...)
+				continue
+			}
+			v, err := sub.eval(item.e)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+		}
+		return vals, nil
+	}
+
+	// 聚合，返回一行
+	for _, item := range s.items {
+		if !item.star && hasAggregate(item.e) {
+			group := make([][]interface{}, 0, len(matched))
+			for _, row := range matched {
+				group = append(group, row.vals)
+			}
+			var first []interface{}
+			if len(group) > 0 {
+				first = group[0]
+			}
+			vals, err := project(first, group)
+			if err != nil {
+				return nil, err
+			}
+			rst.rows = append(rst.rows, vals)
+			return rst, nil
+		}
+	}
+
+	// 排序
+	if len(s.orderBy) > 0 {
+		keys := make(map[*memRow][]interface{}, len(matched))
+		for _, row := range matched {
+			sub := &evaluator{db: db, table: t, row: row.vals, args: e.args, now: e.now}
+			key := make([]interface{}, 0, len(s.orderBy))
+			for _, o := range s.orderBy {
+				v, err := sub.eval(o.e)
+				if err != nil {
+					return nil, err
+				}
+				key = append(key, v)
+			}
+			keys[row] = key
+		}
+		sort.SliceStable(matched, func(i, j int) bool {
+			ki, kj := keys[matched[i]], keys[matched[j]]
+			for n, o := range s.orderBy {
+				c := compareNull(ki[n], kj[n])
+				if c == 0 {
+					continue
+				}
+				return (c < 0) != o.desc
+			}
+			return false
+		})
+	} else if t.primary != nil {
+		sort.SliceStable(matched, func(i, j int) bool {
+			for _, c := range t.primary.cols {
+				if n := compareNull(matched[i].vals[c], matched[j].vals[c]); n != 0 {
+					return n < 0
+				}
+			}
+			return false
+		})
+	}
+
+	// 分页
+	if s.limit != nil {
+		offset := int64(0)
+		if s.offset != nil {
+			v, err := e.eval(s.offset)
+			if err != nil {
+				return nil, err
+			}
+			f, _ := toFloat(v)
+			offset = int64(f)
+		}
+		v, err := e.eval(s.limit)
+		if err != nil {
+			return nil, err
+		}
+		f, _ := toFloat(v)
+		limit := int64(f)
+		if offset >= int64(len(matched)) {
+			matched = nil
+		} else {
+			matched = matched[offset:]
+			if limit < int64(len(matched)) {
+				matched = matched[:limit]
+			}
+		}
+	}
+
+	for _, row := range matched {
+		vals, err := project(row.vals, nil)
+		if err != nil {
+			return nil, err
+		}
+		rst.rows = append(rst.rows, vals)
+	}
+	return rst, nil
+}
+
+func (db *memDB) insert(s *insertStmt, e *evaluator, result *memResult, undo *[]undoOp) error {
+	t, err := db.table(s.table)
+	if err != nil {
+		return err
+	}
+	cols := make([]int, 0, len(t.columns))
+	if len(s.columns) == 0 {
+		for i := range t.columns {
+			cols = append(cols, i)
+		}
+	}
+	for _, name := range s.columns {
+		i := t.columnIndex(name)
+		if i == -1 {
+			return sqlError(1054, "42S22", "Unknown column '%s' in 'field list'", name)
+		}
+		cols = append(cols, i)
+	}
+
+	// 要插入的值
+	var valuess [][]interface{}
+	if s.sel != nil {
+		rows, err := db.query(s.sel, e)
+		if err != nil {
+			return err
+		}
+		valuess = rows.rows
+	} else {
+		for _, row := range s.rows {
+			values := make([]interface{}, 0, len(row))
+			for _, x := range row {
+				v, err := e.eval(x)
+				if err != nil {
+					return err
+				}
+				values = append(values, v)
+			}
+			valuess = append(valuess, values)
+		}
+	}
+
+	for _, values := range valuess {
+		if len(values) != len(cols) {
+			return sqlError(1136, "21S01", "Column count doesn't match value count at row 1")
+		}
+		vals := make([]interface{}, len(t.columns))
+		set := make([]bool, len(t.columns))
+		for n, c := range cols {
+			v, err := convertValue(t.columns[c], values[n])
+			if err != nil {
+				return err
+			}
+			vals[c] = v
+			set[c] = true
+		}
+		for i, col := range t.columns {
+			if col.autoInc {
+				if f, _ := toFloat(vals[i]); vals[i] == nil || f == 0 {
+					vals[i] = t.autoInc
+				}
+				id := vals[i].(int64)
+				if id >= t.autoInc {
+					t.autoInc = id + 1
+				}
+				result.lastInsertId = id
+				continue
+			}
+			if set[i] {
+				continue
+			}
+			if col.def != nil {
+				v, err := e.eval(col.def)
+				if err != nil {
+					return err
+				}
+				if vals[i], err = convertValue(col, v); err != nil {
+					return err
+				}
+			} else if col.notNull {
+				return sqlError(1364, "HY000", "Field '%s' doesn't have a default value", col.name)
+			}
+		}
+		if err := t.checkNotNull(vals); err != nil {
+			return err
+		}
+		if err := t.checkUnique(vals, nil); err != nil {
+			return err
+		}
+		row := &memRow{vals: vals}
+		t.rows = append(t.rows, row)
+		*undo = append(*undo, undoOp{table: t, new: row})
+		result.rowsAffected++
+	}
+	return nil
+}
+
+func (db *memDB) update(s *updateStmt, e *evaluator, result *memResult, undo *[]undoOp) error {
+	t, err := db.table(s.table)
+	if err != nil {
+		return err
+	}
+	sets := make([]int, 0, len(s.sets))
+	for _, set := range s.sets {
+		i := t.columnIndex(set.column)
+		if i == -1 {
+			return sqlError(1054, "42S22", "Unknown column '%s' in 'field list'", set.column)
+		}
+		sets = append(sets, i)
+	}
+	matched, err := db.filter(t, s.where, e)
+	if err != nil {
+		return err
+	}
+	for _, row := range matched {
+		vals := append([]interface{}{}, row.vals...)
+		// 从左到右计算，后面的表达式使用前面修改后的值
+		sub := &evaluator{db: db, table: t, row: vals, args: e.args, now: e.now}
+		for n, set := range s.sets {
+			v, err := sub.eval(set.e)
+			if err != nil {
+				return err
+			}
+			if vals[sets[n]], err = convertValue(t.columns[sets[n]], v); err != nil {
+				return err
+			}
+		}
+		changed := false
+		for i := range vals {
+			if compareNull(vals[i], row.vals[i]) != 0 {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue // 值没变化不算影响的行数
+		}
+		for i, col := range t.columns {
+			if col.onUpdateNow && compareNull(vals[i], row.vals[i]) == 0 {
+				vals[i], _ = convertValue(col, e.now)
+			}
+		}
+		if err := t.checkNotNull(vals); err != nil {
+			return err
+		}
+		if err := t.checkUnique(vals, row); err != nil {
+			return err
+		}
+		nrow := &memRow{vals: vals}
+		t.rows[t.rowIndex(row)] = nrow
+		*undo = append(*undo, undoOp{table: t, old: row, new: nrow})
+		result.rowsAffected++
+	}
+	return nil
+}
+
+func (db *memDB) delete(s *deleteStmt, e *evaluator, result *memResult, undo *[]undoOp) error {
+	t, err := db.table(s.table)
+	if err != nil {
+		return err
+	}
+	matched, err := db.filter(t, s.where, e)
+	if err != nil {
+		return err
+	}
+	for _, row := range matched {
+		at := t.rowIndex(row)
+		t.rows = append(t.rows[:at], t.rows[at+1:]...)
+		*undo = append(*undo, undoOp{table: t, old: row})
+		result.rowsAffected++
+	}
+	return nil
+}
+
+// 驱动 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type memDriver struct{}
+
+func (d *memDriver) Open(name string) (driver.Conn, error) {
+	return &memConn{db: getMemDB(name)}, nil
+}
+
+type memConn struct {
+	db *memDB
+	tx *memTx
+}
+
+type memTx struct {
+	conn *memConn
+	undo []undoOp
+}
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{conn: c, query: query}, nil
+}
+
+func (c *memConn) Close() error {
+	return nil
+}
+
+func (c *memConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *memConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.tx = &memTx{conn: c}
+	return c.tx, nil
+}
+
+func (c *memConn) exec(query string, args []driver.NamedValue) (*memResult, *memRows, error) {
+	values := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		values = append(values, arg.Value)
+	}
+	if c.tx != nil {
+		return c.db.exec(query, values, &c.tx.undo)
+	}
+	return c.db.exec(query, values, nil)
+}
+
+func (c *memConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, _, err := c.exec(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *memConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	_, rows, err := c.exec(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (tx *memTx) Commit() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	tx.conn.db.mu.Lock()
+	rollback(tx.undo)
+	tx.conn.db.mu.Unlock()
+	tx.conn.tx = nil
+	return nil
+}
+
+type memStmt struct {
+	conn  *memConn
+	query string
+}
+
+func (s *memStmt) Close() error {
+	return nil
+}
+
+func (s *memStmt) NumInput() int {
+	return -1
+}
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, 0, len(args))
+	for i, v := range args {
+		named = append(named, driver.NamedValue{Ordinal: i + 1, Value: v})
+	}
+	return named
+}
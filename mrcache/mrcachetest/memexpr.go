@@ -0,0 +1,816 @@
+package mrcachetest
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 内存mysql的值和表达式计算
+// 值统一使用 nil int64 float64 string []byte time.Time jsonText 表示
+// 字符串比较和mysql默认的排序规则一样忽略大小写，[]byte按字节比较
+
+// 字段的存储类型
+type colKind int
+
+const (
+	kindString colKind = iota
+	kindInt
+	kindFloat
+	kindTime
+	kindDate
+	kindBytes
+	kindJSON
+)
+
+// JSON类型的值，和普通字符串区分，JSON函数中不会当成字符串处理
+type jsonText string
+
+// 根据字段类型获取存储类型，返回值：存储类型 时间的小数位数
+func columnKind(typ string, params []string) (colKind, int) {
+	switch typ {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT", "BIT", "BOOL", "BOOLEAN", "YEAR", "SERIAL":
+		return kindInt, 0
+	case "FLOAT", "DOUBLE", "REAL", "DECIMAL", "NUMERIC", "DEC", "FIXED":
+		return kindFloat, 0
+	case "DATETIME", "TIMESTAMP":
+		fsp := 0
+		if len(params) > 0 {
+			fsp, _ = strconv.Atoi(params[0])
+		}
+		return kindTime, fsp
+	case "DATE":
+		return kindDate, 0
+	case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BINARY", "VARBINARY":
+		return kindBytes, 0
+	case "JSON":
+		return kindJSON, 0
+	}
+	return kindString, 0
+}
+
+func sqlError(number uint16, state string, format string, args ...interface{}) error {
+	err := &mysqlError{Number: number, Message: fmt.Sprintf(format, args...)}
+	copy(err.SQLState[:], state)
+	return err
+}
+
+// 转换成字段的存储类型
+func convertValue(col *memColumn, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch col.kind {
+	case kindInt:
+		switch val := v.(type) {
+		case int64:
+			return val, nil
+		case float64:
+			return int64(math.Round(val)), nil
+		case bool:
+			if val {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case time.Time:
+			f, _ := toFloat(val)
+			return int64(f), nil
+		}
+		f, ok := parseFloat(toString(v))
+		if !ok {
+			return nil, sqlError(1366, "HY000", "Incorrect integer value: '%s' for column '%s' at row 1", toString(v), col.name)
+		}
+		return int64(math.Round(f)), nil
+	case kindFloat:
+		f, ok := toFloat(v)
+		if !ok {
+			return nil, sqlError(1366, "HY000", "Incorrect decimal value: '%s' for column '%s' at row 1", toString(v), col.name)
+		}
+		return f, nil
+	case kindTime, kindDate:
+		t, ok := toTime(v)
+		if !ok {
+			return nil, sqlError(1292, "22007", "Incorrect datetime value: '%s' for column '%s' at row 1", toString(v), col.name)
+		}
+		if t.IsZero() {
+			return t, nil
+		}
+		if col.kind == kindDate {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()), nil
+		}
+		d := time.Second
+		for i := 0; i < col.fsp && i < 9; i++ {
+			d /= 10
+		}
+		return t.Round(d), nil
+	case kindBytes:
+		return append([]byte{}, toBytes(v)...), nil
+	case kindJSON:
+		if j, ok := v.(jsonText); ok {
+			return j, nil
+		}
+		doc, err := parseJSON(toString(v))
+		if err != nil {
+			return nil, sqlError(3140, "22032", "Invalid JSON text: \"%s\" at position 0 in value for column '%s'.", err.Error(), col.name)
+		}
+		return jsonText(formatJSON(doc)), nil
+	}
+	return toString(v), nil
+}
+
+// 返回给驱动的值
+func driverValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case string:
+		return []byte(val)
+	case jsonText:
+		return []byte(val)
+	case []byte:
+		return append([]byte{}, val...)
+	case time.Time:
+		if val.IsZero() {
+			return val
+		}
+		return val.In(time.Local)
+	}
+	return v
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case jsonText:
+		return string(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		if val {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		if val.IsZero() {
+			return "0000-00-00 00:00:00"
+		}
+		val = val.In(time.Local)
+		if val.Nanosecond() != 0 {
+			return strings.TrimRight(val.Format("2006-01-02 15:04:05.000000"), "0")
+		}
+		return val.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprint(v)
+}
+
+func toBytes(v interface{}) []byte {
+	if b, ok := v.([]byte); ok {
+		return b
+	}
+	return []byte(toString(v))
+}
+
+// 解析字符串开头的数字，和mysql一样忽略后面不能解析的部分
+func parseFloat(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	end := 0
+	for end < len(s) && strings.IndexByte("+-.0123456789eE", s[end]) != -1 {
+		end++
+	}
+	for ; end > 0; end-- {
+		if f, err := strconv.ParseFloat(s[:end], 64); err == nil {
+			return f, false
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case int64:
+		return float64(val), true
+	case float64:
+		return val, true
+	case bool:
+		if val {
+			return 1, true
+		}
+		return 0, true
+	case time.Time:
+		val = val.In(time.Local)
+		return float64(val.Year())*1e10 + float64(val.Month())*1e8 + float64(val.Day())*1e6 + float64(val.Hour())*1e4 + float64(val.Minute())*1e2 + float64(val.Second()), true
+	case nil:
+		return 0, false
+	}
+	return parseFloat(toString(v))
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, true
+	case int64, float64, bool, nil:
+		return time.Time{}, false
+	}
+	s := strings.TrimSpace(toString(v))
+	if strings.HasPrefix(s, "0000-00-00") {
+		return time.Time{}, true
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func isNumeric(v interface{}) bool {
+	switch v.(type) {
+	case int64, float64, bool:
+		return true
+	}
+	return false
+}
+
+// 比较两个非空的值
+func compareValues(a, b interface{}) int {
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := toTime(b); ok {
+			return ta.Compare(tb)
+		}
+	}
+	if tb, ok := b.(time.Time); ok {
+		if ta, ok := toTime(a); ok {
+			return ta.Compare(tb)
+		}
+	}
+	if isNumeric(a) || isNumeric(b) {
+		ia, aok := a.(int64)
+		ib, bok := b.(int64)
+		if aok && bok {
+			switch {
+			case ia < ib:
+				return -1
+			case ia > ib:
+				return 1
+			}
+			return 0
+		}
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	_, ab := a.([]byte)
+	_, bb := b.([]byte)
+	if ab || bb {
+		return bytes.Compare(toBytes(a), toBytes(b))
+	}
+	return strings.Compare(strings.ToLower(toString(a)), strings.ToLower(toString(b)))
+}
+
+// 排序比较，NULL最小
+func compareNull(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return compareValues(a, b)
+}
+
+func truthy(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	if _, ok := v.(time.Time); ok {
+		return true
+	}
+	f, _ := toFloat(v)
+	return f != 0
+}
+
+func boolValue(b bool) interface{} {
+	if b {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+// LIKE匹配，支持 % _ 和\转义，[]byte区分大小写
+func likeMatch(s, pattern string, caseSensitive bool) bool {
+	if !caseSensitive {
+		s = strings.ToLower(s)
+		pattern = strings.ToLower(pattern)
+	}
+	var match func(s, p string) bool
+	match = func(s, p string) bool {
+		for len(p) > 0 {
+			switch p[0] {
+			case '%':
+				for len(p) > 0 && p[0] == '%' {
+					p = p[1:]
+				}
+				if len(p) == 0 {
+					return true
+				}
+				for i := 0; i <= len(s); i++ {
+					if match(s[i:], p) {
+						return true
+					}
+				}
+				return false
+			case '_':
+				if len(s) == 0 {
+					return false
+				}
+				_, n := utf8.DecodeRuneInString(s)
+				s, p = s[n:], p[1:]
+			default:
+				if p[0] == '\\' && len(p) > 1 {
+					p = p[1:]
+				}
+				if len(s) == 0 || s[0] != p[0] {
+					return false
+				}
+				s, p = s[1:], p[1:]
+			}
+		}
+		return len(s) == 0
+	}
+	return match(s, pattern)
+}
+
+// 表达式计算
+type evaluator struct {
+	db    *memDB
+	table *memTable
+	row   []interface{}
+	args  []interface{}
+	group [][]interface{} // 聚合时满足条件的所有行
+	now   time.Time
+}
+
+func (e *evaluator) column(name string) (interface{}, error) {
+	if e.table != nil {
+		if i := e.table.columnIndex(name); i != -1 {
+			if e.row == nil {
+				return nil, nil
+			}
+			return e.row[i], nil
+		}
+	}
+	return nil, sqlError(1054, "42S22", "Unknown column '%s' in 'field list'", name)
+}
+
+func (e *evaluator) eval(x expr) (interface{}, error) {
+	switch x := x.(type) {
+	case *litExpr:
+		return x.v, nil
+	case *paramExpr:
+		return e.args[x.i], nil
+	case *colExpr:
+		return e.column(x.name)
+	case *tupleExpr:
+		values := make([]interface{}, 0, len(x.items))
+		for _, item := range x.items {
+			v, err := e.eval(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case *unaryExpr:
+		v, err := e.eval(x.x)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		if x.op == "NOT" {
+			return boolValue(!truthy(v)), nil
+		}
+		switch val := v.(type) {
+		case int64:
+			return -val, nil
+		}
+		f, _ := toFloat(v)
+		return -f, nil
+	case *binaryExpr:
+		return e.evalBinary(x)
+	case *isNullExpr:
+		v, err := e.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		return boolValue((v == nil) != x.not), nil
+	case *inExpr:
+		v, err := e.eval(x.x)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		sawNull := false
+		for _, item := range x.list {
+			iv, err := e.eval(item)
+			if err != nil {
+				return nil, err
+			}
+			eq, null := equalValues(v, iv)
+			if null {
+				sawNull = true
+				continue
+			}
+			if eq {
+				return boolValue(!x.not), nil
+			}
+		}
+		if sawNull {
+			return nil, nil
+		}
+		return boolValue(x.not), nil
+	case *likeExpr:
+		v, err := e.eval(x.x)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		p, err := e.eval(x.pattern)
+		if err != nil || p == nil {
+			return nil, err
+		}
+		_, vb := v.([]byte)
+		_, pb := p.([]byte)
+		return boolValue(likeMatch(toString(v), toString(p), vb || pb) != x.not), nil
+	case *betweenExpr:
+		v, err := e.eval(x.x)
+		if err != nil {
+			return nil, err
+		}
+		lo, err := e.eval(x.lo)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := e.eval(x.hi)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil || lo == nil || hi == nil {
+			return nil, nil
+		}
+		in := compareValues(v, lo) >= 0 && compareValues(v, hi) <= 0
+		return boolValue(in != x.not), nil
+	case *caseExpr:
+		var operand interface{}
+		if x.operand != nil {
+			var err error
+			if operand, err = e.eval(x.operand); err != nil {
+				return nil, err
+			}
+		}
+		for _, w := range x.whens {
+			c, err := e.eval(w.cond)
+			if err != nil {
+				return nil, err
+			}
+			hit := false
+			if x.operand != nil {
+				eq, null := equalValues(operand, c)
+				hit = eq && !null
+			} else {
+				hit = truthy(c)
+			}
+			if hit {
+				return e.eval(w.then)
+			}
+		}
+		if x.els != nil {
+			return e.eval(x.els)
+		}
+		return nil, nil
+	case *funcExpr:
+		return e.evalFunc(x)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", x)
+}
+
+// 相等比较，支持元组，返回值：是否相等 是否有NULL参与比较
+func equalValues(a, b interface{}) (bool, bool) {
+	ta, aok := a.([]interface{})
+	tb, bok := b.([]interface{})
+	if aok || bok {
+		if !aok || !bok || len(ta) != len(tb) {
+			return false, false
+		}
+		null := false
+		for i := range ta {
+			eq, n := equalValues(ta[i], tb[i])
+			if n {
+				null = true
+				continue
+			}
+			if !eq {
+				return false, false
+			}
+		}
+		return !null, null
+	}
+	if a == nil || b == nil {
+		return false, true
+	}
+	return compareValues(a, b) == 0, false
+}
+
+func (e *evaluator) evalBinary(x *binaryExpr) (interface{}, error) {
+	l, err := e.eval(x.l)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.eval(x.r)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "AND":
+		if (l != nil && !truthy(l)) || (r != nil && !truthy(r)) {
+			return int64(0), nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return int64(1), nil
+	case "OR":
+		if truthy(l) || truthy(r) {
+			return int64(1), nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return int64(0), nil
+	case "<=>":
+		if l == nil || r == nil {
+			return boolValue(l == nil && r == nil), nil
+		}
+		eq, _ := equalValues(l, r)
+		return boolValue(eq), nil
+	case "=", "<>":
+		eq, null := equalValues(l, r)
+		if null {
+			return nil, nil
+		}
+		return boolValue(eq == (x.op == "=")), nil
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	switch x.op {
+	case "<":
+		return boolValue(compareValues(l, r) < 0), nil
+	case "<=":
+		return boolValue(compareValues(l, r) <= 0), nil
+	case ">":
+		return boolValue(compareValues(l, r) > 0), nil
+	case ">=":
+		return boolValue(compareValues(l, r) >= 0), nil
+	}
+	// 算术运算
+	li, lok := l.(int64)
+	ri, rok := r.(int64)
+	if lok && rok && x.op != "/" {
+		switch x.op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "%":
+			if ri == 0 {
+				return nil, nil
+			}
+			return li % ri, nil
+		}
+	}
+	lf, _ := toFloat(l)
+	rf, _ := toFloat(r)
+	switch x.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, nil
+		}
+		return lf / rf, nil
+	case "%":
+		if rf == 0 {
+			return nil, nil
+		}
+		return math.Mod(lf, rf), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", x.op)
+}
+
+func isAggregate(name string) bool {
+	switch name {
+	case "COUNT", "MAX", "MIN", "SUM", "AVG":
+		return true
+	}
+	return false
+}
+
+// 表达式中是否有聚合函数
+func hasAggregate(x expr) bool {
+	switch x := x.(type) {
+	case *funcExpr:
+		if isAggregate(x.name) {
+			return true
+		}
+		for _, arg := range x.args {
+			if hasAggregate(arg) {
+				return true
+			}
+		}
+	case *binaryExpr:
+		return hasAggregate(x.l) || hasAggregate(x.r)
+	case *unaryExpr:
+		return hasAggregate(x.x)
+	}
+	return false
+}
+
+func (e *evaluator) evalAggregate(x *funcExpr) (interface{}, error) {
+	if x.name == "COUNT" && x.star {
+		return int64(len(e.group)), nil
+	}
+	if len(x.args) != 1 {
+		return nil, sqlError(1582, "42000", "Incorrect parameter count in the call to native function '%s'", x.name)
+	}
+	var rst interface{}
+	count := int64(0)
+	sum := float64(0)
+	sumInt, isInt := int64(0), true
+	for _, row := range e.group {
+		sub := &evaluator{db: e.db, table: e.table, row: row, args: e.args, now: e.now}
+		v, err := sub.eval(x.args[0])
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		count++
+		switch x.name {
+		case "MAX":
+			if rst == nil || compareValues(v, rst) > 0 {
+				rst = v
+			}
+		case "MIN":
+			if rst == nil || compareValues(v, rst) < 0 {
+				rst = v
+			}
+		case "SUM", "AVG":
+			if i, ok := v.(int64); ok {
+				sumInt += i
+			} else {
+				isInt = false
+			}
+			f, _ := toFloat(v)
+			sum += f
+		}
+	}
+	switch x.name {
+	case "COUNT":
+		return count, nil
+	case "SUM":
+		if count == 0 {
+			return nil, nil
+		}
+		if isInt {
+			return sumInt, nil
+		}
+		return sum, nil
+	case "AVG":
+		if count == 0 {
+			return nil, nil
+		}
+		return sum / float64(count), nil
+	}
+	return rst, nil
+}
+
+func (e *evaluator) evalFunc(x *funcExpr) (interface{}, error) {
+	if isAggregate(x.name) {
+		if e.group == nil {
+			return nil, sqlError(1111, "HY000", "Invalid use of group function")
+		}
+		return e.evalAggregate(x)
+	}
+	args := make([]interface{}, 0, len(x.args))
+	for _, arg := range x.args {
+		v, err := e.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	argc := func(min, max int) error {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			return sqlError(1582, "42000", "Incorrect parameter count in the call to native function '%s'", x.name)
+		}
+		return nil
+	}
+	switch x.name {
+	case "DATABASE", "SCHEMA":
+		return e.db.name, nil
+	case "NOW", "CURRENT_TIMESTAMP", "LOCALTIMESTAMP", "SYSDATE":
+		return e.now, nil
+	case "CURRENT_DATE", "CURDATE":
+		return time.Date(e.now.Year(), e.now.Month(), e.now.Day(), 0, 0, 0, 0, e.now.Location()), nil
+	case "UNIX_TIMESTAMP":
+		if len(args) == 0 {
+			return e.now.Unix(), nil
+		}
+		t, ok := toTime(args[0])
+		if !ok {
+			return nil, nil
+		}
+		return t.Unix(), nil
+	case "IF":
+		if err := argc(3, 3); err != nil {
+			return nil, err
+		}
+		if truthy(args[0]) {
+			return args[1], nil
+		}
+		return args[2], nil
+	case "IFNULL", "COALESCE":
+		for _, v := range args {
+			if v != nil {
+				return v, nil
+			}
+		}
+		return nil, nil
+	case "LOWER", "LCASE", "UPPER", "UCASE":
+		if err := argc(1, 1); err != nil || args[0] == nil {
+			return nil, err
+		}
+		if x.name == "LOWER" || x.name == "LCASE" {
+			return strings.ToLower(toString(args[0])), nil
+		}
+		return strings.ToUpper(toString(args[0])), nil
+	case "CONCAT":
+		var s strings.Builder
+		for _, v := range args {
+			if v == nil {
+				return nil, nil
+			}
+			s.WriteString(toString(v))
+		}
+		return s.String(), nil
+	case "LENGTH":
+		if err := argc(1, 1); err != nil || args[0] == nil {
+			return nil, err
+		}
+		return int64(len(toBytes(args[0]))), nil
+	case "JSON_TYPE", "JSON_ARRAY", "JSON_OBJECT", "JSON_ARRAY_APPEND", "JSON_SEARCH", "JSON_REMOVE", "JSON_UNQUOTE", "JSON_EXTRACT", "JSON_CONTAINS", "JSON_LENGTH", "JSON_VALID":
+		return evalJSONFunc(x.name, args)
+	}
+	return nil, sqlError(1305, "42000", "FUNCTION %s.%s does not exist", e.db.name, strings.ToLower(x.name))
+}
+
+// 标识符是否不需要加引号
+func isPlainIdent(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,531 @@
+package mrcachetest
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 内存mysql的JSON函数，路径只支持 $ $[n] $.key 的组合
+
+func parseJSON(s string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("The document root must not be followed by other values")
+	}
+	return doc, nil
+}
+
+// 和mysql的JSON输出格式一致 ["a", 1] {"k": "v"}，对象的key按长度和字节序排序
+func formatJSON(doc interface{}) string {
+	var buf bytes.Buffer
+	writeJSON(&buf, doc)
+	return buf.String()
+}
+
+func writeJSON(buf *bytes.Buffer, doc interface{}) {
+	switch val := doc.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(val))
+	case json.Number:
+		buf.WriteString(val.String())
+	case string:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(val)
+		buf.Truncate(buf.Len() - 1) // Encode会添加换行
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, v := range val {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeJSON(buf, v)
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		buf.WriteByte('{')
+		for i, k := range jsonKeys(val) {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeJSON(buf, k)
+			buf.WriteString(": ")
+			writeJSON(buf, val[k])
+		}
+		buf.WriteByte('}')
+	}
+}
+
+func jsonKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) < len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// 函数参数转换成JSON文档，非JSON类型的字符串按JSON文本解析
+func jsonDoc(v interface{}) (interface{}, error) {
+	doc, err := parseJSON(toString(v))
+	if err != nil {
+		return nil, sqlError(3141, "22032", "Invalid JSON text in argument 1 to function: %s", err.Error())
+	}
+	return doc, nil
+}
+
+// 函数参数转换成JSON的值，JSON类型解析，其他类型作为标量
+func jsonValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case jsonText:
+		doc, _ := parseJSON(string(val))
+		return doc
+	case int64:
+		return json.Number(strconv.FormatInt(val, 10))
+	case float64:
+		return json.Number(strconv.FormatFloat(val, 'g', -1, 64))
+	case bool:
+		return val
+	case time.Time:
+		return toString(val)
+	}
+	return toString(v)
+}
+
+// 路径的一段，key为空时表示数组下标
+type jsonLeg struct {
+	key   string
+	index int
+}
+
+func parseJSONPath(v interface{}) ([]jsonLeg, error) {
+	path := strings.TrimSpace(toString(v))
+	invalid := sqlError(3143, "42000", "Invalid JSON path expression. The error is around character position 0 in '%s'.", path)
+	if !strings.HasPrefix(path, "$") {
+		return nil, invalid
+	}
+	var legs []jsonLeg
+	s := path[1:]
+	for len(s) > 0 {
+		switch s[0] {
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, invalid
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(s[1:end]))
+			if err != nil || n < 0 {
+				return nil, invalid
+			}
+			legs = append(legs, jsonLeg{index: n})
+			s = s[end+1:]
+		case '.':
+			s = s[1:]
+			if strings.HasPrefix(s, "\"") {
+				end := strings.IndexByte(s[1:], '"')
+				if end == -1 {
+					return nil, invalid
+				}
+				legs = append(legs, jsonLeg{key: s[1 : end+1]})
+				s = s[end+2:]
+				continue
+			}
+			end := strings.IndexAny(s, ".[")
+			if end == -1 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, invalid
+			}
+			legs = append(legs, jsonLeg{key: s[:end]})
+			s = s[end:]
+		default:
+			return nil, invalid
+		}
+	}
+	return legs, nil
+}
+
+func formatJSONPath(legs []jsonLeg) string {
+	var s strings.Builder
+	s.WriteString("$")
+	for _, leg := range legs {
+		if len(leg.key) == 0 {
+			s.WriteString("[" + strconv.Itoa(leg.index) + "]")
+		} else if isPlainIdent(leg.key) {
+			s.WriteString("." + leg.key)
+		} else {
+			s.WriteString("." + strconv.Quote(leg.key))
+		}
+	}
+	return s.String()
+}
+
+func jsonGet(doc interface{}, legs []jsonLeg) (interface{}, bool) {
+	for _, leg := range legs {
+		if len(leg.key) == 0 {
+			arr, ok := doc.([]interface{})
+			if !ok {
+				// mysql中标量可以当成只有一个元素的数组
+				if leg.index == 0 {
+					continue
+				}
+				return nil, false
+			}
+			if leg.index >= len(arr) {
+				return nil, false
+			}
+			doc = arr[leg.index]
+		} else {
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = obj[leg.key]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return doc, true
+}
+
+// 修改路径上的值，fn返回新的值和是否删除，路径不存在时不修改
+func jsonModify(doc interface{}, legs []jsonLeg, fn func(v interface{}) (interface{}, bool)) interface{} {
+	if len(legs) == 0 {
+		v, _ := fn(doc)
+		return v
+	}
+	leg := legs[0]
+	if len(leg.key) == 0 {
+		arr, ok := doc.([]interface{})
+		if !ok || leg.index >= len(arr) {
+			return doc
+		}
+		arr = append([]interface{}{}, arr...)
+		if len(legs) == 1 {
+			v, del := fn(arr[leg.index])
+			if del {
+				return append(arr[:leg.index], arr[leg.index+1:]...)
+			}
+			arr[leg.index] = v
+			return arr
+		}
+		arr[leg.index] = jsonModify(arr[leg.index], legs[1:], fn)
+		return arr
+	}
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return doc
+	}
+	child, ok := obj[leg.key]
+	if !ok {
+		return doc
+	}
+	cp := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		cp[k] = v
+	}
+	if len(legs) == 1 {
+		v, del := fn(child)
+		if del {
+			delete(cp, leg.key)
+		} else {
+			cp[leg.key] = v
+		}
+		return cp
+	}
+	cp[leg.key] = jsonModify(child, legs[1:], fn)
+	return cp
+}
+
+// 按文档顺序查找匹配的字符串，返回路径
+func jsonSearch(doc interface{}, legs []jsonLeg, pattern string, all bool, paths *[]string) {
+	if !all && len(*paths) > 0 {
+		return
+	}
+	switch val := doc.(type) {
+	case string:
+		if likeMatch(val, pattern, false) {
+			*paths = append(*paths, formatJSONPath(legs))
+		}
+	case []interface{}:
+		for i, v := range val {
+			jsonSearch(v, append(legs[:len(legs):len(legs)], jsonLeg{index: i}), pattern, all, paths)
+		}
+	case map[string]interface{}:
+		for _, k := range jsonKeys(val) {
+			jsonSearch(val[k], append(legs[:len(legs):len(legs)], jsonLeg{key: k}), pattern, all, paths)
+		}
+	}
+}
+
+func jsonTypeName(doc interface{}) string {
+	switch val := doc.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		return "BOOLEAN"
+	case json.Number:
+		if strings.ContainsAny(val.String(), ".eE") {
+			return "DOUBLE"
+		}
+		return "INTEGER"
+	case string:
+		return "STRING"
+	case []interface{}:
+		return "ARRAY"
+	}
+	return "OBJECT"
+}
+
+func evalJSONFunc(name string, args []interface{}) (interface{}, error) {
+	argc := func(min, max int) error {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			return sqlError(1582, "42000", "Incorrect parameter count in the call to native function '%s'", name)
+		}
+		return nil
+	}
+	switch name {
+	case "JSON_ARRAY":
+		arr := make([]interface{}, 0, len(args))
+		for _, v := range args {
+			arr = append(arr, jsonValue(v))
+		}
+		return jsonText(formatJSON(arr)), nil
+	case "JSON_OBJECT":
+		if len(args)%2 != 0 {
+			return nil, sqlError(1582, "42000", "Incorrect parameter count in the call to native function '%s'", name)
+		}
+		obj := make(map[string]interface{}, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			obj[toString(args[i])] = jsonValue(args[i+1])
+		}
+		return jsonText(formatJSON(obj)), nil
+	case "JSON_UNQUOTE":
+		if err := argc(1, 1); err != nil || args[0] == nil {
+			return nil, err
+		}
+		s := toString(args[0])
+		if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+			var rst string
+			if err := json.Unmarshal([]byte(s), &rst); err == nil {
+				return rst, nil
+			}
+		}
+		return s, nil
+	case "JSON_VALID":
+		if err := argc(1, 1); err != nil || args[0] == nil {
+			return nil, err
+		}
+		_, err := parseJSON(toString(args[0]))
+		return boolValue(err == nil), nil
+	}
+
+	// 第一个参数为JSON文档
+	if err := argc(1, -1); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	doc, err := jsonDoc(args[0])
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "JSON_TYPE":
+		if err := argc(1, 1); err != nil {
+			return nil, err
+		}
+		return jsonTypeName(doc), nil
+	case "JSON_LENGTH":
+		if err := argc(1, 2); err != nil {
+			return nil, err
+		}
+		if len(args) == 2 {
+			legs, err := parseJSONPath(args[1])
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if doc, ok = jsonGet(doc, legs); !ok {
+				return nil, nil
+			}
+		}
+		switch val := doc.(type) {
+		case []interface{}:
+			return int64(len(val)), nil
+		case map[string]interface{}:
+			return int64(len(val)), nil
+		}
+		return int64(1), nil
+	case "JSON_EXTRACT":
+		if err := argc(2, -1); err != nil {
+			return nil, err
+		}
+		var found []interface{}
+		for _, p := range args[1:] {
+			legs, err := parseJSONPath(p)
+			if err != nil {
+				return nil, err
+			}
+			if v, ok := jsonGet(doc, legs); ok {
+				found = append(found, v)
+			}
+		}
+		switch len(found) {
+		case 0:
+			return nil, nil
+		case 1:
+			if len(args) == 2 {
+				return jsonText(formatJSON(found[0])), nil
+			}
+		}
+		return jsonText(formatJSON(found)), nil
+	case "JSON_CONTAINS":
+		if err := argc(2, 3); err != nil || args[1] == nil {
+			return nil, err
+		}
+		target, err := jsonDoc(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 3 {
+			legs, err := parseJSONPath(args[2])
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if doc, ok = jsonGet(doc, legs); !ok {
+				return nil, nil
+			}
+		}
+		return boolValue(jsonContains(doc, target)), nil
+	case "JSON_ARRAY_APPEND":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return nil, sqlError(1582, "42000", "Incorrect parameter count in the call to native function '%s'", name)
+		}
+		for i := 1; i < len(args); i += 2 {
+			legs, err := parseJSONPath(args[i])
+			if err != nil {
+				return nil, err
+			}
+			v := jsonValue(args[i+1])
+			doc = jsonModify(doc, legs, func(old interface{}) (interface{}, bool) {
+				if arr, ok := old.([]interface{}); ok {
+					return append(append([]interface{}{}, arr...), v), false
+				}
+				return []interface{}{old, v}, false
+			})
+		}
+		return jsonText(formatJSON(doc)), nil
+	case "JSON_REMOVE":
+		if err := argc(2, -1); err != nil {
+			return nil, err
+		}
+		for _, p := range args[1:] {
+			legs, err := parseJSONPath(p)
+			if err != nil {
+				return nil, err
+			}
+			if len(legs) == 0 {
+				return nil, sqlError(3153, "42000", "The path expression '$' is not allowed in this context.")
+			}
+			doc = jsonModify(doc, legs, func(old interface{}) (interface{}, bool) { return nil, true })
+		}
+		return jsonText(formatJSON(doc)), nil
+	case "JSON_SEARCH":
+		if err := argc(3, 5); err != nil {
+			return nil, err
+		}
+		mode := strings.ToLower(toString(args[1]))
+		if mode != "one" && mode != "all" {
+			return nil, sqlError(3144, "42000", "The oneOrAll argument to json_search may take these values: 'one' or 'all'.")
+		}
+		if args[2] == nil {
+			return nil, nil
+		}
+		var legs []jsonLeg
+		if len(args) == 5 {
+			if legs, err = parseJSONPath(args[4]); err != nil {
+				return nil, err
+			}
+			var ok bool
+			if doc, ok = jsonGet(doc, legs); !ok {
+				return nil, nil
+			}
+		}
+		var paths []string
+		jsonSearch(doc, legs, toString(args[2]), mode == "all", &paths)
+		switch len(paths) {
+		case 0:
+			return nil, nil
+		case 1:
+			return jsonText(formatJSON(paths[0])), nil
+		}
+		arr := make([]interface{}, 0, len(paths))
+		for _, p := range paths {
+			arr = append(arr, p)
+		}
+		return jsonText(formatJSON(arr)), nil
+	}
+	return nil, fmt.Errorf("unsupported function %s", name)
+}
+
+func jsonContains(doc, target interface{}) bool {
+	switch t := target.(type) {
+	case []interface{}:
+		arr, ok := doc.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, tv := range t {
+			if !jsonContains(arr, tv) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, tv := range t {
+			v, ok := obj[k]
+			if !ok || !jsonContains(v, tv) {
+				return false
+			}
+		}
+		return true
+	}
+	if arr, ok := doc.([]interface{}); ok {
+		for _, v := range arr {
+			if jsonContains(v, target) {
+				return true
+			}
+		}
+		return false
+	}
+	return formatJSON(doc) == formatJSON(target)
+}
@@ -0,0 +1,1157 @@
+package mrcachetest
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 内存mysql的sql解析，只支持mrcache生成的语句以及常用的建表语句
+
+type tokenKind int
+
+const (
+	tokEOF    tokenKind = iota
+	tokIdent            // 标识符和关键字
+	tokQuoted           // `标识符`
+	tokNumber           // 数字
+	tokString           // 字符串
+	tokParam            // ?
+	tokOp               // 运算符和标点
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // 在sql中的开始位置
+	end  int // 在sql中的结束位置
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= utf8.RuneSelf
+}
+
+func tokenize(sql string) ([]token, error) {
+	toks := make([]token, 0, 64)
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || (c == '-' && strings.HasPrefix(sql[i:], "-- ")):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated comment at %d", i)
+			}
+			i += end + 4
+		case c >= '0' && c <= '9', c == '.' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9':
+			start := i
+			for i < len(sql) && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.') {
+				i++
+			}
+			if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+				i++
+				if i < len(sql) && (sql[i] == '+' || sql[i] == '-') {
+					i++
+				}
+				for i < len(sql) && sql[i] >= '0' && sql[i] <= '9' {
+					i++
+				}
+			}
+			if i < len(sql) && isIdentChar(sql[i]) {
+				// 数字开头的标识符
+				for i < len(sql) && isIdentChar(sql[i]) {
+					i++
+				}
+				toks = append(toks, token{kind: tokIdent, text: sql[start:i], pos: start, end: i})
+				continue
+			}
+			toks = append(toks, token{kind: tokNumber, text: sql[start:i], pos: start, end: i})
+		case isIdentChar(c):
+			start := i
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: sql[start:i], pos: start, end: i})
+		case c == '`':
+			start := i
+			var s strings.Builder
+			i++
+			for {
+				if i >= len(sql) {
+					return nil, fmt.Errorf("unterminated identifier at %d", start)
+				}
+				if sql[i] == '`' {
+					if i+1 < len(sql) && sql[i+1] == '`' {
+						s.WriteByte('`')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				s.WriteByte(sql[i])
+				i++
+			}
+			toks = append(toks, token{kind: tokQuoted, text: s.String(), pos: start, end: i})
+		case c == '\'' || c == '"':
+			start := i
+			var s strings.Builder
+			i++
+			for {
+				if i >= len(sql) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				ch := sql[i]
+				if ch == c {
+					if i+1 < len(sql) && sql[i+1] == c {
+						s.WriteByte(c)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				if ch == '\\' && i+1 < len(sql) {
+					i++
+					switch sql[i] {
+					case 'n':
+						s.WriteByte('\n')
+					case 't':
+						s.WriteByte('\t')
+					case 'r':
+						s.WriteByte('\r')
+					case '0':
+						s.WriteByte(0)
+					case 'b':
+						s.WriteByte('\b')
+					case 'Z':
+						s.WriteByte(26)
+					case '%', '_':
+						s.WriteByte('\\') // LIKE中使用，保留转义符
+						s.WriteByte(sql[i])
+					default:
+						s.WriteByte(sql[i])
+					}
+					i++
+					continue
+				}
+				s.WriteByte(ch)
+				i++
+			}
+			toks = append(toks, token{kind: tokString, text: s.String(), pos: start, end: i})
+		case c == '?':
+			toks = append(toks, token{kind: tokParam, text: "?", pos: i, end: i + 1})
+			i++
+		default:
+			op := string(c)
+			for _, two := range []string{"<=>", "<=", ">=", "<>", "!=", "||", "&&"} {
+				if strings.HasPrefix(sql[i:], two) {
+					op = two
+					break
+				}
+			}
+			if !strings.Contains("=<>!|&(),.*+-/;%", op[:1]) {
+				return nil, fmt.Errorf("unexpected char %q at %d", c, i)
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i, end: i + len(op)})
+			i += len(op)
+		}
+	}
+	toks = append(toks, token{kind: tokEOF, pos: len(sql), end: len(sql)})
+	return toks, nil
+}
+
+// 语句 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type stmt interface{}
+
+type createDatabaseStmt struct {
+	name string
+}
+
+type createTableStmt struct {
+	name        string
+	ifNotExists bool
+	like        string // CREATE TABLE a LIKE b
+	columns     []*memColumn
+	primary     []string
+	uniques     []*indexDef
+	autoInc     int64
+}
+
+type indexDef struct {
+	name string
+	cols []string
+}
+
+type alterTableStmt struct {
+	name   string
+	column *memColumn // 只支持ADD COLUMN
+}
+
+type dropTableStmt struct {
+	names    []string
+	ifExists bool
+}
+
+type truncateStmt struct {
+	name string
+}
+
+type selectItem struct {
+	e    expr
+	name string // 返回的列名
+	star bool   // *
+}
+
+type orderItem struct {
+	e    expr
+	desc bool
+}
+
+type selectStmt struct {
+	items   []*selectItem
+	schema  string
+	table   string // 为空表示没有FROM
+	where   expr
+	orderBy []*orderItem
+	offset  expr
+	limit   expr
+}
+
+type insertStmt struct {
+	table   string
+	columns []string
+	rows    [][]expr
+	sel     *selectStmt // INSERT INTO ... SELECT
+}
+
+type setItem struct {
+	column string
+	e      expr
+}
+
+type updateStmt struct {
+	table string
+	sets  []*setItem
+	where expr
+}
+
+type deleteStmt struct {
+	table string
+	where expr
+}
+
+// 表达式 //////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type expr interface{}
+
+type (
+	litExpr struct {
+		v interface{}
+	}
+	paramExpr struct {
+		i int
+	}
+	colExpr struct {
+		name string
+	}
+	tupleExpr struct {
+		items []expr
+	}
+	unaryExpr struct {
+		op string // NOT -
+		x  expr
+	}
+	binaryExpr struct {
+		op   string // AND OR = <> < <= > >= <=> + - * / %
+		l, r expr
+	}
+	isNullExpr struct {
+		x   expr
+		not bool
+	}
+	inExpr struct {
+		x    expr
+		list []expr
+		not  bool
+	}
+	likeExpr struct {
+		x, pattern expr
+		not        bool
+	}
+	betweenExpr struct {
+		x, lo, hi expr
+		not       bool
+	}
+	caseWhen struct {
+		cond, then expr
+	}
+	caseExpr struct {
+		operand expr
+		whens   []*caseWhen
+		els     expr
+	}
+	funcExpr struct {
+		name string // 大写
+		args []expr
+		star bool // COUNT(*)
+	}
+)
+
+// 解析 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type parser struct {
+	sql    string
+	toks   []token
+	i      int
+	nparam int // ?的数量
+}
+
+func parse(sql string) (stmt, int, error) {
+	toks, err := tokenize(sql)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := &parser{sql: sql, toks: toks}
+	s, err := p.parseStmt()
+	if err != nil {
+		return nil, 0, err
+	}
+	p.acceptOp(";")
+	if p.peek().kind != tokEOF {
+		return nil, 0, p.errorf("unexpected %q", p.peek().text)
+	}
+	return s, p.nparam, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("You have an error in your SQL syntax near '%s': %s", p.sql[p.peek().pos:], fmt.Sprintf(format, args...))
+}
+
+// 当前及之后的token是否为指定的关键字
+func (p *parser) isKw(kws ...string) bool {
+	for i, kw := range kws {
+		if p.i+i >= len(p.toks) {
+			return false
+		}
+		t := p.toks[p.i+i]
+		if t.kind != tokIdent || !strings.EqualFold(t.text, kw) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *parser) acceptKw(kws ...string) bool {
+	if p.isKw(kws...) {
+		p.i += len(kws)
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKw(kws ...string) error {
+	if !p.acceptKw(kws...) {
+		return p.errorf("expect %s", strings.Join(kws, " "))
+	}
+	return nil
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *parser) acceptOp(op string) bool {
+	if p.isOp(op) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.acceptOp(op) {
+		return p.errorf("expect %s", op)
+	}
+	return nil
+}
+
+// 当前token是否为子句的关键字
+func (p *parser) isReserved() bool {
+	for _, kw := range []string{"FROM", "WHERE", "ORDER", "GROUP", "HAVING", "LIMIT", "FOR", "UNION"} {
+		if p.isKw(kw) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent && t.kind != tokQuoted {
+		return "", p.errorf("expect identifier")
+	}
+	p.i++
+	return t.text, nil
+}
+
+// 表名，可以带库名
+func (p *parser) tableName() (string, string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return "", "", err
+	}
+	if p.acceptOp(".") {
+		table, err := p.ident()
+		return name, table, err
+	}
+	return "", name, nil
+}
+
+// 跳过当前token，如果是括号跳过整个括号
+func (p *parser) skip() {
+	depth := 0
+	for {
+		t := p.next()
+		if t.kind == tokEOF {
+			return
+		}
+		if t.kind == tokOp && t.text == "(" {
+			depth++
+		} else if t.kind == tokOp && t.text == ")" {
+			depth--
+		}
+		if depth <= 0 {
+			return
+		}
+	}
+}
+
+func (p *parser) parseStmt() (stmt, error) {
+	switch {
+	case p.isKw("SELECT"):
+		return p.parseSelect()
+	case p.acceptKw("INSERT"):
+		return p.parseInsert()
+	case p.acceptKw("UPDATE"):
+		return p.parseUpdate()
+	case p.acceptKw("DELETE"):
+		return p.parseDelete()
+	case p.acceptKw("CREATE"):
+		if p.acceptKw("DATABASE") || p.acceptKw("SCHEMA") {
+			p.acceptKw("IF", "NOT", "EXISTS")
+			name, err := p.ident()
+			for p.peek().kind != tokEOF && !p.isOp(";") {
+				p.next() // 字符集等参数
+			}
+			return &createDatabaseStmt{name: name}, err
+		}
+		return p.parseCreateTable()
+	case p.acceptKw("ALTER"):
+		return p.parseAlterTable()
+	case p.acceptKw("DROP"):
+		if err := p.expectKw("TABLE"); err != nil {
+			return nil, err
+		}
+		s := &dropTableStmt{ifExists: p.acceptKw("IF", "EXISTS")}
+		for {
+			_, name, err := p.tableName()
+			if err != nil {
+				return nil, err
+			}
+			s.names = append(s.names, name)
+			if !p.acceptOp(",") {
+				return s, nil
+			}
+		}
+	case p.acceptKw("TRUNCATE"):
+		p.acceptKw("TABLE")
+		_, name, err := p.tableName()
+		return &truncateStmt{name: name}, err
+	}
+	return nil, p.errorf("unsupported statement")
+}
+
+func (p *parser) parseSelect() (*selectStmt, error) {
+	if err := p.expectKw("SELECT"); err != nil {
+		return nil, err
+	}
+	s := &selectStmt{}
+	for {
+		if p.acceptOp("*") {
+			s.items = append(s.items, &selectItem{star: true})
+		} else {
+			start := p.peek().pos
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			item := &selectItem{e: e, name: strings.TrimSpace(p.sql[start:p.toks[p.i-1].end])}
+			if c, ok := e.(*colExpr); ok {
+				item.name = c.name
+			}
+			if p.acceptKw("AS") || p.peek().kind == tokQuoted || (p.peek().kind == tokIdent && !p.isReserved()) {
+				if item.name, err = p.ident(); err != nil {
+					return nil, err
+				}
+			}
+			s.items = append(s.items, item)
+		}
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	if p.acceptKw("FROM") {
+		var err error
+		if s.schema, s.table, err = p.tableName(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKw("WHERE") {
+		var err error
+		if s.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKw("ORDER", "BY") {
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			item := &orderItem{e: e}
+			if p.acceptKw("DESC") {
+				item.desc = true
+			} else {
+				p.acceptKw("ASC")
+			}
+			s.orderBy = append(s.orderBy, item)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKw("LIMIT") {
+		first, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		s.limit = first
+		if p.acceptOp(",") {
+			s.offset = first
+			if s.limit, err = p.parsePrimary(); err != nil {
+				return nil, err
+			}
+		} else if p.acceptKw("OFFSET") {
+			if s.offset, err = p.parsePrimary(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.acceptKw("FOR", "UPDATE")
+	return s, nil
+}
+
+func (p *parser) parseInsert() (stmt, error) {
+	p.acceptKw("IGNORE")
+	p.acceptKw("INTO")
+	_, table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	s := &insertStmt{table: table}
+	if p.acceptOp("(") {
+		for {
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			s.columns = append(s.columns, name)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+	if p.isKw("SELECT") {
+		s.sel, err = p.parseSelect()
+		return s, err
+	}
+	if !p.acceptKw("VALUES") && !p.acceptKw("VALUE") {
+		return nil, p.errorf("expect VALUES")
+	}
+	for {
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		var row []expr
+		for !p.isOp(")") {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		s.rows = append(s.rows, row)
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	if p.isKw("ON", "DUPLICATE") {
+		return nil, p.errorf("ON DUPLICATE KEY UPDATE not supported")
+	}
+	return s, nil
+}
+
+func (p *parser) parseUpdate() (stmt, error) {
+	_, table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKw("SET"); err != nil {
+		return nil, err
+	}
+	s := &updateStmt{table: table}
+	for {
+		_, column, err := p.tableName() // 可能带表名
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOp("="); err != nil {
+			return nil, err
+		}
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		s.sets = append(s.sets, &setItem{column: column, e: e})
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	if p.acceptKw("WHERE") {
+		if s.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) parseDelete() (stmt, error) {
+	if err := p.expectKw("FROM"); err != nil {
+		return nil, err
+	}
+	_, table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	s := &deleteStmt{table: table}
+	if p.acceptKw("WHERE") {
+		if s.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) parseCreateTable() (stmt, error) {
+	p.acceptKw("TEMPORARY")
+	if err := p.expectKw("TABLE"); err != nil {
+		return nil, err
+	}
+	s := &createTableStmt{ifNotExists: p.acceptKw("IF", "NOT", "EXISTS")}
+	var err error
+	if _, s.name, err = p.tableName(); err != nil {
+		return nil, err
+	}
+	if p.acceptKw("LIKE") {
+		_, s.like, err = p.tableName()
+		return s, err
+	}
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.acceptKw("CONSTRAINT"):
+			if !p.isKw("PRIMARY") && !p.isKw("UNIQUE") && !p.isKw("FOREIGN") && !p.isKw("CHECK") {
+				p.next() // 约束名
+			}
+			continue
+		case p.acceptKw("PRIMARY", "KEY"):
+			if s.primary, err = p.parseIndexColumns(); err != nil {
+				return nil, err
+			}
+		case p.acceptKw("UNIQUE"):
+			_ = p.acceptKw("KEY") || p.acceptKw("INDEX")
+			idx := &indexDef{}
+			if !p.isOp("(") {
+				if idx.name, err = p.ident(); err != nil {
+					return nil, err
+				}
+			}
+			if idx.cols, err = p.parseIndexColumns(); err != nil {
+				return nil, err
+			}
+			s.uniques = append(s.uniques, idx)
+		case p.isKw("KEY"), p.isKw("INDEX"), p.isKw("FULLTEXT"), p.isKw("SPATIAL"), p.isKw("FOREIGN"), p.isKw("CHECK"):
+			// 普通索引和外键不处理
+			for !p.isOp(",") && !p.isOp(")") && p.peek().kind != tokEOF {
+				p.skip()
+			}
+		default:
+			col, inline, err := p.parseColumnDef()
+			if err != nil {
+				return nil, err
+			}
+			s.columns = append(s.columns, col)
+			switch inline {
+			case "PRIMARY":
+				s.primary = []string{col.name}
+			case "UNIQUE":
+				s.uniques = append(s.uniques, &indexDef{name: col.name, cols: []string{col.name}})
+			}
+		}
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	// 表参数只处理AUTO_INCREMENT
+	for p.peek().kind != tokEOF && !p.isOp(";") {
+		if p.acceptKw("AUTO_INCREMENT") {
+			p.acceptOp("=")
+			t := p.next()
+			if s.autoInc, err = strconv.ParseInt(t.text, 10, 64); err != nil {
+				return nil, p.errorf("invalid AUTO_INCREMENT")
+			}
+			continue
+		}
+		p.next()
+	}
+	return s, nil
+}
+
+// 索引的字段 (a,b(10),c DESC)
+func (p *parser) parseIndexColumns() ([]string, error) {
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	var cols []string
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+		if p.isOp("(") {
+			p.skip() // 前缀长度
+		}
+		_ = p.acceptKw("ASC") || p.acceptKw("DESC")
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	p.acceptKw("USING", "BTREE")
+	return cols, nil
+}
+
+// 字段定义，返回字段和行内定义的索引（PRIMARY UNIQUE）
+func (p *parser) parseColumnDef() (*memColumn, string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, "", err
+	}
+	typ, err := p.ident()
+	if err != nil {
+		return nil, "", err
+	}
+	col := &memColumn{name: name, typ: strings.ToUpper(typ)}
+	var params []string
+	if p.acceptOp("(") {
+		for !p.isOp(")") && p.peek().kind != tokEOF {
+			t := p.next()
+			if t.kind != tokOp {
+				params = append(params, t.text)
+			}
+		}
+		p.expectOp(")")
+	}
+	col.kind, col.fsp = columnKind(col.typ, params)
+
+	inline := ""
+	for !p.isOp(",") && !p.isOp(")") && p.peek().kind != tokEOF {
+		switch {
+		case p.acceptKw("NOT", "NULL"):
+			col.notNull = true
+		case p.acceptKw("NULL"):
+			col.notNull = false
+		case p.acceptKw("DEFAULT"):
+			if col.def, err = p.parseUnary(); err != nil {
+				return nil, "", err
+			}
+		case p.acceptKw("ON", "UPDATE"):
+			if _, err = p.parseUnary(); err != nil {
+				return nil, "", err
+			}
+			col.onUpdateNow = true
+		case p.acceptKw("AUTO_INCREMENT"):
+			col.autoInc = true
+		case p.acceptKw("PRIMARY", "KEY"):
+			col.notNull = true
+			inline = "PRIMARY"
+		case p.acceptKw("UNIQUE"):
+			p.acceptKw("KEY")
+			inline = "UNIQUE"
+		case p.acceptKw("CHARACTER", "SET"), p.acceptKw("CHARSET"), p.acceptKw("COLLATE"), p.acceptKw("COMMENT"):
+			p.next()
+		default:
+			p.skip() // UNSIGNED ZEROFILL等
+		}
+	}
+	if col.autoInc {
+		col.notNull = true
+	}
+	return col, inline, nil
+}
+
+func (p *parser) parseAlterTable() (stmt, error) {
+	if err := p.expectKw("TABLE"); err != nil {
+		return nil, err
+	}
+	_, name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKw("ADD"); err != nil {
+		return nil, err
+	}
+	p.acceptKw("COLUMN")
+	col, _, err := p.parseColumnDef()
+	if err != nil {
+		return nil, err
+	}
+	_ = p.acceptKw("FIRST") || (p.acceptKw("AFTER") && p.next().kind != tokEOF)
+	return &alterTableStmt{name: name, column: col}, nil
+}
+
+func (p *parser) parseExpr() (expr, error) {
+	return p.parseOr()
+}
+
+func (p *parser) parseOr() (expr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKw("OR") || p.acceptOp("||") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: "OR", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKw("AND") || p.acceptOp("&&") {
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: "AND", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.acceptKw("NOT") || p.acceptOp("!") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "NOT", x: x}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (expr, error) {
+	l, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.acceptKw("IS"):
+			not := p.acceptKw("NOT")
+			if err := p.expectKw("NULL"); err != nil {
+				return nil, err
+			}
+			l = &isNullExpr{x: l, not: not}
+		case p.isKw("IN"), p.isKw("NOT", "IN"):
+			not := p.acceptKw("NOT")
+			p.acceptKw("IN")
+			if err := p.expectOp("("); err != nil {
+				return nil, err
+			}
+			if p.isKw("SELECT") {
+				return nil, p.errorf("subquery not supported")
+			}
+			in := &inExpr{x: l, not: not}
+			for !p.isOp(")") {
+				e, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				in.list = append(in.list, e)
+				if !p.acceptOp(",") {
+					break
+				}
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			l = in
+		case p.isKw("LIKE"), p.isKw("NOT", "LIKE"):
+			not := p.acceptKw("NOT")
+			p.acceptKw("LIKE")
+			r, err := p.parseAdd()
+			if err != nil {
+				return nil, err
+			}
+			l = &likeExpr{x: l, pattern: r, not: not}
+		case p.isKw("BETWEEN"), p.isKw("NOT", "BETWEEN"):
+			not := p.acceptKw("NOT")
+			p.acceptKw("BETWEEN")
+			lo, err := p.parseAdd()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectKw("AND"); err != nil {
+				return nil, err
+			}
+			hi, err := p.parseAdd()
+			if err != nil {
+				return nil, err
+			}
+			l = &betweenExpr{x: l, lo: lo, hi: hi, not: not}
+		default:
+			t := p.peek()
+			if t.kind == tokOp && (t.text == "=" || t.text == "<>" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">=" || t.text == "<=>") {
+				p.next()
+				r, err := p.parseAdd()
+				if err != nil {
+					return nil, err
+				}
+				op := t.text
+				if op == "!=" {
+					op = "<>"
+				}
+				l = &binaryExpr{op: op, l: l, r: r}
+				continue
+			}
+			return l, nil
+		}
+	}
+}
+
+func (p *parser) parseAdd() (expr, error) {
+	l, err := p.parseMul()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.next().text
+		r, err := p.parseMul()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseMul() (expr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") || p.isOp("%") {
+		op := p.next().text
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.acceptOp("-") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "-", x: x}, nil
+	}
+	p.acceptOp("+")
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokParam:
+		p.next()
+		p.nparam++
+		return &paramExpr{i: p.nparam - 1}, nil
+	case tokNumber:
+		p.next()
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &litExpr{v: n}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", t.text)
+		}
+		return &litExpr{v: f}, nil
+	case tokString:
+		p.next()
+		return &litExpr{v: t.text}, nil
+	case tokQuoted:
+		p.next()
+		return &colExpr{name: t.text}, nil
+	case tokOp:
+		if t.text == "(" {
+			p.next()
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if p.isOp(",") {
+				tuple := &tupleExpr{items: []expr{e}}
+				for p.acceptOp(",") {
+					e, err := p.parseExpr()
+					if err != nil {
+						return nil, err
+					}
+					tuple.items = append(tuple.items, e)
+				}
+				e = tuple
+			}
+			return e, p.expectOp(")")
+		}
+	case tokIdent:
+		switch {
+		case p.acceptKw("NULL"):
+			return &litExpr{v: nil}, nil
+		case p.acceptKw("TRUE"):
+			return &litExpr{v: int64(1)}, nil
+		case p.acceptKw("FALSE"):
+			return &litExpr{v: int64(0)}, nil
+		case p.acceptKw("CASE"):
+			return p.parseCase()
+		}
+		p.next()
+		if p.acceptOp("(") {
+			f := &funcExpr{name: strings.ToUpper(t.text)}
+			if p.acceptOp("*") {
+				f.star = true
+			} else {
+				p.acceptKw("DISTINCT")
+				for !p.isOp(")") {
+					e, err := p.parseExpr()
+					if err != nil {
+						return nil, err
+					}
+					f.args = append(f.args, e)
+					if !p.acceptOp(",") {
+						break
+					}
+				}
+			}
+			return f, p.expectOp(")")
+		}
+		upper := strings.ToUpper(t.text)
+		if upper == "CURRENT_TIMESTAMP" || upper == "LOCALTIMESTAMP" || upper == "CURRENT_DATE" {
+			return &funcExpr{name: upper}, nil
+		}
+		if p.acceptOp(".") {
+			name, err := p.ident()
+			return &colExpr{name: name}, err
+		}
+		return &colExpr{name: t.text}, nil
+	}
+	return nil, p.errorf("unexpected %q", t.text)
+}
+
+func (p *parser) parseCase() (expr, error) {
+	c := &caseExpr{}
+	var err error
+	if !p.isKw("WHEN") {
+		if c.operand, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	for p.acceptKw("WHEN") {
+		w := &caseWhen{}
+		if w.cond, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKw("THEN"); err != nil {
+			return nil, err
+		}
+		if w.then, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		c.whens = append(c.whens, w)
+	}
+	if p.acceptKw("ELSE") {
+		if c.els, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return c, p.expectKw("END")
+}
@@ -0,0 +1,76 @@
+package mrcachetest
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"fmt"
+	"gobase/goredis"
+	"gobase/mysql"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// mrcache的单元测试环境，不依赖外部的Redis和mysql
+// Redis使用miniredis，支持EVAL执行script.go中的lua脚本
+// mysql使用内存实现的驱动，见memdb.go
+// 使用方式：
+//  env := mrcachetest.New(t)
+//  env.MustExec(`CREATE TABLE ...`)  // 或者使用Cache.EnsureSchema建表
+//  cache := mrcache.NewCacheRow[T](env.Redis, env.MySQL, "tablename")
+
+type Env struct {
+	Mini  *miniredis.Miniredis // 可以用来修改时间 FastForward，检查数据等
+	Redis *goredis.Redis
+	MySQL *mysql.MySQL
+	DB    string // 内存mysql的库名
+}
+
+var envSeq int64
+
+// 创建测试环境，测试结束时自动关闭
+func New(tb testing.TB) *Env {
+	tb.Helper()
+	env, err := Start()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(env.Close)
+	return env
+}
+
+// 创建测试环境，使用完调用Close
+func Start() (*Env, error) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	r, err := goredis.NewRedis(&goredis.Config{Addrs: []string{mini.Addr()}})
+	if err != nil {
+		mini.Close()
+		return nil, err
+	}
+	name := fmt.Sprintf("mrcachetest%d", atomic.AddInt64(&envSeq, 1))
+	m, err := mysql.NewMySQL(&mysql.Config{Driver: DriverName, Source: name})
+	if err != nil {
+		r.Close()
+		mini.Close()
+		return nil, err
+	}
+	return &Env{Mini: mini, Redis: r, MySQL: m, DB: name}, nil
+}
+
+func (env *Env) Close() {
+	env.MySQL.Close()
+	env.Redis.Close()
+	env.Mini.Close()
+	DropMemDB(env.DB)
+}
+
+// 执行sql，出错时panic，用来建表和准备数据
+func (env *Env) MustExec(query string, args ...interface{}) {
+	if _, err := env.MySQL.DB().Exec(query, args...); err != nil {
+		panic(err)
+	}
+}
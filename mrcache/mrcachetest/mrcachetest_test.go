@@ -0,0 +1,261 @@
+package mrcachetest
+
+import (
+	"context"
+	"errors"
+	"gobase/mrcache"
+	"gobase/mysql"
+	"testing"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+type Test struct {
+	Id         int               `db:"Id"`
+	CreateTime time.Time         `db:"create_time" redis:"ct"`
+	UpdateTime time.Time         `db:"update_time" redis:"ut"`
+	UID        int               `db:"UID" redis:"U"`
+	Type       int               `db:"Type"`
+	GroupType  string            `db:"GroupType"`
+	Name       string            `db:"Name"`
+	Age        int               `db:"Age"`
+	Mark       *string           `db:"Mark"`
+	Strs       mysql.JsonStrings `db:"Strs"`
+}
+
+const testDDL = `
+	CREATE TABLE IF NOT EXISTS test (
+		Id bigint NOT NULL AUTO_INCREMENT COMMENT '自增住建',
+		create_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '创建时间',
+		update_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP COMMENT '更新时间',
+		UID bigint NOT NULL DEFAULT '0' COMMENT '用户ID',
+		Type int NOT NULL DEFAULT '0' COMMENT '用户类型',
+		GroupType varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci NOT NULL DEFAULT '""' COMMENT '组',
+		Name varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci NOT NULL DEFAULT '""' COMMENT '名字',
+		Age int DEFAULT NULL COMMENT '年龄',
+		Mark varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci COMMENT '标记',
+		Strs JSON NULL COMMENT '',
+		PRIMARY KEY (Id),
+		UNIQUE KEY uk_UID_Type (UID,Type)
+	) ENGINE=InnoDB AUTO_INCREMENT=11019 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+	`
+
+func newTestEnv(t *testing.T) *Env {
+	env := New(t)
+	env.MustExec(testDDL)
+	env.MustExec(`INSERT INTO test (Id,UID,Type,GroupType,Name,Age,Mark) VALUES
+	(1, 123, 0, "G0", "Name123_0",  0, "Mark123_0"),
+	(2, 123, 1, "G0", "Name123_1", 10, "Mark123_1"),
+	(3, 123, 2, "G1", "Name123_2", 20, null);`)
+	return env
+}
+
+func TestMemSQL(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.TODO()
+
+	var rows []*Test
+	err := env.MySQL.Select(ctx, &rows, "SELECT Id,UID,Type,Name,Age,Mark FROM test WHERE UID=? AND Age>=? ORDER BY Age DESC LIMIT ?,?", 123, 10, 0, 10)
+	if err != nil || len(rows) != 2 || rows[0].Age != 20 || rows[0].Mark != nil || *rows[1].Mark != "Mark123_1" {
+		t.Fatalf("select err:%v rows:%d", err, len(rows))
+	}
+
+	// 主键冲突，错误格式和mysql一致
+	_, err = env.MySQL.Exec(ctx, "INSERT INTO test (Id,UID,Type) VALUES(?,?,?)", 1, 124, 0)
+	var me *mysqldriver.MySQLError
+	if !errors.As(err, &me) || me.Number != 1062 {
+		t.Fatalf("duplicate err:%v", err)
+	}
+	// 自增从表参数开始
+	rst, err := env.MySQL.Exec(ctx, "INSERT INTO test (UID,Type) VALUES(?,?)", 124, 0)
+	if id, _ := rst.LastInsertId(); err != nil || id != 11019 {
+		t.Fatalf("auto increment err:%v id:%d", err, id)
+	}
+	// 值不变时影响的行数为0
+	if n, err := env.MySQL.Update(ctx, "UPDATE test SET Name=? WHERE UID=? AND Type=?", "Name123_0", 123, 0); err != nil || n != 0 {
+		t.Fatalf("update err:%v n:%d", err, n)
+	}
+	// 元组IN和聚合
+	var count int
+	err = env.MySQL.Get(ctx, &count, "SELECT COUNT(*) FROM test WHERE (UID,Type) IN ((?,?),(?,?))", 123, 1, 124, 0)
+	if err != nil || count != 2 {
+		t.Fatalf("count err:%v count:%d", err, count)
+	}
+
+	// mrcache生成的JSON数组修改语句
+	_, err = env.MySQL.Update(ctx, "UPDATE test SET Strs=JSON_ARRAY_APPEND(IF(JSON_TYPE(Strs) = 'ARRAY', Strs, JSON_ARRAY()),'$',?,'$',?) WHERE UID=? AND Type=?", "a", "b", 123, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.MySQL.Update(ctx, "UPDATE test SET Strs=CASE WHEN JSON_SEARCH(Strs, 'one', ?) IS NOT NULL THEN JSON_REMOVE(Strs, JSON_UNQUOTE(JSON_SEARCH(Strs, 'one', ?))) ELSE Strs END WHERE UID=? AND Type=?", "a", "a", 123, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs mysql.JsonStrings
+	if err := env.MySQL.Get(ctx, &strs, "SELECT Strs FROM test WHERE Id=?", 1); err != nil || len(strs) != 1 || strs[0] != "b" {
+		t.Fatalf("json err:%v strs:%v", err, strs)
+	}
+
+	// 事务回滚
+	tx, _ := env.MySQL.Begin(ctx)
+	tx.Exec(ctx, "DELETE FROM test WHERE UID=?", 123)
+	tx.Rollback(ctx)
+	if err := env.MySQL.Get(ctx, &count, "SELECT COUNT(*) FROM test WHERE UID=?", 123); err != nil || count != 3 {
+		t.Fatalf("rollback err:%v count:%d", err, count)
+	}
+}
+
+func TestCacheRow(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.TODO()
+
+	cache, err := mrcache.NewCacheRow[Test](env.Redis, env.MySQL, "test", 0, 0, []string{"UID", "Type"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.ConfigIncrement(env.Redis, "Id"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 从mysql加载
+	data, err := cache.Get(ctx, []interface{}{123, 1})
+	if err != nil || data.Name != "Name123_1" || data.Age != 10 {
+		t.Fatalf("get err:%v", err)
+	}
+	// 修改后mysql中的数据一致
+	data, _, err = cache.Modify(ctx, []interface{}{123, 1}, map[string]interface{}{"Age": 5}, nil)
+	if err != nil || data.Age != 15 {
+		t.Fatalf("modify err:%v", err)
+	}
+	data, err = cache.GetFromSQL(ctx, []interface{}{123, 1})
+	if err != nil || data.Age != 15 {
+		t.Fatalf("get from sql err:%v", err)
+	}
+	// 添加
+	data, _, err = cache.Add(ctx, []interface{}{125, 1}, map[string]interface{}{"Name": "Name125_1", "Age": 1}, nil)
+	if err != nil || data.Id == 0 {
+		t.Fatalf("add err:%v", err)
+	}
+	if _, _, err := cache.Add(ctx, []interface{}{125, 1}, map[string]interface{}{"Name": "Name125_1", "Age": 1}, nil); err == nil {
+		t.Fatal("add exist must fail")
+	}
+	// 删除
+	if err := cache.Del(ctx, []interface{}{125, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(ctx, []interface{}{125, 1}); err != mrcache.ErrNullData {
+		t.Fatalf("get deleted err:%v", err)
+	}
+}
+
+func TestCacheRows(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.TODO()
+
+	cache, err := mrcache.NewCacheRows[Test](env.Redis, env.MySQL, "test", 0, 0, []string{"UID"}, []string{"Type"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.ConfigIncrement(env.Redis, "Id"); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := cache.GetAll(ctx, []interface{}{123})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("get all err:%v len:%d", err, len(all))
+	}
+	page, err := cache.GetPage(ctx, []interface{}{123}, "Age DESC", 0, 2)
+	if err != nil || len(page) != 2 || page[0].Age != 20 {
+		t.Fatalf("get page err:%v", err)
+	}
+	// JSON数组字段
+	_, err = cache.JsonArrayFieldAdd(ctx, []interface{}{123}, []interface{}{2}, map[string][]string{"Strs": {"a", "b"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.JsonArrayFieldDel(ctx, []interface{}{123}, []interface{}{2}, map[string][]string{"Strs": {"a"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.DelAllCache(ctx, []interface{}{123})
+	data, err := cache.Get(ctx, []interface{}{123}, []interface{}{2})
+	if err != nil || len(data.Strs) != 1 || data.Strs[0] != "b" {
+		t.Fatalf("json array err:%v", err)
+	}
+
+	// 事务
+	err = mrcache.NewTx().
+		Modify(cache, []interface{}{123}, []interface{}{0}, map[string]interface{}{"Age": 1}).
+		Del(cache, []interface{}{123}, []interface{}{1}).
+		Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err = cache.GetAllFromSQL(ctx, []interface{}{123})
+	if err != nil || len(all) != 2 || all[0].Age != 1 {
+		t.Fatalf("tx err:%v", err)
+	}
+}
+
+type Item struct {
+	Id      int64  `db:"Id"`
+	UID     int64  `db:"UID"`
+	Name    string `db:"Name"`
+	Score   int    `db:"Score"`
+	DelTime int64  `db:"del_time"`
+}
+
+func TestSchema(t *testing.T) {
+	env := New(t)
+	ctx := context.TODO()
+
+	cache, err := mrcache.NewCacheRow[Item](env.Redis, env.MySQL, "item", 0, 0, []string{"UID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.ConfigIncrement(env.Redis, "Id")
+	if err := cache.ConfigSoftDelete("del_time", ""); err != nil {
+		t.Fatal(err)
+	}
+	// 建表，第二次没有变化
+	if ddl, err := cache.EnsureSchema(ctx); err != nil || len(ddl) != 1 {
+		t.Fatalf("ensure schema err:%v ddl:%v", err, ddl)
+	}
+	if ddl, err := cache.EnsureSchema(ctx); err != nil || len(ddl) != 0 {
+		t.Fatalf("ensure schema err:%v ddl:%v", err, ddl)
+	}
+
+	for uid := int64(1); uid <= 3; uid++ {
+		if _, _, err := cache.Add(ctx, []interface{}{uid}, map[string]interface{}{"Name": "name", "Score": int(uid)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 软删除后读不到，归档后可以重新添加
+	if err := cache.Del(ctx, []interface{}{int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetFromSQL(ctx, []interface{}{int64(1)}); err != mrcache.ErrNullData {
+		t.Fatalf("get soft deleted err:%v", err)
+	}
+	if n, err := cache.Archive(ctx, -time.Hour); err != nil || n != 1 {
+		t.Fatalf("archive err:%v n:%d", err, n)
+	}
+	if _, _, err := cache.Add(ctx, []interface{}{int64(1)}, map[string]interface{}{"Name": "name"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 预热和一致性检查
+	env.Mini.FlushAll()
+	if rows, keys, err := cache.Warmup(ctx, nil, 2, 0); err != nil || rows != 3 || keys != 3 {
+		t.Fatalf("warmup err:%v rows:%d keys:%d", err, rows, keys)
+	}
+	env.MustExec("UPDATE item SET Score=? WHERE UID=?", 100, 2)
+	report, err := cache.Verify(ctx, nil, mrcache.RepairMySQLWins, 0)
+	if err != nil || report.Cached != 3 || len(report.Diffs) != 1 || report.Repaired != 1 {
+		t.Fatalf("verify err:%v report:%+v", err, report)
+	}
+	if data, err := cache.Get(ctx, []interface{}{int64(2)}); err != nil || data.Score != 100 {
+		t.Fatalf("get repaired err:%v", err)
+	}
+}
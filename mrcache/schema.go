@@ -0,0 +1,227 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"database/sql"
+	"gobase/utils"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// 根据结构的tag生成表结构
+// 拆表时所有的拆表都会处理，表不存在时CREATE TABLE，存在时对比字段，结构中新增的字段ALTER TABLE ADD COLUMN
+// 不会删除和修改已有的字段，也不会修改已有的索引
+// 字段类型根据结构字段的类型推导，可以通过SQLTypeTag指定，如 sqltype:"varchar(64) NOT NULL DEFAULT ''"
+
+// 检查并创建或修改表结构，返回执行的DDL语句
+func (c *Cache) EnsureSchema(ctx context.Context) (_ddl_ []string, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Strs("ddl", _ddl_).Msgf("Cache %s EnsureSchema", c.tableName)
+	})()
+
+	return c.ensureSchema(ctx, false)
+}
+
+// 只生成需要执行的DDL语句并输出日志，不执行
+func (c *Cache) EnsureSchemaDryRun(ctx context.Context) (_ddl_ []string, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Strs("ddl", _ddl_).Msgf("Cache %s EnsureSchemaDryRun", c.tableName)
+	})()
+
+	ddls, err := c.ensureSchema(ctx, true)
+	for _, ddl := range ddls {
+		log.Info().Msg(ddl)
+	}
+	return ddls, err
+}
+
+// 所有拆表的表名
+func (c *Cache) tableNames() []string {
+	if c.tableCount == 0 {
+		return []string{c.tableName}
+	}
+	tableNames := make([]string, 0, c.tableCount)
+	for i := 0; i < c.tableCount; i++ {
+		tableNames = append(tableNames, c.tableName+strconv.Itoa(i))
+	}
+	return tableNames
+}
+
+func (c *Cache) ensureSchema(ctx context.Context, dryRun bool) ([]string, error) {
+	var ddls []string
+	for _, tableName := range c.tableNames() {
+		// 已有的字段
+		var columns []string
+		err := c.mysql.Select(ctx, &columns, "SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=?", tableName)
+		if err != nil {
+			return ddls, err
+		}
+
+		var tableDDLs []string
+		if len(columns) == 0 {
+			tableDDLs = append(tableDDLs, c.fmtCreateTableSQL(tableName))
+		} else {
+			for i, tag := range c.Tags {
+				exist := false
+				for _, column := range columns {
+					if strings.EqualFold(column, tag) {
+						exist = true
+						break
+					}
+				}
+				if !exist {
+					tableDDLs = append(tableDDLs, "ALTER TABLE "+tableName+" ADD COLUMN "+c.fmtColumnSQL(i))
+				}
+			}
+		}
+
+		for _, ddl := range tableDDLs {
+			ddls = append(ddls, ddl)
+			if dryRun {
+				continue
+			}
+			_, err := c.mysql.Exec(ctx, ddl)
+			if err != nil {
+				return ddls, err
+			}
+		}
+	}
+	return ddls, nil
+}
+
+// 生成建表语句
+// 配置的自增字段为AUTO_INCREMENT主键
+// CacheRow：条件字段为唯一索引
+// CacheRows、CacheColumn：条件字段为普通索引，条件字段+key字段为唯一索引
+func (c *Cache) fmtCreateTableSQL(tableName string) string {
+	var sqlStr strings.Builder
+	sqlStr.WriteString("CREATE TABLE IF NOT EXISTS " + tableName + " (\n")
+	for i := range c.Tags {
+		sqlStr.WriteString("\t" + c.fmtColumnSQL(i) + ",\n")
+	}
+	var keys []string
+	if len(c.incrementField) != 0 {
+		keys = append(keys, "PRIMARY KEY ("+c.incrementField+")")
+	}
+	if len(c.keyFields) == 0 {
+		keys = append(keys, "UNIQUE KEY uk_"+strings.Join(c.condFields, "_")+" ("+strings.Join(c.condFields, ",")+")")
+	} else {
+		ukFields := append(append([]string{}, c.condFields...), c.keyFields...)
+		keys = append(keys, "KEY idx_"+strings.Join(c.condFields, "_")+" ("+strings.Join(c.condFields, ",")+")")
+		keys = append(keys, "UNIQUE KEY uk_"+strings.Join(ukFields, "_")+" ("+strings.Join(ukFields, ",")+")")
+	}
+	sqlStr.WriteString("\t" + strings.Join(keys, ",\n\t") + "\n")
+	sqlStr.WriteString(") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	return sqlStr.String()
+}
+
+// 生成字段定义
+func (c *Cache) fmtColumnSQL(at int) string {
+	tag := c.Tags[at]
+	field := c.Fields[at]
+	if sqlType := field.Tag.Get(SQLTypeTag); len(sqlType) > 0 {
+		return tag + " " + sqlType
+	}
+
+	t := field.Type
+	null := false
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		null = true
+	}
+	sqlType, defValue, canNull := sqlTypeOf(t)
+	if canNull {
+		null = true
+	}
+	// 删除时间字段，时间类型未删除时为NULL
+	if tag == c.softDelField && !c.softDelUnix() {
+		null = true
+	}
+	// 条件字段和key字段不能为空
+	if utils.Contains(c.condFields, tag) || utils.Contains(c.keyFields, tag) {
+		null = false
+	}
+	if tag == c.incrementField {
+		return tag + " " + sqlType + " NOT NULL AUTO_INCREMENT"
+	}
+	if null {
+		return tag + " " + sqlType + " NULL"
+	}
+	if len(defValue) > 0 {
+		return tag + " " + sqlType + " NOT NULL DEFAULT " + defValue
+	}
+	return tag + " " + sqlType + " NOT NULL"
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	bytesType      = reflect.TypeOf([]byte{})
+	nullStringType = reflect.TypeOf(sql.NullString{})
+	nullInt64Type  = reflect.TypeOf(sql.NullInt64{})
+	nullInt32Type  = reflect.TypeOf(sql.NullInt32{})
+	nullFloatType  = reflect.TypeOf(sql.NullFloat64{})
+	nullBoolType   = reflect.TypeOf(sql.NullBool{})
+	nullTimeType   = reflect.TypeOf(sql.NullTime{})
+)
+
+// 根据类型推导mysql的类型 返回值：类型 默认值 是否只能为NULL
+func sqlTypeOf(t reflect.Type) (string, string, bool) {
+	switch t {
+	case timeType:
+		return "DATETIME(3)", "CURRENT_TIMESTAMP(3)", false // 保留毫秒
+	case bytesType:
+		return "BLOB", "", true
+	case nullStringType:
+		return "VARCHAR(255)", "", true
+	case nullInt64Type:
+		return "BIGINT", "", true
+	case nullInt32Type:
+		return "INT", "", true
+	case nullFloatType:
+		return "DOUBLE", "", true
+	case nullBoolType:
+		return "TINYINT(1)", "", true
+	case nullTimeType:
+		return "DATETIME(3)", "", true
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "TINYINT(1)", "'0'", false
+	case reflect.Int8:
+		return "TINYINT", "'0'", false
+	case reflect.Int16:
+		return "SMALLINT", "'0'", false
+	case reflect.Int32:
+		return "INT", "'0'", false
+	case reflect.Int, reflect.Int64:
+		return "BIGINT", "'0'", false
+	case reflect.Uint8:
+		return "TINYINT UNSIGNED", "'0'", false
+	case reflect.Uint16:
+		return "SMALLINT UNSIGNED", "'0'", false
+	case reflect.Uint32:
+		return "INT UNSIGNED", "'0'", false
+	case reflect.Uint, reflect.Uint64:
+		return "BIGINT UNSIGNED", "'0'", false
+	case reflect.Float32:
+		return "FLOAT", "'0'", false
+	case reflect.Float64:
+		return "DOUBLE", "'0'", false
+	case reflect.String:
+		return "VARCHAR(255)", "''", false
+	case reflect.Array:
+		// 定长字节数组，比如md5、uuid
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "BINARY(" + strconv.Itoa(t.Len()) + ")", "''", false
+		}
+	}
+	// 其他类型都用JSON存储，比如结构、切片、map
+	return "JSON", "", true
+}
@@ -57,11 +57,24 @@ var rowAddScript = goredis.NewScript(`
 	return 'OK'
 `)
 
+// row 预热数据，key已经存在时不覆盖，防止把旧数据写入
+// key：生成的key
+// 参数：第一个是有效期 其他: field value field value ..
+// 返回值：err=nil时 0:已存在 1:写入
+var rowWarmupScript = goredis.NewScript(`
+	if redis.call('EXISTS', KEYS[1]) == 1 then
+		return 0
+	end
+	redis.call('HMSET', KEYS[1], select(2,unpack(ARGV)))
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+	return 1
+`)
+
 // row 修改数据 没有返回值
 // key：生成的key，key不存在返回值为空
 // 参数：第一个是有效期 第二个参数无效 其他: field op value field op value ..
 // 返回值 err=nil时 1：空：数据为空  2：OK
-var rowModifyScript = goredis.NewScript(`
+var rowModifyScript = goredis.NewScript(luaGuardScript + `
 	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
 	if rst == 0 then
 		return
@@ -69,9 +82,20 @@ var rowModifyScript = goredis.NewScript(`
 	if #ARGV == 1 then -- 只有一个过期时间
 		return 'OK'
 	end
+	local ver
 	local setkv = {}
-	for i = 3, #ARGV, 3 do
-		if ARGV[i+1] == "del" then
+	local start, err = guardCheck(KEYS[1])
+	if err then
+		return err
+	end
+	for i = start, #ARGV, 3 do
+		if ARGV[i+1] == "ver" then
+			-- 版本号，在修改参数的最前面，先检查再增加
+			if ARGV[i+2] ~= "" and ARGV[i+2] ~= (redis.call('HGET', KEYS[1], ARGV[i]) or "0") then
+				return redis.error_reply("VERSION")
+			end
+			ver = redis.call('HINCRBY', KEYS[1], ARGV[i], 1)
+		elseif ARGV[i+1] == "del" then
 			redis.call('HDEL', KEYS[1], ARGV[i])
 		elseif ARGV[i+1] == "set" then
 			setkv[#setkv+1] = ARGV[i]
@@ -85,6 +109,9 @@ var rowModifyScript = goredis.NewScript(`
 	if #setkv > 0 then
 		redis.call('HMSET', KEYS[1], unpack(setkv))
 	end
+	if ver then
+		return ver -- 有版本号时返回新的版本号
+	end
 	return 'OK'
 `)
 
@@ -92,16 +119,27 @@ var rowModifyScript = goredis.NewScript(`
 // key：生成的key，key不存在返回值为空
 // 参数：第一个是有效期 第二个参数空 其他: field op value field op value ..
 // 返回值：err=nil时 1：空：没加载数据 2：value value .. 和上面field对应
-var rowModifyGetScript = goredis.NewScript(`
+var rowModifyGetScript = goredis.NewScript(luaGuardScript + `
 	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
 	if rst == 0 then
 		return
 	end
 	local fields = {}
+	local ver
 	local setkv = {}
-	for i = 3, #ARGV, 3 do
+	local start, err = guardCheck(KEYS[1])
+	if err then
+		return err
+	end
+	for i = start, #ARGV, 3 do
 		fields[#fields+1] = ARGV[i]
-		if ARGV[i+1] == "del" then
+		if ARGV[i+1] == "ver" then
+			-- 版本号，在修改参数的最前面，先检查再增加
+			if ARGV[i+2] ~= "" and ARGV[i+2] ~= (redis.call('HGET', KEYS[1], ARGV[i]) or "0") then
+				return redis.error_reply("VERSION")
+			end
+			ver = redis.call('HINCRBY', KEYS[1], ARGV[i], 1)
+		elseif ARGV[i+1] == "del" then
 			redis.call('HDEL', KEYS[1], ARGV[i])
 		elseif ARGV[i+1] == "set" then
 			setkv[#setkv+1] = ARGV[i]
@@ -122,6 +160,94 @@ var rowModifyGetScript = goredis.NewScript(`
 	return redis.call('HMGET', KEYS[1], unpack(fields))
 `)
 
+// 修改前的条件检查，条件参数放到修改参数的最前面 field guard<op> value，op为 >= > <= < == ~=
+// 返回修改参数开始的位置，条件不满足时返回错误 GUARD{条件字段的当前值}，不会做任何修改
+var luaGuardScript = `
+	local function guardCheck(key)
+		local i = 3
+		local ok = true
+		while ARGV[i+1] and string.sub(ARGV[i+1], 1, 5) == "guard" do
+			if ok then
+				local op = string.sub(ARGV[i+1], 6)
+				local cur = redis.call('HGET', key, ARGV[i])
+				local a = tonumber(cur or "0")
+				local b = tonumber(ARGV[i+2])
+				if a and b then
+					if op == ">=" then ok = (a >= b)
+					elseif op == ">" then ok = (a > b)
+					elseif op == "<=" then ok = (a <= b)
+					elseif op == "<" then ok = (a < b)
+					elseif op == "==" then ok = (a == b)
+					elseif op == "~=" then ok = (a ~= b)
+					else ok = false end
+				elseif op == "==" then
+					ok = ((cur or "") == ARGV[i+2])
+				elseif op == "~=" then
+					ok = ((cur or "") ~= ARGV[i+2])
+				else
+					ok = false
+				end
+			end
+			i = i + 3
+		end
+		if not ok then
+			local cur = {}
+			for j = 3, i - 1, 3 do
+				cur[ARGV[j]] = redis.call('HGET', key, ARGV[j]) or false
+			end
+			return nil, redis.error_reply("GUARD" .. cjson.encode(cur))
+		end
+		return i
+	end
+`
+
+// rows 排序索引
+// 排序索引key：索引key#z#field，zset结构，member为keyValuesStr，score为数据中field的值
+// 排序字段key：索引key#z，set结构，记录已经建立了排序索引的field，修改数据时维护这些field的排序索引
+// 使用#分隔，dataKey是索引key_keyValuesStr，条件值中不允许有#，所以不会和dataKey、其他的索引key重名
+// 排序字段key和排序索引key的有效期同时设置，保证同时过期
+var luaSortScript = `
+local function sortExpire(expire)
+	local zfields = redis.call('SMEMBERS', KEYS[1] .. "#z")
+	if #zfields == 0 then
+		return
+	end
+	redis.call('EXPIRE', KEYS[1] .. "#z", expire)
+	for i = 1, #zfields do
+		redis.call('EXPIRE', KEYS[1] .. "#z#" .. zfields[i], expire)
+	end
+end
+-- 更新排序索引 fields为空表示更新全部排序字段
+local function sortUpdate(expire, keyValuesStr, dataKey, fields)
+	local zfields = redis.call('SMEMBERS', KEYS[1] .. "#z")
+	if #zfields == 0 then
+		return
+	end
+	for i = 1, #zfields do
+		local field = zfields[i]
+		if fields == nil or fields[field] then
+			local v = redis.call('HGET', dataKey, field)
+			redis.call('ZADD', KEYS[1] .. "#z#" .. field, tonumber(v) or 0, keyValuesStr)
+		end
+	end
+	sortExpire(expire)
+end
+local function sortRemove(keyValuesStrs)
+	local zfields = redis.call('SMEMBERS', KEYS[1] .. "#z")
+	for i = 1, #zfields do
+		redis.call('ZREM', KEYS[1] .. "#z#" .. zfields[i], unpack(keyValuesStrs))
+	end
+end
+local function sortClear()
+	local zfields = redis.call('SMEMBERS', KEYS[1] .. "#z")
+	local keys = {KEYS[1] .. "#z"}
+	for i = 1, #zfields do
+		keys[#keys+1] = KEYS[1] .. "#z#" .. zfields[i]
+	end
+	redis.call('DEL', unpack(keys))
+end
+`
+
 // rows /////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 // rows 读取数据
 // key：索引key
@@ -210,7 +336,11 @@ var rowsGetScript = goredis.NewScript(`
 // key：索引key
 // 参数：第一个是有效期 其他为数据组：keyValuesStr num field value field value ..  keyValuesStr num  field value field value ..
 // 返回值 err=nil时 OK
-var rowsAddScript = goredis.NewScript(`
+var rowsAddScript = goredis.NewScript(luaSortScript + `
+	-- 索引key不存在，之前的排序索引都无效了
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+		sortClear()
+	end
 	local keyValuesStrs = {}
 	local pos = 2
 	while pos < #ARGV do
@@ -229,6 +359,9 @@ var rowsAddScript = goredis.NewScript(`
 			end
 			redis.call('HMSET', dataKey, unpack(kv))
 			redis.call('EXPIRE', dataKey, ARGV[1])
+			sortUpdate(ARGV[1], keyValuesStr, dataKey, nil)
+		else
+			sortClear() -- 只有索引没有数据，排序索引建立不了
 		end
 	end
 
@@ -238,6 +371,43 @@ var rowsAddScript = goredis.NewScript(`
 	return 'OK'
 `)
 
+// rows 预热数据，索引key已经存在时不覆盖，防止把旧数据写入
+// key：索引key
+// 参数：第一个是有效期 其他为数据组：keyValuesStr num field value field value ..  keyValuesStr num  field value field value ..
+// 返回值 err=nil时 0:已存在 1:写入
+var rowsWarmupScript = goredis.NewScript(luaSortScript + `
+	if redis.call('EXISTS', KEYS[1]) == 1 then
+		return 0
+	end
+	sortClear()
+	local keyValuesStrs = {}
+	local pos = 2
+	while pos < #ARGV do
+		local keyValuesStr = ARGV[pos]
+		pos = pos + 1
+		local num = tonumber(ARGV[pos])
+		pos = pos + 1
+
+		local dataKey = KEYS[1] .. "_" .. keyValuesStr
+		keyValuesStrs[#keyValuesStrs+1] = keyValuesStr
+		if num > 0 then
+			local kv = {}
+			for i = 1, num do
+				kv[#kv+1] = ARGV[pos]
+				pos = pos + 1
+			end
+			redis.call('HMSET', dataKey, unpack(kv))
+			redis.call('EXPIRE', dataKey, ARGV[1])
+			sortUpdate(ARGV[1], keyValuesStr, dataKey, nil)
+		else
+			sortClear()
+		end
+	end
+	redis.call('SADD', KEYS[1], unpack(keyValuesStrs))
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+	return 1
+`)
+
 // rows 读取数据
 // key：索引key
 // 参数：第一个是有效期 第二个为keyValuesStr
@@ -255,13 +425,49 @@ var rowsExistScript = goredis.NewScript(`
 	return 1
 `)
 
+// rows 读取数据数量
+// key：索引key
+// 参数：第一个是有效期
+// 返回值 err=nil时 1：空：没加载数据 2：数量
+var rowsCountScript = goredis.NewScript(`
+	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if rst == 0 then
+		return
+	end
+	return redis.call('SCARD', KEYS[1])
+`)
+
+// rows 新增数据前占用一个位置，检查数量上限
+// key：索引key
+// 参数：第一个是有效期 第二个是数量上限 第三个为keyValuesStr 第四个索引key不存在时是否创建（0or1）
+// 返回值 err=nil时 1：空：没加载数据 2：0：超过上限 1：成功 2：已经存在
+var rowsReserveScript = goredis.NewScript(luaSortScript + `
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+		if ARGV[4] == "0" then
+			return
+		end
+		sortClear()
+	end
+	if redis.call('SISMEMBER', KEYS[1], ARGV[3]) == 1 then
+		return 2
+	end
+	if redis.call('SCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+		return 0
+	end
+	redis.call('SADD', KEYS[1], ARGV[3])
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+	-- 数据还没有写入，排序索引在加载数据时更新，读取排序时数量不一致会重建
+	return 1
+`)
+
 // rows 删除数据
 // key：索引key
 // 参数：keyValuesStr keyValuesStr ...
 // 返回值：err=nil时 OK
-var rowsDelsScript = goredis.NewScript(`
+var rowsDelsScript = goredis.NewScript(luaSortScript + `
 	-- 删除索引key中的数据
 	local count = redis.call('SREM', KEYS[1], unpack(ARGV))
+	sortRemove(ARGV)
 	-- 删除索引key
 	local dataKeys = {}
 	for i = 1, #ARGV do
@@ -274,7 +480,8 @@ var rowsDelsScript = goredis.NewScript(`
 // rows 删除全部数据
 // key：索引key
 // 返回值：err=nil时 删除数据的个数
-var rowsDelAllScript = goredis.NewScript(`
+var rowsDelAllScript = goredis.NewScript(luaSortScript + `
+	sortClear()
 	local keyValuesStrs = redis.call('SMEMBERS', KEYS[1])
 	if #keyValuesStrs == 0 then
 		return 0
@@ -291,7 +498,7 @@ var rowsDelAllScript = goredis.NewScript(`
 // key：索引key
 // 参数：第一个是有效期 第二个为keyValuesStr 其他: field op value field op value ..
 // 返回值：err=nil时 1：空：数据为空  2：OK
-var rowsModifyScript = goredis.NewScript(`
+var rowsModifyScript = goredis.NewScript(luaGuardScript + luaSortScript + `
 	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
 	if rst == 0 then
 		return
@@ -307,9 +514,22 @@ var rowsModifyScript = goredis.NewScript(`
 		return -- 数据不一致了 返回空 重新读
 	end
 
+	local fields = {}
+	local ver
 	local setkv = {}
-	for i = 3, #ARGV, 3 do
-		if ARGV[i+1] == "del" then
+	local start, err = guardCheck(dataKey)
+	if err then
+		return err
+	end
+	for i = start, #ARGV, 3 do
+		fields[ARGV[i]] = true
+		if ARGV[i+1] == "ver" then
+			-- 版本号，在修改参数的最前面，先检查再增加
+			if ARGV[i+2] ~= "" and ARGV[i+2] ~= (redis.call('HGET', dataKey, ARGV[i]) or "0") then
+				return redis.error_reply("VERSION")
+			end
+			ver = redis.call('HINCRBY', dataKey, ARGV[i], 1)
+		elseif ARGV[i+1] == "del" then
 			redis.call('HDEL', dataKey, ARGV[i])
 		elseif ARGV[i+1] == "set" then
 			setkv[#setkv+1] = ARGV[i]
@@ -323,6 +543,10 @@ var rowsModifyScript = goredis.NewScript(`
 	if #setkv > 0 then
 		redis.call('HMSET', dataKey, unpack(setkv))
 	end
+	sortUpdate(ARGV[1], keyValuesStr, dataKey, fields)
+	if ver then
+		return ver -- 有版本号时返回新的版本号
+	end
 	return 'OK'
 `)
 
@@ -330,7 +554,7 @@ var rowsModifyScript = goredis.NewScript(`
 // key：索引key
 // 参数：第一个是有效期 第二个为keyValuesStr 第三个值表示是否去重（0or1） 其他: field op num value..  field op num value..
 // 返回值：err=nil时 1：空：数据为空  2：返回修改的值列表 和传入的对称
-var rowsJsonArrayModifyScript = goredis.NewScript(luaJsonScript + `
+var rowsJsonArrayModifyScript = goredis.NewScript(luaJsonScript + luaSortScript + `
 	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
 	if rst == 0 then
 		return
@@ -348,9 +572,20 @@ var rowsJsonArrayModifyScript = goredis.NewScript(luaJsonScript + `
 
 	local duplicate = tonumber(ARGV[3])
 
+	local changed = {}
 	local setkv = {}
 	local rst = {} -- 返回修改的值列表
 	local pos = 4
+	if ARGV[pos+1] == "ver" then
+		-- 版本号，一定是第一个参数 field ver 1 expect，先检查再增加，增加后的值放在返回值列表的第一个
+		local field = ARGV[pos]
+		local expect = ARGV[pos+3]
+		pos = pos + 4
+		if expect ~= "" and expect ~= (redis.call('HGET', dataKey, field) or "0") then
+			return redis.error_reply("VERSION")
+		end
+		rst[#rst+1] = {tostring(redis.call('HINCRBY', dataKey, field, 1))}
+	end
 	while pos < #ARGV do
 		local field = ARGV[pos]
 		pos = pos + 1
@@ -404,6 +639,7 @@ var rowsJsonArrayModifyScript = goredis.NewScript(luaJsonScript + `
 			end
 		end
 
+		changed[field] = true
 		setkv[#setkv+1] = field
 		setkv[#setkv+1] = json.encode(jsonv)
 		rst[#rst+1] = change
@@ -411,6 +647,7 @@ var rowsJsonArrayModifyScript = goredis.NewScript(luaJsonScript + `
 	if #setkv > 0 then
 		redis.call('HMSET', dataKey, unpack(setkv))
 	end
+	sortUpdate(ARGV[1], keyValuesStr, dataKey, changed)
 	return rst
 `)
 
@@ -418,7 +655,7 @@ var rowsJsonArrayModifyScript = goredis.NewScript(luaJsonScript + `
 // key：索引key
 // 参数：第一个是有效期 第二个为keyValuesStr 其他: field op value field op value ..
 // 返回值：err=nil时 1：空：没加载数据 2：value value .. 和上面field对应
-var rowsModifyGetScript = goredis.NewScript(`
+var rowsModifyGetScript = goredis.NewScript(luaGuardScript + luaSortScript + `
 	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
 	if rst == 0 then
 		return
@@ -435,10 +672,23 @@ var rowsModifyGetScript = goredis.NewScript(`
 	end
 
 	local fields = {}
+	local changed = {}
+	local ver
 	local setkv = {}
-	for i = 3, #ARGV, 3 do
+	local start, err = guardCheck(dataKey)
+	if err then
+		return err
+	end
+	for i = start, #ARGV, 3 do
 		fields[#fields+1] = ARGV[i]
-		if ARGV[i+1] == "del" then
+		changed[ARGV[i]] = true
+		if ARGV[i+1] == "ver" then
+			-- 版本号，在修改参数的最前面，先检查再增加
+			if ARGV[i+2] ~= "" and ARGV[i+2] ~= (redis.call('HGET', dataKey, ARGV[i]) or "0") then
+				return redis.error_reply("VERSION")
+			end
+			ver = redis.call('HINCRBY', dataKey, ARGV[i], 1)
+		elseif ARGV[i+1] == "del" then
 			redis.call('HDEL', dataKey, ARGV[i])
 		elseif ARGV[i+1] == "set" then
 			setkv[#setkv+1] = ARGV[i]
@@ -452,6 +702,7 @@ var rowsModifyGetScript = goredis.NewScript(`
 	if #setkv > 0 then
 		redis.call('HMSET', dataKey, unpack(setkv))
 	end
+	sortUpdate(ARGV[1], keyValuesStr, dataKey, changed)
 	if #fields == 0 then
 		return {}
 	end
@@ -459,6 +710,70 @@ var rowsModifyGetScript = goredis.NewScript(`
 	return redis.call('HMGET', dataKey, unpack(fields))
 `)
 
+// rows 按排序索引读取数据，排序索引不存在或者和索引key数量不一致时先建立
+// key：索引key
+// 参数：第一个是有效期 第二个是排序的field 第三个是否倒序（0or1） 第四个是读取方式（page or range） 第五第六个参数：page时为offset limit，range时为min max  其他：field field .. 要获取的字段
+// 返回值：err=nil时 1:空 数据为空或者不完整  2:{value value ..} {value value ..} .. 按排序后的顺序
+var rowsSortGetScript = goredis.NewScript(luaSortScript + `
+	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if rst == 0 then
+		return
+	end
+	local field = ARGV[2]
+	local zkey = KEYS[1] .. "#z#" .. field
+	-- 建立排序索引
+	if redis.call('SISMEMBER', KEYS[1] .. "#z", field) == 0 or redis.call('ZCARD', zkey) ~= redis.call('SCARD', KEYS[1]) then
+		redis.call('DEL', zkey)
+		local keyValuesStrs = redis.call('SMEMBERS', KEYS[1])
+		local zv = {}
+		for i = 1, #keyValuesStrs do
+			local dataKey = KEYS[1] .. "_" .. keyValuesStrs[i]
+			if redis.call('EXISTS', dataKey) == 0 then
+				return -- 数据不完整
+			end
+			local v = redis.call('HGET', dataKey, field)
+			zv[#zv+1] = tonumber(v) or 0
+			zv[#zv+1] = keyValuesStrs[i]
+			if #zv >= 200 then
+				redis.call('ZADD', zkey, unpack(zv))
+				zv = {}
+			end
+		end
+		if #zv > 0 then
+			redis.call('ZADD', zkey, unpack(zv))
+		end
+		redis.call('SADD', KEYS[1] .. "#z", field)
+	end
+	sortExpire(ARGV[1])
+
+	local members
+	if ARGV[4] == "page" then
+		local start = tonumber(ARGV[5])
+		local stop = start + tonumber(ARGV[6]) - 1
+		if ARGV[3] == "1" then
+			members = redis.call('ZREVRANGE', zkey, start, stop)
+		else
+			members = redis.call('ZRANGE', zkey, start, stop)
+		end
+	else
+		if ARGV[3] == "1" then
+			members = redis.call('ZREVRANGEBYSCORE', zkey, ARGV[6], ARGV[5])
+		else
+			members = redis.call('ZRANGEBYSCORE', zkey, ARGV[5], ARGV[6])
+		end
+	end
+	local resp = {}
+	for i = 1, #members do
+		local dataKey = KEYS[1] .. "_" .. members[i]
+		local rst = redis.call('EXPIRE', dataKey, ARGV[1])
+		if rst == 0 then
+			return -- 数据不一致了 返回空 重新读
+		end
+		resp[i] = redis.call('HMGET', dataKey, select(7,unpack(ARGV)))
+	end
+	return resp
+`)
+
 // column /////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 // column 新增数据，直接保存
 // key：生成的key
@@ -470,16 +785,167 @@ var columnAddScript = goredis.NewScript(`
 	return 'OK'
 `)
 
-// column 新增数据，直接保存
+// column 添加一条数据，key存在时才写入
 // key：生成的key
 // 参数：第一个是有效期 其他：field value
-// 返回值：err=nil时 OK  空不存在
+// 返回值：err=nil时 OK  空：key不存在
+var columnAddFieldScript = goredis.NewScript(`
+	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if rst == 0 then
+		return
+	end
+	redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+	return 'OK'
+`)
+
+// column 修改数据
+// key：生成的key
+// 参数：第一个是有效期 其他：field value
+// 返回值：err=nil时 OK  0：field不存在  空：key不存在
 var columnSetScript = goredis.NewScript(`
-	local exists = redis.call('HEXISTS', key, ARGV[2])
-	if exists == 0 then
+	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if rst == 0 then
 		return
 	end
-	redis.call('HMSET', KEYS[1], ARGV[2], ARGV[3])
-	redis.call('EXPIRE', KEYS[1], ARGV[1])
+	local exists = redis.call('HEXISTS', KEYS[1], ARGV[2])
+	if exists == 0 then
+		return 0
+	end
+	redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
 	return 'OK'
 `)
+
+// column 读取全部数据
+// key：生成的key
+// 参数：第一个是有效期
+// 返回值：err=nil时 field value field value ..  空：key不存在
+var columnGetAllScript = goredis.NewScript(`
+	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if rst == 0 then
+		return
+	end
+	return redis.call('HGETALL', KEYS[1])
+`)
+
+// column 读取一条数据
+// key：生成的key
+// 参数：第一个是有效期 第二个是field
+// 返回值：err=nil时 {1,value}：存在 {0}：field不存在  空：key不存在
+var columnGetScript = goredis.NewScript(`
+	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if rst == 0 then
+		return
+	end
+	local v = redis.call('HGET', KEYS[1], ARGV[2])
+	if not v then
+		return {0}
+	end
+	return {1, v}
+`)
+
+// column 增加数据
+// key：生成的key
+// 参数：第一个是有效期 第二个是field 第三个是增加的值 第四个是否是浮点数
+// 返回值：err=nil时 {1,value}：增加后的值 {0}：field不存在  空：key不存在
+var columnIncrScript = goredis.NewScript(`
+	local rst = redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if rst == 0 then
+		return
+	end
+	local exists = redis.call('HEXISTS', KEYS[1], ARGV[2])
+	if exists == 0 then
+		return {0}
+	end
+	if ARGV[4] == '1' then
+		return {1, redis.call('HINCRBYFLOAT', KEYS[1], ARGV[2], ARGV[3])}
+	end
+	return {1, redis.call('HINCRBY', KEYS[1], ARGV[2], ARGV[3])}
+`)
+
+// 事务 多个key一起修改
+// key：所有涉及的key
+// 参数：操作组：type keyIndex expire sortIndex num 参数..
+// type为m：修改keyIndex对应的数据，参数为 field op value field op value ..，op：get set del incr fincr ver，ver的value不为空时校验版本号
+// sortIndex不为0时为CacheRows的索引key，修改后更新修改字段的排序索引
+// type为d：删除keyIndex对应的key，没有参数
+// 返回值 err=nil时 所有修改操作的field修改后的值，不存在对应的Value填充nil
+// 修改的数据不存在时返回错误NULL..keyIndex，版本号不一致返回错误VERSION，此时还没有执行任何修改
+var txScript = goredis.NewScript(`
+	local pos = 1
+	while pos <= #ARGV do
+		local num = tonumber(ARGV[pos+4])
+		if ARGV[pos] == 'm' then
+			local key = KEYS[tonumber(ARGV[pos+1])]
+			if redis.call('EXISTS', key) == 0 then
+				return redis.error_reply('NULL' .. ARGV[pos+1])
+			end
+			for i = pos + 5, pos + 4 + num, 3 do
+				if ARGV[i+1] == 'ver' and ARGV[i+2] ~= '' and ARGV[i+2] ~= (redis.call('HGET', key, ARGV[i]) or '0') then
+					return redis.error_reply('VERSION')
+				end
+			end
+		end
+		pos = pos + 5 + num
+	end
+
+	local rst = {}
+	pos = 1
+	while pos <= #ARGV do
+		local key = KEYS[tonumber(ARGV[pos+1])]
+		local num = tonumber(ARGV[pos+4])
+		if ARGV[pos] == 'm' then
+			redis.call('EXPIRE', key, ARGV[pos+2])
+			local changed = {}
+			for i = pos + 5, pos + 4 + num, 3 do
+				local field, op, value = ARGV[i], ARGV[i+1], ARGV[i+2]
+				if op == 'set' then
+					redis.call('HSET', key, field, value)
+				elseif op == 'del' then
+					redis.call('HDEL', key, field)
+				elseif op == 'incr' then
+					redis.call('HINCRBY', key, field, value)
+				elseif op == 'fincr' then
+					redis.call('HINCRBYFLOAT', key, field, value)
+				elseif op == 'ver' then
+					redis.call('HINCRBY', key, field, 1)
+				end
+				changed[field] = true
+				rst[#rst+1] = redis.call('HGET', key, field)
+			end
+			-- 更新排序索引
+			local sortIndex = tonumber(ARGV[pos+3])
+			if sortIndex > 0 then
+				local idxKey = KEYS[sortIndex]
+				local member = string.sub(key, #idxKey + 2)
+				local zfields = redis.call('SMEMBERS', idxKey .. "#z")
+				for i = 1, #zfields do
+					if changed[zfields[i]] then
+						redis.call('ZADD', idxKey .. "#z#" .. zfields[i], tonumber(redis.call('HGET', key, zfields[i])) or 0, member)
+					end
+				end
+			end
+		else
+			redis.call('DEL', key)
+		end
+		pos = pos + 5 + num
+	end
+	return rst
+`)
+
+// journal /////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// 重放锁续期 锁还是自己的才续期 返回值 1：成功 0：锁丢失了
+var journalLockRenewScript = goredis.NewScript(`
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+	return 0
+`)
+
+// 重放锁解锁 锁还是自己的才删除
+var journalLockDelScript = goredis.NewScript(`
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		return redis.call('DEL', KEYS[1])
+	end
+	return 0
+`)
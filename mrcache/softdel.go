@@ -0,0 +1,189 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gobase/utils"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// 软删除
+// 开启后Del、Dels、DelAll等删除mysql数据时不执行DELETE，而是把删除时间字段设置成当前时间，Redis中的数据照常删除
+// 读取mysql时自动过滤掉已删除的数据，删除时间字段不能通过Set、Modify修改
+// 删除时间字段支持时间类型（未删除为NULL）和整数类型（未删除为0，删除后为秒时间戳）
+// Archive把删除时间超过指定时长的数据从所有拆表中移动到归档表
+// 添加数据时如果和已删除的数据唯一索引冲突，会先把已删除的数据移动到归档表再添加
+
+// 配置软删除，field：删除时间字段 archiveTable：归档表名，为空时使用 表名_archive，拆表时所有拆表共用一个归档表
+// field为空表示关闭
+func (c *Cache) ConfigSoftDelete(field, archiveTable string) error {
+	if len(field) == 0 {
+		c.softDelField = ""
+		c.softDelFieldIndex = 0
+		c.archiveTable = ""
+		return nil
+	}
+	idx := c.FindIndexByTag(field)
+	if idx == -1 {
+		return fmt.Errorf("tag:%s not find in %s", field, c.T.String())
+	}
+	if utils.Contains(c.condFields, field) || utils.Contains(c.keyFields, field) || field == c.incrementField || field == c.versionField {
+		return fmt.Errorf("tag:%s can not be cond, key, increment or version field", field)
+	}
+	t := c.Fields[idx].Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != timeType && t != nullTimeType && !c.IsNumType(t) {
+		return fmt.Errorf("tag:%s not time or int", field)
+	}
+	if len(archiveTable) == 0 {
+		archiveTable = c.tableName + "_archive"
+	}
+	c.softDelField = field
+	c.softDelFieldIndex = idx
+	c.archiveTable = archiveTable
+	return nil
+}
+
+// 删除时间字段是否为整数类型
+func (c *Cache) softDelUnix() bool {
+	t := c.Fields[c.softDelFieldIndex].Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return c.IsNumType(t)
+}
+
+// 添加未删除的条件
+func (c *Cache) softDelExclude(cond TableConds) TableConds {
+	if len(c.softDelField) == 0 {
+		return cond
+	}
+	if c.softDelUnix() {
+		return cond.Eq(c.softDelField, 0)
+	}
+	return cond.IsNull(c.softDelField)
+}
+
+// 添加删除时间在before之前的条件
+func (c *Cache) softDelDeleted(cond TableConds, before time.Time) TableConds {
+	if c.softDelUnix() {
+		return cond.Gt(c.softDelField, 0).Lt(c.softDelField, before.Unix())
+	}
+	return cond.Lt(c.softDelField, before)
+}
+
+// 生成软删除的UPDATE语句
+func (c *Cache) fmtSoftDelSQL(cond TableConds) (string, []interface{}) {
+	var value interface{} = time.Now()
+	if c.softDelUnix() {
+		value = time.Now().Unix()
+	}
+
+	var sqlStr strings.Builder
+	sqlStr.WriteString("UPDATE ")
+	sqlStr.WriteString(c.TableName())
+	sqlStr.WriteString(" SET " + c.softDelField + "=? WHERE ")
+
+	cond = append(cond, c.queryCond...)
+	cond = c.softDelExclude(cond)
+	args := append([]interface{}{value}, cond.fmtCond(&sqlStr)...)
+	return sqlStr.String(), args
+}
+
+// 把tableName中满足cond的数据移动到归档表，通过事务先复制再删除，返回移动的数量
+func (c *Cache) archiveToMySQL(ctx context.Context, tableName string, cond TableConds) (int, error) {
+	_, err := c.mysql.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+c.archiveTable+" LIKE "+tableName)
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Join(c.Tags, ",")
+	var where strings.Builder
+	args := cond.fmtCond(&where)
+
+	tx, err := c.mysql.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO "+c.archiveTable+" ("+fields+") SELECT "+fields+" FROM "+tableName+" WHERE "+where.String(), args...)
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, err
+	}
+	rst, err := tx.Exec(ctx, "DELETE FROM "+tableName+" WHERE "+where.String(), args...)
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, err
+	}
+	n, err := rst.RowsAffected()
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// 归档，把删除时间超过olderThan的数据从所有拆表中移动到归档表，返回移动的数量
+// 配置了自增字段时按自增字段分段移动，每段WarmupChunk条
+func (c *Cache) Archive(ctx context.Context, olderThan time.Duration) (_n_ int, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Dur("olderThan", olderThan).Int("n", _n_).Msgf("Cache %s Archive", c.tableName)
+	})()
+
+	if len(c.softDelField) == 0 {
+		return 0, errors.New("soft delete not config")
+	}
+	chunk := WarmupChunk
+	if chunk <= 0 {
+		chunk = 500
+	}
+
+	before := time.Now().Add(-olderThan)
+	for _, tableName := range c.tableNames() {
+		if len(c.incrementField) == 0 {
+			n, err := c.archiveToMySQL(ctx, tableName, c.softDelDeleted(NewConds(), before))
+			_n_ += n
+			if err != nil {
+				return _n_, err
+			}
+			continue
+		}
+		for {
+			var where strings.Builder
+			args := c.softDelDeleted(NewConds(), before).fmtCond(&where)
+			var ids []int64
+			err := c.mysql.Select(ctx, &ids, "SELECT "+c.incrementField+" FROM "+tableName+" WHERE "+where.String()+" ORDER BY "+c.incrementField+" LIMIT ?", append(args, chunk)...)
+			if err != nil {
+				return _n_, err
+			}
+			if len(ids) == 0 {
+				break
+			}
+			idsI := make([]interface{}, 0, len(ids))
+			for _, id := range ids {
+				idsI = append(idsI, id)
+			}
+			n, err := c.archiveToMySQL(ctx, tableName, c.softDelDeleted(NewConds().In(c.incrementField, idsI...), before))
+			_n_ += n
+			if err != nil {
+				return _n_, err
+			}
+			if len(ids) < chunk {
+				break
+			}
+		}
+	}
+	return _n_, nil
+}
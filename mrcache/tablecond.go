@@ -10,11 +10,12 @@ import (
 
 // 查询条件
 type TableCond struct {
-	field   string      // 字段
-	opvalue string      // len>0 合并了op和value
-	op      string      // 条件和值的连接符
-	value   interface{} // 值
-	link    string      // 和下个条件的连接值 不填充默认为AND
+	field   string        // 字段
+	opvalue string        // len>0 合并了op和value
+	op      string        // 条件和值的连接符
+	value   interface{}   // 值
+	link    string        // 和下个条件的连接值 不填充默认为AND
+	args    []interface{} // opvalue中?对应的参数
 }
 
 type TableConds []*TableCond
@@ -55,10 +56,11 @@ func (cond TableConds) Eq(field string, value interface{}) TableConds {
 }
 
 // 内部方便使用，调用层保证condFields和condValues大小一样
+// 条件值通过KeyCodec转换成mysql的参数
 func (cond TableConds) eqs(condFields []string, condValues []interface{}) TableConds {
 	if len(condFields) == len(condValues) {
 		for i, tag := range condFields {
-			cond = cond.Eq(tag, condValues[i])
+			cond = cond.Eq(tag, keySQLValue(condValues[i]))
 		}
 	}
 	return cond
@@ -103,39 +105,47 @@ func (cond TableConds) NotLike(field string, value interface{}) TableConds {
 }
 
 func (cond TableConds) IsNull(field string) TableConds {
-	return append(cond, &TableCond{field: field, op: "IS", value: "NULL"})
+	return append(cond, &TableCond{field: field, opvalue: "IS NULL", op: "IS", value: "NULL"})
 }
 
 func (cond TableConds) IsNotNull(field string) TableConds {
-	return append(cond, &TableCond{field: field, op: "IN NOT", value: "NULL"})
+	return append(cond, &TableCond{field: field, opvalue: "IS NOT NULL", op: "IS NOT", value: "NULL"})
 }
 
 func (cond TableConds) In(field string, values ...interface{}) TableConds {
-	var strArgs []string
+	args := make([]interface{}, 0, len(values))
 	for _, v := range values {
-		strArgs = append(strArgs, fmt.Sprintf("'%v'", v)) // 将元素转为字符串
+		args = append(args, keySQLValue(v))
 	}
-	return append(cond, &TableCond{field: field, opvalue: "IN (" + strings.Join(strArgs, ",") + ")", op: "IN", value: values})
+	return append(cond, &TableCond{field: field, opvalue: "IN (" + placeholders(len(values)) + ")", op: "IN", value: values, args: args})
 }
 
 func (cond TableConds) NoIn(field string, values []interface{}) TableConds {
-	var strArgs []string
+	args := make([]interface{}, 0, len(values))
 	for _, v := range values {
-		strArgs = append(strArgs, fmt.Sprintf("'%v'", v)) // 将元素转为字符串
+		args = append(args, keySQLValue(v))
 	}
-	return append(cond, &TableCond{field: field, opvalue: "NOT IN(" + strings.Join(strArgs, ",") + ")", op: "NOT IN", value: values})
+	return append(cond, &TableCond{field: field, opvalue: "NOT IN(" + placeholders(len(values)) + ")", op: "NOT IN", value: values, args: args})
 }
 
 func (cond TableConds) Ins(fields []string, valuess ...[]interface{}) TableConds {
 	var strArgs []string
+	var args []interface{}
 	for _, values := range valuess {
-		var strArgs2 []string
 		for _, v := range values {
-			strArgs2 = append(strArgs2, fmt.Sprintf("'%v'", v)) // 将元素转为字符串
+			args = append(args, keySQLValue(v))
 		}
-		strArgs = append(strArgs, "("+strings.Join(strArgs2, ",")+")")
+		strArgs = append(strArgs, "("+placeholders(len(values))+")")
+	}
+	return append(cond, &TableCond{field: "(" + strings.Join(fields, ",") + ")", opvalue: "IN (" + strings.Join(strArgs, ",") + ")", op: "IN", value: valuess, args: args})
+}
+
+// n个?用,连接
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
 	}
-	return append(cond, &TableCond{field: "(" + strings.Join(fields, ",") + ")", opvalue: "IN (" + strings.Join(strArgs, ",") + ")", op: "IN", value: valuess})
+	return strings.Repeat("?,", n-1) + "?"
 }
 
 func (cond TableConds) Or() TableConds {
@@ -164,6 +174,7 @@ func (cond TableConds) fmtCond(sqlStr io.StringWriter) []interface{} {
 			args = append(args, v.value)
 		} else {
 			sqlStr.WriteString(" " + v.opvalue)
+			args = append(args, v.args...)
 		}
 	}
 	return args
@@ -0,0 +1,518 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gobase/goredis"
+	"gobase/utils"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// 多个缓存的原子事务
+// 收集多个CacheRow、CacheRows的Modify、Set、Add、Del操作，Exec时一起执行
+// 所有缓存要使用同一个Redis和mysql对象，Redis为集群时所有key要有相同的hashtag，参考ConfigHashTag
+// 执行流程：
+// 1. 按key排序加保存锁，防止和其他保存流程交叉
+// 2. 一个Redis脚本执行所有的修改，Add、Del的数据直接删除Redis中的缓存（CacheRows删除索引），下次访问时重新加载
+//    CacheRows修改时同时更新排序索引，配置了数量上限时Add先在索引中占用位置，不删除索引
+// 3. 一个mysql事务执行所有的语句，失败回滚，并删除Redis中所有涉及的缓存，下次访问时从mysql重新加载
+// 4. mysql提交后再次删除Add、Del涉及的缓存，只加了保存锁，提交前其他读取可能从mysql加载了旧数据
+// 事务中的保存都是同步的，不走异步和批量保存
+
+const (
+	txOpModify = "modify"
+	txOpSet    = "set"
+	txOpAdd    = "add"
+	txOpDel    = "del"
+)
+
+// 事务中使用的缓存，CacheRow、CacheRows实现
+type TxCache interface {
+	txCache() *Cache
+	// 加载数据到Redis，key：CacheRow为数据key，CacheRows为索引key
+	txPreLoad(ctx context.Context, key string, condValues []interface{}) error
+	// 添加数据前检查数量上限，在索引中占用位置，返回值：释放位置的函数，为nil表示没有占用
+	txReserve(ctx context.Context, key string, condValues []interface{}, data map[string]interface{}) (func(), error)
+}
+
+type txOp struct {
+	tc         TxCache
+	c          *Cache
+	op         string
+	condValues []interface{}
+	keyValues  []interface{}
+	data       map[string]interface{}
+	key        string   // 加锁的key，CacheRow为数据key，CacheRows为索引key
+	dataKey    string   // 数据key
+	tags       []string // Modify、Set的字段，按c.Tags的顺序
+	version    *int64   // 校验的版本号，nil表示不校验
+	reserved   bool     // Add时在索引中占用了位置
+}
+
+type Tx struct {
+	ops []*txOp
+	err error // 收集操作时的错误，Exec时返回
+}
+
+func NewTx() *Tx {
+	return &Tx{}
+}
+
+// 修改数据，数值类型为增量，其他类型直接设置，和Modify一致，数据不存在返回ErrNullData
+// keyValues：CacheRow填nil
+func (tx *Tx) Modify(tc TxCache, condValues, keyValues []interface{}, data map[string]interface{}) *Tx {
+	return tx.add(tc, txOpModify, condValues, keyValues, data)
+}
+
+// 设置数据，和Set一致，数据不存在返回ErrNullData
+// keyValues：CacheRow填nil
+func (tx *Tx) Set(tc TxCache, condValues, keyValues []interface{}, data map[string]interface{}) *Tx {
+	return tx.add(tc, txOpSet, condValues, keyValues, data)
+}
+
+// 校验版本号的修改，Redis或者mysql中的版本号不一致时返回ErrVersion，需要配置版本号字段
+// keyValues：CacheRow填nil
+func (tx *Tx) ModifyIfVersion(tc TxCache, condValues, keyValues []interface{}, data map[string]interface{}, version int64) *Tx {
+	return tx.add(tc, txOpModify, condValues, keyValues, data).withVersion(version)
+}
+
+// 校验版本号的设置，Redis或者mysql中的版本号不一致时返回ErrVersion，需要配置版本号字段
+// keyValues：CacheRow填nil
+func (tx *Tx) SetIfVersion(tc TxCache, condValues, keyValues []interface{}, data map[string]interface{}, version int64) *Tx {
+	return tx.add(tc, txOpSet, condValues, keyValues, data).withVersion(version)
+}
+
+// 给最后添加的操作设置校验的版本号
+func (tx *Tx) withVersion(version int64) *Tx {
+	if tx.err != nil {
+		return tx
+	}
+	o := tx.ops[len(tx.ops)-1]
+	if len(o.c.versionField) == 0 {
+		tx.err = errors.New("version not config")
+		return tx
+	}
+	o.version = &version
+	return tx
+}
+
+// 添加数据，CacheRows的keyFields需要在data中，自增字段除外，配置了数量上限时自增字段也需要在data中
+func (tx *Tx) Add(tc TxCache, condValues []interface{}, data map[string]interface{}) *Tx {
+	return tx.add(tc, txOpAdd, condValues, nil, data)
+}
+
+// 删除数据，开启了软删除时设置删除时间
+// keyValues：CacheRow填nil
+func (tx *Tx) Del(tc TxCache, condValues, keyValues []interface{}) *Tx {
+	return tx.add(tc, txOpDel, condValues, keyValues, nil)
+}
+
+func (tx *Tx) add(tc TxCache, op string, condValues, keyValues []interface{}, data map[string]interface{}) *Tx {
+	if tx.err != nil {
+		return tx
+	}
+	c := tc.txCache()
+	key, err := c.checkCondValuesGenKey(condValues)
+	if err != nil {
+		tx.err = err
+		return tx
+	}
+	if data != nil {
+		if err := c.checkMapData(data); err != nil {
+			tx.err = err
+			return tx
+		}
+	}
+	o := &txOp{tc: tc, c: c, op: op, condValues: condValues, keyValues: keyValues, data: data, key: key, dataKey: key}
+	if len(c.keyFields) > 0 {
+		if op == txOpAdd {
+			for _, tag := range c.keyFields {
+				if _, ok := data[tag]; !ok && tag != c.incrementField {
+					tx.err = fmt.Errorf("tag:%s not find in data", tag)
+					return tx
+				}
+			}
+		} else {
+			keyValuesStr, err := c.checkKeyValuesGenStr(keyValues)
+			if err != nil {
+				tx.err = err
+				return tx
+			}
+			o.dataKey = key + "_" + keyValuesStr
+		}
+	}
+	for _, tag := range c.Tags {
+		if _, ok := data[tag]; ok && (op == txOpModify || op == txOpSet) {
+			o.tags = append(o.tags, tag)
+		}
+	}
+	tx.ops = append(tx.ops, o)
+	return tx
+}
+
+// 执行事务
+func (tx *Tx) Exec(ctx context.Context) (_err_ error) {
+	if len(tx.ops) == 0 {
+		return tx.err
+	}
+	c := tx.ops[0].c
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Int("ops", len(tx.ops)).Msg("Tx Exec")
+	})()
+
+	if tx.err != nil {
+		return tx.err
+	}
+
+	// Redis的key
+	keys := []string{}
+	keyIndex := map[string]int{}
+	addKey := func(key string) {
+		if _, ok := keyIndex[key]; !ok {
+			keys = append(keys, key)
+			keyIndex[key] = len(keys)
+		}
+	}
+	lockKeys := []string{}
+	for _, o := range tx.ops {
+		if o.c.redis != c.redis || o.c.mysql != c.mysql {
+			return errors.New("tx caches must use the same redis and mysql")
+		}
+		if !utils.Contains(lockKeys, o.key) {
+			lockKeys = append(lockKeys, o.key)
+		}
+		addKey(o.dataKey)
+		addKey(o.key)
+	}
+	if err := txCheckHashTag(c.redis, keys); err != nil {
+		return err
+	}
+
+	// 加锁 按key排序防止死锁
+	sort.Strings(lockKeys)
+	for _, lockKey := range lockKeys {
+		for _, o := range tx.ops {
+			if o.key != lockKey {
+				continue
+			}
+			unlock, err := o.c.saveLock(ctx, lockKey)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			break
+		}
+	}
+	// 批量保存的缓冲先写入，防止旧数据覆盖事务的数据
+	for _, o := range tx.ops {
+		o.c.batchFlushKey(ctx, o.key, o.dataKey)
+	}
+
+	// 检查数量上限，Redis脚本执行前失败了要释放占用的位置
+	var releases []func()
+	release := func() {
+		for _, f := range releases {
+			f()
+		}
+	}
+	for _, o := range tx.ops {
+		if o.op != txOpAdd {
+			continue
+		}
+		f, err := o.tc.txReserve(ctx, o.key, o.condValues, o.data)
+		if err != nil {
+			release()
+			return err
+		}
+		if f != nil {
+			releases = append(releases, f)
+			o.reserved = true
+		}
+	}
+
+	// Redis参数
+	redisParams := []interface{}{}
+	for _, o := range tx.ops {
+		switch o.op {
+		case txOpModify, txOpSet:
+			pctx := ctx
+			if o.version != nil {
+				pctx = context.WithValue(ctx, ctxKey_version, *o.version)
+			}
+			params := o.c.redisSetGetParam(pctx, "", o.tags, o.data, o.op == txOpModify)[2:] // 配置了版本号时版本号在最前面
+			sortIndex := 0
+			if o.key != o.dataKey {
+				sortIndex = keyIndex[o.key]
+			}
+			redisParams = append(redisParams, "m", keyIndex[o.dataKey], o.c.expire, sortIndex, len(params))
+			redisParams = append(redisParams, params...)
+		case txOpAdd:
+			if !o.reserved {
+				redisParams = append(redisParams, "d", keyIndex[o.key], 0, 0, 0)
+			}
+		case txOpDel:
+			redisParams = append(redisParams, "d", keyIndex[o.dataKey], 0, 0, 0)
+			if o.key != o.dataKey {
+				redisParams = append(redisParams, "d", keyIndex[o.key], 0, 0, 0)
+			}
+		}
+	}
+
+	// 执行脚本，数据不存在时加载后重试
+	reply := make([]interface{}, 0)
+	var err error
+	for i := 0; i < 3; i++ {
+		reply = reply[:0]
+		err = c.redis.DoScript2(goredis.CtxNonilErrIgnore(ctx), txScript, keys, redisParams...).BindSlice(&reply)
+		if err == nil || !strings.HasPrefix(scriptErrorCode(err), "NULL") {
+			break
+		}
+		idx, _ := strconv.Atoi(strings.TrimPrefix(scriptErrorCode(err), "NULL"))
+		if idx <= 0 || idx > len(keys) {
+			break
+		}
+		loaded := false
+		for _, o := range tx.ops {
+			if (o.op == txOpModify || o.op == txOpSet) && o.dataKey == keys[idx-1] {
+				if err := o.tc.txPreLoad(ctx, o.key, o.condValues); err != nil {
+					return err
+				}
+				loaded = true
+				break
+			}
+		}
+		if !loaded {
+			break
+		}
+	}
+	if err != nil {
+		release()
+		if strings.HasPrefix(scriptErrorCode(err), "NULL") {
+			return ErrNullData // 检查阶段还没有修改
+		}
+		if scriptErrorCode(err) == "VERSION" {
+			return ErrVersion // 检查阶段还没有修改
+		}
+		tx.rollback(ctx, keys)
+		return err
+	}
+
+	// mysql事务
+	sqlTx, err := c.mysql.Begin(ctx)
+	if err != nil {
+		tx.rollback(ctx, keys)
+		return err
+	}
+	pos := 0
+	incrementIds := make([]int64, len(tx.ops))
+	modifyDatas := make([]map[string]interface{}, len(tx.ops))
+	for i, o := range tx.ops {
+		var sqlStr string
+		var args []interface{}
+		verCheck := false
+		switch o.op {
+		case txOpModify, txOpSet:
+			data, err := o.txReplyData(reply, &pos)
+			if err != nil {
+				sqlTx.Rollback(ctx)
+				tx.rollback(ctx, keys)
+				return err
+			}
+			modifyDatas[i] = data
+			cond := NewConds().eqs(o.c.condFields, o.condValues)
+			if len(o.keyValues) > 0 {
+				cond = cond.eqs(o.c.keyFields, o.keyValues)
+			}
+			if o.version != nil {
+				cond = cond.Eq(o.c.versionField, *o.version)
+				verCheck = true
+			}
+			sqlStr, args = o.c.fmtSaveSQL(cond, data)
+		case txOpAdd:
+			var increment *int64
+			sqlStr, args, increment, err = o.c.fmtAddSQL(ctx, o.condValues, o.data)
+			if err != nil {
+				sqlTx.Rollback(ctx)
+				tx.rollback(ctx, keys)
+				return err
+			}
+			incrementIds[i] = *increment
+		case txOpDel:
+			cond := NewConds().eqs(o.c.condFields, o.condValues)
+			if len(o.keyValues) > 0 {
+				cond = cond.eqs(o.c.keyFields, o.keyValues)
+			}
+			sqlStr, args = o.c.fmtDelSQL(cond)
+		}
+		if len(sqlStr) == 0 {
+			continue
+		}
+		rst, err := sqlTx.Exec(ctx, sqlStr, args...)
+		if err == nil && verCheck {
+			// 版本号一定会变化，影响的行数为0表示mysql中的版本号不一致
+			if n, _ := rst.RowsAffected(); n == 0 {
+				err = ErrVersion
+			}
+		}
+		if err != nil {
+			sqlTx.Rollback(ctx)
+			tx.rollback(ctx, keys)
+			return err
+		}
+	}
+	if err := sqlTx.Commit(ctx); err != nil {
+		tx.rollback(ctx, keys)
+		return err
+	}
+
+	// 成功了，Add、Del的缓存提交后再删除一次，提交前其他的读取可能又从mysql加载了旧数据
+	delKeys := []string{}
+	for _, o := range tx.ops {
+		switch o.op {
+		case txOpAdd:
+			if !o.reserved && !utils.Contains(delKeys, o.key) {
+				delKeys = append(delKeys, o.key)
+			}
+		case txOpDel:
+			for _, key := range []string{o.dataKey, o.key} {
+				if !utils.Contains(delKeys, key) {
+					delKeys = append(delKeys, key)
+				}
+			}
+		}
+	}
+	if len(delKeys) > 0 {
+		c.redis.Del(ctx, delKeys...)
+	}
+	for i, o := range tx.ops {
+		switch o.op {
+		case txOpModify, txOpSet:
+			o.c.localDel(ctx, o.dataKey)
+			o.c.emitEvent(ctx, &ChangeEvent{Op: EventModify, CondValues: o.condValues, KeyValues: o.keyValues, New: modifyDatas[i]})
+		case txOpAdd:
+			DelPass(o.key)
+			o.c.emitAddEvent(ctx, o.condValues, o.data, incrementIds[i])
+		case txOpDel:
+			o.c.localDel(ctx, o.dataKey)
+			o.c.emitEvent(ctx, &ChangeEvent{Op: EventDel, CondValues: o.condValues, KeyValues: o.keyValues})
+		}
+	}
+	return nil
+}
+
+// 失败了删除所有涉及的缓存，下次访问时从mysql重新加载
+func (tx *Tx) rollback(ctx context.Context, keys []string) {
+	c := tx.ops[0].c
+	c.redis.Del(ctx, keys...)
+	for _, o := range tx.ops {
+		o.c.localDel(ctx, o.dataKey)
+	}
+}
+
+// 从脚本的返回值中读取修改后的值，pos为读取的位置
+func (o *txOp) txReplyData(reply []interface{}, pos *int) (map[string]interface{}, error) {
+	tags := o.tags
+	if len(o.c.versionField) > 0 {
+		tags = append([]string{o.c.versionField}, tags...)
+	}
+	if *pos+len(tags) > len(reply) {
+		return nil, errors.New("tx reply len err")
+	}
+	data := make(map[string]interface{}, len(tags))
+	for _, tag := range tags {
+		r := reply[*pos]
+		*pos++
+		if o.c.saveIgnoreTag(tag) {
+			continue
+		}
+		if r == nil {
+			data[tag] = nil
+			continue
+		}
+		v := reflect.New(o.c.Fields[o.c.FindIndexByTag(tag)].Type).Elem()
+		if err := goredis.InterfaceToValue(r, v); err != nil {
+			return nil, err
+		}
+		data[tag] = v.Interface()
+	}
+	return data, nil
+}
+
+// Redis集群时所有key要在同一个slot中，要求所有key有相同的hashtag
+func txCheckHashTag(r *goredis.Redis, keys []string) error {
+	if _, ok := r.UniversalClient.(*redis.ClusterClient); !ok {
+		return nil
+	}
+	hashTag := func(key string) string {
+		s := strings.IndexByte(key, '{')
+		if s == -1 {
+			return key
+		}
+		e := strings.IndexByte(key[s+1:], '}')
+		if e <= 0 {
+			return key
+		}
+		return key[s+1 : s+1+e]
+	}
+	tag := hashTag(keys[0])
+	for _, key := range keys[1:] {
+		if hashTag(key) != tag {
+			return fmt.Errorf("tx keys must have the same hashtag, %s %s", keys[0], key)
+		}
+	}
+	return nil
+}
+
+func (c *CacheRow[T]) txCache() *Cache {
+	return c.Cache
+}
+
+func (c *CacheRow[T]) txPreLoad(ctx context.Context, key string, condValues []interface{}) error {
+	_, _, err := c.preLoad(ctx, key, condValues, nil)
+	return err
+}
+
+func (c *CacheRow[T]) txReserve(ctx context.Context, key string, condValues []interface{}, data map[string]interface{}) (func(), error) {
+	return nil, nil
+}
+
+func (c *CacheRows[T]) txCache() *Cache {
+	return c.Cache
+}
+
+func (c *CacheRows[T]) txPreLoad(ctx context.Context, key string, condValues []interface{}) error {
+	_, err := c.preLoadAll(ctx, key, condValues)
+	return err
+}
+
+func (c *CacheRows[T]) txReserve(ctx context.Context, key string, condValues []interface{}, data map[string]interface{}) (func(), error) {
+	if c.maxRows <= 0 {
+		return nil, nil
+	}
+	keyValuesStr, _, err := c.checkKeyValuesGenStrByMap(data)
+	if err != nil {
+		return nil, err
+	}
+	rst, err := c.reserveRow(ctx, key, condValues, keyValuesStr)
+	if err != nil {
+		return nil, err
+	}
+	if rst == 0 {
+		return nil, ErrMaxRows
+	}
+	if rst == 2 {
+		return nil, nil // 已经存在了，添加mysql时会返回错误
+	}
+	return func() {
+		c.redis.DoScript(ctx, rowsDelsScript, []string{key}, keyValuesStr)
+	}, nil
+}
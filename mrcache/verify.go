@@ -0,0 +1,482 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"gobase/goredis"
+	"gobase/utils"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// Redis和mysql的一致性检查
+// 1：分段读取mysql中的数据，和Redis中缓存的数据逐个字段比较，Redis中不存在的数据不比较
+//    配置了自增字段时按自增字段分段，否则按条件字段和key字段排序分页
+// 2：SCAN扫描Redis中缓存的数据，检查mysql中是否存在，不存在的报告为Redis中多出的数据，不受conds的限制
+//    拆表时只能通过自增字段判断数据属于哪个表，没有配置自增字段时不扫描
+// Redis中的值先按结构字段的类型解析，再和mysql的值格式化后比较，消除浮点数等格式的差异
+// 条件字段、key字段、自增字段不比较
+
+// 修复方式
+type RepairMode int
+
+const (
+	RepairNone      RepairMode = iota // 只检查不修复
+	RepairRedisWins                   // 以Redis为准，不一致的字段写入mysql
+	RepairMySQLWins                   // 以mysql为准，删除Redis中的数据，下次访问时重新加载
+)
+
+// 一条数据的差异
+type VerifyDiff struct {
+	CondValues []interface{}          `json:"cond"`          // condFields对应的值
+	KeyValues  []interface{}          `json:"key,omitempty"` // CacheRows中keyFields对应的值
+	Fields     []string               `json:"fields"`        // 不一致的字段
+	Redis      map[string]interface{} `json:"redis"`         // Redis中的值，不存在为nil
+	MySQL      map[string]interface{} `json:"mysql"`         // mysql中的值，RedisOnly时为nil
+	RedisOnly  bool                   `json:"redisonly"`     // mysql中不存在，Redis中多出的数据，只有RepairMySQLWins会修复（删除缓存）
+	Repaired   bool                   `json:"repaired"`      // 是否修复成功
+}
+
+// 检查结果
+type VerifyReport struct {
+	Rows     int           `json:"rows"`     // 检查的mysql数据条数
+	Cached   int           `json:"cached"`   // Redis中存在的数据条数
+	Scanned  int           `json:"scanned"`  // 扫描的Redis数据条数
+	Repaired int           `json:"repaired"` // 修复成功的数据条数
+	Diffs    []*VerifyDiff `json:"diffs"`
+}
+
+// 一条mysql数据在Redis中的位置
+type verifyRow struct {
+	key        string     // 加锁使用的key
+	dataKey    string     // 数据存储的key
+	keyStr     string     // CacheRows中的keyValuesStr
+	cond       TableConds // 修改mysql的条件
+	condValues []interface{}
+	keyValues  []interface{}
+}
+
+// 检查流程
+// locate：根据mysql数据确定Redis中的位置
+// rateLimit：每秒检查的数据条数上限，<=0不限制
+func (c *Cache) verify(ctx context.Context, conds TableConds, repair RepairMode, rateLimit int, locate func(tInfo *utils.StructValue) *verifyRow) (*VerifyReport, error) {
+	chunk := WarmupChunk
+	if chunk <= 0 {
+		chunk = 500
+	}
+
+	c.Flush(ctx) // 批量保存时先把缓冲中的数据全部写入，防止读到旧数据
+
+	report := &VerifyReport{}
+	start := time.Now()
+	// 限速
+	wait := func() error {
+		if rateLimit <= 0 {
+			return nil
+		}
+		wait := time.Duration(int64(report.Rows+report.Scanned)*int64(time.Second)/int64(rateLimit)) - time.Since(start)
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		return nil
+	}
+
+	// mysql -> Redis
+	var last int64
+	offset := 0
+	for {
+		cond := append(NewConds(), conds...)
+		var datas interface{}
+		var err error
+		if len(c.incrementField) != 0 {
+			datas, err = c.getsFromMySQLOrder(ctx, c.T, c.Tags, cond.Gt(c.incrementField, last), c.incrementField, 0, chunk)
+		} else {
+			datas, err = c.getsFromMySQLOrder(ctx, c.T, c.Tags, cond, strings.Join(c.verifyFields(), ","), offset, chunk)
+		}
+		if err != nil {
+			return report, err
+		}
+		n := reflect.ValueOf(datas).Len()
+		if n == 0 {
+			break
+		}
+		if len(c.incrementField) != 0 {
+			last = c.warmupLastIncrement(datas)
+		}
+		offset += n
+		report.Rows += n
+
+		if err := c.verifyChunk(ctx, datas, repair, locate, report); err != nil {
+			return report, err
+		}
+		if n < chunk {
+			break
+		}
+		if err := wait(); err != nil {
+			return report, err
+		}
+	}
+
+	// Redis -> mysql
+	if c.tableCount > 0 && len(c.incrementField) == 0 {
+		return report, nil
+	}
+	err := c.verifyScan(ctx, c.genCondValuesKey(nil)+"_", int64(chunk), func(keys []string) error {
+		if err := c.verifyRedisOnly(ctx, keys, repair, locate, report); err != nil {
+			return err
+		}
+		return wait()
+	})
+	return report, err
+}
+
+// 唯一确定一条数据的字段
+func (c *Cache) verifyFields() []string {
+	return append(append([]string{}, c.condFields...), c.keyFields...)
+}
+
+// 扫描prefix开头的hash结构的key，集群模式下扫描所有的主节点，fn串行调用
+func (c *Cache) verifyScan(ctx context.Context, prefix string, count int64, fn func(keys []string) error) error {
+	match := strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?", "[", "\\[", "]", "\\]").Replace(prefix) + "*"
+	var mu sync.Mutex
+	scan := func(ctx context.Context, client redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.ScanType(ctx, cursor, match, count, "hash").Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				mu.Lock()
+				err = fn(keys)
+				mu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+	if cluster, ok := c.redis.UniversalClient.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	}
+	return scan(ctx, c.redis.UniversalClient)
+}
+
+// 检查扫描到的Redis数据在mysql中是否存在
+func (c *Cache) verifyRedisOnly(ctx context.Context, keys []string, repair RepairMode, locate func(tInfo *utils.StructValue) *verifyRow, report *VerifyReport) error {
+	cmds := make([]*goredis.RedisCommond, 0, len(keys))
+	pipeline := c.redis.NewPipeline()
+	for _, key := range keys {
+		args := make([]interface{}, 0, 2+len(c.RedisTags))
+		args = append(args, "HMGET", key)
+		args = append(args, c.RedisTagsInterface()...)
+		cmds = append(cmds, pipeline.Cmd(ctx, args...))
+	}
+	_, err := pipeline.ExecNoNil(ctx)
+	if err != nil {
+		return err
+	}
+
+	// 解析出数据的位置，重新生成的key不一致的不是本缓存的数据
+	fields := c.verifyFields()
+	rows := make([]*verifyRow, 0, len(keys))
+	datas := make([]map[string]interface{}, 0, len(keys))
+	valuess := make([][]interface{}, 0, len(keys))
+	for i, cmd := range cmds {
+		reply := make([]interface{}, 0, len(c.Tags))
+		if err := cmd.BindSlice(&reply); err != nil || len(reply) != len(c.Tags) {
+			continue
+		}
+		dest := reflect.New(c.T)
+		tInfo, _ := utils.GetStructInfoByStructType(dest.Interface(), c.StructType)
+		data := map[string]interface{}{}
+		ok := true
+		for at, tag := range c.Tags {
+			if reply[at] == nil {
+				continue
+			}
+			if err := goredis.InterfaceToValue(reply[at], tInfo.Elemts[at]); err != nil {
+				ok = false
+				break
+			}
+			data[tag] = tInfo.Elemts[at].Interface()
+		}
+		if !ok {
+			continue
+		}
+		// 拆表时通过自增字段判断是否是本表的数据
+		if c.tableCount > 0 {
+			if _, ok := data[c.incrementField]; !ok || c.incrementValueOf(tInfo)%int64(c.tableCount) != int64(c.tableIndex) {
+				continue
+			}
+		}
+		row := locate(tInfo)
+		if row.dataKey != keys[i] {
+			continue
+		}
+		rows = append(rows, row)
+		datas = append(datas, data)
+		valuess = append(valuess, append(append([]interface{}{}, row.condValues...), row.keyValues...))
+	}
+	report.Scanned += len(rows)
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// mysql中存在的
+	all, err := c.getsFromMySQL(ctx, c.T, fields, NewConds().Ins(fields, valuess...))
+	if err != nil {
+		return err
+	}
+	exist := map[string]bool{}
+	v := reflect.ValueOf(all)
+	for i := 0; i < v.Len(); i++ {
+		tInfo, _ := utils.GetStructInfoByStructType(v.Index(i).Interface(), c.StructType)
+		exist[locate(tInfo).dataKey] = true
+	}
+	for i, row := range rows {
+		if exist[row.dataKey] {
+			continue
+		}
+		diff := &VerifyDiff{CondValues: row.condValues, KeyValues: row.keyValues, Redis: datas[i], RedisOnly: true}
+		for _, tag := range c.Tags {
+			if _, ok := datas[i][tag]; ok {
+				diff.Fields = append(diff.Fields, tag)
+			}
+		}
+		if repair == RepairMySQLWins {
+			if c.verifyRemove(ctx, row) == nil {
+				diff.Repaired = true
+				report.Repaired++
+			}
+		}
+		report.Diffs = append(report.Diffs, diff)
+	}
+	return nil
+}
+
+// 检查一段数据，datas为[]*T
+func (c *Cache) verifyChunk(ctx context.Context, datas interface{}, repair RepairMode, locate func(tInfo *utils.StructValue) *verifyRow, report *VerifyReport) error {
+	v := reflect.ValueOf(datas)
+	tInfos := make([]*utils.StructValue, 0, v.Len())
+	rows := make([]*verifyRow, 0, v.Len())
+	cmds := make([]*goredis.RedisCommond, 0, v.Len())
+	pipeline := c.redis.NewPipeline()
+	for i := 0; i < v.Len(); i++ {
+		tInfo, _ := utils.GetStructInfoByStructType(v.Index(i).Interface(), c.StructType)
+		row := locate(tInfo)
+		args := make([]interface{}, 0, 2+len(c.RedisTags))
+		args = append(args, "HMGET", row.dataKey)
+		args = append(args, c.RedisTagsInterface()...)
+		tInfos = append(tInfos, tInfo)
+		rows = append(rows, row)
+		cmds = append(cmds, pipeline.Cmd(ctx, args...))
+	}
+	_, err := pipeline.ExecNoNil(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i, cmd := range cmds {
+		reply := make([]interface{}, 0, len(c.Tags))
+		if err := cmd.BindSlice(&reply); err != nil || len(reply) != len(c.Tags) {
+			continue
+		}
+		cached := false
+		for _, r := range reply {
+			if r != nil {
+				cached = true
+				break
+			}
+		}
+		if !cached {
+			continue // Redis中没有缓存
+		}
+		report.Cached++
+
+		diff := &VerifyDiff{CondValues: rows[i].condValues, KeyValues: rows[i].keyValues, Redis: map[string]interface{}{}, MySQL: map[string]interface{}{}}
+		for at, tag := range c.Tags {
+			if c.saveIgnoreTag(tag) {
+				continue
+			}
+			redisValue, equal := c.verifyValue(at, tInfos[i].Elemts[at], reply[at])
+			if equal {
+				continue
+			}
+			diff.Fields = append(diff.Fields, tag)
+			diff.Redis[tag] = redisValue
+			diff.MySQL[tag] = tInfos[i].Elemts[at].Interface()
+		}
+		if len(diff.Fields) == 0 {
+			continue
+		}
+		if repair != RepairNone {
+			if c.verifyRepair(ctx, rows[i], diff.Fields, repair) == nil {
+				diff.Repaired = true
+				report.Repaired++
+			}
+		}
+		report.Diffs = append(report.Diffs, diff)
+	}
+	return nil
+}
+
+// 比较mysql和Redis中的值，返回Redis中的值（按字段类型解析）和是否相等
+func (c *Cache) verifyValue(at int, mysqlValue reflect.Value, redisValue interface{}) (interface{}, bool) {
+	var redisFmt, mysqlFmt interface{}
+	var rst interface{}
+	if redisValue != nil {
+		v := reflect.New(c.Fields[at].Type).Elem()
+		if err := goredis.InterfaceToValue(redisValue, v); err != nil {
+			return redisValue, false // 解析不了，肯定不一致
+		}
+		rst = v.Interface()
+		redisFmt = goredis.ValueFmt(v)
+	}
+	mysqlFmt = goredis.ValueFmt(mysqlValue)
+	if redisFmt == nil || mysqlFmt == nil {
+		return rst, redisFmt == nil && mysqlFmt == nil
+	}
+	return rst, c.fmtBaseType(redisFmt) == c.fmtBaseType(mysqlFmt)
+}
+
+// 修复一条数据，加保存锁，防止和正常的保存流程冲突
+func (c *Cache) verifyRepair(ctx context.Context, row *verifyRow, tags []string, repair RepairMode) error {
+	unlock, err := c.saveLock(ctx, row.key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	switch repair {
+	case RepairRedisWins:
+		// 加锁后重新读取Redis中的值
+		redisParams := make([]interface{}, 0, 2+len(tags))
+		redisParams = append(redisParams, "HMGET", row.dataKey)
+		for _, tag := range tags {
+			redisParams = append(redisParams, c.GetRedisTagByTag(tag))
+		}
+		reply := make([]interface{}, 0, len(tags))
+		err := c.redis.Do2(ctx, redisParams...).BindSlice(&reply)
+		if err != nil {
+			return err
+		}
+		if len(reply) != len(tags) {
+			return errors.New("redis reply len err")
+		}
+		data := make(map[string]interface{}, len(tags))
+		cached := false
+		for i, tag := range tags {
+			if reply[i] == nil {
+				data[tag] = nil
+				continue
+			}
+			v := reflect.New(c.Fields[c.FindIndexByTag(tag)].Type).Elem()
+			if err := goredis.InterfaceToValue(reply[i], v); err != nil {
+				return err
+			}
+			data[tag] = v.Interface()
+			cached = true
+		}
+		if !cached {
+			return ErrNullData // 期间缓存过期了，不能用空值覆盖mysql
+		}
+		sqlStr, args := c.fmtSaveSQL(row.cond, data)
+		if len(sqlStr) == 0 {
+			return nil
+		}
+		_, err = c.mysql.Update(ctx, sqlStr, args...)
+		return err
+	case RepairMySQLWins:
+		err := c.redis.Del(ctx, row.dataKey).Err()
+		if err != nil {
+			return err
+		}
+		c.localDel(ctx, row.dataKey)
+		return nil
+	}
+	return nil
+}
+
+// 删除Redis中多出的数据，加保存锁，防止和正常的保存流程冲突
+func (c *Cache) verifyRemove(ctx context.Context, row *verifyRow) error {
+	unlock, err := c.saveLock(ctx, row.key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if row.dataKey == row.key {
+		err = c.redis.Del(ctx, row.dataKey).Err()
+	} else {
+		err = c.redis.DoScript(ctx, rowsDelsScript, []string{row.key}, row.keyStr).Err()
+	}
+	if err != nil {
+		return err
+	}
+	c.localDel(ctx, row.dataKey)
+	return nil
+}
+
+// 检查Redis和mysql数据的一致性，conds为读取mysql的过滤条件，可以为空
+// repair：修复方式 rateLimit：每秒检查的数据条数上限，<=0不限制
+func (c *CacheRow[T]) Verify(ctx context.Context, conds TableConds, repair RepairMode, rateLimit int) (_rst_ *VerifyReport, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Str("conds", conds.Log()).Int("repair", int(repair)).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRow %s Verify", c.TableName())
+	})()
+
+	return c.verify(ctx, conds, repair, rateLimit, func(tInfo *utils.StructValue) *verifyRow {
+		condValues := make([]interface{}, 0, len(c.condFields))
+		for i := 0; i < len(c.condFields); i++ {
+			condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
+		}
+		key := c.genCondValuesKey(condValues)
+		return &verifyRow{key: key, dataKey: key, cond: NewConds().eqs(c.condFields, condValues), condValues: condValues}
+	})
+}
+
+// 检查Redis和mysql数据的一致性，conds为读取mysql的过滤条件，可以为空
+// repair：修复方式 rateLimit：每秒检查的数据条数上限，<=0不限制
+func (c *CacheRows[T]) Verify(ctx context.Context, conds TableConds, repair RepairMode, rateLimit int) (_rst_ *VerifyReport, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Str("conds", conds.Log()).Int("repair", int(repair)).Interface("rst", utils.TruncatedLog(_rst_)).Msgf("CacheRows %s Verify", c.TableName())
+	})()
+
+	return c.verify(ctx, conds, repair, rateLimit, func(tInfo *utils.StructValue) *verifyRow {
+		condValues := make([]interface{}, 0, len(c.condFields))
+		for i := 0; i < len(c.condFields); i++ {
+			condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
+		}
+		keyValues := make([]interface{}, 0, len(c.keyFields))
+		for i := 0; i < len(c.keyFields); i++ {
+			keyValues = append(keyValues, c.keyValueOf(tInfo.Elemts[c.keyFieldsIndex[i]]))
+		}
+		key := c.genCondValuesKey(condValues)
+		keyStr := c.genKeyValuesStrByTInfo(tInfo)
+		return &verifyRow{
+			key:        key,
+			dataKey:    c.genDataKey(key, keyStr),
+			keyStr:     keyStr,
+			cond:       NewConds().eqs(c.condFields, condValues).eqs(c.keyFields, keyValues),
+			condValues: condValues,
+			keyValues:  keyValues,
+		}
+	})
+}
@@ -0,0 +1,385 @@
+package mrcache
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"gobase/goredis"
+	"gobase/utils"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// 缓存预热
+// Redis故障切换或者修改了keyPrefix后，第一次访问都会走preLoad，大量请求同时加载会对mysql造成冲击
+// Warmup按自增字段分段从mysql中读取数据，通过管道批量写入Redis，Redis中已经存在的key不覆盖
+// 写入前和preLoad一样对key加锁，加锁后重新从mysql读取要写入的数据，加锁失败或者标记了pass的key跳过
+// 每轮写入完成后把读取到的最大自增值记录到Redis中作为断点，中断后再次调用从断点继续，全部完成后删除断点
+// 需要先通过ConfigIncrement配置自增字段
+
+// 预热断点的key，命名: [keyPrefix_]WarmupKey_表名[_keySuffix]
+func (c *Cache) warmupKey() string {
+	var key strings.Builder
+	if len(c.keyPrefix) > 0 {
+		key.WriteString(c.keyPrefix + "_")
+	}
+	key.WriteString(WarmupKey + "_" + c.TableName())
+	if len(c.keySuffix) > 0 {
+		key.WriteString("_" + c.keySuffix)
+	}
+	return key.String()
+}
+
+// 删除预热的断点，下次Warmup从头开始
+func (c *Cache) ResetWarmup(ctx context.Context, conds TableConds) error {
+	return c.redis.HDel(ctx, c.warmupKey(), conds.Log()).Err()
+}
+
+// 预热流程，每轮顺序读取concurrency段数据，并发调用write写入Redis
+// write：写入一段数据，参数为[]*T，返回写入Redis的key数量
+// 返回值：读取的数据条数 写入Redis的key数量
+func (c *Cache) warmup(ctx context.Context, conds TableConds, concurrency, rateLimit int, write func(ctx context.Context, datas interface{}) (int, error)) (int, int, error) {
+	if len(c.incrementField) == 0 {
+		return 0, 0, errors.New("increment not config")
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	chunk := WarmupChunk
+	if chunk <= 0 {
+		chunk = 500
+	}
+
+	// 读取断点
+	key := c.warmupKey()
+	field := conds.Log()
+	var last int64
+	s, err := c.redis.HGet(ctx, key, field).Result()
+	if err == nil {
+		last, _ = strconv.ParseInt(s, 10, 64)
+	} else if !goredis.IsNilError(err) {
+		return 0, 0, err
+	}
+
+	c.Flush(ctx) // 批量保存时先把缓冲中的数据全部写入，防止读到旧数据
+
+	// 分段读取只需要条件字段和自增字段，写入时加锁后再读取完整的数据
+	fields := append([]string{}, c.condFields...)
+	if !utils.Contains(fields, c.incrementField) {
+		fields = append(fields, c.incrementField)
+	}
+
+	rows, keys := 0, 0
+	start := time.Now()
+	for {
+		// 顺序读取
+		chunks := make([]interface{}, 0, concurrency)
+		end := false
+		for len(chunks) < concurrency {
+			cond := append(NewConds(), conds...).Gt(c.incrementField, last)
+			datas, err := c.getsFromMySQLOrder(ctx, c.T, fields, cond, c.incrementField, 0, chunk)
+			if err != nil {
+				return rows, keys, err
+			}
+			n := reflect.ValueOf(datas).Len()
+			if n > 0 {
+				chunks = append(chunks, datas)
+				rows += n
+				last = c.warmupLastIncrement(datas)
+			}
+			if n < chunk {
+				end = true
+				break
+			}
+		}
+
+		// 并发写入
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var writeErr error
+		for _, datas := range chunks {
+			wg.Add(1)
+			go func(datas interface{}) {
+				defer wg.Done()
+				defer utils.HandlePanic()
+				n, err := write(ctx, datas)
+				mu.Lock()
+				defer mu.Unlock()
+				keys += n
+				if err != nil {
+					writeErr = err
+				}
+			}(datas)
+		}
+		wg.Wait()
+		if writeErr != nil {
+			return rows, keys, writeErr
+		}
+
+		if end {
+			c.redis.HDel(ctx, key, field)
+			return rows, keys, nil
+		}
+		// 记录断点
+		if err := c.redis.HSet(ctx, key, field, last).Err(); err != nil {
+			return rows, keys, err
+		}
+		log.Info().Str("conds", field).Int("rows", rows).Int("keys", keys).Int64("last", last).Msgf("Cache %s Warmup progress", c.TableName())
+
+		// 限速 rateLimit为每秒读取的数据条数
+		if rateLimit > 0 {
+			wait := time.Duration(int64(rows)*int64(time.Second)/int64(rateLimit)) - time.Since(start)
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					return rows, keys, ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+	}
+}
+
+// 一段数据中最后一条的自增值，datas为[]*T，按自增字段升序
+func (c *Cache) warmupLastIncrement(datas interface{}) int64 {
+	v := reflect.ValueOf(datas)
+	tInfo, _ := utils.GetStructInfoByStructType(v.Index(v.Len()-1).Interface(), c.StructType)
+	return c.incrementValueOf(tInfo)
+}
+
+// 一条数据的自增值
+func (c *Cache) incrementValueOf(tInfo *utils.StructValue) int64 {
+	elem := tInfo.Elemts[c.incrementFieldIndex]
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	switch elem.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return elem.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(elem.Uint())
+	}
+	return 0
+}
+
+// 一段数据涉及的condValues，key为genCondValuesKey生成的key，标记了pass的和条件值不合法的不返回
+func (c *Cache) warmupCondValues(datas interface{}) map[string][]interface{} {
+	v := reflect.ValueOf(datas)
+	condValuess := map[string][]interface{}{}
+	for i := 0; i < v.Len(); i++ {
+		tInfo, _ := utils.GetStructInfoByStructType(v.Index(i).Interface(), c.StructType)
+		condValues := make([]interface{}, 0, len(c.condFields))
+		valid := true
+		for j := 0; j < len(c.condFields); j++ {
+			condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[j]]))
+			if strings.Contains(c.fmtKeyValue(condValues[j]), "#") {
+				valid = false // 和checkCondValues一致，有#的条件值不能生成key
+			}
+		}
+		if !valid {
+			continue
+		}
+		key := c.genCondValuesKey(condValues)
+		if GetPass(key) {
+			continue // 刚删除过，不能再写入
+		}
+		condValuess[key] = condValues
+	}
+	return condValuess
+}
+
+// 对要写入的key加preLoad的锁，只尝试一次，加锁失败的说明正在加载，跳过
+// 返回值：加锁成功的condValues 解锁函数
+func (c *Cache) warmupLock(ctx context.Context, condValuess map[string][]interface{}) (map[string][]interface{}, func()) {
+	if !c.lock {
+		return condValuess, func() {}
+	}
+	locked := make(map[string][]interface{}, len(condValuess))
+	unlocks := make([]func(), 0, len(condValuess))
+	for key, condValues := range condValuess {
+		// 不等待锁，跳过是安全的：持锁方是preLoad或者其他预热，会自己从MySQL读取最新数据写入，即使持锁方失败了，Redis中没有的key之后访问时也会再加载
+		unlock, err := c.redis.TryLock(utils.CtxSetNolog(ctx), c.preLoadLockKey(key), time.Second*8)
+		if err != nil || unlock == nil {
+			continue
+		}
+		locked[key] = condValues
+		unlocks = append(unlocks, unlock)
+	}
+	return locked, func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+}
+
+// 预热数据，conds为读取mysql的过滤条件，可以为空
+// concurrency：并发写入的段数 rateLimit：每秒读取的数据条数上限，<=0不限制
+// 返回值：读取的数据条数 写入Redis的key数量
+func (c *CacheRow[T]) Warmup(ctx context.Context, conds TableConds, concurrency, rateLimit int) (_rows_, _keys_ int, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Str("conds", conds.Log()).Int("rows", _rows_).Int("keys", _keys_).Msgf("CacheRow %s Warmup", c.TableName())
+	})()
+
+	return c.warmup(ctx, conds, concurrency, rateLimit, func(ctx context.Context, t interface{}) (int, error) {
+		condValuess, unlock := c.warmupLock(ctx, c.warmupCondValues(t))
+		defer unlock()
+		if len(condValuess) == 0 {
+			return 0, nil
+		}
+
+		// 加锁后重新读取
+		keys := make([]string, 0, len(condValuess))
+		missing := make([][]interface{}, 0, len(condValuess))
+		for key, condValues := range condValuess {
+			keys = append(keys, key)
+			missing = append(missing, condValues)
+		}
+		c.batchFlushKey(ctx, keys...) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+		all, err := c.getsFromMySQL(ctx, c.T, c.Tags, NewConds().Ins(c.condFields, missing...))
+		if err != nil {
+			return 0, err
+		}
+		datas := all.([]*T)
+
+		keys = keys[:0]
+		cmds := make([]*goredis.RedisCommond, 0, len(datas))
+		pipeline := c.redis.NewPipeline()
+		for _, data := range datas {
+			tInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
+			condValues := make([]interface{}, 0, len(c.condFields))
+			for i := 0; i < len(c.condFields); i++ {
+				condValues = append(condValues, c.keyValueOf(tInfo.Elemts[c.condFieldsIndex[i]]))
+			}
+			key := c.genCondValuesKey(condValues)
+
+			redisParams := make([]interface{}, 0, 1+2*len(tInfo.Tags))
+			redisParams = append(redisParams, c.expire)
+			for i, v := range tInfo.Elemts {
+				vfmt := goredis.ValueFmt(v)
+				if vfmt == nil {
+					continue // 空的不填充，redis处理空会写成string类型，后续incr会出错
+				}
+				redisParams = append(redisParams, c.RedisTags[i])
+				redisParams = append(redisParams, vfmt)
+			}
+			keys = append(keys, key)
+			cmds = append(cmds, pipeline.Script2(ctx, rowWarmupScript, []string{key}, redisParams...))
+		}
+		if len(cmds) == 0 {
+			return 0, nil
+		}
+		_, err = pipeline.ExecNoNil(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for _, cmd := range cmds {
+			var rst int
+			if cmd.Bind(&rst) == nil && rst == 1 {
+				n++
+			}
+		}
+		return n, nil
+	})
+}
+
+// 预热数据，conds为读取mysql的过滤条件，可以为空
+// 每段数据涉及的condValues，如果Redis中索引不存在，会读取condValues对应的全部数据写入Redis
+// concurrency：并发写入的段数 rateLimit：每秒读取的数据条数上限，<=0不限制
+// 返回值：读取的数据条数 写入Redis的索引key数量
+func (c *CacheRows[T]) Warmup(ctx context.Context, conds TableConds, concurrency, rateLimit int) (_rows_, _keys_ int, _err_ error) {
+	defer c.logContext(&ctx, &_err_, func(l *zerolog.Event) {
+		l.Err(_err_).Str("conds", conds.Log()).Int("rows", _rows_).Int("keys", _keys_).Msgf("CacheRows %s Warmup", c.TableName())
+	})()
+
+	return c.warmup(ctx, conds, concurrency, rateLimit, func(ctx context.Context, t interface{}) (int, error) {
+		condValuess, unlock := c.warmupLock(ctx, c.warmupCondValues(t))
+		defer unlock()
+		if len(condValuess) == 0 {
+			return 0, nil
+		}
+
+		// 过滤掉Redis中已经存在的
+		keys := make([]string, 0, len(condValuess))
+		cmds := make([]*goredis.RedisCommond, 0, len(condValuess))
+		pipeline := c.redis.NewPipeline()
+		for key := range condValuess {
+			keys = append(keys, key)
+			cmds = append(cmds, pipeline.Cmd(ctx, "EXISTS", key))
+		}
+		_, err := pipeline.ExecNoNil(ctx)
+		if err != nil {
+			return 0, err
+		}
+		missing := make([][]interface{}, 0, len(keys))
+		for i, cmd := range cmds {
+			var exist int
+			if cmd.Bind(&exist) == nil && exist == 0 {
+				missing = append(missing, condValuess[keys[i]])
+			}
+		}
+		if len(missing) == 0 {
+			return 0, nil
+		}
+
+		// 读取全部数据
+		c.batchFlushKey(ctx, keys...) // 批量保存时，先把缓冲中的数据写入，防止读到旧数据
+		all, err := c.getsFromMySQL(ctx, c.T, c.Tags, NewConds().Ins(c.condFields, missing...))
+		if err != nil {
+			return 0, err
+		}
+		keys = keys[:0]
+		redisParamss := map[string][]interface{}{}
+		for _, data := range all.([]*T) {
+			dataInfo, _ := utils.GetStructInfoByStructType(data, c.StructType)
+			condValues := make([]interface{}, 0, len(c.condFields))
+			for i := 0; i < len(c.condFields); i++ {
+				condValues = append(condValues, c.keyValueOf(dataInfo.Elemts[c.condFieldsIndex[i]]))
+			}
+			key := c.genCondValuesKey(condValues)
+			redisParams, ok := redisParamss[key]
+			if !ok {
+				keys = append(keys, key)
+				redisParams = append(redisParams, c.expire)
+			}
+			sli := make([]interface{}, 0, 2*len(dataInfo.Tags))
+			for i, v := range dataInfo.Elemts {
+				vfmt := goredis.ValueFmt(v)
+				if vfmt == nil {
+					continue // 空的不填充，redis处理空会写成string类型，后续incr会出错
+				}
+				sli = append(sli, c.RedisTags[i])
+				sli = append(sli, vfmt)
+			}
+			redisParams = append(redisParams, c.genKeyValuesStrByTInfo(dataInfo))
+			redisParams = append(redisParams, len(sli))
+			redisParams = append(redisParams, sli...)
+			redisParamss[key] = redisParams
+		}
+
+		cmds = cmds[:0]
+		pipeline = c.redis.NewPipeline()
+		for _, key := range keys {
+			cmds = append(cmds, pipeline.Script2(ctx, rowsWarmupScript, []string{key}, redisParamss[key]...))
+		}
+		_, err = pipeline.ExecNoNil(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for _, cmd := range cmds {
+			var rst int
+			if cmd.Bind(&rst) == nil && rst == 1 {
+				n++
+			}
+		}
+		return n, nil
+	})
+}
@@ -30,6 +30,9 @@ type MsgDispatch struct {
 
 	// 请求处理完后回调 不使用锁，默认要求提前注册好
 	hook []func(ctx context.Context, mr Msger, elapsed time.Duration)
+
+	// 消息处理前的检查，返回错误时消息不处理 不使用锁，默认要求提前注册好
+	guard []func(ctx context.Context, mr Msger, t interface{}) error
 }
 
 // Msg表示用来透传的消息类型，必须实现Msger接口，否则无法分发
@@ -522,6 +525,11 @@ func (r *MsgDispatch) RegHook(f func(ctx context.Context, mr Msger, elapsed time
 	r.hook = append(r.hook, f)
 }
 
+// 注册消息处理前的检查，比如限流，参考RateLimitGuard
+func (r *MsgDispatch) RegGuard(f func(ctx context.Context, mr Msger, t interface{}) error) {
+	r.guard = append(r.guard, f)
+}
+
 // 注册的消息ID
 func (md *MsgDispatch) RegMsgIds() []string {
 	msgids := []string{}
@@ -584,6 +592,10 @@ func (md *MsgDispatch) Dispatch(ctx context.Context, mr RecvMsger, t interface{}
 	value1, ok1 := md.handlers.Load(msgid)
 	if ok1 {
 		handler, _ := value1.(*MsgHandler)
+		if err := md.checkGuard(ctx, mr, t); err != nil {
+			md.log(ctx, handler, mr, t, int(zerolog.WarnLevel), logPrefix+" Guard, "+err.Error())
+			return true, err
+		}
 		msg := reflect.New(handler.MsgType).Interface()
 		err := mr.BodyUnMarshal(msg)
 		if err == nil {
@@ -690,6 +702,16 @@ func (md *MsgDispatch) callFunc(ctx context.Context, handler *MsgHandler, mr Msg
 	return nil
 }
 
+func (md *MsgDispatch) checkGuard(ctx context.Context, mr Msger, t interface{}) (err error) {
+	defer utils.HandlePanic()
+	for _, f := range md.guard {
+		if err = f(ctx, mr, t); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (md *MsgDispatch) callhook(ctx context.Context, mr Msger, elapsed time.Duration) {
 	defer utils.HandlePanic()
 	// 回调
@@ -0,0 +1,71 @@
+package msger
+
+// https://github.com/yuwf/gobase2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"gobase/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// 限流器接口 goredis.RateLimiter实现了该接口
+// 返回是否允许 被拒绝时需要等待的时间(-1表示永远不会允许)
+type RateLimiter interface {
+	Limit(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// 按消息ID限流
+func RateLimitKeyMsgID(ctx context.Context, mr Msger, t interface{}) string {
+	return mr.MsgID()
+}
+
+// 按连接限流，t需要实现ConnName接口
+func RateLimitKeyConn(ctx context.Context, mr Msger, t interface{}) string {
+	if cn, ok := t.(ConnName); ok {
+		return cn.ConnName()
+	}
+	return ""
+}
+
+// 按客户端IP限流，t需要实现RemoteAddr() net.TCPAddr，比如tcpserver.TCPClient和gnetserver.GNetClient
+func RateLimitKeyIP(ctx context.Context, mr Msger, t interface{}) string {
+	if ra, ok := t.(interface{ RemoteAddr() net.TCPAddr }); ok {
+		addr := ra.RemoteAddr()
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// 按连接+消息ID限流
+func RateLimitKeyConnMsgID(ctx context.Context, mr Msger, t interface{}) string {
+	conn := RateLimitKeyConn(ctx, mr, t)
+	if len(conn) == 0 {
+		return ""
+	}
+	return conn + ":" + mr.MsgID()
+}
+
+// 限流检查 使用MsgDispatch.RegGuard注册
+// key返回空表示不限流，比如只对部分消息ID限流，按用户限流时可以从t的ClientInfo中取用户ID
+// 限流器出错时不限流，被限流时返回ErrRateLimited，消息不处理
+func RateLimitGuard(limiter RateLimiter, key func(ctx context.Context, mr Msger, t interface{}) string) func(ctx context.Context, mr Msger, t interface{}) error {
+	return func(ctx context.Context, mr Msger, t interface{}) error {
+		k := key(ctx, mr, t)
+		if len(k) == 0 {
+			return nil
+		}
+		allowed, retryAfter, err := limiter.Limit(ctx, k)
+		if err != nil || allowed {
+			return nil
+		}
+		utils.LogCtx(log.Debug(), ctx).Str("key", k).Dur("retryAfter", retryAfter).Str("MsgID", mr.MsgID()).Msg("MsgDispatch RateLimit")
+		return ErrRateLimited
+	}
+}
@@ -25,6 +25,7 @@ const CtxKey_NoDuplicate = utils.CtxKey("_NoDuplicate_")
 var AllMySQL sync.Map // key = *MySQL, value = struct{}
 
 type Config struct {
+	Driver string `json:"driver,omitempty"` // 驱动名 为空使用mysql，测试时可以使用内存实现的驱动
 	Source string `json:"source,omitempty"` //地址 username:password@tcp(ip:port)/database?charset=utf8
 	// 如果Source为空 就用下面的配置
 	Addr     string            `json:"addr,omitempty"` // host:port
@@ -92,7 +93,11 @@ func NewMySQL(conf *Config) (*MySQL, error) {
 			conf.Source += fmt.Sprintf("%s=%s", k, v)
 		}
 	}
-	db, err := sqlx.Connect("mysql", conf.Source)
+	driverName := conf.Driver
+	if len(driverName) == 0 {
+		driverName = "mysql"
+	}
+	db, err := sqlx.Connect(driverName, conf.Source)
 	if err != nil {
 		log.Error().Err(err).Str("source", conf.Source).Msg("MySQL Conn Fail")
 		return nil, err